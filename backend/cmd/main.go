@@ -10,21 +10,39 @@ import (
 	"github.com/vaanskii/vansify/db"
 	notifications "github.com/vaanskii/vansify/notifications"
 	"github.com/vaanskii/vansify/notifications/chat_notifications"
+	"github.com/vaanskii/vansify/notifications/webpush"
+	"github.com/vaanskii/vansify/services/account"
+	"github.com/vaanskii/vansify/services/admin"
 	auth "github.com/vaanskii/vansify/services/auth"
+	"github.com/vaanskii/vansify/services/audience"
 	"github.com/vaanskii/vansify/services/aws"
+	"github.com/vaanskii/vansify/services/block"
 	"github.com/vaanskii/vansify/services/chat"
+	"github.com/vaanskii/vansify/services/digest"
+	"github.com/vaanskii/vansify/services/ratelimit"
+	"github.com/vaanskii/vansify/services/report"
 	follow "github.com/vaanskii/vansify/services/follow"
 	"github.com/vaanskii/vansify/services/search"
+	"github.com/vaanskii/vansify/services/suggestions"
 	user "github.com/vaanskii/vansify/services/user"
 	"github.com/vaanskii/vansify/utils"
 )
 
 func main() {
     db.ConnectToDatabase()
-    auth.InitGoogleAuth()
+    utils.InitKeyring()
+    auth.InitOAuthProviders()
+    auth.InitWebAuthn()
 
     aws.InitAWSSession()
 
+    go account.RunDeletionPurger(10 * time.Minute)
+    go account.RunExportWorker(time.Minute)
+    go suggestions.RunSuggestionWorker(15 * time.Minute)
+    go webpush.RunDispatcher(4)
+    go digest.RunDigestWorker(15 * time.Minute)
+    go notifications.RunRetentionPurger(time.Hour)
+
     r := gin.Default()
 
     r.Use(func(c *gin.Context){
@@ -45,72 +63,182 @@ func main() {
         AllowOrigins:     []string{"https://vansify.vercel.app", "http://localhost:5173"},
         AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
         AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Accept"},
-        ExposeHeaders:    []string{"Content-Length", "ETag", "x-amz-server-side-encryption", "x-amz-access-control-allow-origin"},
+        ExposeHeaders:    []string{"Content-Length", "ETag", "x-amz-server-side-encryption", "x-amz-access-control-allow-origin", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
         AllowCredentials: false,
         MaxAge:           12 * time.Hour,
     }))
       
 
     r.Static("/assets", "./assets")
+    r.GET("/.well-known/jwks.json", utils.JWKSHandler)
+
+    // Rate limiting for the authentication endpoints
+    var limitStore ratelimit.Store = ratelimit.NewMemoryStore()
+    if os.Getenv("RATE_LIMIT_STORE") == "mysql" {
+        limitStore = ratelimit.NewSQLStore(db.DB)
+    }
+    loginByIP := ratelimit.Limit(limitStore, "login", ratelimit.Rule{Burst: 20, Period: time.Minute}, ratelimit.ByIP)
+    loginByAccount := ratelimit.Limit(limitStore, "login", ratelimit.Rule{Burst: 10, Period: 15 * time.Minute}, ratelimit.ByJSONField("username"))
+    registerByIP := ratelimit.Limit(limitStore, "register", ratelimit.Rule{Burst: 5, Period: time.Hour}, ratelimit.ByIP)
+    emailByIP := ratelimit.Limit(limitStore, "email", ratelimit.Rule{Burst: 5, Period: 15 * time.Minute}, ratelimit.ByIP)
+    emailByAccount := ratelimit.Limit(limitStore, "email", ratelimit.Rule{Burst: 3, Period: time.Hour}, ratelimit.ByJSONField("email"))
+    refreshByIP := ratelimit.Limit(limitStore, "refresh", ratelimit.Rule{Burst: 60, Period: time.Minute}, ratelimit.ByIP)
 
     v1 := r.Group("/v1")
     {
         // Authorization Routes
-        v1.POST("/register", auth.RegisterUser)
-        v1.POST("/login", auth.LoginUser)
+        v1.POST("/register", registerByIP, auth.RegisterUser)
+        v1.POST("/login", loginByIP, loginByAccount, auth.LoginUser)
+        v1.POST("/login/magic-link", emailByIP, emailByAccount, auth.RequestMagicLink)
+        v1.POST("/login/magic-link/verify", loginByIP, auth.MagicLinkLogin)
         v1.GET("/verify", auth.VerifyEmail)
-        v1.DELETE("/delete-account", auth.AuthMiddleware(), auth.DeleteUser)
-        v1.POST("/forgot-password", auth.ForgotPassword)
-        v1.POST("/reset-password", auth.ResetPassword)
+        v1.POST("/resend-verification", emailByIP, emailByAccount, auth.ResendVerificationEmail)
+        v1.GET("/unlock-account", auth.UnlockAccount)
+        v1.DELETE("/delete-account", auth.AuthMiddleware(), auth.RequestAccountDeletion)
+        v1.GET("/cancel-deletion", auth.CancelAccountDeletion)
+        v1.POST("/me/email", emailByIP, auth.AuthMiddleware(), auth.RequestEmailChange)
+        v1.GET("/confirm-email", auth.ConfirmEmailChange)
+        v1.PUT("/me/username", auth.AuthMiddleware(), auth.ChangeUsername)
+        v1.POST("/forgot-password", emailByIP, emailByAccount, auth.ForgotPassword)
+        v1.POST("/reset-password", loginByIP, auth.ResetPassword)
         v1.POST("/logout", auth.AuthMiddleware(), auth.LogoutUser)
 
-        //google auth
+        // Data exports
+        v1.POST("/me/export", auth.AuthMiddleware(), account.RequestDataExport)
+        v1.GET("/me/exports", auth.AuthMiddleware(), account.ListDataExports)
+        v1.GET("/exports/download", account.DownloadDataExport)
+
+        // OAuth providers
         v1.GET("/auth/:provider", auth.AuthHandler) 
         v1.GET("/auth/:provider/callback", auth.AuthCallback)
-        v1.POST("/create-user", auth.CreateUserWithUsername)
-        v1.POST("/validate-token", auth.ValidateOauthToken)
+        v1.GET("/auth/:provider/link", auth.AuthMiddleware(), auth.LinkProvider)
+        v1.GET("/auth/:provider/reauth", auth.AuthMiddleware(), auth.BeginReauth)
+        v1.GET("/me/identities", auth.AuthMiddleware(), auth.GetIdentities)
+        v1.DELETE("/me/identities/:provider", auth.AuthMiddleware(), auth.UnlinkIdentity)
+        v1.POST("/create-user", registerByIP, auth.CreateUserWithUsername)
+        v1.POST("/validate-token", loginByIP, auth.ValidateOauthToken)
+
+        // Passkeys
+        v1.POST("/passkeys/register/begin", auth.AuthMiddleware(), auth.BeginPasskeyRegistration)
+        v1.POST("/passkeys/register/finish", auth.AuthMiddleware(), auth.FinishPasskeyRegistration)
+        v1.POST("/passkeys/login/begin", loginByIP, auth.BeginPasskeyLogin)
+        v1.POST("/passkeys/login/finish", loginByIP, auth.FinishPasskeyLogin)
+        v1.GET("/passkeys", auth.AuthMiddleware(), auth.ListPasskeys)
+        v1.DELETE("/passkeys/:id", auth.AuthMiddleware(), auth.DeletePasskey)
+
+        // Personal access tokens can only be managed from an interactive login
+        v1.POST("/me/tokens", auth.AuthMiddleware(), auth.CreatePersonalToken)
+        v1.GET("/me/tokens", auth.AuthMiddleware(), auth.ListPersonalTokens)
+        v1.DELETE("/me/tokens/:id", auth.AuthMiddleware(), auth.DeletePersonalToken)
         
         // refresh token
-        v1.POST("/refresh-token", utils.RefreshToken)
+        v1.POST("/refresh-token", refreshByIP, auth.RefreshToken)
 
         // aws s3
         v1.POST("/upload/chat/:chatid", aws.UploadFile)
         v1.POST("/upload/profile/:username", aws.UploadFile)
 
         // Follow/Unfollow system Routes
-        v1.POST("/follow/:username", auth.AuthMiddleware(), follow.FollowUser)
-        v1.DELETE("/unfollow/:username", auth.AuthMiddleware(), follow.UnfollowUser)
-        v1.GET("/is-following/:follower/:following", auth.AuthMiddleware(), follow.CheckFollowStatus)
-        v1.GET("/followers/:username", auth.AuthMiddleware(), follow.GetFollowers)
-        v1.GET("/following/:username", auth.AuthMiddleware(), follow.GetFollowing)
-        v1.GET("/notifications/ws", auth.AuthMiddleware(), notifications.NotificationWsHandler)
+        followWrite := v1.Group("", auth.AuthMiddleware(auth.ScopeFollowWrite))
+        followWrite.POST("/follow/:username", follow.FollowUser)
+        followWrite.DELETE("/unfollow/:username", follow.UnfollowUser)
+        followWrite.POST("/follow-requests/:username/approve", follow.ApproveFollowRequest)
+        followWrite.DELETE("/follow-requests/:username", follow.RejectFollowRequest)
+
+        followRead := v1.Group("", auth.AuthMiddleware(auth.ScopeFollowRead))
+        followRead.GET("/is-following/:follower/:following", follow.CheckFollowStatus)
+        followRead.GET("/followers/:username", follow.GetFollowers)
+        followRead.GET("/following/:username", follow.GetFollowing)
+        followRead.GET("/follow-requests", follow.ListFollowRequests)
+        followRead.GET("/suggestions", suggestions.GetSuggestions)
+
+        v1.PUT("/me/privacy", auth.AuthMiddleware(), follow.SetAccountPrivacy)
+
+        // Blocking and muting
+        v1.POST("/block/:username", auth.AuthMiddleware(), block.BlockUser)
+        v1.DELETE("/block/:username", auth.AuthMiddleware(), block.UnblockUser)
+        v1.GET("/me/blocks", auth.AuthMiddleware(), block.ListBlockedUsers)
+        v1.POST("/mute/:username", auth.AuthMiddleware(), block.MuteUser)
+        v1.DELETE("/mute/:username", auth.AuthMiddleware(), block.UnmuteUser)
+        v1.GET("/me/mutes", auth.AuthMiddleware(), block.ListMutedUsers)
+        v1.GET("/me/lists", auth.AuthMiddleware(), audience.ListAudienceLists)
+        v1.POST("/me/lists", auth.AuthMiddleware(), audience.CreateAudienceList)
+        v1.GET("/me/lists/:id", auth.AuthMiddleware(), audience.GetAudienceList)
+        v1.PUT("/me/lists/:id", auth.AuthMiddleware(), audience.RenameAudienceList)
+        v1.DELETE("/me/lists/:id", auth.AuthMiddleware(), audience.DeleteAudienceList)
+        v1.POST("/me/lists/:id/members", auth.AuthMiddleware(), audience.AddAudienceListMember)
+        v1.DELETE("/me/lists/:id/members/:username", auth.AuthMiddleware(), audience.RemoveAudienceListMember)
+        v1.GET("/me/audiences", auth.AuthMiddleware(), audience.GetAudienceRules)
+        v1.PUT("/me/audiences/:rule", auth.AuthMiddleware(), audience.SetAudienceRule)
 
         // Chat routes
-        v1.POST("/create-chat", auth.AuthMiddleware(), chat.CreateChat)
-        v1.GET("/chat/:chatID/ws", auth.AuthMiddleware(), chat.ChatWsHandler)
-        v1.GET("/chat/:chatID/history", auth.AuthMiddleware(), chat.GetChatHistory)
-        v1.GET("/check-chat/:user1/:user2", auth.AuthMiddleware(), chat.CheckChatExists)
-        v1.GET("/notifications/chat/unread", auth.AuthMiddleware(), chat_notifications.GetUnreadChatNotifications)
-        v1.POST("/notifications/chat/mark-read/:chatID", auth.AuthMiddleware(), chat.MarkChatNotificationsAsRead)
-        v1.DELETE("/chat/:chatID", auth.AuthMiddleware(), chat.DeleteChat)
-        v1.DELETE("/chat/:chatID/delete-messages", auth.AuthMiddleware(), chat.DeleteUserMessages)
-        v1.DELETE("/message/:messageID", auth.AuthMiddleware(), chat.DeleteMessage)
-        v1.GET("/chat-notifications/ws", auth.AuthMiddleware(), chat_notifications.ChatNotificationWsHandler)
+        chatWrite := v1.Group("", auth.AuthMiddleware(auth.ScopeChatWrite))
+        chatWrite.POST("/create-chat", chat.CreateChat)
+        chatWrite.GET("/chat/:chatID/ws", chat.ChatWsHandler)
+        chatWrite.POST("/notifications/chat/mark-read/:chatID", chat.MarkChatNotificationsAsRead)
+        chatWrite.DELETE("/chat/:chatID", chat.DeleteChat)
+        chatWrite.DELETE("/chat/:chatID/delete-messages", chat.DeleteUserMessages)
+        chatWrite.DELETE("/message/:messageID", chat.DeleteMessage)
+        chatWrite.POST("/message-requests/:chatID/accept", chat.AcceptMessageRequest)
+        chatWrite.POST("/message-requests/:chatID/decline", chat.DeclineMessageRequest)
+
+        chatRead := v1.Group("", auth.AuthMiddleware(auth.ScopeChatRead))
+        chatRead.GET("/chat/:chatID/history", chat.GetChatHistory)
+        chatRead.GET("/check-chat/:user1/:user2", chat.CheckChatExists)
+        chatRead.GET("/notifications/chat/unread", chat_notifications.GetUnreadChatNotifications)
+        chatRead.GET("/chat-notifications/ws", chat_notifications.ChatNotificationWsHandler)
+        chatRead.GET("/me/chats", user.GetUserChats)
+        chatRead.GET("/me/message-requests", chat.ListMessageRequests)
 
         // User Profile Retrieval
-        v1.GET("/me/chats", auth.AuthMiddleware(), user.GetUserChats)
-        v1.GET("/user/:username", user.GetUserByUsername)
+        v1.GET("/user/:username", auth.OptionalAuthMiddleware(), user.GetUserByUsername)
         v1.GET("/active-users", auth.AuthMiddleware(), user.GetActiveUsersHandler)
-        v1.GET("/active-users/ws", user.HandleConnections)
+        v1.GET("/active-users/ws", auth.AuthMiddleware(), user.HandleConnections)
 
         // General Notifications
-        v1.GET("/notifications", auth.AuthMiddleware(), notifications.GetNotifications)
-        v1.GET("/notifications/count", auth.AuthMiddleware(), notifications.GetUnreadNotificationCount)
+        notificationsRead := v1.Group("", auth.AuthMiddleware(auth.ScopeNotificationsRead))
+        notificationsRead.GET("/notifications", notifications.GetNotifications)
+        notificationsRead.GET("/notifications/count", notifications.GetUnreadNotificationCount)
+        notificationsRead.GET("/notifications/ws", notifications.NotificationWsHandler)
+
         v1.POST("/notifications/general/mark-read/:notificationID", auth.AuthMiddleware(), notifications.MarkNotificationAsRead)
+        v1.POST("/notifications/general/mark-all-read", auth.AuthMiddleware(), notifications.MarkAllNotificationsAsRead)
+        v1.POST("/notifications/general/mark-read-up-to/:notificationID", auth.AuthMiddleware(), notifications.MarkNotificationsReadUpTo)
         v1.DELETE("/notifications/delete/:notificationID", auth.AuthMiddleware(), notifications.DeleteNotification)
+        v1.DELETE("/notifications", auth.AuthMiddleware(), notifications.DeleteNotifications)
+        v1.GET("/me/notification-preferences", auth.AuthMiddleware(), notifications.GetNotificationPreferences)
+        v1.PUT("/me/notification-preferences", auth.AuthMiddleware(), notifications.UpdateNotificationPreferences)
+        v1.PUT("/me/do-not-disturb", auth.AuthMiddleware(), notifications.SetDoNotDisturb)
+        v1.DELETE("/me/do-not-disturb", auth.AuthMiddleware(), notifications.ClearDoNotDisturb)
+
+        // Web Push
+        v1.GET("/push/vapid-public-key", webpush.GetVAPIDPublicKey)
+        v1.GET("/me/push-subscriptions", auth.AuthMiddleware(), webpush.ListSubscriptions)
+        v1.POST("/me/push-subscriptions", auth.AuthMiddleware(), webpush.Subscribe)
+        v1.DELETE("/me/push-subscriptions", auth.AuthMiddleware(), webpush.Unsubscribe)
+
+        // Email digests
+        v1.GET("/me/email-digest", auth.AuthMiddleware(), digest.GetDigestSetting)
+        v1.PUT("/me/email-digest", auth.AuthMiddleware(), digest.UpdateDigestSetting)
+        v1.GET("/email/unsubscribe", digest.Unsubscribe)
+        v1.POST("/email/unsubscribe", digest.UnsubscribeOneClick)
 
         // search 
-        v1.GET("/search", search.SearchUsers(db.DB))
+        v1.GET("/search", auth.OptionalAuthMiddleware(), search.SearchUsers(db.DB))
+
+        // Reports
+        v1.POST("/report/:username", auth.AuthMiddleware(), report.ReportUser)
+
+        // Administration
+        staff := v1.Group("/admin", auth.AuthMiddleware(), auth.RequireRole(auth.RoleModerator))
+        staff.GET("/users", admin.ListUsers)
+        staff.GET("/users/:id/reports", admin.GetUserReports)
+        staff.POST("/users/:id/suspend", admin.SuspendUser)
+        staff.POST("/users/:id/reactivate", admin.ReactivateUser)
+        staff.POST("/users/:id/logout", admin.ForceLogout)
+        staff.POST("/users/:id/verify-email", admin.ForceVerifyEmail)
+        staff.PUT("/users/:id/role", auth.RequireRole(auth.RoleAdmin), admin.SetUserRole)
+        staff.POST("/announcements", auth.RequireRole(auth.RoleAdmin), admin.SendAnnouncement)
     }
 
     r.GET("/", func(c *gin.Context) {
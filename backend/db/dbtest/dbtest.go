@@ -0,0 +1,214 @@
+// Package dbtest installs a scripted database as db.DB, so handlers can be tested
+// without a MySQL server. Tests answer statements by pattern and inspect the ones
+// that were run.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vaanskii/vansify/db"
+)
+
+// Result answers a statement. Queries return Columns and Rows, other statements
+// LastInsertID and RowsAffected. A non-nil Err fails the statement.
+type Result struct {
+    Columns      []string
+    Rows         [][]driver.Value
+    LastInsertID int64
+    RowsAffected int64
+    Err          error
+}
+
+// Statement is a statement that was run, with its whitespace collapsed
+type Statement struct {
+    Query string
+    Args  []driver.Value
+}
+
+type handler struct {
+    pattern *regexp.Regexp
+    answer  func(args []driver.Value) Result
+}
+
+// Fake is the scripted database behind db.DB
+type Fake struct {
+    mu         sync.Mutex
+    handlers   []handler
+    statements []Statement
+}
+
+// Open installs a new fake as db.DB. It is left in place after the test, since
+// handlers may still be finishing work in the background.
+func Open(t testing.TB) *Fake {
+    t.Helper()
+    fake := &Fake{}
+    db.DB = sql.OpenDB(connector{fake})
+    return fake
+}
+
+// On answers statements matching the regular expression pattern. Handlers added
+// later take precedence; statements nothing matches fail.
+func (f *Fake) On(pattern string, answer func(args []driver.Value) Result) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.handlers = append(f.handlers, handler{regexp.MustCompile(pattern), answer})
+}
+
+// Answer answers statements matching pattern with the same result every time
+func (f *Fake) Answer(pattern string, result Result) {
+    f.On(pattern, func([]driver.Value) Result { return result })
+}
+
+// Statements returns the statements run so far that match pattern
+func (f *Fake) Statements(pattern string) []Statement {
+    re := regexp.MustCompile(pattern)
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    var matched []Statement
+    for _, statement := range f.statements {
+        if re.MatchString(statement.Query) {
+            matched = append(matched, statement)
+        }
+    }
+    return matched
+}
+
+func (f *Fake) run(query string, args []driver.Value) Result {
+    query = strings.Join(strings.Fields(query), " ")
+
+    f.mu.Lock()
+    f.statements = append(f.statements, Statement{Query: query, Args: args})
+    var answer func([]driver.Value) Result
+    for i := len(f.handlers) - 1; i >= 0; i-- {
+        if f.handlers[i].pattern.MatchString(query) {
+            answer = f.handlers[i].answer
+            break
+        }
+    }
+    f.mu.Unlock()
+
+    if answer == nil {
+        return Result{Err: fmt.Errorf("dbtest: unexpected statement %q", query)}
+    }
+    return answer(args)
+}
+
+type connector struct {
+    fake *Fake
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+    return conn{c.fake}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+    return fakeDriver{c.fake}
+}
+
+type fakeDriver struct {
+    fake *Fake
+}
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+    return conn{d.fake}, nil
+}
+
+type conn struct {
+    fake *Fake
+}
+
+func (c conn) Prepare(query string) (driver.Stmt, error) {
+    return stmt{c.fake, query}, nil
+}
+
+func (c conn) Close() error {
+    return nil
+}
+
+// Begin starts a transaction; statements in it are answered like any other
+func (c conn) Begin() (driver.Tx, error) {
+    return tx{}, nil
+}
+
+type tx struct{}
+
+func (tx) Commit() error {
+    return nil
+}
+
+func (tx) Rollback() error {
+    return nil
+}
+
+type stmt struct {
+    fake  *Fake
+    query string
+}
+
+func (s stmt) Close() error {
+    return nil
+}
+
+func (s stmt) NumInput() int {
+    return -1
+}
+
+func (s stmt) Exec(args []driver.Value) (driver.Result, error) {
+    result := s.fake.run(s.query, args)
+    if result.Err != nil {
+        return nil, result.Err
+    }
+    return execResult{result.LastInsertID, result.RowsAffected}, nil
+}
+
+func (s stmt) Query(args []driver.Value) (driver.Rows, error) {
+    result := s.fake.run(s.query, args)
+    if result.Err != nil {
+        return nil, result.Err
+    }
+    return &rows{columns: result.Columns, values: result.Rows}, nil
+}
+
+type execResult struct {
+    lastInsertID int64
+    rowsAffected int64
+}
+
+func (r execResult) LastInsertId() (int64, error) {
+    return r.lastInsertID, nil
+}
+
+func (r execResult) RowsAffected() (int64, error) {
+    return r.rowsAffected, nil
+}
+
+type rows struct {
+    columns []string
+    values  [][]driver.Value
+}
+
+func (r *rows) Columns() []string {
+    return r.columns
+}
+
+func (r *rows) Close() error {
+    return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+    if len(r.values) == 0 {
+        return io.EOF
+    }
+    copy(dest, r.values[0])
+    r.values = r.values[1:]
+    return nil
+}
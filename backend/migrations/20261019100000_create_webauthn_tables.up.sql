@@ -0,0 +1,25 @@
+CREATE TABLE webauthn_credentials (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    credential_id VARBINARY(1023) NOT NULL UNIQUE,
+    public_key BLOB NOT NULL,
+    attestation_type VARCHAR(50) NOT NULL DEFAULT '',
+    aaguid VARBINARY(16),
+    sign_count INT UNSIGNED NOT NULL DEFAULT 0,
+    transports VARCHAR(255) NOT NULL DEFAULT '',
+    backup_eligible BOOLEAN DEFAULT FALSE,
+    backup_state BOOLEAN DEFAULT FALSE,
+    name VARCHAR(100) NOT NULL DEFAULT 'Passkey',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE webauthn_sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INT NULL,
+    ceremony ENUM('registration', 'login') NOT NULL,
+    data TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,5 @@
+ALTER TABLE users
+    DROP COLUMN locked_until,
+    DROP COLUMN failed_login_attempts;
+
+DROP TABLE IF EXISTS rate_limit_buckets;
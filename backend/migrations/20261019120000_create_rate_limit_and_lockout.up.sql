@@ -0,0 +1,11 @@
+CREATE TABLE rate_limit_buckets (
+    bucket_key VARCHAR(191) PRIMARY KEY,
+    tokens DOUBLE NOT NULL,
+    updated_at DATETIME(6) NOT NULL,
+    expires_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX (expires_at)
+);
+
+ALTER TABLE users
+    ADD COLUMN failed_login_attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN locked_until TIMESTAMP NULL DEFAULT NULL;
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS reports;
+
+ALTER TABLE users
+    DROP COLUMN tokens_valid_after,
+    DROP COLUMN suspension_reason,
+    DROP COLUMN suspended_at,
+    DROP COLUMN role;
@@ -0,0 +1,21 @@
+ALTER TABLE users
+    ADD COLUMN role ENUM('user', 'moderator', 'admin') NOT NULL DEFAULT 'user',
+    ADD COLUMN suspended_at TIMESTAMP NULL DEFAULT NULL,
+    ADD COLUMN suspension_reason VARCHAR(255) NULL DEFAULT NULL,
+    ADD COLUMN tokens_valid_after TIMESTAMP NULL DEFAULT NULL;
+
+CREATE TABLE reports (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    reporter_id INT NOT NULL,
+    reported_id INT NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    details TEXT,
+    status ENUM('open', 'resolved', 'dismissed') NOT NULL DEFAULT 'open',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP NULL DEFAULT NULL,
+    resolved_by INT NULL,
+    INDEX (reported_id, created_at),
+    FOREIGN KEY (reporter_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (reported_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (resolved_by) REFERENCES users(id) ON DELETE SET NULL
+);
@@ -0,0 +1,4 @@
+ALTER TABLE users
+    DROP INDEX deletion_scheduled_for,
+    DROP COLUMN deletion_scheduled_for,
+    DROP COLUMN deletion_requested_at;
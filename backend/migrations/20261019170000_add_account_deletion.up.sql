@@ -0,0 +1,4 @@
+ALTER TABLE users
+    ADD COLUMN deletion_requested_at TIMESTAMP NULL DEFAULT NULL,
+    ADD COLUMN deletion_scheduled_for TIMESTAMP NULL DEFAULT NULL,
+    ADD INDEX (deletion_scheduled_for);
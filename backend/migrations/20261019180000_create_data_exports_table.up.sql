@@ -0,0 +1,17 @@
+CREATE TABLE data_exports (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    status ENUM('pending', 'running', 'ready', 'failed', 'expired') NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    lease_until TIMESTAMP NULL DEFAULT NULL,
+    storage_key VARCHAR(255),
+    size_bytes BIGINT,
+    token_hash CHAR(64) UNIQUE,
+    error VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP NULL DEFAULT NULL,
+    expires_at TIMESTAMP NULL DEFAULT NULL,
+    INDEX (status),
+    INDEX (user_id, created_at),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS username_reservations;
+
+ALTER TABLE chats
+    DROP FOREIGN KEY chats_ibfk_1,
+    DROP FOREIGN KEY chats_ibfk_2;
+ALTER TABLE chats
+    ADD CONSTRAINT chats_ibfk_1 FOREIGN KEY (user1) REFERENCES users(username) ON DELETE CASCADE,
+    ADD CONSTRAINT chats_ibfk_2 FOREIGN KEY (user2) REFERENCES users(username) ON DELETE CASCADE;
+
+ALTER TABLE users
+    DROP COLUMN username_changed_at,
+    DROP COLUMN pending_email;
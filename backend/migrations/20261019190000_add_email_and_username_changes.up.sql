@@ -0,0 +1,18 @@
+ALTER TABLE users
+    ADD COLUMN pending_email VARCHAR(100) NULL DEFAULT NULL,
+    ADD COLUMN username_changed_at TIMESTAMP NULL DEFAULT NULL;
+
+-- Renaming a user renames the chats they are in
+ALTER TABLE chats
+    DROP FOREIGN KEY chats_ibfk_1,
+    DROP FOREIGN KEY chats_ibfk_2;
+ALTER TABLE chats
+    ADD CONSTRAINT chats_ibfk_1 FOREIGN KEY (user1) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+    ADD CONSTRAINT chats_ibfk_2 FOREIGN KEY (user2) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE;
+
+CREATE TABLE username_reservations (
+    username VARCHAR(50) PRIMARY KEY,
+    user_id INT NOT NULL,
+    reserved_until TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,49 @@
+ALTER TABLE messages
+    ADD COLUMN username VARCHAR(255) NULL AFTER message,
+    ADD COLUMN deleted_for TEXT;
+
+UPDATE messages m JOIN users u ON u.id = m.user_id SET m.username = u.username;
+UPDATE messages m
+JOIN (
+    SELECT d.message_id, GROUP_CONCAT(u.username) AS usernames
+    FROM message_deletions d
+    JOIN users u ON u.id = d.user_id
+    GROUP BY d.message_id
+) deleted ON deleted.message_id = m.id
+SET m.deleted_for = deleted.usernames;
+
+DROP TABLE IF EXISTS message_deletions;
+
+ALTER TABLE messages
+    DROP FOREIGN KEY messages_user_fk,
+    DROP INDEX messages_chat_created,
+    DROP COLUMN user_id,
+    MODIFY username VARCHAR(255) NOT NULL;
+
+ALTER TABLE chats
+    ADD COLUMN user1 VARCHAR(255) NULL AFTER chat_id,
+    ADD COLUMN user2 VARCHAR(255) NULL AFTER user1,
+    ADD COLUMN deleted_for TEXT;
+
+UPDATE chats c JOIN users u ON u.id = c.user1_id SET c.user1 = u.username;
+UPDATE chats c JOIN users u ON u.id = c.user2_id SET c.user2 = u.username;
+UPDATE chats c
+JOIN (
+    SELECT d.chat_id, GROUP_CONCAT(u.username) AS usernames
+    FROM chat_deletions d
+    JOIN users u ON u.id = d.user_id
+    GROUP BY d.chat_id
+) deleted ON deleted.chat_id = c.chat_id
+SET c.deleted_for = deleted.usernames;
+
+DROP TABLE IF EXISTS chat_deletions;
+
+ALTER TABLE chats
+    DROP FOREIGN KEY chats_user1_fk,
+    DROP FOREIGN KEY chats_user2_fk,
+    DROP COLUMN user1_id,
+    DROP COLUMN user2_id,
+    MODIFY user1 VARCHAR(255) NOT NULL,
+    MODIFY user2 VARCHAR(255) NOT NULL,
+    ADD CONSTRAINT chats_ibfk_1 FOREIGN KEY (user1) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+    ADD CONSTRAINT chats_ibfk_2 FOREIGN KEY (user2) REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE;
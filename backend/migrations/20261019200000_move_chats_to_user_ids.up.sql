@@ -0,0 +1,64 @@
+-- Chats reference their users by ID
+ALTER TABLE chats
+    ADD COLUMN user1_id INT NULL AFTER chat_id,
+    ADD COLUMN user2_id INT NULL AFTER user1_id;
+
+UPDATE chats c JOIN users u ON u.username = c.user1 SET c.user1_id = u.id;
+UPDATE chats c JOIN users u ON u.username = c.user2 SET c.user2_id = u.id;
+DELETE FROM chats WHERE user1_id IS NULL OR user2_id IS NULL;
+
+-- Who removed a chat from their list, until the next message brings it back
+CREATE TABLE chat_deletions (
+    user_id INT NOT NULL,
+    chat_id VARCHAR(255) NOT NULL,
+    deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, chat_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (chat_id) REFERENCES chats(chat_id) ON DELETE CASCADE
+);
+
+INSERT IGNORE INTO chat_deletions (user_id, chat_id)
+SELECT u.id, c.chat_id
+FROM chats c
+JOIN users u ON FIND_IN_SET(u.username, c.deleted_for) > 0;
+
+ALTER TABLE chats
+    DROP FOREIGN KEY chats_ibfk_1,
+    DROP FOREIGN KEY chats_ibfk_2;
+ALTER TABLE chats
+    DROP COLUMN user1,
+    DROP COLUMN user2,
+    DROP COLUMN deleted_for,
+    MODIFY user1_id INT NOT NULL,
+    MODIFY user2_id INT NOT NULL,
+    ADD CONSTRAINT chats_user1_fk FOREIGN KEY (user1_id) REFERENCES users(id) ON DELETE CASCADE,
+    ADD CONSTRAINT chats_user2_fk FOREIGN KEY (user2_id) REFERENCES users(id) ON DELETE CASCADE;
+
+-- Messages reference their sender by ID
+ALTER TABLE messages ADD COLUMN user_id INT NULL AFTER message;
+
+UPDATE messages m JOIN users u ON u.username = m.username SET m.user_id = u.id;
+DELETE FROM messages WHERE user_id IS NULL;
+
+-- Messages a user deleted for themselves
+CREATE TABLE message_deletions (
+    user_id INT NOT NULL,
+    message_id INT NOT NULL,
+    deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, message_id),
+    INDEX (message_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+INSERT IGNORE INTO message_deletions (user_id, message_id)
+SELECT u.id, m.id
+FROM messages m
+JOIN users u ON FIND_IN_SET(u.username, m.deleted_for) > 0;
+
+ALTER TABLE messages
+    DROP COLUMN username,
+    DROP COLUMN deleted_for,
+    MODIFY user_id INT NOT NULL,
+    ADD CONSTRAINT messages_user_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    ADD INDEX messages_chat_created (chat_id, created_at);
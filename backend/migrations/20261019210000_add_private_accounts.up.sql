@@ -0,0 +1,13 @@
+ALTER TABLE users
+    ADD COLUMN private BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE follow_requests (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    requester_id INT NOT NULL,
+    target_id INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY follow_requests_pair (requester_id, target_id),
+    INDEX follow_requests_target (target_id, created_at),
+    FOREIGN KEY (requester_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (target_id) REFERENCES users(id) ON DELETE CASCADE
+);
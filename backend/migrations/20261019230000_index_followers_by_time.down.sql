@@ -0,0 +1,2 @@
+DROP INDEX followers_follower_created ON followers;
+DROP INDEX followers_following_created ON followers;
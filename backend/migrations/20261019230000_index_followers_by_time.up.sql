@@ -0,0 +1,2 @@
+CREATE INDEX followers_following_created ON followers (following_id, created_at);
+CREATE INDEX followers_follower_created ON followers (follower_id, created_at);
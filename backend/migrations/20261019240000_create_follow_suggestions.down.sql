@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS follow_suggestions;
+
+ALTER TABLE users
+    DROP COLUMN suggestions_computed_at;
@@ -0,0 +1,18 @@
+ALTER TABLE users
+    ADD COLUMN suggestions_computed_at TIMESTAMP NULL DEFAULT NULL;
+
+CREATE TABLE follow_suggestions (
+    user_id INT NOT NULL,
+    suggested_id INT NOT NULL,
+    score DOUBLE NOT NULL,
+    mutual_count INT NOT NULL DEFAULT 0,
+    sample_mutual_id INT NULL,
+    shared_chat BOOLEAN NOT NULL DEFAULT FALSE,
+    follows_you BOOLEAN NOT NULL DEFAULT FALSE,
+    computed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, suggested_id),
+    INDEX follow_suggestions_rank (user_id, score),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (suggested_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (sample_mutual_id) REFERENCES users(id) ON DELETE SET NULL
+);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS notification_actors;
+
+ALTER TABLE notifications
+    DROP COLUMN aggregate_until;
@@ -0,0 +1,19 @@
+-- Follow notifications collect the followers of a time window until aggregate_until
+ALTER TABLE notifications
+    ADD COLUMN aggregate_until TIMESTAMP NULL DEFAULT NULL;
+
+CREATE TABLE notification_actors (
+    notification_id INT NOT NULL,
+    actor_id INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (notification_id, actor_id),
+    INDEX notification_actors_actor (actor_id),
+    CONSTRAINT notification_actors_notification_fk FOREIGN KEY (notification_id) REFERENCES notifications(id) ON DELETE CASCADE,
+    CONSTRAINT notification_actors_actor_fk FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT INTO notification_actors (notification_id, actor_id, created_at)
+SELECT n.id, n.follower_id, n.created_at
+FROM notifications n
+JOIN users u ON u.id = n.follower_id
+WHERE n.type = 'FOLLOW';
@@ -0,0 +1,29 @@
+CREATE TABLE audience_lists (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY audience_lists_name (user_id, name),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE audience_list_members (
+    list_id INT NOT NULL,
+    member_id INT NOT NULL,
+    added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (list_id, member_id),
+    INDEX audience_list_members_member (member_id),
+    FOREIGN KEY (list_id) REFERENCES audience_lists(id) ON DELETE CASCADE,
+    FOREIGN KEY (member_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Who may see or do what; a missing rule means everyone
+CREATE TABLE audience_rules (
+    user_id INT NOT NULL,
+    rule VARCHAR(20) NOT NULL,
+    audience VARCHAR(20) NOT NULL,
+    list_id INT NULL,
+    PRIMARY KEY (user_id, rule),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (list_id) REFERENCES audience_lists(id)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE chats
+    DROP INDEX chats_user2_request,
+    DROP COLUMN request_decided_at,
+    DROP COLUMN request_status;
@@ -0,0 +1,6 @@
+-- A chat started by someone outside the recipient's chat audience waits in their
+-- message requests until they accept or decline it. user1 started the chat.
+ALTER TABLE chats
+    ADD COLUMN request_status ENUM('accepted', 'pending', 'declined') NOT NULL DEFAULT 'accepted',
+    ADD COLUMN request_decided_at TIMESTAMP NULL,
+    ADD INDEX chats_user2_request (user2_id, request_status);
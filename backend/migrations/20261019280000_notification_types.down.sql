@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS login_devices;
+
+ALTER TABLE notifications
+    DROP FOREIGN KEY notifications_actor_fk;
+
+ALTER TABLE notifications
+    DROP INDEX notifications_actor_fk,
+    DROP INDEX notifications_user_created,
+    DROP COLUMN payload,
+    DROP COLUMN object_id,
+    DROP COLUMN object_type;
+
+ALTER TABLE notifications
+    CHANGE actor_id follower_id INT NULL;
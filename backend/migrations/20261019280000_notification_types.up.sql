@@ -0,0 +1,38 @@
+-- A notification is an actor doing something, its type, to an object, with whatever
+-- else the type needs in payload. follower_id becomes the actor of any type.
+DELETE n FROM notifications n
+LEFT JOIN users u ON u.id = n.follower_id
+WHERE n.follower_id IS NOT NULL AND u.id IS NULL;
+
+ALTER TABLE notifications
+    CHANGE follower_id actor_id INT NULL;
+
+ALTER TABLE notifications
+    ADD COLUMN object_type VARCHAR(50) NULL AFTER actor_id,
+    ADD COLUMN object_id VARCHAR(255) NULL AFTER object_type,
+    ADD COLUMN payload JSON NULL AFTER object_id,
+    ADD CONSTRAINT notifications_actor_fk FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE CASCADE,
+    ADD INDEX notifications_user_created (user_id, created_at);
+
+-- Follow notifications keep the names of their newest followers and how many there are
+UPDATE notifications n
+SET n.payload = JSON_OBJECT(
+    'actors', JSON_ARRAY((SELECT u.username FROM users u WHERE u.id = n.actor_id)),
+    'actor_count', GREATEST(1, (SELECT COUNT(*) FROM notification_actors a WHERE a.notification_id = n.id)))
+WHERE n.type IN ('FOLLOW', 'FOLLOW_REQUEST');
+
+UPDATE notifications n
+SET n.payload = JSON_OBJECT()
+WHERE n.payload IS NULL;
+
+-- Devices each user has logged in from, so logins from a new one can be announced
+CREATE TABLE login_devices (
+    user_id INT NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    last_ip VARCHAR(45) NOT NULL,
+    first_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, fingerprint),
+    CONSTRAINT login_devices_user_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,6 @@
+ALTER TABLE users
+    DROP COLUMN dnd_end,
+    DROP COLUMN dnd_start,
+    DROP COLUMN timezone;
+
+DROP TABLE IF EXISTS notification_preferences;
@@ -0,0 +1,17 @@
+-- Channels a user turned on or off for a notification type. Anything not listed
+-- uses the default of the channel.
+CREATE TABLE notification_preferences (
+    user_id INT NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    channel VARCHAR(20) NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, type, channel),
+    CONSTRAINT notification_preferences_user_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Do-not-disturb hours are minutes after midnight in the user's timezone
+ALTER TABLE users
+    ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    ADD COLUMN dnd_start SMALLINT NULL DEFAULT NULL,
+    ADD COLUMN dnd_end SMALLINT NULL DEFAULT NULL;
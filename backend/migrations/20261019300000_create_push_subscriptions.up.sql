@@ -0,0 +1,17 @@
+-- Web Push subscriptions, one per browser or device. endpoint_hash keeps the
+-- endpoint unique since endpoints are too long to index.
+CREATE TABLE push_subscriptions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    endpoint TEXT NOT NULL,
+    endpoint_hash CHAR(64) NOT NULL,
+    p256dh VARCHAR(128) NOT NULL,
+    auth VARCHAR(64) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP NULL DEFAULT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_success_at TIMESTAMP NULL DEFAULT NULL,
+    UNIQUE KEY push_subscriptions_endpoint (endpoint_hash),
+    INDEX push_subscriptions_user (user_id),
+    CONSTRAINT push_subscriptions_user_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+ALTER TABLE users
+    DROP COLUMN email_digest;
+
+DROP TABLE IF EXISTS email_digests;
@@ -0,0 +1,17 @@
+-- Digests of unread activity emailed to users who have been away. Each row records
+-- the newest notification and chat notification it covered, so later digests only
+-- cover what came after.
+CREATE TABLE email_digests (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    notifications_until INT NOT NULL DEFAULT 0,
+    chat_notifications_until INT NOT NULL DEFAULT 0,
+    unsubscribe_token_hash CHAR(64) NOT NULL,
+    sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY email_digests_unsubscribe (unsubscribe_token_hash),
+    INDEX email_digests_user_sent (user_id, sent_at),
+    CONSTRAINT email_digests_user_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE users
+    ADD COLUMN email_digest BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,2 @@
+ALTER TABLE notifications
+    DROP INDEX notifications_read_created;
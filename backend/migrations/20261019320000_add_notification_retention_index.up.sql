@@ -0,0 +1,3 @@
+-- Lets the retention purge find old read notifications without scanning every user
+ALTER TABLE notifications
+    ADD INDEX notifications_read_created (is_read, created_at);
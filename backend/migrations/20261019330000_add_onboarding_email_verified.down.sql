@@ -0,0 +1,2 @@
+ALTER TABLE oauth_onboarding_codes
+    DROP COLUMN email_verified;
@@ -0,0 +1,4 @@
+-- Whether the provider asserted the user owns the email of a sign up, so accounts
+-- made from an unverified address have to verify it like any other
+ALTER TABLE oauth_onboarding_codes
+    ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE AFTER email;
@@ -6,17 +6,20 @@ type Message struct {
     ID          int       `json:"id"`
     ChatID      string    `json:"chat_id"`
     Message     string    `json:"message"`
+    UserID      int64     `json:"user_id"`
     Username    string    `json:"username"`
     FileURL     string    `json:"file_url,omitempty"`
     CreatedAt   time.Time `json:"created_at"`
-    DeletedFor  string    `json:"deleted_for"`
     Status      string    `json:"status"`
 }
 
 type Chat struct {
     ID       int    `json:"id"`
     ChatID   string `json:"chat_id"`
+    User1ID  int64  `json:"user1_id"`
+    User2ID  int64  `json:"user2_id"`
     User1    string `json:"user1"`
     User2    string `json:"user2"`
-    DeletedFor  string    `json:"deleted_for"`
+    // RequestStatus is pending or declined while the chat is a message request to user2
+    RequestStatus string `json:"request_status"`
 }
@@ -3,15 +3,31 @@ package models
 type NotificationType string
 
 const (
-    FollowNotificationType NotificationType = "FOLLOW"
+    FollowNotificationType             NotificationType = "FOLLOW"
+    FollowRequestNotificationType      NotificationType = "FOLLOW_REQUEST"
+    FollowAcceptedNotificationType     NotificationType = "FOLLOW_ACCEPTED"
+    MentionNotificationType            NotificationType = "MENTION"
+    ReactionNotificationType           NotificationType = "REACTION"
+    NewDeviceLoginNotificationType     NotificationType = "NEW_DEVICE_LOGIN"
+    SystemAnnouncementNotificationType NotificationType = "SYSTEM_ANNOUNCEMENT"
+    DataExportNotificationType         NotificationType = "DATA_EXPORT"
+    // MessageNotificationType is for chat messages, which are not stored as notifications
+    // but have notification preferences like the other types
+    MessageNotificationType            NotificationType = "MESSAGE"
 )
+
+// Notification is an actor doing something, its type, to an object. Payload holds
+// whatever else the type needs; see notifications.Types for what each type uses.
 type Notification struct {
-    ID        int64           `json:"id"`
-    UserID    int64           `json:"user_id"`
-    Message   string          `json:"message"`
-    IsRead    bool            `json:"is_read"`
-    Type      NotificationType `json:"type"`
-    CreatedAt string          `json:"created_at"`
+    ID         int64                  `json:"id"`
+    UserID     int64                  `json:"user_id"`
+    Message    string                 `json:"message"`
+    IsRead     bool                   `json:"is_read"`
+    Type       NotificationType       `json:"type"`
+    ActorID    int64                  `json:"actor_id,omitempty"`
+    ObjectID   string                 `json:"object_id,omitempty"`
+    Payload    map[string]interface{} `json:"payload"`
+    CreatedAt  string                 `json:"created_at"`
 }
 
 type ChatNotification struct {
@@ -0,0 +1,253 @@
+package notifications
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const (
+    defaultNotificationsLimit = 20
+    maxNotificationsLimit     = 100
+    // maxBulkDelete bounds the IDs one bulk delete takes
+    maxBulkDelete = 100
+)
+
+// notificationCursor points at the last notification of a page. Notifications are
+// ordered by creation time and then by ID, since several can share a second.
+type notificationCursor struct {
+    CreatedAt int64
+    ID        int64
+}
+
+func (cur notificationCursor) encode() string {
+    return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", cur.CreatedAt, cur.ID)))
+}
+
+func decodeNotificationCursor(raw string) (notificationCursor, bool) {
+    var cur notificationCursor
+    decoded, err := base64.RawURLEncoding.DecodeString(raw)
+    if err != nil {
+        return cur, false
+    }
+    parts := strings.SplitN(string(decoded), ":", 2)
+    if len(parts) != 2 {
+        return cur, false
+    }
+    cur.CreatedAt, err = strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        return cur, false
+    }
+    cur.ID, err = strconv.ParseInt(parts[1], 10, 64)
+    return cur, err == nil
+}
+
+// notificationFilters turns the type and read query parameters into conditions on
+// notifications n of a user. It answers the request itself when a filter is invalid.
+func notificationFilters(c *gin.Context, userID int64) ([]string, []interface{}, bool) {
+    conditions := []string{"n.user_id = ?"}
+    args := []interface{}{userID}
+
+    var types []interface{}
+    for _, value := range c.QueryArray("type") {
+        for _, name := range strings.Split(value, ",") {
+            notificationType := models.NotificationType(strings.TrimSpace(name))
+            if notificationType == "" {
+                continue
+            }
+            if _, ok := Types[notificationType]; !ok {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown notification type " + string(notificationType)})
+                return nil, nil, false
+            }
+            types = append(types, notificationType)
+        }
+    }
+    if len(types) > 0 {
+        conditions = append(conditions, "n.type IN (?"+strings.Repeat(", ?", len(types)-1)+")")
+        args = append(args, types...)
+    }
+
+    if raw := c.Query("read"); raw != "" {
+        read, err := strconv.ParseBool(raw)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid read filter"})
+            return nil, nil, false
+        }
+        conditions = append(conditions, "n.is_read = ?")
+        args = append(args, read)
+    }
+
+    return conditions, args, true
+}
+
+// notificationsUser reads the user a bulk change is for
+func notificationsUser(c *gin.Context) (int64, string, bool) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return 0, "", false
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return 0, "", false
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        log.Printf("Error retrieving user ID: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return 0, "", false
+    }
+    return userID, customClaims.Username, true
+}
+
+// BroadcastUnreadCount pushes the unread notification count of a user to their
+// notification socket, so other tabs and devices catch up with a change, and returns it
+func BroadcastUnreadCount(userID int64, username string) (int, error) {
+    var count int
+    err := db.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND is_read = false", userID).Scan(&count)
+    if err != nil {
+        return 0, err
+    }
+
+    message, err := json.Marshal(map[string]interface{}{
+        "type":                      "UNREAD_COUNT",
+        "unread_notification_count": count,
+        "receiver":                  username,
+    })
+    if err != nil {
+        return 0, err
+    }
+    GlobalNotificationHub.BroadcastNotification(username, message)
+    return count, nil
+}
+
+// respondBulkChange pushes and returns the unread count after a bulk change
+func respondBulkChange(c *gin.Context, userID int64, username, key string, affected int64) {
+    count, err := BroadcastUnreadCount(userID, username)
+    if err != nil {
+        log.Printf("Error broadcasting unread notification count: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching unread notification count"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{key: affected, "unread_count": count})
+}
+
+// MarkAllNotificationsAsRead marks every unread notification of the user as read, or
+// only those of the types given in the type query parameter
+func MarkAllNotificationsAsRead(c *gin.Context) {
+    userID, username, ok := notificationsUser(c)
+    if !ok {
+        return
+    }
+    conditions, args, ok := notificationFilters(c, userID)
+    if !ok {
+        return
+    }
+
+    result, err := db.DB.Exec("UPDATE notifications n SET n.is_read = TRUE WHERE "+strings.Join(conditions, " AND ")+" AND n.is_read = FALSE", args...)
+    if err != nil {
+        log.Printf("Error marking notifications as read: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marking notifications as read"})
+        return
+    }
+    updated, _ := result.RowsAffected()
+
+    respondBulkChange(c, userID, username, "updated", updated)
+}
+
+// MarkNotificationsReadUpTo marks a notification and every one listed after it, that
+// is created before it, as read. Clients pass the last notification the user has seen.
+func MarkNotificationsReadUpTo(c *gin.Context) {
+    userID, username, ok := notificationsUser(c)
+    if !ok {
+        return
+    }
+    notificationID, err := strconv.ParseInt(c.Param("notificationID"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+        return
+    }
+
+    // Joining the notification itself keeps its position in the database's own time
+    result, err := db.DB.Exec(`
+        UPDATE notifications n
+        JOIN notifications t ON t.id = ? AND t.user_id = n.user_id
+        SET n.is_read = TRUE
+        WHERE n.user_id = ? AND n.is_read = FALSE
+            AND (n.created_at < t.created_at OR (n.created_at = t.created_at AND n.id <= t.id))`, notificationID, userID)
+    if err != nil {
+        log.Printf("Error marking notifications as read: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marking notifications as read"})
+        return
+    }
+    updated, _ := result.RowsAffected()
+    if updated == 0 {
+        var exists bool
+        if err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM notifications WHERE id = ? AND user_id = ?)", notificationID, userID).Scan(&exists); err == nil && !exists {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+            return
+        }
+    }
+
+    respondBulkChange(c, userID, username, "updated", updated)
+}
+
+// DeleteNotifications deletes the notifications with the given IDs, or every read
+// notification of the user with {"read": true}
+func DeleteNotifications(c *gin.Context) {
+    userID, username, ok := notificationsUser(c)
+    if !ok {
+        return
+    }
+
+    var request struct {
+        IDs  []int64 `json:"ids"`
+        Read bool    `json:"read"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+    if len(request.IDs) == 0 && !request.Read {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Either ids or read is required"})
+        return
+    }
+    if len(request.IDs) > maxBulkDelete {
+        c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d notifications can be deleted at once", maxBulkDelete)})
+        return
+    }
+
+    query := "DELETE FROM notifications WHERE user_id = ?"
+    args := []interface{}{userID}
+    if len(request.IDs) > 0 {
+        query += " AND id IN (?" + strings.Repeat(", ?", len(request.IDs)-1) + ")"
+        for _, id := range request.IDs {
+            args = append(args, id)
+        }
+    }
+    if request.Read {
+        query += " AND is_read = TRUE"
+    }
+
+    result, err := db.DB.Exec(query, args...)
+    if err != nil {
+        log.Printf("Error deleting notifications: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting notifications"})
+        return
+    }
+    deleted, _ := result.RowsAffected()
+
+    respondBulkChange(c, userID, username, "deleted", deleted)
+}
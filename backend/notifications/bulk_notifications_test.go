@@ -0,0 +1,65 @@
+package notifications
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vaanskii/vansify/db/dbtest"
+)
+
+func TestMarkNotificationsReadUpTo(t *testing.T) {
+    for _, test := range []struct {
+        name    string
+        id      string
+        updated int64
+        exists  bool
+        status  int
+    }{
+        {"marks older notifications", "7", 3, true, http.StatusOK},
+        {"everything already read", "7", 0, true, http.StatusOK},
+        {"notification of someone else", "7", 0, false, http.StatusNotFound},
+        {"invalid ID", "seven", 0, false, http.StatusBadRequest},
+    } {
+        fake, router := fakeNotifications(t, nil)
+        fake.Answer(`^UPDATE notifications n JOIN notifications t`, dbtest.Result{RowsAffected: test.updated})
+        fake.Answer(`^SELECT EXISTS\(SELECT 1 FROM notifications WHERE id = \? AND user_id = \?\)`, dbtest.Result{
+            Columns: []string{"exists"}, Rows: [][]driver.Value{{test.exists}},
+        })
+        fake.Answer(`^SELECT COUNT\(\*\) FROM notifications`, dbtest.Result{Columns: []string{"count"}, Rows: [][]driver.Value{{int64(2)}}})
+
+        recorder := httptest.NewRecorder()
+        router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/notifications/general/mark-read-up-to/"+test.id, nil))
+        if recorder.Code != test.status {
+            t.Errorf("%s: got %d %s, want %d", test.name, recorder.Code, recorder.Body, test.status)
+            continue
+        }
+
+        updates := fake.Statements(`^UPDATE notifications n JOIN notifications t`)
+        if test.status == http.StatusBadRequest {
+            if len(updates) != 0 {
+                t.Errorf("%s: notifications were updated", test.name)
+            }
+            continue
+        }
+        if len(updates) != 1 || updates[0].Args[0] != int64(7) || updates[0].Args[1] != int64(notificationsTestUserID) {
+            t.Errorf("%s: updated with %+v, want notification 7 of user %d", test.name, updates, notificationsTestUserID)
+        }
+        if test.status != http.StatusOK {
+            continue
+        }
+
+        var response struct {
+            Updated     int64 `json:"updated"`
+            UnreadCount int   `json:"unread_count"`
+        }
+        if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+            t.Fatal(err)
+        }
+        if response.Updated != test.updated || response.UnreadCount != 2 {
+            t.Errorf("%s: answered %+v", test.name, response)
+        }
+    }
+}
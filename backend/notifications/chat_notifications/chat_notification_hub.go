@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	"github.com/gorilla/websocket"
+	"github.com/vaanskii/vansify/utils"
 )
 
 type ChatNotificationHub struct {
@@ -46,4 +47,23 @@ func (h *ChatNotificationHub) SendChatNotification(username string, message []by
     }
 }
 
+// IsConnected reports whether a user has the chat notification socket open
+func (h *ChatNotificationHub) IsConnected(username string) bool {
+    h.mu.RLock()
+    _, exists := h.connections[username]
+    h.mu.RUnlock()
+    return exists
+}
+
+// DisconnectUser closes the chat notification connection of a user
+func (h *ChatNotificationHub) DisconnectUser(username, reason string) {
+    h.mu.Lock()
+    conn, exists := h.connections[username]
+    delete(h.connections, username)
+    h.mu.Unlock()
+    if exists {
+        utils.CloseWebSocket(conn, reason)
+    }
+}
+
 var ChatNotification = NewChatNotificationHub()
@@ -0,0 +1,157 @@
+package notifications
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/vaanskii/vansify/models"
+)
+
+// followNotificationWindow is how long a follow notification keeps collecting new
+// followers before the next follow starts a new one
+const followNotificationWindow = time.Hour
+
+// NotifyFollow adds a follower to the open follow notification of a user, or starts a
+// new one. Following again within the window does not notify twice. It reports whether
+// the notifications of the user changed.
+func NotifyFollow(tx *sql.Tx, userID, followerID int64) (bool, error) {
+    var notificationID int64
+    err := tx.QueryRow(`
+        SELECT id FROM notifications
+        WHERE user_id = ? AND type = ? AND is_read = FALSE AND aggregate_until > NOW()
+        ORDER BY id DESC LIMIT 1
+        FOR UPDATE`, userID, models.FollowNotificationType).Scan(&notificationID)
+    if err != nil && err != sql.ErrNoRows {
+        return false, err
+    }
+
+    if err == sql.ErrNoRows {
+        // A follower whose earlier notification in this window was already read is not announced again
+        var seen bool
+        err = tx.QueryRow(`
+            SELECT EXISTS(SELECT 1 FROM notifications n
+                JOIN notification_actors a ON a.notification_id = n.id
+                WHERE n.user_id = ? AND n.type = ? AND a.actor_id = ? AND n.aggregate_until > NOW())`,
+            userID, models.FollowNotificationType, followerID).Scan(&seen)
+        if err != nil || seen {
+            return false, err
+        }
+
+        result, err := tx.Exec("INSERT INTO notifications (user_id, type, message, actor_id, payload, aggregate_until) VALUES (?, ?, '', ?, JSON_OBJECT(), DATE_ADD(NOW(), INTERVAL ? SECOND))",
+            userID, models.FollowNotificationType, followerID, int(followNotificationWindow.Seconds()))
+        if err != nil {
+            return false, err
+        }
+        notificationID, err = result.LastInsertId()
+        if err != nil {
+            return false, err
+        }
+    }
+
+    result, err := tx.Exec("INSERT IGNORE INTO notification_actors (notification_id, actor_id) VALUES (?, ?)", notificationID, followerID)
+    if err != nil {
+        return false, err
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        return false, nil
+    }
+
+    _, err = tx.Exec("UPDATE notifications SET created_at = NOW() WHERE id = ?", notificationID)
+    if err != nil {
+        return false, err
+    }
+    return true, refreshFollowNotification(tx, notificationID)
+}
+
+// RetractFollow takes a follower who stopped following, or was blocked, out of the
+// unread follow notifications of the user they followed. It reports whether the
+// notifications of the user changed.
+func RetractFollow(tx *sql.Tx, userID, followerID int64) (bool, error) {
+    rows, err := tx.Query(`
+        SELECT n.id FROM notifications n
+        JOIN notification_actors a ON a.notification_id = n.id
+        WHERE n.user_id = ? AND n.type = ? AND n.is_read = FALSE AND a.actor_id = ?`,
+        userID, models.FollowNotificationType, followerID)
+    if err != nil {
+        return false, err
+    }
+    var notificationIDs []int64
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return false, err
+        }
+        notificationIDs = append(notificationIDs, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return false, err
+    }
+
+    for _, id := range notificationIDs {
+        if _, err := tx.Exec("DELETE FROM notification_actors WHERE notification_id = ? AND actor_id = ?", id, followerID); err != nil {
+            return false, err
+        }
+        if err := refreshFollowNotification(tx, id); err != nil {
+            return false, err
+        }
+    }
+    return len(notificationIDs) > 0, nil
+}
+
+// refreshFollowNotification rewrites the actor, payload and message of a follow
+// notification from its followers, newest first, and deletes it once none are left
+func refreshFollowNotification(tx *sql.Tx, notificationID int64) error {
+    rows, err := tx.Query(`
+        SELECT u.id, u.username FROM notification_actors a
+        JOIN users u ON u.id = a.actor_id
+        WHERE a.notification_id = ?
+        ORDER BY a.created_at DESC, a.actor_id DESC`, notificationID)
+    if err != nil {
+        return err
+    }
+    var latestID int64
+    var names []string
+    for rows.Next() {
+        var id int64
+        var username string
+        if err := rows.Scan(&id, &username); err != nil {
+            rows.Close()
+            return err
+        }
+        if len(names) == 0 {
+            latestID = id
+        }
+        names = append(names, username)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    if len(names) == 0 {
+        _, err := tx.Exec("DELETE FROM notifications WHERE id = ?", notificationID)
+        return err
+    }
+
+    payload := FollowNotificationPayload(names)
+    encoded, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec("UPDATE notifications SET message = ?, actor_id = ?, payload = ? WHERE id = ?",
+        Render(models.FollowNotificationType, names[0], payload), latestID, string(encoded), notificationID)
+    return err
+}
+
+// FollowNotificationPayload keeps the two newest followers, which is all the message
+// names, and counts them all
+func FollowNotificationPayload(names []string) map[string]interface{} {
+    count := len(names)
+    if len(names) > 2 {
+        names = names[:2]
+    }
+    return map[string]interface{}{"actors": names, "actor_count": count}
+}
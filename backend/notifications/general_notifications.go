@@ -2,8 +2,11 @@ package notifications
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,7 +15,8 @@ import (
 	"github.com/vaanskii/vansify/utils"
 )
 
-
+// GetNotifications lists the notifications of the user, newest first, a page at a time.
+// Filters: type (repeated or comma separated) and read (true or false).
 func GetNotifications(c *gin.Context) {
     claims, exists := c.Get("claims")
     if !exists {
@@ -32,7 +36,39 @@ func GetNotifications(c *gin.Context) {
         return
     }
 
-    rows, err := db.DB.Query("SELECT id, user_id, type, message, is_read, created_at, follower_id FROM notifications WHERE user_id = ? ORDER BY created_at DESC", userID)
+    limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultNotificationsLimit)))
+    if err != nil || limit < 1 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit specified"})
+        return
+    }
+    if limit > maxNotificationsLimit {
+        limit = maxNotificationsLimit
+    }
+
+    conditions, args, ok := notificationFilters(c, userID)
+    if !ok {
+        return
+    }
+    if raw := c.Query("cursor"); raw != "" {
+        cur, ok := decodeNotificationCursor(raw)
+        if !ok {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+            return
+        }
+        conditions = append(conditions, "(n.created_at < FROM_UNIXTIME(?) OR (n.created_at = FROM_UNIXTIME(?) AND n.id < ?))")
+        args = append(args, cur.CreatedAt, cur.CreatedAt, cur.ID)
+    }
+
+    // The actor comes along in the same query, so rendering needs no lookups per row.
+    // One extra row tells whether there is another page.
+    rows, err := db.DB.Query(`
+        SELECT n.id, n.user_id, n.type, n.message, n.is_read, n.created_at, UNIX_TIMESTAMP(n.created_at),
+            n.actor_id, u.username, u.profile_picture, n.object_type, n.object_id, n.payload
+        FROM notifications n
+        LEFT JOIN users u ON u.id = n.actor_id
+        WHERE `+strings.Join(conditions, " AND ")+`
+        ORDER BY n.created_at DESC, n.id DESC
+        LIMIT ?`, append(args, limit+1)...)
     if err != nil {
         log.Printf("Error fetching notifications: %v\n", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching notifications"})
@@ -40,38 +76,71 @@ func GetNotifications(c *gin.Context) {
     }
     defer rows.Close()
 
-    var notifications []map[string]interface{}
+    notifications := []map[string]interface{}{}
+    var last notificationCursor
+    hasMore := false
     for rows.Next() {
+        if len(notifications) == limit {
+            hasMore = true
+            break
+        }
+
         var notification models.Notification
-        var followerID sql.NullInt64
+        var actorID sql.NullInt64
+        var actorUsername, actorPicture, objectType, objectID sql.NullString
+        var payload []byte
         var createdAt time.Time
-        if err := rows.Scan(&notification.ID, &notification.UserID, &notification.Type, &notification.Message, &notification.IsRead, &createdAt, &followerID); err != nil {
+        var createdAtUnix int64
+        if err := rows.Scan(&notification.ID, &notification.UserID, &notification.Type, &notification.Message, &notification.IsRead, &createdAt, &createdAtUnix,
+            &actorID, &actorUsername, &actorPicture, &objectType, &objectID, &payload); err != nil {
             log.Printf("Error scanning notification: %v\n", err)
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning notification"})
             return
         }
         formattedTime := createdAt.Format("2006-01-02 15:04:05")
 
-        var profilePicture string
-        if followerID.Valid {
-            err = db.DB.QueryRow("SELECT profile_picture FROM users WHERE id = ?", followerID.Int64).Scan(&profilePicture)
-            if err != nil {
-                log.Printf("Error fetching profile picture for user ID %d: %v\n", followerID.Int64, err)
-                profilePicture = ""
+        notification.Payload = map[string]interface{}{}
+        if len(payload) > 0 {
+            if err := json.Unmarshal(payload, &notification.Payload); err != nil {
+                log.Printf("Error decoding payload of notification %d: %v\n", notification.ID, err)
+            }
+        }
+
+        // Types without a renderer keep the message they were stored with
+        message := Render(notification.Type, actorUsername.String, notification.Payload)
+        if message == "" {
+            message = notification.Message
+        }
+
+        var actor, object interface{}
+        if actorID.Valid {
+            actor = map[string]interface{}{
+                "id":              actorID.Int64,
+                "username":        actorUsername.String,
+                "profile_picture": actorPicture.String,
+            }
+        }
+        if objectType.Valid {
+            object = map[string]interface{}{
+                "type": objectType.String,
+                "id":   objectID.String,
             }
-        } else {
-            profilePicture = ""
         }
 
         notifications = append(notifications, map[string]interface{}{
             "id":              notification.ID,
             "user_id":         notification.UserID,
             "type":            notification.Type,
-            "message":         notification.Message,
+            "verb":            Types[notification.Type].Verb,
+            "actor":           actor,
+            "object":          object,
+            "payload":         notification.Payload,
+            "message":         message,
             "is_read":         notification.IsRead,
             "created_at":      formattedTime,
-            "profile_picture":  profilePicture,
+            "profile_picture": actorPicture.String,
         })
+        last = notificationCursor{CreatedAt: createdAtUnix, ID: notification.ID}
     }
 
     if err = rows.Err(); err != nil {
@@ -80,7 +149,12 @@ func GetNotifications(c *gin.Context) {
         return
     }
 
-    c.JSON(http.StatusOK, gin.H{"notifications": notifications})
+    var nextCursor interface{}
+    if hasMore {
+        nextCursor = last.encode()
+    }
+
+    c.JSON(http.StatusOK, gin.H{"notifications": notifications, "next_cursor": nextCursor})
 }
 
 func GetUnreadNotificationCount(c *gin.Context) {
@@ -0,0 +1,182 @@
+package notifications
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db/dbtest"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const notificationsTestUserID = 9
+
+// storedNotification is a row of the notifications table behind the fake database
+type storedNotification struct {
+    id        int64
+    createdAt int64
+}
+
+// fakeNotifications answers the notification page query from rows, applying the cursor
+// and limit the way MySQL would
+func fakeNotifications(t *testing.T, stored []storedNotification) (*dbtest.Fake, *gin.Engine) {
+    gin.SetMode(gin.TestMode)
+    fake := dbtest.Open(t)
+    fake.Answer(`^SELECT id FROM users WHERE username = \?`, dbtest.Result{Columns: []string{"id"}, Rows: [][]driver.Value{{int64(notificationsTestUserID)}}})
+
+    fake.On(`^SELECT n\.id, n\.user_id, n\.type`, func(args []driver.Value) dbtest.Result {
+        rows := append([]storedNotification{}, stored...)
+        sort.Slice(rows, func(i, j int) bool {
+            if rows[i].createdAt != rows[j].createdAt {
+                return rows[i].createdAt > rows[j].createdAt
+            }
+            return rows[i].id > rows[j].id
+        })
+
+        // Arguments: user ID, the cursor's time twice and its ID when paging, then the limit
+        limit := args[len(args)-1].(int64)
+        result := dbtest.Result{Columns: []string{"id", "user_id", "type", "message", "is_read", "created_at", "created_at_unix",
+            "actor_id", "username", "profile_picture", "object_type", "object_id", "payload"}}
+        for _, row := range rows {
+            if len(args) == 5 {
+                createdAt, id := args[1].(int64), args[3].(int64)
+                if !(row.createdAt < createdAt || (row.createdAt == createdAt && row.id < id)) {
+                    continue
+                }
+            }
+            if int64(len(result.Rows)) == limit {
+                break
+            }
+            result.Rows = append(result.Rows, []driver.Value{row.id, int64(notificationsTestUserID), string(models.FollowAcceptedNotificationType), "", false,
+                time.Unix(row.createdAt, 0), row.createdAt, nil, nil, nil, nil, nil, []byte("{}")})
+        }
+        return result
+    })
+
+    loggedIn := func(c *gin.Context) {
+        c.Set("claims", &utils.CustomClaims{Username: "bob"})
+    }
+    router := gin.New()
+    router.GET("/notifications", loggedIn, GetNotifications)
+    router.POST("/notifications/general/mark-read-up-to/:notificationID", loggedIn, MarkNotificationsReadUpTo)
+    return fake, router
+}
+
+type notificationsPage struct {
+    Notifications []struct {
+        ID int64 `json:"id"`
+    } `json:"notifications"`
+    NextCursor *string `json:"next_cursor"`
+}
+
+func getNotificationsPage(t *testing.T, router *gin.Engine, query string) notificationsPage {
+    recorder := httptest.NewRecorder()
+    router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notifications?"+query, nil))
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("listing notifications with %q: got %d %s", query, recorder.Code, recorder.Body)
+    }
+    var page notificationsPage
+    if err := json.Unmarshal(recorder.Body.Bytes(), &page); err != nil {
+        t.Fatal(err)
+    }
+    return page
+}
+
+func TestNotificationCursorRoundTrip(t *testing.T) {
+    for _, cur := range []notificationCursor{{0, 0}, {1760875200, 42}, {1760875200, 9007199254740993}} {
+        decoded, ok := decodeNotificationCursor(cur.encode())
+        if !ok || decoded != cur {
+            t.Errorf("cursor %+v decoded as %+v, %v", cur, decoded, ok)
+        }
+    }
+}
+
+func TestNotificationPagesBreakTiesByID(t *testing.T) {
+    // Three notifications share a second, and one page ends between them
+    _, router := fakeNotifications(t, []storedNotification{
+        {1, 100}, {2, 200}, {3, 200}, {4, 200}, {5, 300},
+    })
+
+    var ids []int64
+    query := "limit=2"
+    for pages := 0; ; pages++ {
+        if pages == 5 {
+            t.Fatalf("paging did not end")
+        }
+        page := getNotificationsPage(t, router, query)
+        for _, notification := range page.Notifications {
+            ids = append(ids, notification.ID)
+        }
+        if page.NextCursor == nil {
+            if len(page.Notifications) != 1 {
+                t.Errorf("last page has %d notifications, want 1", len(page.Notifications))
+            }
+            break
+        }
+        if len(page.Notifications) != 2 {
+            t.Errorf("page with a next cursor has %d notifications, want 2", len(page.Notifications))
+        }
+        query = "limit=2&cursor=" + *page.NextCursor
+    }
+
+    want := []int64{5, 4, 3, 2, 1}
+    if len(ids) != len(want) {
+        t.Fatalf("paged through %v, want %v", ids, want)
+    }
+    for i := range want {
+        if ids[i] != want[i] {
+            t.Fatalf("paged through %v, want %v", ids, want)
+        }
+    }
+}
+
+func TestNotificationPageBoundary(t *testing.T) {
+    fake, router := fakeNotifications(t, []storedNotification{{1, 100}, {2, 200}, {3, 300}})
+
+    // A page exactly as long as what is left has no next page
+    if page := getNotificationsPage(t, router, "limit=3"); len(page.Notifications) != 3 || page.NextCursor != nil {
+        t.Errorf("full listing: %d notifications, next cursor %v", len(page.Notifications), page.NextCursor)
+    }
+
+    page := getNotificationsPage(t, router, "limit=2")
+    if len(page.Notifications) != 2 || page.NextCursor == nil {
+        t.Fatalf("first page: %d notifications, next cursor %v", len(page.Notifications), page.NextCursor)
+    }
+    if cur, ok := decodeNotificationCursor(*page.NextCursor); !ok || cur != (notificationCursor{CreatedAt: 200, ID: 2}) {
+        t.Errorf("next cursor points at %+v, want the last notification of the page", cur)
+    }
+
+    // One row more than the limit is asked for, to tell whether there is another page
+    queries := fake.Statements(`^SELECT n\.id`)
+    if limit := queries[len(queries)-1].Args[1]; limit != int64(3) {
+        t.Errorf("queried %v rows for a page of 2", limit)
+    }
+}
+
+func TestNotificationsRejectInvalidCursor(t *testing.T) {
+    fake, router := fakeNotifications(t, nil)
+
+    for _, cursor := range []string{
+        "not-base64!",
+        base64.RawURLEncoding.EncodeToString([]byte("1760875200")),
+        base64.RawURLEncoding.EncodeToString([]byte("1760875200:x")),
+        base64.RawURLEncoding.EncodeToString([]byte("x:42")),
+        base64.StdEncoding.EncodeToString([]byte("1760875200:42")),
+    } {
+        recorder := httptest.NewRecorder()
+        router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/notifications?cursor="+cursor, nil))
+        if recorder.Code != http.StatusBadRequest {
+            t.Errorf("cursor %q: got %d, want 400", cursor, recorder.Code)
+        }
+    }
+    if queries := fake.Statements(`^SELECT n\.id`); len(queries) != 0 {
+        t.Errorf("an invalid cursor was queried")
+    }
+}
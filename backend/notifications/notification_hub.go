@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	"github.com/gorilla/websocket"
+	"github.com/vaanskii/vansify/utils"
 )
 
 type NotificationHub struct {
@@ -48,4 +49,23 @@ func (h *NotificationHub) BroadcastNotification(username string, message []byte)
     }
 }
 
+// IsConnected reports whether a user has the notification socket open
+func (h *NotificationHub) IsConnected(username string) bool {
+    h.mu.Lock()
+    _, exists := h.connections[username]
+    h.mu.Unlock()
+    return exists
+}
+
+// DisconnectUser closes the notification connection of a user
+func (h *NotificationHub) DisconnectUser(username, reason string) {
+    h.mu.Lock()
+    conn, exists := h.connections[username]
+    delete(h.connections, username)
+    h.mu.Unlock()
+    if exists {
+        utils.CloseWebSocket(conn, reason)
+    }
+}
+
 var GlobalNotificationHub = NewNotificationHub()
@@ -0,0 +1,211 @@
+package notifications
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vaanskii/vansify/models"
+)
+
+// NotificationTypeInfo describes a notification type: the verb its actor performed, what
+// object_id points at, and how the notification reads
+type NotificationTypeInfo struct {
+    Verb string
+    // ObjectType is what object_id refers to, empty when the type has no object
+    ObjectType string
+    // Render writes the message from the actor's username, empty without an actor, and the payload
+    Render func(actor string, payload map[string]interface{}) string
+    // Channels are the channels the type is delivered on, which users can turn on or off
+    Channels []string
+}
+
+// Types is the registry of notification types. Payload keys each type uses:
+//   FOLLOW, FOLLOW_REQUEST: actors (newest usernames), actor_count
+//   MENTION: chat_id, excerpt
+//   REACTION: chat_id, emoji
+//   NEW_DEVICE_LOGIN: user_agent, ip
+//   SYSTEM_ANNOUNCEMENT: title, body, link
+//   DATA_EXPORT: expires_at
+var Types = map[models.NotificationType]NotificationTypeInfo{
+    models.FollowNotificationType: {
+        Verb:     "follow",
+        Render:   renderFollow,
+        Channels: []string{ChannelInApp, ChannelEmail, ChannelWebPush},
+    },
+    models.FollowRequestNotificationType: {
+        Verb:     "request_follow",
+        Channels: []string{ChannelInApp, ChannelEmail},
+        Render: func(actor string, payload map[string]interface{}) string {
+            return actor + " requested to follow you"
+        },
+    },
+    models.FollowAcceptedNotificationType: {
+        Verb:     "accept_follow",
+        Channels: []string{ChannelInApp},
+        Render: func(actor string, payload map[string]interface{}) string {
+            return actor + " accepted your follow request"
+        },
+    },
+    models.MentionNotificationType: {
+        Verb:       "mention",
+        Channels:   []string{ChannelInApp},
+        ObjectType: "message",
+        Render: func(actor string, payload map[string]interface{}) string {
+            if excerpt := payloadString(payload, "excerpt"); excerpt != "" {
+                return actor + " mentioned you: " + excerpt
+            }
+            return actor + " mentioned you"
+        },
+    },
+    models.ReactionNotificationType: {
+        Verb:       "react",
+        Channels:   []string{ChannelInApp},
+        ObjectType: "message",
+        Render: func(actor string, payload map[string]interface{}) string {
+            if emoji := payloadString(payload, "emoji"); emoji != "" {
+                return actor + " reacted " + emoji + " to your message"
+            }
+            return actor + " reacted to your message"
+        },
+    },
+    models.NewDeviceLoginNotificationType: {
+        Verb:       "login",
+        Channels:   []string{ChannelInApp},
+        ObjectType: "device",
+        Render: func(actor string, payload map[string]interface{}) string {
+            if userAgent := payloadString(payload, "user_agent"); userAgent != "" {
+                return "New login to your account from " + userAgent
+            }
+            return "New login to your account from an unknown device"
+        },
+    },
+    models.SystemAnnouncementNotificationType: {
+        Verb:       "announce",
+        Channels:   []string{ChannelInApp},
+        ObjectType: "announcement",
+        Render: func(actor string, payload map[string]interface{}) string {
+            title, body := payloadString(payload, "title"), payloadString(payload, "body")
+            if title == "" {
+                return body
+            }
+            if body == "" {
+                return title
+            }
+            return title + ": " + body
+        },
+    },
+    models.DataExportNotificationType: {
+        Verb:       "export",
+        Channels:   []string{ChannelInApp},
+        ObjectType: "data_export",
+        Render: func(actor string, payload map[string]interface{}) string {
+            return "Your data export is ready. Check your email for the download link."
+        },
+    },
+}
+
+// renderFollow names up to two of the newest followers and counts the rest
+func renderFollow(actor string, payload map[string]interface{}) string {
+    // actors is a []string when rendering before the payload is stored
+    var names []string
+    switch actors := payload["actors"].(type) {
+    case []string:
+        names = append(names, actors...)
+    case []interface{}:
+        for _, name := range actors {
+            if name, ok := name.(string); ok && name != "" {
+                names = append(names, name)
+            }
+        }
+    }
+    if len(names) == 0 && actor != "" {
+        names = []string{actor}
+    }
+    count := payloadInt(payload, "actor_count")
+    if count < len(names) {
+        count = len(names)
+    }
+    if len(names) > 2 {
+        names = names[:2]
+    }
+
+    switch {
+    case count == 0:
+        return "Someone started following you"
+    case count == 1:
+        return names[0] + " started following you"
+    case count == 2 && len(names) == 2:
+        return names[0] + " and " + names[1] + " started following you"
+    case count-len(names) == 1:
+        return strings.Join(names, ", ") + " and 1 other started following you"
+    default:
+        return fmt.Sprintf("%s and %d others started following you", strings.Join(names, ", "), count-len(names))
+    }
+}
+
+func payloadString(payload map[string]interface{}, key string) string {
+    value, _ := payload[key].(string)
+    return value
+}
+
+// payloadInt reads a number from a payload, which holds float64 once decoded from JSON
+func payloadInt(payload map[string]interface{}, key string) int {
+    switch value := payload[key].(type) {
+    case float64:
+        return int(value)
+    case int:
+        return value
+    case int64:
+        return int(value)
+    }
+    return 0
+}
+
+// Render writes the message of a notification, or returns an empty string for a type
+// that is not registered
+func Render(notificationType models.NotificationType, actor string, payload map[string]interface{}) string {
+    info, ok := Types[notificationType]
+    if !ok {
+        return ""
+    }
+    return info.Render(actor, payload)
+}
+
+// execer runs a statement on the database or inside a transaction
+type execer interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Create stores a notification of a registered type. The message is rendered now so
+// exports and older clients have it; GetNotifications renders it again when listing.
+// actor is the username of n.ActorID, empty when the notification has no actor.
+func Create(exec execer, n models.Notification, actor string) (int64, error) {
+    info, ok := Types[n.Type]
+    if !ok {
+        return 0, fmt.Errorf("unknown notification type %q", n.Type)
+    }
+    if n.Payload == nil {
+        n.Payload = map[string]interface{}{}
+    }
+    payload, err := json.Marshal(n.Payload)
+    if err != nil {
+        return 0, err
+    }
+
+    var actorID, objectType, objectID interface{}
+    if n.ActorID != 0 {
+        actorID = n.ActorID
+    }
+    if info.ObjectType != "" && n.ObjectID != "" {
+        objectType, objectID = info.ObjectType, n.ObjectID
+    }
+
+    result, err := exec.Exec("INSERT INTO notifications (user_id, type, message, actor_id, object_type, object_id, payload) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        n.UserID, n.Type, info.Render(actor, n.Payload), actorID, objectType, objectID, string(payload))
+    if err != nil {
+        return 0, err
+    }
+    return result.LastInsertId()
+}
@@ -0,0 +1,371 @@
+package notifications
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// Channels a notification can be delivered on
+const (
+    // ChannelInApp keeps the notification in the in-app list and pushes it over NotificationHub
+    ChannelInApp = "in_app"
+    // ChannelChatSocket pushes messages over the chat-notification socket
+    ChannelChatSocket = "chat_socket"
+    ChannelEmail      = "email"
+    ChannelWebPush    = "web_push"
+)
+
+// messageChannels are the channels of chat messages, which are not in Types since they
+// are not stored as notifications. Only messages use the chat-notification socket.
+var messageChannels = []string{ChannelInApp, ChannelChatSocket, ChannelEmail, ChannelWebPush}
+
+// Channels lists the channels a type is delivered on, or nil for an unknown type
+func Channels(notificationType models.NotificationType) []string {
+    if notificationType == models.MessageNotificationType {
+        return messageChannels
+    }
+    return Types[notificationType].Channels
+}
+
+// preferenceTypes lists every type a user can set preferences for
+func preferenceTypes() []models.NotificationType {
+    types := []models.NotificationType{models.MessageNotificationType}
+    for notificationType := range Types {
+        types = append(types, notificationType)
+    }
+    return types
+}
+
+// Delivery says where a notification of one type may go to a user right now
+type Delivery struct {
+    // Store keeps the notification in the in-app list, or in the unread counts of a chat for messages
+    Store      bool
+    InApp      bool
+    ChatSocket bool
+    Email      bool
+    WebPush    bool
+    // Quiet is set during do-not-disturb hours, when nothing but Store is set
+    Quiet bool
+}
+
+// DeliveryFor reads the preferences of a user for a type together with their
+// do-not-disturb hours. If they cannot be read every channel is used, so nothing
+// is lost to a database error.
+func DeliveryFor(userID int64, notificationType models.NotificationType) Delivery {
+    enabled, quiet, err := loadPreferences(userID, notificationType)
+    if err != nil {
+        log.Printf("Error retrieving notification preferences of user %d: %v\n", userID, err)
+        return Delivery{Store: true, InApp: true, ChatSocket: true, Email: true, WebPush: true}
+    }
+
+    delivery := Delivery{Store: enabled[ChannelInApp], Quiet: quiet}
+    if !quiet {
+        delivery.InApp = enabled[ChannelInApp]
+        delivery.ChatSocket = enabled[ChannelChatSocket]
+        delivery.Email = enabled[ChannelEmail]
+        delivery.WebPush = enabled[ChannelWebPush]
+    }
+    return delivery
+}
+
+// loadPreferences reads which channels of a type a user has on, and whether it is
+// within their do-not-disturb hours
+func loadPreferences(userID int64, notificationType models.NotificationType) (map[string]bool, bool, error) {
+    enabled := map[string]bool{}
+    for _, channel := range Channels(notificationType) {
+        enabled[channel] = true
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT u.timezone, u.dnd_start, u.dnd_end, p.channel, p.enabled
+        FROM users u
+        LEFT JOIN notification_preferences p ON p.user_id = u.id AND p.type = ?
+        WHERE u.id = ?`, notificationType, userID)
+    if err != nil {
+        return nil, false, err
+    }
+    defer rows.Close()
+
+    var timezone string
+    var dndStart, dndEnd sql.NullInt64
+    found := false
+    for rows.Next() {
+        var channel sql.NullString
+        var channelEnabled sql.NullBool
+        if err := rows.Scan(&timezone, &dndStart, &dndEnd, &channel, &channelEnabled); err != nil {
+            return nil, false, err
+        }
+        found = true
+        if _, ok := enabled[channel.String]; ok && channelEnabled.Valid {
+            enabled[channel.String] = channelEnabled.Bool
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return nil, false, err
+    }
+    if !found {
+        return nil, false, sql.ErrNoRows
+    }
+
+    return enabled, inQuietHours(timezone, dndStart, dndEnd, time.Now()), nil
+}
+
+// inQuietHours reports whether a time falls within do-not-disturb hours, which may run
+// past midnight
+func inQuietHours(timezone string, start, end sql.NullInt64, now time.Time) bool {
+    if !start.Valid || !end.Valid || start.Int64 == end.Int64 {
+        return false
+    }
+    location, err := time.LoadLocation(timezone)
+    if err != nil {
+        location = time.UTC
+    }
+    local := now.In(location)
+    minute := int64(local.Hour()*60 + local.Minute())
+    if start.Int64 < end.Int64 {
+        return minute >= start.Int64 && minute < end.Int64
+    }
+    return minute >= start.Int64 || minute < end.Int64
+}
+
+// formatMinute writes minutes after midnight as HH:MM
+func formatMinute(minute sql.NullInt64) interface{} {
+    if !minute.Valid {
+        return nil
+    }
+    return fmt.Sprintf("%02d:%02d", minute.Int64/60, minute.Int64%60)
+}
+
+// parseMinute reads HH:MM as minutes after midnight
+func parseMinute(value string) (int, bool) {
+    parsed, err := time.Parse("15:04", value)
+    if err != nil {
+        return 0, false
+    }
+    return parsed.Hour()*60 + parsed.Minute(), true
+}
+
+// preferencesUserID reads the ID of the logged in user, answering the request if that fails
+func preferencesUserID(c *gin.Context) (int64, bool) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return 0, false
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return 0, false
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        log.Printf("Error retrieving user ID: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return 0, false
+    }
+    return userID, true
+}
+
+// GetNotificationPreferences returns the channels of every type and the do-not-disturb hours
+func GetNotificationPreferences(c *gin.Context) {
+    userID, ok := preferencesUserID(c)
+    if !ok {
+        return
+    }
+
+    preferences := map[models.NotificationType]map[string]bool{}
+    for _, notificationType := range preferenceTypes() {
+        preferences[notificationType] = map[string]bool{}
+        for _, channel := range Channels(notificationType) {
+            preferences[notificationType][channel] = true
+        }
+    }
+
+    rows, err := db.DB.Query("SELECT type, channel, enabled FROM notification_preferences WHERE user_id = ?", userID)
+    if err != nil {
+        log.Printf("Error retrieving notification preferences: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving notification preferences"})
+        return
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var notificationType models.NotificationType
+        var channel string
+        var enabled bool
+        if err := rows.Scan(&notificationType, &channel, &enabled); err != nil {
+            log.Printf("Error scanning notification preference: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving notification preferences"})
+            return
+        }
+        if channels, ok := preferences[notificationType]; ok {
+            if _, ok := channels[channel]; ok {
+                channels[channel] = enabled
+            }
+        }
+    }
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through notification preferences: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving notification preferences"})
+        return
+    }
+
+    var timezone string
+    var dndStart, dndEnd sql.NullInt64
+    err = db.DB.QueryRow("SELECT timezone, dnd_start, dnd_end FROM users WHERE id = ?", userID).Scan(&timezone, &dndStart, &dndEnd)
+    if err != nil {
+        log.Printf("Error retrieving do-not-disturb hours: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving notification preferences"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "preferences": preferences,
+        "do_not_disturb": gin.H{
+            "start":    formatMinute(dndStart),
+            "end":      formatMinute(dndEnd),
+            "timezone": timezone,
+            "active":   inQuietHours(timezone, dndStart, dndEnd, time.Now()),
+        },
+    })
+}
+
+// UpdateNotificationPreferences turns channels of types on or off. Only the channels
+// sent change, e.g. {"preferences": {"FOLLOW": {"email": false}}}.
+func UpdateNotificationPreferences(c *gin.Context) {
+    userID, ok := preferencesUserID(c)
+    if !ok {
+        return
+    }
+
+    var request struct {
+        Preferences map[models.NotificationType]map[string]bool `json:"preferences" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    statements := []struct {
+        query string
+        args  []interface{}
+    }{}
+    for notificationType, channels := range request.Preferences {
+        allowed := map[string]bool{}
+        for _, channel := range Channels(notificationType) {
+            allowed[channel] = true
+        }
+        if len(allowed) == 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown notification type " + string(notificationType)})
+            return
+        }
+        for channel, enabled := range channels {
+            if !allowed[channel] {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "Notification type " + string(notificationType) + " has no channel " + channel})
+                return
+            }
+            statements = append(statements, struct {
+                query string
+                args  []interface{}
+            }{`INSERT INTO notification_preferences (user_id, type, channel, enabled) VALUES (?, ?, ?, ?)
+                ON DUPLICATE KEY UPDATE enabled = VALUES(enabled)`, []interface{}{userID, notificationType, channel, enabled}})
+        }
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Printf("Error starting transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating notification preferences"})
+        return
+    }
+    defer tx.Rollback()
+
+    for _, statement := range statements {
+        if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+            log.Printf("Error updating notification preferences: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating notification preferences"})
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        log.Printf("Error committing transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating notification preferences"})
+        return
+    }
+
+    GetNotificationPreferences(c)
+}
+
+// SetDoNotDisturb sets the do-not-disturb hours, e.g. {"start": "22:00", "end": "07:00",
+// "timezone": "Europe/Berlin"}. The timezone is kept when it is left out.
+func SetDoNotDisturb(c *gin.Context) {
+    userID, ok := preferencesUserID(c)
+    if !ok {
+        return
+    }
+
+    var request struct {
+        Start    string `json:"start" binding:"required"`
+        End      string `json:"end" binding:"required"`
+        Timezone string `json:"timezone"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+    start, startOK := parseMinute(request.Start)
+    end, endOK := parseMinute(request.End)
+    if !startOK || !endOK {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Times must be given as HH:MM"})
+        return
+    }
+    if start == end {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Do-not-disturb hours must not start and end at the same time"})
+        return
+    }
+
+    var err error
+    if request.Timezone != "" {
+        if _, err := time.LoadLocation(request.Timezone); err != nil || request.Timezone == "Local" {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+            return
+        }
+        _, err = db.DB.Exec("UPDATE users SET dnd_start = ?, dnd_end = ?, timezone = ? WHERE id = ?", start, end, request.Timezone, userID)
+    } else {
+        _, err = db.DB.Exec("UPDATE users SET dnd_start = ?, dnd_end = ? WHERE id = ?", start, end, userID)
+    }
+    if err != nil {
+        log.Printf("Error updating do-not-disturb hours: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating do-not-disturb hours"})
+        return
+    }
+
+    GetNotificationPreferences(c)
+}
+
+// ClearDoNotDisturb turns do-not-disturb hours off
+func ClearDoNotDisturb(c *gin.Context) {
+    userID, ok := preferencesUserID(c)
+    if !ok {
+        return
+    }
+
+    if _, err := db.DB.Exec("UPDATE users SET dnd_start = NULL, dnd_end = NULL WHERE id = ?", userID); err != nil {
+        log.Printf("Error clearing do-not-disturb hours: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating do-not-disturb hours"})
+        return
+    }
+
+    GetNotificationPreferences(c)
+}
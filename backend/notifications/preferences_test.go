@@ -0,0 +1,58 @@
+package notifications
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestInQuietHours(t *testing.T) {
+    minute := func(value string) sql.NullInt64 {
+        parsed, ok := parseMinute(value)
+        if !ok {
+            t.Fatalf("invalid time %q", value)
+        }
+        return sql.NullInt64{Int64: int64(parsed), Valid: true}
+    }
+    at := func(value string) time.Time {
+        parsed, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return parsed
+    }
+
+    for _, test := range []struct {
+        name       string
+        timezone   string
+        start, end sql.NullInt64
+        now        time.Time
+        want       bool
+    }{
+        {"within a day window", "UTC", minute("09:00"), minute("17:00"), at("2026-10-19T12:00:00Z"), true},
+        {"start of a day window", "UTC", minute("09:00"), minute("17:00"), at("2026-10-19T09:00:00Z"), true},
+        {"end of a day window", "UTC", minute("09:00"), minute("17:00"), at("2026-10-19T17:00:00Z"), false},
+        {"before a day window", "UTC", minute("09:00"), minute("17:00"), at("2026-10-19T08:59:00Z"), false},
+        {"before midnight in a window past midnight", "UTC", minute("22:00"), minute("07:00"), at("2026-10-19T23:30:00Z"), true},
+        {"after midnight in a window past midnight", "UTC", minute("22:00"), minute("07:00"), at("2026-10-20T03:00:00Z"), true},
+        {"start of a window past midnight", "UTC", minute("22:00"), minute("07:00"), at("2026-10-19T22:00:00Z"), true},
+        {"end of a window past midnight", "UTC", minute("22:00"), minute("07:00"), at("2026-10-20T07:00:00Z"), false},
+        {"outside a window past midnight", "UTC", minute("22:00"), minute("07:00"), at("2026-10-19T12:00:00Z"), false},
+        {"same start and end", "UTC", minute("22:00"), minute("22:00"), at("2026-10-19T22:00:00Z"), false},
+        {"same start and end at midnight", "UTC", minute("00:00"), minute("00:00"), at("2026-10-19T12:00:00Z"), false},
+        {"no hours set", "UTC", sql.NullInt64{}, sql.NullInt64{}, at("2026-10-19T23:00:00Z"), false},
+        {"only a start", "UTC", minute("22:00"), sql.NullInt64{}, at("2026-10-19T23:00:00Z"), false},
+        // 21:30 UTC is 22:30 in Berlin in winter, and 05:30 UTC is 07:30 in summer
+        {"local time inside the window", "Europe/Berlin", minute("22:00"), minute("07:00"), at("2026-01-15T21:30:00Z"), true},
+        {"local time past the window", "Europe/Berlin", minute("22:00"), minute("07:00"), at("2026-07-15T05:30:00Z"), false},
+        {"daylight saving time", "Europe/Berlin", minute("22:00"), minute("07:00"), at("2026-07-15T04:30:00Z"), true},
+        // 02:00 UTC is the evening before in New York
+        {"local date differs from UTC", "America/New_York", minute("09:00"), minute("17:00"), at("2026-10-20T02:00:00Z"), false},
+        {"local evening", "America/New_York", minute("21:00"), minute("23:00"), at("2026-10-20T02:00:00Z"), true},
+        {"unknown timezone falls back to UTC", "Mars/Olympus_Mons", minute("22:00"), minute("07:00"), at("2026-10-19T23:00:00Z"), true},
+    } {
+        if got := inQuietHours(test.timezone, test.start, test.end, test.now); got != test.want {
+            t.Errorf("%s: inQuietHours is %v, want %v", test.name, got, test.want)
+        }
+    }
+}
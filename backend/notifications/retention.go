@@ -0,0 +1,58 @@
+package notifications
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lpernett/godotenv"
+	"github.com/vaanskii/vansify/db"
+)
+
+// defaultRetentionDays is how long read notifications are kept when
+// NOTIFICATION_RETENTION_DAYS is not set
+const defaultRetentionDays = 90
+
+// retentionBatch bounds each delete, so a large purge does not hold locks for long
+const retentionBatch = 1000
+
+// retentionDays reads NOTIFICATION_RETENTION_DAYS. 0 keeps read notifications forever.
+func retentionDays() int {
+    godotenv.Load()
+    days, err := strconv.Atoi(os.Getenv("NOTIFICATION_RETENTION_DAYS"))
+    if err != nil || days < 0 {
+        return defaultRetentionDays
+    }
+    return days
+}
+
+// RunRetentionPurger deletes read notifications older than the retention period.
+// Unread notifications are kept however old they are.
+func RunRetentionPurger(interval time.Duration) {
+    days := retentionDays()
+    if days == 0 {
+        return
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        purgeReadNotifications(days)
+        <-ticker.C
+    }
+}
+
+func purgeReadNotifications(days int) {
+    for {
+        result, err := db.DB.Exec("DELETE FROM notifications WHERE is_read = TRUE AND created_at < NOW() - INTERVAL ? DAY LIMIT ?", days, retentionBatch)
+        if err != nil {
+            log.Println("Error purging read notifications:", err)
+            return
+        }
+        if purged, _ := result.RowsAffected(); purged < retentionBatch {
+            return
+        }
+    }
+}
@@ -0,0 +1,251 @@
+package webpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
+)
+
+// Message is what the service worker receives in a push event
+type Message struct {
+    Type  models.NotificationType `json:"type"`
+    Title string                  `json:"title"`
+    Body  string                  `json:"body"`
+    // Tag lets the service worker replace an earlier notification about the same thing
+    Tag    string `json:"tag,omitempty"`
+    URL    string `json:"url,omitempty"`
+    Actor  string `json:"actor,omitempty"`
+    ChatID string `json:"chat_id,omitempty"`
+}
+
+// delivery is a message on its way to the devices of one user
+type delivery struct {
+    userID  int64
+    message Message
+}
+
+// pushOptions are the headers push services read from a request (RFC 8030)
+type pushOptions struct {
+    // ttl is how long the push service keeps the message for an offline device
+    ttl     time.Duration
+    urgency string
+}
+
+// optionsFor picks how long a type is worth delivering. A message is stale after a
+// day, a follow still matters a week later.
+func optionsFor(notificationType models.NotificationType) pushOptions {
+    switch notificationType {
+    case models.MessageNotificationType:
+        return pushOptions{ttl: 24 * time.Hour, urgency: "high"}
+    default:
+        return pushOptions{ttl: 7 * 24 * time.Hour, urgency: "normal"}
+    }
+}
+
+// queueSize bounds the pushes waiting for a worker. Pushes past it are dropped rather
+// than holding up the chat or follow request that caused them.
+const queueSize = 1024
+
+var queue = make(chan delivery, queueSize)
+
+// Client sends the requests to push services. It can be replaced to point at a fake
+// push service during development. It refuses to connect to internal addresses, which
+// a host name of a stored endpoint could resolve to.
+var Client = &http.Client{
+    Timeout: 10 * time.Second,
+    Transport: &http.Transport{
+        DialContext: (&net.Dialer{
+            Timeout: 5 * time.Second,
+            Control: func(network, address string, _ syscall.RawConn) error {
+                host, _, err := net.SplitHostPort(address)
+                if err != nil {
+                    return err
+                }
+                if ip := net.ParseIP(host); ip == nil || !allowedPushIP(ip) {
+                    return fmt.Errorf("push endpoint address %s is not allowed", host)
+                }
+                return nil
+            },
+        }).DialContext,
+        TLSHandshakeTimeout: 5 * time.Second,
+    },
+}
+
+// allowedPushIP reports whether pushes may be sent to an address. Push services are on
+// the public internet; loopback is only allowed outside release mode, for a push
+// service run in development.
+func allowedPushIP(ip net.IP) bool {
+    if ip.IsLoopback() {
+        return gin.Mode() != gin.ReleaseMode
+    }
+    return !(ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+        ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// Notify queues a push to every device of a user, if Web Push is configured and the
+// user wants this type pushed right now. It never blocks.
+func Notify(userID int64, message Message) {
+    if loadVAPIDKeys() == nil {
+        return
+    }
+    if !notifications.DeliveryFor(userID, message.Type).WebPush {
+        return
+    }
+    select {
+    case queue <- delivery{userID: userID, message: message}:
+    default:
+        log.Printf("Web Push queue is full, dropping %s push to user %d\n", message.Type, userID)
+    }
+}
+
+// RunDispatcher sends queued pushes with a number of workers
+func RunDispatcher(workers int) {
+    if loadVAPIDKeys() == nil {
+        return
+    }
+    for i := 1; i < workers; i++ {
+        go dispatch()
+    }
+    dispatch()
+}
+
+func dispatch() {
+    for d := range queue {
+        sendToUser(d)
+    }
+}
+
+type subscription struct {
+    id       int64
+    endpoint string
+    p256dh   string
+    auth     string
+}
+
+// sendToUser encrypts the message for every live subscription of the user and posts it
+func sendToUser(d delivery) {
+    payload, err := marshalMessage(d.message)
+    if err != nil {
+        log.Printf("Error encoding push message: %v\n", err)
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT id, endpoint, p256dh, auth FROM push_subscriptions
+        WHERE user_id = ? AND (expires_at IS NULL OR expires_at > NOW())`, d.userID)
+    if err != nil {
+        log.Printf("Error retrieving push subscriptions of user %d: %v\n", d.userID, err)
+        return
+    }
+    var subscriptions []subscription
+    for rows.Next() {
+        var s subscription
+        if err := rows.Scan(&s.id, &s.endpoint, &s.p256dh, &s.auth); err != nil {
+            log.Printf("Error scanning push subscription: %v\n", err)
+            rows.Close()
+            return
+        }
+        subscriptions = append(subscriptions, s)
+    }
+    rows.Close()
+
+    options := optionsFor(d.message.Type)
+    for _, s := range subscriptions {
+        send(s, payload, options, d.message.Tag)
+    }
+}
+
+// marshalMessage encodes a message, shortening the body until the payload fits in a
+// single push record
+func marshalMessage(message Message) ([]byte, error) {
+    for {
+        payload, err := json.Marshal(message)
+        if err != nil || len(payload) <= maxPlaintextLen || message.Body == "" {
+            return payload, err
+        }
+        runes := []rune(message.Body)
+        cut := len(runes) - (len(payload)-maxPlaintextLen) - 1
+        if cut < 0 {
+            cut = 0
+        }
+        message.Body = string(runes[:cut]) + "…"
+        if cut == 0 {
+            message.Body = ""
+        }
+    }
+}
+
+// send posts one encrypted message to a push service. A subscription the service no
+// longer knows, 404 or 410, is deleted.
+func send(s subscription, payload []byte, options pushOptions, topic string) {
+    body, err := encrypt(s.p256dh, s.auth, payload)
+    if err != nil {
+        log.Printf("Error encrypting push for subscription %d: %v\n", s.id, err)
+        return
+    }
+    authorization, err := loadVAPIDKeys().authorization(s.endpoint)
+    if err != nil {
+        log.Printf("Error signing push for subscription %d: %v\n", s.id, err)
+        return
+    }
+
+    req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+    if err != nil {
+        log.Printf("Error creating push request for subscription %d: %v\n", s.id, err)
+        return
+    }
+    req.Header.Set("Authorization", authorization)
+    req.Header.Set("Content-Encoding", "aes128gcm")
+    req.Header.Set("Content-Type", "application/octet-stream")
+    req.Header.Set("TTL", strconv.Itoa(int(options.ttl.Seconds())))
+    req.Header.Set("Urgency", options.urgency)
+    if topic := topicHeader(topic); topic != "" {
+        // A topic replaces a message about the same thing still waiting at the push service
+        req.Header.Set("Topic", topic)
+    }
+
+    resp, err := Client.Do(req)
+    if err != nil {
+        log.Printf("Error sending push to subscription %d: %v\n", s.id, err)
+        return
+    }
+    defer resp.Body.Close()
+
+    switch {
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        if _, err := db.DB.Exec("UPDATE push_subscriptions SET last_success_at = NOW() WHERE id = ?", s.id); err != nil {
+            log.Printf("Error updating push subscription %d: %v\n", s.id, err)
+        }
+    case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+        if _, err := db.DB.Exec("DELETE FROM push_subscriptions WHERE id = ?", s.id); err != nil {
+            log.Printf("Error deleting expired push subscription %d: %v\n", s.id, err)
+        }
+    default:
+        reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        log.Printf("Push service rejected push to subscription %d with %d: %s\n", s.id, resp.StatusCode, reason)
+    }
+}
+
+// topicHeader keeps a topic within the 32 URL-safe characters push services accept
+func topicHeader(topic string) string {
+    safe := make([]byte, 0, 32)
+    for i := 0; i < len(topic) && len(safe) < 32; i++ {
+        ch := topic[i]
+        if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '_' {
+            safe = append(safe, ch)
+        }
+    }
+    return string(safe)
+}
@@ -0,0 +1,259 @@
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vaanskii/vansify/db/dbtest"
+	"github.com/vaanskii/vansify/models"
+	"golang.org/x/crypto/hkdf"
+)
+
+func TestMain(m *testing.M) {
+    // The fake push services listen on loopback, which release mode refuses
+    gin.SetMode(gin.DebugMode)
+    private, err := ecdh.P256().GenerateKey(rand.Reader)
+    if err != nil {
+        panic(err)
+    }
+    os.Setenv("VAPID_PRIVATE_KEY", base64.RawURLEncoding.EncodeToString(private.Bytes()))
+    os.Setenv("VAPID_PUBLIC_KEY", base64.RawURLEncoding.EncodeToString(private.PublicKey().Bytes()))
+    os.Setenv("VAPID_SUBJECT", "mailto:push@example.com")
+    if loadVAPIDKeys() == nil {
+        panic("VAPID keys were not loaded")
+    }
+    os.Exit(m.Run())
+}
+
+// browserSubscription holds the keys a browser keeps for a push subscription
+type browserSubscription struct {
+    private    *ecdh.PrivateKey
+    authSecret []byte
+}
+
+func newBrowserSubscription(t *testing.T) *browserSubscription {
+    private, err := ecdh.P256().GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    authSecret := make([]byte, 16)
+    rand.Read(authSecret)
+    return &browserSubscription{private: private, authSecret: authSecret}
+}
+
+// decrypt reverses the aes128gcm content encoding the way a browser does (RFC 8291)
+func (b *browserSubscription) decrypt(t *testing.T, body []byte) []byte {
+    if len(body) < 86 {
+        t.Fatalf("push body is %d bytes, too short for the header", len(body))
+    }
+    salt := body[:16]
+    if rs := binary.BigEndian.Uint32(body[16:20]); rs != recordSize {
+        t.Errorf("record size is %d, want %d", rs, recordSize)
+    }
+    if body[20] != 65 {
+        t.Fatalf("key ID is %d bytes, want 65", body[20])
+    }
+    serverPublic, err := ecdh.P256().NewPublicKey(body[21:86])
+    if err != nil {
+        t.Fatal(err)
+    }
+    shared, err := b.private.ECDH(serverPublic)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    read := func(secret, salt []byte, info string, size int) []byte {
+        out := make([]byte, size)
+        if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out); err != nil {
+            t.Fatal(err)
+        }
+        return out
+    }
+    keyInfo := "WebPush: info\x00" + string(b.private.PublicKey().Bytes()) + string(serverPublic.Bytes())
+    ikm := read(shared, b.authSecret, keyInfo, 32)
+    block, err := aes.NewCipher(read(ikm, salt, "Content-Encoding: aes128gcm\x00", 16))
+    if err != nil {
+        t.Fatal(err)
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        t.Fatal(err)
+    }
+    record, err := gcm.Open(nil, read(ikm, salt, "Content-Encoding: nonce\x00", 12), body[86:], nil)
+    if err != nil {
+        t.Fatalf("push body does not decrypt with the subscription keys: %v", err)
+    }
+
+    // The last record ends with the delimiter 2 and any zero padding
+    end := bytes.LastIndexFunc(record, func(r rune) bool { return r != 0 })
+    if end < 0 || record[end] != 2 {
+        t.Fatalf("push record has no last record delimiter")
+    }
+    return record[:end]
+}
+
+type pushRequest struct {
+    header http.Header
+    body   []byte
+}
+
+// pushService is a fake push service answering every request with status
+type pushService struct {
+    *httptest.Server
+    mu       sync.Mutex
+    requests []pushRequest
+}
+
+func newPushService(t *testing.T, status int) *pushService {
+    service := &pushService{}
+    service.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        service.mu.Lock()
+        service.requests = append(service.requests, pushRequest{header: r.Header.Clone(), body: body})
+        service.mu.Unlock()
+        w.WriteHeader(status)
+    }))
+    t.Cleanup(service.Close)
+    return service
+}
+
+func subscribe(t *testing.T, service *pushService, browser *browserSubscription) *dbtest.Fake {
+    fake := dbtest.Open(t)
+    fake.Answer(`^SELECT id, endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = \?`, dbtest.Result{
+        Columns: []string{"id", "endpoint", "p256dh", "auth"},
+        Rows: [][]driver.Value{{
+            int64(42),
+            service.URL + "/push/42",
+            base64.RawURLEncoding.EncodeToString(browser.private.PublicKey().Bytes()),
+            base64.RawURLEncoding.EncodeToString(browser.authSecret),
+        }},
+    })
+    fake.Answer(`^UPDATE push_subscriptions SET last_success_at`, dbtest.Result{RowsAffected: 1})
+    fake.Answer(`^DELETE FROM push_subscriptions WHERE id = \?`, dbtest.Result{RowsAffected: 1})
+    return fake
+}
+
+func TestSendToUserEncryptsForTheSubscription(t *testing.T) {
+    service := newPushService(t, http.StatusCreated)
+    browser := newBrowserSubscription(t)
+    fake := subscribe(t, service, browser)
+
+    message := Message{Type: models.MessageNotificationType, Title: "alice", Body: "hi", Tag: "chat-1234", URL: "/inbox/1234", Actor: "alice", ChatID: "1234"}
+    sendToUser(delivery{userID: 3, message: message})
+
+    if len(service.requests) != 1 {
+        t.Fatalf("push service got %d requests, want 1", len(service.requests))
+    }
+    request := service.requests[0]
+
+    var received Message
+    if err := json.Unmarshal(browser.decrypt(t, request.body), &received); err != nil {
+        t.Fatal(err)
+    }
+    if received != message {
+        t.Errorf("browser received %+v, want %+v", received, message)
+    }
+
+    for header, want := range map[string]string{
+        "Content-Encoding": "aes128gcm",
+        "TTL":              "86400",
+        "Urgency":          "high",
+        "Topic":            "chat-1234",
+    } {
+        if got := request.header.Get(header); got != want {
+            t.Errorf("%s header is %q, want %q", header, got, want)
+        }
+    }
+
+    // The VAPID token is signed with the key in k and scoped to the push service
+    authorization := request.header.Get("Authorization")
+    token, publicKey, ok := strings.Cut(strings.TrimPrefix(authorization, "vapid t="), ", k=")
+    if !strings.HasPrefix(authorization, "vapid t=") || !ok {
+        t.Fatalf("Authorization header is %q", authorization)
+    }
+    if publicKey != os.Getenv("VAPID_PUBLIC_KEY") {
+        t.Errorf("VAPID k is %q, want the configured public key", publicKey)
+    }
+    claims := &jwt.RegisteredClaims{}
+    _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+        return &loadVAPIDKeys().private.PublicKey, nil
+    }, jwt.WithValidMethods([]string{"ES256"}), jwt.WithAudience(service.URL), jwt.WithExpirationRequired())
+    if err != nil {
+        t.Fatalf("VAPID token is invalid: %v", err)
+    }
+    if claims.Subject != "mailto:push@example.com" {
+        t.Errorf("VAPID subject is %q", claims.Subject)
+    }
+    if time.Until(claims.ExpiresAt.Time) > 24*time.Hour {
+        t.Errorf("VAPID token expires at %v, more than a day away", claims.ExpiresAt)
+    }
+
+    if updates := fake.Statements(`^UPDATE push_subscriptions SET last_success_at`); len(updates) != 1 || updates[0].Args[0] != int64(42) {
+        t.Errorf("successful push recorded %+v", updates)
+    }
+    if deletes := fake.Statements(`^DELETE FROM push_subscriptions`); len(deletes) != 0 {
+        t.Errorf("successful push deleted the subscription")
+    }
+}
+
+func TestSendToUserDeletesSubscriptionsThePushServiceForgot(t *testing.T) {
+    for _, test := range []struct {
+        status  int
+        deleted bool
+    }{
+        {http.StatusNotFound, true},
+        {http.StatusGone, true},
+        {http.StatusTooManyRequests, false},
+        {http.StatusInternalServerError, false},
+    } {
+        service := newPushService(t, test.status)
+        fake := subscribe(t, service, newBrowserSubscription(t))
+
+        sendToUser(delivery{userID: 3, message: Message{Type: models.FollowNotificationType, Title: "alice", Body: "started following you"}})
+
+        deletes := fake.Statements(`^DELETE FROM push_subscriptions WHERE id = \?`)
+        if test.deleted && (len(deletes) != 1 || deletes[0].Args[0] != int64(42)) {
+            t.Errorf("%d: deleted %+v, want subscription 42", test.status, deletes)
+        }
+        if !test.deleted && len(deletes) != 0 {
+            t.Errorf("%d: deleted the subscription", test.status)
+        }
+        if updates := fake.Statements(`^UPDATE push_subscriptions`); len(updates) != 0 {
+            t.Errorf("%d: recorded a successful push", test.status)
+        }
+    }
+}
+
+func TestSendRefusesLoopbackInReleaseMode(t *testing.T) {
+    gin.SetMode(gin.ReleaseMode)
+    defer gin.SetMode(gin.DebugMode)
+
+    service := newPushService(t, http.StatusCreated)
+    fake := subscribe(t, service, newBrowserSubscription(t))
+    sendToUser(delivery{userID: 3, message: Message{Type: models.FollowNotificationType, Title: "alice", Body: "started following you"}})
+
+    if len(service.requests) != 0 {
+        t.Errorf("push service on loopback got %d requests in release mode", len(service.requests))
+    }
+    if statements := fake.Statements(`^(UPDATE|DELETE) .*push_subscriptions`); len(statements) != 0 {
+        t.Errorf("refused push changed the subscription: %+v", statements)
+    }
+}
@@ -0,0 +1,109 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// recordSize is the record size announced in the header. Push payloads always fit in
+// a single record.
+const recordSize = 4096
+
+// maxPlaintextLen is what is left of the 4096 bytes push services accept once the
+// header (86 bytes), the padding delimiter and the AEAD tag are taken off
+const maxPlaintextLen = recordSize - 86 - 1 - 16
+
+// decodeKey reads a key from a subscription, which browsers encode as unpadded
+// base64url but some clients send padded or in standard base64
+func decodeKey(key string) ([]byte, error) {
+    key = strings.TrimRight(key, "=")
+    key = strings.NewReplacer("+", "-", "/", "_").Replace(key)
+    return base64.RawURLEncoding.DecodeString(key)
+}
+
+// encrypt encrypts a payload for a subscription with the aes128gcm content encoding
+// of RFC 8291: an ephemeral ECDH key agreed with the browser's p256dh key, mixed with
+// its auth secret
+func encrypt(p256dh, authSecret string, plaintext []byte) ([]byte, error) {
+    if len(plaintext) > maxPlaintextLen {
+        return nil, errors.New("web push payload is too large")
+    }
+
+    uaPublicBytes, err := decodeKey(p256dh)
+    if err != nil {
+        return nil, err
+    }
+    uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+    if err != nil {
+        return nil, err
+    }
+    auth, err := decodeKey(authSecret)
+    if err != nil {
+        return nil, err
+    }
+    if len(auth) != 16 {
+        return nil, errors.New("web push auth secret must be 16 bytes")
+    }
+
+    asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    asPublicBytes := asPrivate.PublicKey().Bytes()
+    ecdhSecret, err := asPrivate.ECDH(uaPublic)
+    if err != nil {
+        return nil, err
+    }
+
+    // IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public)
+    keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+    keyInfo = append(keyInfo, asPublicBytes...)
+    ikm := make([]byte, 32)
+    if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, auth, keyInfo), ikm); err != nil {
+        return nil, err
+    }
+
+    salt := make([]byte, 16)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, err
+    }
+    contentKey := make([]byte, 16)
+    if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), contentKey); err != nil {
+        return nil, err
+    }
+    nonce := make([]byte, 12)
+    if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+        return nil, err
+    }
+
+    block, err := aes.NewCipher(contentKey)
+    if err != nil {
+        return nil, err
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+
+    // The single record ends with the 0x02 delimiter of a last record
+    record := append(append([]byte{}, plaintext...), 0x02)
+
+    // Header: salt || record size || key ID length || key ID, where the key ID is as_public
+    header := make([]byte, 0, 16+4+1+len(asPublicBytes))
+    header = append(header, salt...)
+    header = binary.BigEndian.AppendUint32(header, recordSize)
+    header = append(header, byte(len(asPublicBytes)))
+    header = append(header, asPublicBytes...)
+
+    return gcm.Seal(header, nonce, record, nil), nil
+}
@@ -0,0 +1,241 @@
+package webpush
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// maxSubscriptionsPerUser bounds the devices of a user, the oldest is dropped past it
+const maxSubscriptionsPerUser = 20
+
+// subscriptionRequest is a PushSubscription as serialized by the browser's toJSON()
+type subscriptionRequest struct {
+    Endpoint string `json:"endpoint" binding:"required"`
+    // ExpirationTime is in milliseconds since the epoch, null when the subscription does not expire
+    ExpirationTime *int64 `json:"expiration_time"`
+    Keys           struct {
+        P256dh string `json:"p256dh" binding:"required"`
+        Auth   string `json:"auth" binding:"required"`
+    } `json:"keys" binding:"required"`
+}
+
+func subscriberID(c *gin.Context) (int64, bool) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return 0, false
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return 0, false
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        log.Printf("Error retrieving user ID: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return 0, false
+    }
+    return userID, true
+}
+
+// validSubscription checks the endpoint is an https URL, or http on localhost for a
+// push service run outside release mode, that it does not point at a loopback, private
+// or link-local address, and that the keys have the sizes RFC 8291 expects
+func validSubscription(request subscriptionRequest) bool {
+    endpoint, err := url.Parse(request.Endpoint)
+    if err != nil || endpoint.Host == "" {
+        return false
+    }
+    host := endpoint.Hostname()
+    ip := net.ParseIP(host)
+    local := host == "localhost" || (ip != nil && ip.IsLoopback())
+    if local && gin.Mode() == gin.ReleaseMode {
+        return false
+    }
+    if ip != nil && !allowedPushIP(ip) {
+        return false
+    }
+    if endpoint.Scheme != "https" && !(endpoint.Scheme == "http" && local) {
+        return false
+    }
+    p256dh, err := decodeKey(request.Keys.P256dh)
+    if err != nil || len(p256dh) != 65 {
+        return false
+    }
+    auth, err := decodeKey(request.Keys.Auth)
+    return err == nil && len(auth) == 16
+}
+
+// GetVAPIDPublicKey returns the application server key browsers subscribe with
+func GetVAPIDPublicKey(c *gin.Context) {
+    keys := loadVAPIDKeys()
+    if keys == nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Web Push is not configured"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"public_key": keys.publicKey})
+}
+
+// Subscribe registers the push subscription of a device. Subscribing the same endpoint
+// again refreshes its keys, and moves it to the caller if another account had it.
+func Subscribe(c *gin.Context) {
+    if loadVAPIDKeys() == nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Web Push is not configured"})
+        return
+    }
+    userID, ok := subscriberID(c)
+    if !ok {
+        return
+    }
+
+    var request subscriptionRequest
+    if err := c.ShouldBindJSON(&request); err != nil || !validSubscription(request) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription"})
+        return
+    }
+
+    var expiresAt interface{}
+    if request.ExpirationTime != nil {
+        expires := time.UnixMilli(*request.ExpirationTime)
+        if !expires.After(time.Now()) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription has expired"})
+            return
+        }
+        expiresAt = expires.UTC()
+    }
+    userAgent := c.Request.UserAgent()
+    if len(userAgent) > 255 {
+        userAgent = userAgent[:255]
+    }
+
+    statements := []struct {
+        query string
+        args  []interface{}
+    }{
+        {`INSERT INTO push_subscriptions (user_id, endpoint, endpoint_hash, p256dh, auth, user_agent, expires_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+            ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), p256dh = VALUES(p256dh), auth = VALUES(auth),
+                user_agent = VALUES(user_agent), expires_at = VALUES(expires_at)`,
+            []interface{}{userID, request.Endpoint, utils.HashToken(request.Endpoint), request.Keys.P256dh, request.Keys.Auth, userAgent, expiresAt}},
+        // Drop the oldest devices past the limit. The derived table lets MySQL read the table it deletes from.
+        {`DELETE FROM push_subscriptions WHERE user_id = ? AND id NOT IN (
+            SELECT id FROM (SELECT id FROM push_subscriptions WHERE user_id = ? ORDER BY created_at DESC, id DESC LIMIT ?) newest)`,
+            []interface{}{userID, userID, maxSubscriptionsPerUser}},
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Printf("Error starting transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving subscription"})
+        return
+    }
+    defer tx.Rollback()
+    for _, statement := range statements {
+        if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+            log.Printf("Error saving push subscription: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving subscription"})
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        log.Printf("Error committing transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving subscription"})
+        return
+    }
+
+    c.JSON(http.StatusCreated, gin.H{"message": "Subscribed to push notifications"})
+}
+
+// Unsubscribe removes the push subscription of a device, after the browser unsubscribed
+// or the user logged out on it
+func Unsubscribe(c *gin.Context) {
+    userID, ok := subscriberID(c)
+    if !ok {
+        return
+    }
+
+    var request struct {
+        Endpoint string `json:"endpoint" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    result, err := db.DB.Exec("DELETE FROM push_subscriptions WHERE endpoint_hash = ? AND user_id = ?", utils.HashToken(request.Endpoint), userID)
+    if err != nil {
+        log.Printf("Error deleting push subscription: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting subscription"})
+        return
+    }
+    if affected, _ := result.RowsAffected(); affected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Unsubscribed from push notifications"})
+}
+
+// ListSubscriptions returns the devices subscribed to push notifications, without their keys
+func ListSubscriptions(c *gin.Context) {
+    userID, ok := subscriberID(c)
+    if !ok {
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT id, endpoint, user_agent, expires_at, created_at, last_success_at
+        FROM push_subscriptions WHERE user_id = ? ORDER BY created_at DESC`, userID)
+    if err != nil {
+        log.Printf("Error retrieving push subscriptions: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving subscriptions"})
+        return
+    }
+    defer rows.Close()
+
+    subscriptions := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var endpoint, userAgent string
+        var createdAt time.Time
+        var expiresAt, lastSuccessAt sql.NullTime
+        if err := rows.Scan(&id, &endpoint, &userAgent, &expiresAt, &createdAt, &lastSuccessAt); err != nil {
+            log.Printf("Error scanning push subscription: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving subscriptions"})
+            return
+        }
+        subscription := gin.H{
+            "id":              id,
+            "endpoint":        endpoint,
+            "user_agent":      userAgent,
+            "expires_at":      nil,
+            "created_at":      createdAt,
+            "last_success_at": nil,
+        }
+        if expiresAt.Valid {
+            subscription["expires_at"] = expiresAt.Time
+        }
+        if lastSuccessAt.Valid {
+            subscription["last_success_at"] = lastSuccessAt.Time
+        }
+        subscriptions = append(subscriptions, subscription)
+    }
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating push subscriptions: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving subscriptions"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"subscriptions": subscriptions})
+}
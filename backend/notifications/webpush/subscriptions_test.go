@@ -0,0 +1,50 @@
+package webpush
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidSubscription(t *testing.T) {
+    p256dh := make([]byte, 65)
+    p256dh[0] = 4
+    auth := make([]byte, 16)
+    rand.Read(p256dh[1:])
+    rand.Read(auth)
+
+    for _, test := range []struct {
+        endpoint string
+        mode     string
+        valid    bool
+    }{
+        {"https://fcm.googleapis.com/fcm/send/abc", gin.ReleaseMode, true},
+        {"https://updates.push.services.mozilla.com/wpush/v2/abc", gin.DebugMode, true},
+        {"http://fcm.googleapis.com/fcm/send/abc", gin.ReleaseMode, false},
+        {"http://localhost:8081/push", gin.DebugMode, true},
+        {"http://127.0.0.1:8081/push", gin.DebugMode, true},
+        {"http://localhost:8081/push", gin.ReleaseMode, false},
+        {"https://127.0.0.1/push", gin.ReleaseMode, false},
+        {"https://[::1]/push", gin.ReleaseMode, false},
+        {"https://10.0.0.5/push", gin.ReleaseMode, false},
+        {"https://192.168.1.1/push", gin.DebugMode, false},
+        {"https://172.16.0.1/push", gin.ReleaseMode, false},
+        {"https://169.254.169.254/latest/meta-data", gin.ReleaseMode, false},
+        {"https://[fe80::1]/push", gin.ReleaseMode, false},
+        {"https://[fd00::1]/push", gin.ReleaseMode, false},
+        {"https://0.0.0.0/push", gin.ReleaseMode, false},
+        {"http://10.0.0.5/push", gin.DebugMode, false},
+        {"not a url", gin.DebugMode, false},
+    } {
+        gin.SetMode(test.mode)
+        request := subscriptionRequest{Endpoint: test.endpoint}
+        request.Keys.P256dh = base64.RawURLEncoding.EncodeToString(p256dh)
+        request.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+        if got := validSubscription(request); got != test.valid {
+            t.Errorf("%s in %s mode: valid is %v, want %v", test.endpoint, test.mode, got, test.valid)
+        }
+    }
+    gin.SetMode(gin.DebugMode)
+}
@@ -0,0 +1,105 @@
+package webpush
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"errors"
+	"log"
+	"math/big"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lpernett/godotenv"
+)
+
+// vapidTokenTTL is how long a VAPID token is valid. Push services refuse more than 24 hours.
+const vapidTokenTTL = 12 * time.Hour
+
+// vapidKeys identify this server to push services (RFC 8292)
+type vapidKeys struct {
+    private   *ecdsa.PrivateKey
+    publicKey string
+    subject   string
+}
+
+var (
+    vapidOnce sync.Once
+    vapid     *vapidKeys
+)
+
+// loadVAPIDKeys reads VAPID_PUBLIC_KEY and VAPID_PRIVATE_KEY, unpadded base64url as
+// printed by `npx web-push generate-vapid-keys`, and VAPID_SUBJECT, a mailto: or
+// https: contact. Web Push is off without them.
+func loadVAPIDKeys() *vapidKeys {
+    vapidOnce.Do(func() {
+        godotenv.Load()
+        privateKey, publicKey := os.Getenv("VAPID_PRIVATE_KEY"), os.Getenv("VAPID_PUBLIC_KEY")
+        if privateKey == "" || publicKey == "" {
+            log.Println("VAPID keys are not set, Web Push is disabled")
+            return
+        }
+        keys, err := parseVAPIDKeys(privateKey, publicKey)
+        if err != nil {
+            log.Println("Invalid VAPID keys, Web Push is disabled:", err)
+            return
+        }
+        keys.subject = os.Getenv("VAPID_SUBJECT")
+        if keys.subject == "" {
+            keys.subject = "mailto:support@vansify.app"
+        }
+        vapid = keys
+    })
+    return vapid
+}
+
+func parseVAPIDKeys(privateKey, publicKey string) (*vapidKeys, error) {
+    d, err := decodeKey(privateKey)
+    if err != nil {
+        return nil, err
+    }
+    private, err := ecdh.P256().NewPrivateKey(d)
+    if err != nil {
+        return nil, err
+    }
+    public := private.PublicKey().Bytes()
+    if base64.RawURLEncoding.EncodeToString(public) != publicKey {
+        return nil, errors.New("VAPID_PUBLIC_KEY does not belong to VAPID_PRIVATE_KEY")
+    }
+
+    return &vapidKeys{
+        private: &ecdsa.PrivateKey{
+            PublicKey: ecdsa.PublicKey{
+                Curve: elliptic.P256(),
+                X:     new(big.Int).SetBytes(public[1:33]),
+                Y:     new(big.Int).SetBytes(public[33:]),
+            },
+            D: new(big.Int).SetBytes(d),
+        },
+        publicKey: publicKey,
+    }, nil
+}
+
+// authorization builds the VAPID Authorization header for a push endpoint. The token
+// is scoped to the origin of the push service.
+func (keys *vapidKeys) authorization(endpoint string) (string, error) {
+    parsed, err := url.Parse(endpoint)
+    if err != nil {
+        return "", err
+    }
+
+    token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+        Audience:  jwt.ClaimStrings{parsed.Scheme + "://" + parsed.Host},
+        ExpiresAt: jwt.NewNumericDate(time.Now().Add(vapidTokenTTL)),
+        Subject:   keys.subject,
+    })
+    signed, err := token.SignedString(keys.private)
+    if err != nil {
+        return "", err
+    }
+    return "vapid t=" + signed + ", k=" + keys.publicKey, nil
+}
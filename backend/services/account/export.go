@@ -0,0 +1,827 @@
+package account
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/services/aws"
+	"github.com/vaanskii/vansify/services/mail"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const (
+    // exportLinkTTL is how long a finished export can be downloaded
+    exportLinkTTL = 7 * 24 * time.Hour
+    // exportCooldown is how often a user can ask for a new export
+    exportCooldown = 24 * time.Hour
+    // exportLease is how long an instance owns an export it started building
+    exportLease       = 30 * time.Minute
+    maxExportAttempts = 3
+)
+
+// exportWake lets a new request start the worker without waiting for the next tick
+var exportWake = make(chan struct{}, 1)
+
+// exportTime formats timestamps inside the archive
+func exportTime(t time.Time) string {
+    return t.UTC().Format(time.RFC3339)
+}
+
+// exportNullTime formats a nullable timestamp, nil when it is not set
+func exportNullTime(t sql.NullTime) interface{} {
+    if !t.Valid {
+        return nil
+    }
+    return exportTime(t.Time)
+}
+
+// RequestDataExport queues an export of everything the user has stored with us
+func RequestDataExport(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    // Failed exports do not count towards the cooldown
+    var inProgress bool
+    var retryAfter int64
+    err = db.DB.QueryRow(`
+        SELECT COALESCE(MAX(status IN ('pending', 'running')), FALSE),
+            COALESCE(MAX(TIMESTAMPDIFF(SECOND, NOW(), DATE_ADD(created_at, INTERVAL ? SECOND))), 0)
+        FROM data_exports
+        WHERE user_id = ? AND status <> 'failed' AND created_at > DATE_SUB(NOW(), INTERVAL ? SECOND)`,
+        int(exportCooldown.Seconds()), userID, int(exportCooldown.Seconds())).Scan(&inProgress, &retryAfter)
+    if err != nil {
+        log.Printf("Error checking data exports: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error requesting data export"})
+        return
+    }
+    if inProgress {
+        c.JSON(http.StatusConflict, gin.H{"error": "Your data export is already being prepared"})
+        return
+    }
+    if retryAfter > 0 {
+        c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+        c.JSON(http.StatusTooManyRequests, gin.H{"error": "You can request one data export per day"})
+        return
+    }
+
+    result, err := db.DB.Exec("INSERT INTO data_exports (user_id) VALUES (?)", userID)
+    if err != nil {
+        log.Printf("Error creating data export: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error requesting data export"})
+        return
+    }
+    exportID, _ := result.LastInsertId()
+
+    select {
+    case exportWake <- struct{}{}:
+    default:
+    }
+
+    c.JSON(http.StatusAccepted, gin.H{
+        "message": "Your data export is being prepared. We will email you a download link when it is ready.",
+        "id":      exportID,
+        "status":  "pending",
+    })
+}
+
+// ListDataExports shows the state of the user's recent exports
+func ListDataExports(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT e.id, e.status, e.size_bytes, e.created_at, e.completed_at, e.expires_at
+        FROM data_exports e
+        JOIN users u ON u.id = e.user_id
+        WHERE u.username = ?
+        ORDER BY e.created_at DESC
+        LIMIT 10`, customClaims.Username)
+    if err != nil {
+        log.Printf("Error fetching data exports: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching data exports"})
+        return
+    }
+    defer rows.Close()
+
+    exports := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var status string
+        var size sql.NullInt64
+        var createdAt time.Time
+        var completedAt, expiresAt sql.NullTime
+        if err := rows.Scan(&id, &status, &size, &createdAt, &completedAt, &expiresAt); err != nil {
+            log.Printf("Error scanning data export: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching data exports"})
+            return
+        }
+
+        export := gin.H{
+            "id":           id,
+            "status":       status,
+            "size_bytes":   nil,
+            "created_at":   createdAt.Format(time.RFC3339),
+            "completed_at": nil,
+            "expires_at":   nil,
+        }
+        if size.Valid {
+            export["size_bytes"] = size.Int64
+        }
+        if completedAt.Valid {
+            export["completed_at"] = completedAt.Time.Format(time.RFC3339)
+        }
+        if expiresAt.Valid {
+            export["expires_at"] = expiresAt.Time.Format(time.RFC3339)
+        }
+        exports = append(exports, export)
+    }
+
+    if err := rows.Err(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching data exports"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"exports": exports})
+}
+
+// DownloadDataExport streams a finished export to whoever holds the link from the email
+func DownloadDataExport(c *gin.Context) {
+    token := c.Query("token")
+    if token == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid download link"})
+        return
+    }
+
+    var id int64
+    var status string
+    var storageKey sql.NullString
+    var expired bool
+    err := db.DB.QueryRow("SELECT id, status, storage_key, expires_at < NOW() FROM data_exports WHERE token_hash = ?", utils.HashToken(token)).
+        Scan(&id, &status, &storageKey, &expired)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid download link"})
+        return
+    } else if err != nil {
+        log.Printf("Error retrieving data export: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving data export"})
+        return
+    }
+    if status != "ready" || expired || !storageKey.Valid {
+        c.JSON(http.StatusGone, gin.H{"error": "This download link has expired, please request a new export"})
+        return
+    }
+
+    body, size, err := aws.GetObject(storageKey.String)
+    if err != nil {
+        log.Printf("Error opening data export %d: %v\n", id, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving data export"})
+        return
+    }
+    defer body.Close()
+
+    c.Header("Cache-Control", "no-store")
+    c.DataFromReader(http.StatusOK, size, "application/zip", body, map[string]string{
+        "Content-Disposition": fmt.Sprintf("attachment; filename=%q", path.Base(storageKey.String)),
+    })
+}
+
+// RunExportWorker builds queued exports and expires old ones, checking every interval
+// or as soon as a new export is requested
+func RunExportWorker(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        processPendingExports()
+        expireDataExports()
+
+        select {
+        case <-ticker.C:
+        case <-exportWake:
+        }
+    }
+}
+
+// exportJob is a queued export with the account it belongs to
+type exportJob struct {
+    id              int64
+    userID          int64
+    username, email string
+    attempts        int
+}
+
+// processPendingExports claims queued exports, and those whose builder went away, and
+// builds them one by one
+func processPendingExports() {
+    rows, err := db.DB.Query(`
+        SELECT e.id, e.user_id, u.username, u.email, e.attempts
+        FROM data_exports e
+        JOIN users u ON u.id = e.user_id
+        WHERE e.status = 'pending' OR (e.status = 'running' AND e.lease_until < NOW())
+        ORDER BY e.created_at
+        LIMIT 10`)
+    if err != nil {
+        log.Println("Error fetching data exports:", err)
+        return
+    }
+
+    var jobs []exportJob
+    for rows.Next() {
+        var job exportJob
+        if err := rows.Scan(&job.id, &job.userID, &job.username, &job.email, &job.attempts); err != nil {
+            log.Println("Error scanning data export:", err)
+            continue
+        }
+        jobs = append(jobs, job)
+    }
+    rows.Close()
+
+    for _, job := range jobs {
+        if job.attempts >= maxExportAttempts {
+            failExport(job, errors.New("too many attempts"))
+            continue
+        }
+
+        // Only the instance that takes the lease builds the export
+        result, err := db.DB.Exec(`
+            UPDATE data_exports SET status = 'running', attempts = attempts + 1, lease_until = DATE_ADD(NOW(), INTERVAL ? SECOND)
+            WHERE id = ? AND attempts = ? AND (status = 'pending' OR (status = 'running' AND lease_until < NOW()))`,
+            int(exportLease.Seconds()), job.id, job.attempts)
+        if err != nil {
+            log.Println("Error claiming data export:", err)
+            continue
+        }
+        if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+            continue
+        }
+
+        if err := runExport(job); err != nil {
+            log.Printf("Error building data export %d: %v\n", job.id, err)
+            if job.attempts+1 >= maxExportAttempts || errors.Is(err, aws.ErrNotConfigured) {
+                failExport(job, err)
+            } else {
+                // Let the next tick retry it
+                db.DB.Exec("UPDATE data_exports SET status = 'pending', lease_until = NULL WHERE id = ?", job.id)
+            }
+        }
+    }
+}
+
+// runExport builds the archive, stores it and lets the user know where to get it
+func runExport(job exportJob) error {
+    file, err := os.CreateTemp("", "vansify-export-*.zip")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(file.Name())
+    defer file.Close()
+
+    archive := zip.NewWriter(file)
+    if err := writeExportArchive(archive, job); err != nil {
+        return err
+    }
+    if err := archive.Close(); err != nil {
+        return err
+    }
+
+    size, err := file.Seek(0, io.SeekEnd)
+    if err != nil {
+        return err
+    }
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+
+    storageKey := fmt.Sprintf("exports/%d/vansify-%s-%d.zip", job.userID, job.username, job.id)
+    if err := aws.PutPrivateObject(storageKey, file, "application/zip"); err != nil {
+        return err
+    }
+
+    token, err := utils.GenerateRandomToken(32)
+    if err != nil {
+        return err
+    }
+
+    _, err = db.DB.Exec(`
+        UPDATE data_exports
+        SET status = 'ready', lease_until = NULL, storage_key = ?, size_bytes = ?, token_hash = ?, error = NULL,
+            completed_at = NOW(), expires_at = DATE_ADD(NOW(), INTERVAL ? SECOND)
+        WHERE id = ?`, storageKey, size, utils.HashToken(token), int(exportLinkTTL.Seconds()), job.id)
+    if err != nil {
+        return err
+    }
+    log.Printf("Built data export %d (%d bytes)\n", job.id, size)
+
+    notifyExportReady(job, token)
+    return nil
+}
+
+// failExport gives up on an export and tells the user
+func failExport(job exportJob, cause error) {
+    message := cause.Error()
+    if len(message) > 255 {
+        message = message[:255]
+    }
+    _, err := db.DB.Exec("UPDATE data_exports SET status = 'failed', lease_until = NULL, error = ? WHERE id = ?", message, job.id)
+    if err != nil {
+        log.Println("Error failing data export:", err)
+        return
+    }
+
+    body := fmt.Sprintf("Hi %s,<br><br>We could not prepare your Vansify data export. Please request a new one in a while.", job.username)
+    if err := mail.Send(job.email, "Your data export failed", body); err != nil {
+        log.Println("Error sending data export failed email:", err)
+    }
+
+    if !notifications.DeliveryFor(job.userID, models.DataExportNotificationType).InApp {
+        return
+    }
+    payload, _ := json.Marshal(map[string]interface{}{
+        "type":      "DATA_EXPORT_FAILED",
+        "export_id": job.id,
+        "receiver":  job.username,
+    })
+    notifications.GlobalNotificationHub.BroadcastNotification(job.username, payload)
+}
+
+// notifyExportReady sends the download link by email and tells the user's open notification
+// sockets the export is ready. The link stays out of the socket, which tokens scoped to
+// notifications:read can open.
+func notifyExportReady(job exportJob, token string) {
+    downloadLink := os.Getenv("BACKEND_URL") + "/v1/exports/download?token=" + url.QueryEscape(token)
+    expiresAt := time.Now().Add(exportLinkTTL)
+
+    body := fmt.Sprintf("Hi %s,<br><br>Your Vansify data export is ready: <a href='%s'>Download my data</a><br><br>The link works until %s. Anyone with the link can download your data, so do not share it.",
+        job.username, downloadLink, expiresAt.UTC().Format("January 2, 2006 15:04 MST"))
+    if err := mail.Send(job.email, "Your data export is ready", body); err != nil {
+        log.Println("Error sending data export email:", err)
+    }
+
+    // The email carries the link, so it goes out whatever the preferences say
+    delivery := notifications.DeliveryFor(job.userID, models.DataExportNotificationType)
+    if delivery.Store {
+        _, err := notifications.Create(db.DB, models.Notification{
+            UserID:   job.userID,
+            Type:     models.DataExportNotificationType,
+            ObjectID: strconv.FormatInt(job.id, 10),
+            Payload:  map[string]interface{}{"expires_at": exportTime(expiresAt)},
+        }, "")
+        if err != nil {
+            log.Println("Error creating data export notification:", err)
+        }
+    }
+    if !delivery.InApp {
+        return
+    }
+
+    var count int
+    if err := db.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND is_read = false", job.userID).Scan(&count); err != nil {
+        log.Println("Error fetching unread notification count:", err)
+    }
+
+    payload, err := json.Marshal(map[string]interface{}{
+        "type":                      string(models.DataExportNotificationType),
+        "unread_notification_count": count,
+        "receiver":                  job.username,
+        "export_id":                 job.id,
+        "expires_at":                exportTime(expiresAt),
+    })
+    if err != nil {
+        log.Println("Error marshalling data export notification:", err)
+        return
+    }
+    notifications.GlobalNotificationHub.BroadcastNotification(job.username, payload)
+}
+
+// expireDataExports deletes the archives of exports whose link ran out
+func expireDataExports() {
+    rows, err := db.DB.Query("SELECT id, storage_key FROM data_exports WHERE status = 'ready' AND expires_at < NOW() LIMIT 100")
+    if err != nil {
+        log.Println("Error fetching expired data exports:", err)
+        return
+    }
+
+    type expiredExport struct {
+        id         int64
+        storageKey sql.NullString
+    }
+    var expired []expiredExport
+    for rows.Next() {
+        var export expiredExport
+        if err := rows.Scan(&export.id, &export.storageKey); err != nil {
+            log.Println("Error scanning expired data export:", err)
+            continue
+        }
+        expired = append(expired, export)
+    }
+    rows.Close()
+
+    for _, export := range expired {
+        if export.storageKey.Valid {
+            if err := aws.DeleteObject(export.storageKey.String); err != nil {
+                log.Printf("Error deleting data export %d: %v\n", export.id, err)
+                continue
+            }
+        }
+        _, err := db.DB.Exec("UPDATE data_exports SET status = 'expired', storage_key = NULL, token_hash = NULL WHERE id = ?", export.id)
+        if err != nil {
+            log.Println("Error expiring data export:", err)
+        }
+    }
+}
+
+// exportArchive collects the files of an export and the media they point to
+type exportArchive struct {
+    zip *zip.Writer
+    // media maps object keys to their path in the archive
+    media map[string]string
+}
+
+// writeJSON adds an indented JSON file to the archive
+func (a *exportArchive) writeJSON(name string, value interface{}) error {
+    w, err := a.zip.Create(name)
+    if err != nil {
+        return err
+    }
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(value)
+}
+
+// mediaPath notes a file to download and returns where it will be in the archive, or
+// nil for files that are not in our storage
+func (a *exportArchive) mediaPath(fileURL string) interface{} {
+    key, ok := aws.KeyFromURL(fileURL)
+    if !ok {
+        return nil
+    }
+    if _, seen := a.media[key]; !seen {
+        a.media[key] = "media/" + key
+    }
+    return a.media[key]
+}
+
+// writeExportArchive writes the JSON files and the media of a user into the archive
+func writeExportArchive(w *zip.Writer, job exportJob) error {
+    archive := &exportArchive{zip: w, media: map[string]string{}}
+
+    sections := []struct {
+        name  string
+        write func(*exportArchive, exportJob) error
+    }{
+        {"profile.json", exportProfile},
+        {"followers.json", exportFollowers},
+        {"following.json", exportFollowing},
+        {"chats", exportChats},
+        {"notifications.json", exportNotifications},
+        {"sessions.json", exportSessions},
+    }
+    for _, section := range sections {
+        if err := section.write(archive, job); err != nil {
+            return fmt.Errorf("%s: %w", section.name, err)
+        }
+    }
+
+    // Media that went missing is listed instead of failing the whole export
+    var missing []string
+    for key, name := range archive.media {
+        if err := archive.copyMedia(key, name); err != nil {
+            log.Printf("Error adding %s to data export %d: %v\n", key, job.id, err)
+            missing = append(missing, name)
+        }
+    }
+
+    return archive.writeJSON("export.json", map[string]interface{}{
+        "username":      job.username,
+        "generated_at":  exportTime(time.Now()),
+        "media_count":   len(archive.media) - len(missing),
+        "missing_media": missing,
+    })
+}
+
+// copyMedia downloads a stored file into the archive
+func (a *exportArchive) copyMedia(key, name string) error {
+    body, _, err := aws.GetObject(key)
+    if err != nil {
+        return err
+    }
+    defer body.Close()
+
+    w, err := a.zip.Create(name)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(w, body)
+    return err
+}
+
+// exportProfile writes the account itself
+func exportProfile(a *exportArchive, job exportJob) error {
+    var username, email, profilePicture, role string
+    var verified, oauthUser, private bool
+    var createdAt time.Time
+    var lastActive sql.NullTime
+    err := db.DB.QueryRow("SELECT username, email, profile_picture, role, verified, oauth_user, private, created_at, last_active FROM users WHERE id = ?", job.userID).
+        Scan(&username, &email, &profilePicture, &role, &verified, &oauthUser, &private, &createdAt, &lastActive)
+    if err != nil {
+        return err
+    }
+
+    return a.writeJSON("profile.json", map[string]interface{}{
+        "id":                   job.userID,
+        "username":             username,
+        "email":                email,
+        "email_verified":       verified,
+        "role":                 role,
+        "oauth_user":           oauthUser,
+        "private":              private,
+        "profile_picture":      profilePicture,
+        "profile_picture_file": a.mediaPath(profilePicture),
+        "created_at":           exportTime(createdAt),
+        "last_active":          exportNullTime(lastActive),
+    })
+}
+
+// exportFollows writes one side of the user's follow relationships
+func exportFollows(a *exportArchive, name, query string, userID int64) error {
+    rows, err := db.DB.Query(query, userID)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    follows := []map[string]interface{}{}
+    for rows.Next() {
+        var username string
+        var since time.Time
+        if err := rows.Scan(&username, &since); err != nil {
+            return err
+        }
+        follows = append(follows, map[string]interface{}{"username": username, "since": exportTime(since)})
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    return a.writeJSON(name, follows)
+}
+
+// exportFollowers writes who follows the user
+func exportFollowers(a *exportArchive, job exportJob) error {
+    return exportFollows(a, "followers.json", `
+        SELECT u.username, f.created_at
+        FROM followers f
+        JOIN users u ON u.id = f.follower_id
+        WHERE f.following_id = ?
+        ORDER BY f.created_at`, job.userID)
+}
+
+// exportFollowing writes who the user follows
+func exportFollowing(a *exportArchive, job exportJob) error {
+    return exportFollows(a, "following.json", `
+        SELECT u.username, f.created_at
+        FROM followers f
+        JOIN users u ON u.id = f.following_id
+        WHERE f.follower_id = ?
+        ORDER BY f.created_at`, job.userID)
+}
+
+// exportChats writes an index of the user's chats and one file with the messages of each
+func exportChats(a *exportArchive, job exportJob) error {
+    rows, err := db.DB.Query(`
+        SELECT c.chat_id, other.username, c.created_at
+        FROM chats c
+        JOIN users other ON other.id = CASE WHEN c.user1_id = ? THEN c.user2_id ELSE c.user1_id END
+        WHERE c.user1_id = ? OR c.user2_id = ?
+        ORDER BY c.created_at`, job.userID, job.userID, job.userID)
+    if err != nil {
+        return err
+    }
+
+    type exportedChat struct {
+        ChatID    string `json:"chat_id"`
+        With      string `json:"with"`
+        CreatedAt string `json:"created_at"`
+        File      string `json:"file"`
+    }
+    chats := []exportedChat{}
+    for rows.Next() {
+        var chatID, with string
+        var createdAt time.Time
+        if err := rows.Scan(&chatID, &with, &createdAt); err != nil {
+            rows.Close()
+            return err
+        }
+        chats = append(chats, exportedChat{chatID, with, exportTime(createdAt), "chats/" + chatID + ".json"})
+    }
+    rows.Close()
+
+    for _, chat := range chats {
+        if err := exportChatMessages(a, job, chat.ChatID, chat.File); err != nil {
+            return err
+        }
+    }
+
+    return a.writeJSON("chats.json", chats)
+}
+
+// exportChatMessages writes the messages of one chat with references to their attachments
+func exportChatMessages(a *exportArchive, job exportJob, chatID, name string) error {
+    rows, err := db.DB.Query(`
+        SELECT m.id, u.username, m.message, m.file_url, m.status, m.created_at,
+            EXISTS(SELECT 1 FROM message_deletions d WHERE d.message_id = m.id AND d.user_id = ?)
+        FROM messages m
+        JOIN users u ON u.id = m.user_id
+        WHERE m.chat_id = ?
+        ORDER BY m.created_at, m.id`, job.userID, chatID)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    messages := []map[string]interface{}{}
+    for rows.Next() {
+        var id int64
+        var sender, message, status string
+        var fileURL sql.NullString
+        var createdAt time.Time
+        var deletedForYou bool
+        if err := rows.Scan(&id, &sender, &message, &fileURL, &status, &createdAt, &deletedForYou); err != nil {
+            return err
+        }
+
+        entry := map[string]interface{}{
+            "id":              id,
+            "sender":          sender,
+            "message":         message,
+            "status":          status,
+            "created_at":      exportTime(createdAt),
+            "deleted_for_you": deletedForYou,
+            "attachment_url":  nil,
+            "attachment_file": nil,
+        }
+        if fileURL.String != "" {
+            entry["attachment_url"] = fileURL.String
+            entry["attachment_file"] = a.mediaPath(fileURL.String)
+        }
+        messages = append(messages, entry)
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    return a.writeJSON(name, messages)
+}
+
+// exportNotifications writes the user's notifications
+func exportNotifications(a *exportArchive, job exportJob) error {
+    rows, err := db.DB.Query("SELECT id, type, message, is_read, created_at FROM notifications WHERE user_id = ? ORDER BY created_at", job.userID)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    list := []map[string]interface{}{}
+    for rows.Next() {
+        var id int64
+        var notificationType, message string
+        var isRead bool
+        var createdAt time.Time
+        if err := rows.Scan(&id, &notificationType, &message, &isRead, &createdAt); err != nil {
+            return err
+        }
+        list = append(list, map[string]interface{}{
+            "id":         id,
+            "type":       notificationType,
+            "message":    message,
+            "is_read":    isRead,
+            "created_at": exportTime(createdAt),
+        })
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    return a.writeJSON("notifications.json", list)
+}
+
+// exportSessions writes the ways the user logs in and when each was last used
+func exportSessions(a *exportArchive, job exportJob) error {
+    identities := []map[string]interface{}{}
+    rows, err := db.DB.Query("SELECT provider, COALESCE(email, ''), created_at, last_login_at FROM user_identities WHERE user_id = ? ORDER BY created_at", job.userID)
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var provider, email string
+        var createdAt time.Time
+        var lastLogin sql.NullTime
+        if err := rows.Scan(&provider, &email, &createdAt, &lastLogin); err != nil {
+            rows.Close()
+            return err
+        }
+        identities = append(identities, map[string]interface{}{
+            "provider":      provider,
+            "email":         email,
+            "linked_at":     exportTime(createdAt),
+            "last_login_at": exportNullTime(lastLogin),
+        })
+    }
+    rows.Close()
+
+    passkeys := []map[string]interface{}{}
+    rows, err = db.DB.Query("SELECT name, created_at, last_used_at FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at", job.userID)
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var name string
+        var createdAt time.Time
+        var lastUsed sql.NullTime
+        if err := rows.Scan(&name, &createdAt, &lastUsed); err != nil {
+            rows.Close()
+            return err
+        }
+        passkeys = append(passkeys, map[string]interface{}{
+            "name":         name,
+            "created_at":   exportTime(createdAt),
+            "last_used_at": exportNullTime(lastUsed),
+        })
+    }
+    rows.Close()
+
+    tokens := []map[string]interface{}{}
+    rows, err = db.DB.Query("SELECT name, scopes, created_at, expires_at, last_used_at FROM personal_access_tokens WHERE user_id = ? ORDER BY created_at", job.userID)
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var name, scopes string
+        var createdAt, expiresAt time.Time
+        var lastUsed sql.NullTime
+        if err := rows.Scan(&name, &scopes, &createdAt, &expiresAt, &lastUsed); err != nil {
+            rows.Close()
+            return err
+        }
+        tokens = append(tokens, map[string]interface{}{
+            "name":         name,
+            "scopes":       strings.Split(scopes, " "),
+            "created_at":   exportTime(createdAt),
+            "expires_at":   exportTime(expiresAt),
+            "last_used_at": exportNullTime(lastUsed),
+        })
+    }
+    rows.Close()
+
+    var tokensValidAfter sql.NullTime
+    err = db.DB.QueryRow("SELECT tokens_valid_after FROM users WHERE id = ?", job.userID).Scan(&tokensValidAfter)
+    if err != nil {
+        return err
+    }
+
+    return a.writeJSON("sessions.json", map[string]interface{}{
+        "linked_providers":         identities,
+        "passkeys":                 passkeys,
+        "personal_access_tokens":   tokens,
+        "logged_out_everywhere_at": exportNullTime(tokensValidAfter),
+    })
+}
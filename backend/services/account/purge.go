@@ -0,0 +1,171 @@
+package account
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/services/aws"
+	"github.com/vaanskii/vansify/services/mail"
+	activeUsers "github.com/vaanskii/vansify/services/user"
+)
+
+// purgeLease is how long an instance owns an account it started purging. An account
+// whose purge failed is picked up again once the lease runs out.
+const purgeLease = time.Hour
+
+// RunDeletionPurger purges the accounts whose deletion grace period is over, checking
+// every interval
+func RunDeletionPurger(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        purgeDueAccounts()
+        <-ticker.C
+    }
+}
+
+// purgeDueAccounts claims the accounts that are due and purges them one by one
+func purgeDueAccounts() {
+    rows, err := db.DB.Query("SELECT id, username, email FROM users WHERE deletion_scheduled_for <= NOW() LIMIT 100")
+    if err != nil {
+        log.Println("Error fetching accounts to purge:", err)
+        return
+    }
+
+    type dueAccount struct {
+        id              int64
+        username, email string
+    }
+    var due []dueAccount
+    for rows.Next() {
+        var account dueAccount
+        if err := rows.Scan(&account.id, &account.username, &account.email); err != nil {
+            log.Println("Error scanning account to purge:", err)
+            continue
+        }
+        due = append(due, account)
+    }
+    rows.Close()
+
+    for _, account := range due {
+        // Only the instance that moves the schedule forward purges the account
+        result, err := db.DB.Exec("UPDATE users SET deletion_scheduled_for = DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE id = ? AND deletion_scheduled_for <= NOW()",
+            int(purgeLease.Seconds()), account.id)
+        if err != nil {
+            log.Println("Error claiming account to purge:", err)
+            continue
+        }
+        if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+            continue
+        }
+
+        if err := purgeAccount(account.id, account.username); err != nil {
+            log.Printf("Error purging account %d: %v\n", account.id, err)
+            continue
+        }
+        log.Printf("Purged account %d\n", account.id)
+
+        body := fmt.Sprintf("Hi %s,<br><br>Your Vansify account and everything in it have been deleted. Thanks for having been with us.", account.username)
+        if err := mail.Send(account.email, "Your account has been deleted", body); err != nil {
+            log.Println("Error sending account deleted email:", err)
+        }
+    }
+
+    if len(due) > 0 {
+        activeUsers.FetchActiveUsersAndBroadcast(db.DB)
+    }
+}
+
+// purgeAccount removes a user's uploads and every row that belongs to them. Rows are
+// deleted explicitly rather than left to cascades, so nothing depends on how each
+// foreign key was declared.
+func purgeAccount(userID int64, username string) error {
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    // The user may have logged in and cancelled since the account was claimed. The row
+    // lock holds off a cancellation until the purge is done, so nothing is deleted from
+    // an account that is kept.
+    var pending bool
+    err = tx.QueryRow("SELECT deletion_requested_at IS NOT NULL FROM users WHERE id = ? FOR UPDATE", userID).Scan(&pending)
+    if err != nil {
+        return err
+    }
+    if !pending {
+        return nil
+    }
+
+    rows, err := tx.Query("SELECT chat_id FROM chats WHERE user1_id = ? OR user2_id = ?", userID, userID)
+    if err != nil {
+        return err
+    }
+    var chatIDs []string
+    for rows.Next() {
+        var chatID string
+        if err := rows.Scan(&chatID); err != nil {
+            rows.Close()
+            return err
+        }
+        chatIDs = append(chatIDs, chatID)
+    }
+    rows.Close()
+
+    // Storage goes before the rows. If it fails the transaction is rolled back, and
+    // the next run after the lease picks the account up again with the rows that lead
+    // to the objects; deleting a prefix twice is harmless.
+    prefixes := []string{"profile/" + username + "/", fmt.Sprintf("exports/%d/", userID)}
+    for _, chatID := range chatIDs {
+        prefixes = append(prefixes, "chat/"+chatID+"/")
+    }
+    for _, prefix := range prefixes {
+        if err := aws.DeletePrefix(prefix); err != nil {
+            return fmt.Errorf("deleting %s: %w", prefix, err)
+        }
+    }
+
+    statements := []struct {
+        query string
+        args  []interface{}
+    }{
+        {"DELETE FROM message_deletions WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM chat_deletions WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM messages WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM chats WHERE user1_id = ? OR user2_id = ?", []interface{}{userID, userID}},
+        {"DELETE FROM chat_notifications WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM notification_actors WHERE actor_id = ?", []interface{}{userID}},
+        {"DELETE FROM notifications WHERE user_id = ? OR actor_id = ?", []interface{}{userID, userID}},
+        {"DELETE FROM followers WHERE follower_id = ? OR following_id = ?", []interface{}{userID, userID}},
+        {"DELETE FROM follow_requests WHERE requester_id = ? OR target_id = ?", []interface{}{userID, userID}},
+        {"DELETE FROM user_blocks WHERE blocker_id = ? OR blocked_id = ?", []interface{}{userID, userID}},
+        {"DELETE FROM user_mutes WHERE muter_id = ? OR muted_id = ?", []interface{}{userID, userID}},
+        {"DELETE FROM follow_suggestions WHERE user_id = ? OR suggested_id = ?", []interface{}{userID, userID}},
+        {"DELETE FROM audience_rules WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM audience_list_members WHERE member_id = ? OR list_id IN (SELECT id FROM audience_lists WHERE user_id = ?)", []interface{}{userID, userID}},
+        {"DELETE FROM audience_lists WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM personal_access_tokens WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM login_devices WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM notification_preferences WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM push_subscriptions WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM email_digests WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM webauthn_credentials WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM webauthn_sessions WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM user_identities WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM email_tokens WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM data_exports WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM username_reservations WHERE user_id = ?", []interface{}{userID}},
+        {"DELETE FROM users WHERE id = ?", []interface{}{userID}},
+    }
+    for _, statement := range statements {
+        if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+            return fmt.Errorf("%s: %w", statement.query, err)
+        }
+    }
+
+    return tx.Commit()
+}
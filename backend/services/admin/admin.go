@@ -0,0 +1,354 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/services/auth"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// targetUser is the account an admin request acts on
+type targetUser struct {
+    ID        int64
+    Username  string
+    Email     string
+    Role      string
+    Verified  bool
+    Suspended bool
+}
+
+// loadTarget reads the user named by the :id parameter. Staff can only act on
+// accounts with a lower role than their own, which also keeps them off their own.
+func loadTarget(c *gin.Context) (targetUser, bool) {
+    var target targetUser
+
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return target, false
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return target, false
+    }
+
+    userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+        return target, false
+    }
+
+    err = db.DB.QueryRow("SELECT id, username, email, role, verified, suspended_at IS NOT NULL FROM users WHERE id = ?", userID).
+        Scan(&target.ID, &target.Username, &target.Email, &target.Role, &target.Verified, &target.Suspended)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+        return target, false
+    } else if err != nil {
+        log.Printf("Error retrieving user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user"})
+        return target, false
+    }
+
+    if c.Request.Method != http.MethodGet && (target.Username == customClaims.Username || auth.RoleAtLeast(target.Role, customClaims.Role)) {
+        c.JSON(http.StatusForbidden, gin.H{"error": "You cannot manage this account"})
+        return target, false
+    }
+
+    log.Printf("[ADMIN] %s %s %s on user %d (%s)\n", customClaims.Username, c.Request.Method, c.FullPath(), target.ID, target.Username)
+    return target, true
+}
+
+// ListUsers lists users, optionally filtered by a search term, role and status
+func ListUsers(c *gin.Context) {
+    page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+    limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+    if page < 1 {
+        page = 1
+    }
+    if limit < 1 || limit > 100 {
+        limit = 50
+    }
+
+    var conditions []string
+    var args []interface{}
+    if q := strings.TrimSpace(c.Query("q")); q != "" {
+        conditions = append(conditions, "(u.username LIKE ? OR u.email LIKE ?)")
+        args = append(args, "%"+q+"%", "%"+q+"%")
+    }
+    if role := c.Query("role"); role != "" {
+        if !auth.ValidRole(role) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+            return
+        }
+        conditions = append(conditions, "u.role = ?")
+        args = append(args, role)
+    }
+    switch c.Query("status") {
+    case "":
+    case "active":
+        conditions = append(conditions, "u.suspended_at IS NULL")
+    case "suspended":
+        conditions = append(conditions, "u.suspended_at IS NOT NULL")
+    default:
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+        return
+    }
+
+    where := ""
+    if len(conditions) > 0 {
+        where = "WHERE " + strings.Join(conditions, " AND ")
+    }
+
+    var total int
+    if err := db.DB.QueryRow("SELECT COUNT(*) FROM users u "+where, args...).Scan(&total); err != nil {
+        log.Printf("Error counting users: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching users"})
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT u.id, u.username, u.email, u.role, u.verified, u.oauth_user, u.created_at, u.suspended_at,
+            (SELECT COUNT(*) FROM reports r WHERE r.reported_id = u.id AND r.status = 'open')
+        FROM users u `+where+`
+        ORDER BY u.id DESC
+        LIMIT ? OFFSET ?`, append(args, limit, (page-1)*limit)...)
+    if err != nil {
+        log.Printf("Error fetching users: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching users"})
+        return
+    }
+    defer rows.Close()
+
+    users := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var username, email, role string
+        var verified, oauthUser bool
+        var createdAt time.Time
+        var suspendedAt sql.NullTime
+        var openReports int
+        if err := rows.Scan(&id, &username, &email, &role, &verified, &oauthUser, &createdAt, &suspendedAt, &openReports); err != nil {
+            log.Printf("Error scanning user: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching users"})
+            return
+        }
+
+        user := gin.H{
+            "id":           id,
+            "username":     username,
+            "email":        email,
+            "role":         role,
+            "verified":     verified,
+            "oauth_user":   oauthUser,
+            "created_at":   createdAt.Format(time.RFC3339),
+            "suspended_at": nil,
+            "open_reports": openReports,
+        }
+        if suspendedAt.Valid {
+            user["suspended_at"] = suspendedAt.Time.Format(time.RFC3339)
+        }
+        users = append(users, user)
+    }
+
+    if err := rows.Err(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching users"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"users": users, "page": page, "limit": limit, "total": total})
+}
+
+// SuspendUser suspends an account and disconnects it everywhere
+func SuspendUser(c *gin.Context) {
+    var request struct {
+        Reason string `json:"reason"`
+    }
+    // The reason is optional, so an empty body is a suspension without one
+    if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+    if len(request.Reason) > 255 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Reason must be at most 255 characters"})
+        return
+    }
+
+    target, ok := loadTarget(c)
+    if !ok {
+        return
+    }
+    if target.Suspended {
+        c.JSON(http.StatusConflict, gin.H{"error": "User is already suspended"})
+        return
+    }
+
+    _, err := db.DB.Exec("UPDATE users SET suspended_at = NOW(), suspension_reason = NULLIF(?, ''), active = false, last_active = NOW() WHERE id = ?",
+        strings.TrimSpace(request.Reason), target.ID)
+    if err != nil {
+        log.Printf("Error suspending user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error suspending user"})
+        return
+    }
+
+    auth.DisconnectEverywhere(target.Username, "account suspended")
+
+    c.JSON(http.StatusOK, gin.H{"message": "User suspended"})
+}
+
+// ReactivateUser lifts the suspension of an account
+func ReactivateUser(c *gin.Context) {
+    target, ok := loadTarget(c)
+    if !ok {
+        return
+    }
+    if !target.Suspended {
+        c.JSON(http.StatusConflict, gin.H{"error": "User is not suspended"})
+        return
+    }
+
+    _, err := db.DB.Exec("UPDATE users SET suspended_at = NULL, suspension_reason = NULL WHERE id = ?", target.ID)
+    if err != nil {
+        log.Printf("Error reactivating user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reactivating user"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "User reactivated"})
+}
+
+// ForceLogout revokes every token of an account and disconnects it everywhere
+func ForceLogout(c *gin.Context) {
+    target, ok := loadTarget(c)
+    if !ok {
+        return
+    }
+
+    if err := auth.EndSessions(target.ID, target.Username, "logged out by an administrator"); err != nil {
+        log.Printf("Error ending sessions: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error logging out user"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "User logged out everywhere"})
+}
+
+// ForceVerifyEmail marks the email of an account as verified
+func ForceVerifyEmail(c *gin.Context) {
+    target, ok := loadTarget(c)
+    if !ok {
+        return
+    }
+    if target.Verified {
+        c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+        return
+    }
+
+    _, err := db.DB.Exec("UPDATE users SET verified = TRUE WHERE id = ?", target.ID)
+    if err != nil {
+        log.Printf("Error verifying email: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error verifying email"})
+        return
+    }
+
+    // Outstanding verification links are of no use anymore
+    _, err = db.DB.Exec("UPDATE email_tokens SET expires_at = NOW() WHERE user_id = ? AND purpose = 'verify_email' AND used_at IS NULL AND expires_at > NOW()", target.ID)
+    if err != nil {
+        log.Printf("Error expiring verification tokens: %v\n", err)
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// SetUserRole changes the role of an account. Only admins get here.
+func SetUserRole(c *gin.Context) {
+    var request struct {
+        Role string `json:"role" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+    if !auth.ValidRole(request.Role) || request.Role == auth.RoleAdmin {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be user or moderator"})
+        return
+    }
+
+    target, ok := loadTarget(c)
+    if !ok {
+        return
+    }
+
+    _, err := db.DB.Exec("UPDATE users SET role = ? WHERE id = ?", request.Role, target.ID)
+    if err != nil {
+        log.Printf("Error changing role: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing role"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Role updated", "role": request.Role})
+}
+
+// GetUserReports lists the reports filed against a user
+func GetUserReports(c *gin.Context) {
+    target, ok := loadTarget(c)
+    if !ok {
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT r.id, reporter.username, r.reason, COALESCE(r.details, ''), r.status, r.created_at, r.resolved_at
+        FROM reports r
+        JOIN users reporter ON reporter.id = r.reporter_id
+        WHERE r.reported_id = ?
+        ORDER BY r.created_at DESC`, target.ID)
+    if err != nil {
+        log.Printf("Error fetching reports: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching reports"})
+        return
+    }
+    defer rows.Close()
+
+    reports := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var reporter, reason, details, status string
+        var createdAt time.Time
+        var resolvedAt sql.NullTime
+        if err := rows.Scan(&id, &reporter, &reason, &details, &status, &createdAt, &resolvedAt); err != nil {
+            log.Printf("Error scanning report: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching reports"})
+            return
+        }
+
+        report := gin.H{
+            "id":          id,
+            "reporter":    reporter,
+            "reason":      reason,
+            "details":     details,
+            "status":      status,
+            "created_at":  createdAt.Format(time.RFC3339),
+            "resolved_at": nil,
+        }
+        if resolvedAt.Valid {
+            report["resolved_at"] = resolvedAt.Time.Format(time.RFC3339)
+        }
+        reports = append(reports, report)
+    }
+
+    if err := rows.Err(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching reports"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"user_id": target.ID, "username": target.Username, "reports": reports})
+}
@@ -0,0 +1,118 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// SendAnnouncement sends a system announcement to the notifications of every account
+// that is not suspended or being deleted and has not turned announcements off. All
+// copies share an object ID.
+func SendAnnouncement(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var request struct {
+        Title string `json:"title"`
+        Body  string `json:"body" binding:"required"`
+        Link  string `json:"link"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil || strings.TrimSpace(request.Body) == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    payload := map[string]interface{}{
+        "title": strings.TrimSpace(request.Title),
+        "body":  strings.TrimSpace(request.Body),
+        "link":  strings.TrimSpace(request.Link),
+    }
+    encoded, err := json.Marshal(payload)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error sending announcement"})
+        return
+    }
+    announcementID, err := utils.GenerateRandomToken(12)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error sending announcement"})
+        return
+    }
+
+    announcementType := models.SystemAnnouncementNotificationType
+    result, err := db.DB.Exec(`
+        INSERT INTO notifications (user_id, type, message, object_type, object_id, payload)
+        SELECT id, ?, ?, ?, ?, ? FROM users u
+        WHERE suspended_at IS NULL AND deletion_scheduled_for IS NULL
+            AND NOT EXISTS (
+                SELECT 1 FROM notification_preferences p
+                WHERE p.user_id = u.id AND p.type = ? AND p.channel = ? AND p.enabled = FALSE
+            )`,
+        announcementType, notifications.Render(announcementType, "", payload), notifications.Types[announcementType].ObjectType, announcementID, string(encoded),
+        announcementType, notifications.ChannelInApp)
+    if err != nil {
+        log.Printf("Error sending announcement: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error sending announcement"})
+        return
+    }
+    recipients, _ := result.RowsAffected()
+    log.Printf("[ADMIN] %s sent announcement %s to %d users\n", customClaims.Username, announcementID, recipients)
+
+    go pushAnnouncementCounts(announcementID)
+
+    c.JSON(http.StatusCreated, gin.H{"id": announcementID, "recipients": recipients})
+}
+
+// pushAnnouncementCounts sends the new unread notification count to the online users
+// who got an announcement, unless they are in their do-not-disturb hours
+func pushAnnouncementCounts(announcementID string) {
+    rows, err := db.DB.Query(`
+        SELECT u.id, u.username, COUNT(n.id)
+        FROM users u
+        JOIN notifications n ON n.user_id = u.id AND n.is_read = FALSE
+        WHERE u.active = TRUE
+            AND EXISTS (SELECT 1 FROM notifications a WHERE a.user_id = u.id AND a.type = ? AND a.object_id = ?)
+        GROUP BY u.id, u.username`, models.SystemAnnouncementNotificationType, announcementID)
+    if err != nil {
+        log.Printf("Error fetching unread notification counts: %v\n", err)
+        return
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var userID int64
+        var username string
+        var count int
+        if err := rows.Scan(&userID, &username, &count); err != nil {
+            log.Printf("Error scanning unread notification count: %v\n", err)
+            return
+        }
+        if !notifications.DeliveryFor(userID, models.SystemAnnouncementNotificationType).InApp {
+            continue
+        }
+        message, err := json.Marshal(map[string]interface{}{
+            "type":                      string(models.SystemAnnouncementNotificationType),
+            "unread_notification_count": count,
+            "receiver":                  username,
+        })
+        if err != nil {
+            continue
+        }
+        notifications.GlobalNotificationHub.BroadcastNotification(username, message)
+    }
+}
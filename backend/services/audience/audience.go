@@ -0,0 +1,202 @@
+package audience
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// Rules a user can restrict to an audience
+const (
+    // RulePresence decides who sees the user in the active users list
+    RulePresence = "presence"
+    // RuleChat decides who can start a chat with the user
+    RuleChat = "chat"
+    // RuleProfile decides who sees the profile picture and follower counts
+    RuleProfile = "profile"
+)
+
+var validRules = map[string]bool{
+    RulePresence: true,
+    RuleChat:     true,
+    RuleProfile:  true,
+}
+
+// Audiences a rule can be set to. Followers follow the user, following are followed by
+// the user, and a list only counts members the user still follows.
+const (
+    Everyone  = "everyone"
+    Followers = "followers"
+    Following = "following"
+    Mutuals   = "mutuals"
+    List      = "list"
+    Nobody    = "nobody"
+)
+
+var validAudiences = map[string]bool{
+    Everyone:  true,
+    Followers: true,
+    Following: true,
+    Mutuals:   true,
+    List:      true,
+    Nobody:    true,
+}
+
+// Condition is an SQL condition that holds when the viewer is in the audience the
+// owner chose for a rule. ownerID and viewerID are column expressions; a viewer of 0
+// is someone who is not logged in. The rule must be one of the Rule constants.
+func Condition(rule, ownerID, viewerID string) string {
+    follows := func(follower, following string) string {
+        return "EXISTS (SELECT 1 FROM followers af WHERE af.follower_id = " + follower + " AND af.following_id = " + following + ")"
+    }
+    return `(` + ownerID + ` = ` + viewerID + `
+        OR NOT EXISTS (SELECT 1 FROM audience_rules ar WHERE ar.user_id = ` + ownerID + ` AND ar.rule = '` + rule + `')
+        OR EXISTS (SELECT 1 FROM audience_rules ar WHERE ar.user_id = ` + ownerID + ` AND ar.rule = '` + rule + `' AND (
+            ar.audience = 'everyone'
+            OR (ar.audience = 'followers' AND ` + follows(viewerID, ownerID) + `)
+            OR (ar.audience = 'following' AND ` + follows(ownerID, viewerID) + `)
+            OR (ar.audience = 'mutuals' AND ` + follows(viewerID, ownerID) + ` AND ` + follows(ownerID, viewerID) + `)
+            OR (ar.audience = 'list' AND EXISTS (SELECT 1 FROM audience_list_members am
+                WHERE am.list_id = ar.list_id AND am.member_id = ` + viewerID + ` AND ` + follows(ownerID, viewerID) + `)))))`
+}
+
+// Allows reports whether a viewer is in the audience the owner chose for a rule
+func Allows(rule string, ownerID, viewerID int64) (bool, error) {
+    var allowed bool
+    err := db.DB.QueryRow("SELECT "+Condition(rule, "o.id", "v.id")+" FROM users o JOIN (SELECT ? AS id) v WHERE o.id = ?", viewerID, ownerID).Scan(&allowed)
+    return allowed, err
+}
+
+// currentUserID reads the ID of the logged in user, answering the request if that fails
+func currentUserID(c *gin.Context) (int64, bool) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return 0, false
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return 0, false
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        log.Printf("Error retrieving user ID: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return 0, false
+    }
+    return userID, true
+}
+
+// GetAudienceRules returns the audience of every rule of the current user
+func GetAudienceRules(c *gin.Context) {
+    userID, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+
+    rules := gin.H{}
+    for rule := range validRules {
+        rules[rule] = gin.H{"audience": Everyone, "list_id": nil}
+    }
+
+    rows, err := db.DB.Query("SELECT rule, audience, list_id FROM audience_rules WHERE user_id = ?", userID)
+    if err != nil {
+        log.Printf("Error retrieving audience rules: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving audience rules"})
+        return
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var rule, audience string
+        var listID sql.NullInt64
+        if err := rows.Scan(&rule, &audience, &listID); err != nil {
+            log.Printf("Error scanning audience rule: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving audience rules"})
+            return
+        }
+        entry := gin.H{"audience": audience, "list_id": nil}
+        if listID.Valid {
+            entry["list_id"] = listID.Int64
+        }
+        rules[rule] = entry
+    }
+
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through audience rules: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving audience rules"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// SetAudienceRule chooses who a rule applies to. The list audience needs the ID of one
+// of the user's lists.
+func SetAudienceRule(c *gin.Context) {
+    userID, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+
+    rule := c.Param("rule")
+    if !validRules[rule] {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Unknown rule"})
+        return
+    }
+
+    var request struct {
+        Audience string `json:"audience" binding:"required"`
+        ListID   *int64 `json:"list_id"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+    if !validAudiences[request.Audience] {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid audience"})
+        return
+    }
+
+    var listID sql.NullInt64
+    if request.Audience == List {
+        if request.ListID == nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "list_id is required for the list audience"})
+            return
+        }
+        var owned bool
+        err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM audience_lists WHERE id = ? AND user_id = ?)", *request.ListID, userID).Scan(&owned)
+        if err != nil {
+            log.Printf("Error checking list: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating audience rule"})
+            return
+        }
+        if !owned {
+            c.JSON(http.StatusNotFound, gin.H{"error": "List not found"})
+            return
+        }
+        listID = sql.NullInt64{Int64: *request.ListID, Valid: true}
+    }
+
+    _, err := db.DB.Exec(`
+        INSERT INTO audience_rules (user_id, rule, audience, list_id) VALUES (?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE audience = VALUES(audience), list_id = VALUES(list_id)`, userID, rule, request.Audience, listID)
+    if err != nil {
+        log.Printf("Error updating audience rule: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating audience rule"})
+        return
+    }
+
+    response := gin.H{"rule": rule, "audience": request.Audience, "list_id": nil}
+    if listID.Valid {
+        response["list_id"] = listID.Int64
+    }
+    c.JSON(http.StatusOK, response)
+}
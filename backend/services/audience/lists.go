@@ -0,0 +1,339 @@
+package audience
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/vaanskii/vansify/db"
+)
+
+const (
+    maxLists       = 20
+    maxListNameLen = 50
+)
+
+// ownedList reads the list in the path if it belongs to the current user, answering
+// the request otherwise
+func ownedList(c *gin.Context) (userID, listID int64, ok bool) {
+    userID, ok = currentUserID(c)
+    if !ok {
+        return
+    }
+    ok = false
+
+    listID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+        return
+    }
+
+    var owned bool
+    err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM audience_lists WHERE id = ? AND user_id = ?)", listID, userID).Scan(&owned)
+    if err != nil {
+        log.Printf("Error retrieving list: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving list"})
+        return
+    }
+    if !owned {
+        c.JSON(http.StatusNotFound, gin.H{"error": "List not found"})
+        return
+    }
+
+    ok = true
+    return
+}
+
+// validListName trims a list name and reports whether it can be used
+func validListName(name string) (string, bool) {
+    name = strings.TrimSpace(name)
+    return name, name != "" && len(name) <= maxListNameLen
+}
+
+func isDuplicateEntry(err error) bool {
+    mysqlErr, ok := err.(*mysqlDriver.MySQLError)
+    return ok && mysqlErr.Number == 1062
+}
+
+// ListAudienceLists returns the lists of the current user with the number of members
+// they still follow
+func ListAudienceLists(c *gin.Context) {
+    userID, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT l.id, l.name, l.created_at,
+            (SELECT COUNT(*) FROM audience_list_members m
+                JOIN followers f ON f.follower_id = l.user_id AND f.following_id = m.member_id
+                WHERE m.list_id = l.id)
+        FROM audience_lists l
+        WHERE l.user_id = ?
+        ORDER BY l.name`, userID)
+    if err != nil {
+        log.Printf("Error retrieving lists: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving lists"})
+        return
+    }
+    defer rows.Close()
+
+    lists := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var name string
+        var createdAt time.Time
+        var memberCount int
+        if err := rows.Scan(&id, &name, &createdAt, &memberCount); err != nil {
+            log.Printf("Error scanning list: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving lists"})
+            return
+        }
+        lists = append(lists, gin.H{
+            "id":           id,
+            "name":         name,
+            "member_count": memberCount,
+            "created_at":   createdAt.Format("2006-01-02 15:04:05"),
+        })
+    }
+
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through lists: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving lists"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"lists": lists})
+}
+
+// CreateAudienceList creates a named list
+func CreateAudienceList(c *gin.Context) {
+    userID, ok := currentUserID(c)
+    if !ok {
+        return
+    }
+
+    var request struct {
+        Name string `json:"name" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+    name, valid := validListName(request.Name)
+    if !valid {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "List names are 1 to 50 characters"})
+        return
+    }
+
+    var count int
+    if err := db.DB.QueryRow("SELECT COUNT(*) FROM audience_lists WHERE user_id = ?", userID).Scan(&count); err != nil {
+        log.Printf("Error counting lists: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating list"})
+        return
+    }
+    if count >= maxLists {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot have more than " + strconv.Itoa(maxLists) + " lists"})
+        return
+    }
+
+    result, err := db.DB.Exec("INSERT INTO audience_lists (user_id, name) VALUES (?, ?)", userID, name)
+    if isDuplicateEntry(err) {
+        c.JSON(http.StatusConflict, gin.H{"error": "You already have a list with this name"})
+        return
+    } else if err != nil {
+        log.Printf("Error creating list: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating list"})
+        return
+    }
+    listID, _ := result.LastInsertId()
+
+    c.JSON(http.StatusCreated, gin.H{"id": listID, "name": name, "member_count": 0})
+}
+
+// GetAudienceList returns a list with its members. Members the user no longer follows
+// are listed with active set to false, since they are not part of the audience.
+func GetAudienceList(c *gin.Context) {
+    userID, listID, ok := ownedList(c)
+    if !ok {
+        return
+    }
+
+    var name string
+    if err := db.DB.QueryRow("SELECT name FROM audience_lists WHERE id = ?", listID).Scan(&name); err != nil {
+        log.Printf("Error retrieving list: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving list"})
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT u.username, u.profile_picture, m.added_at,
+            EXISTS(SELECT 1 FROM followers f WHERE f.follower_id = ? AND f.following_id = u.id)
+        FROM audience_list_members m
+        JOIN users u ON u.id = m.member_id
+        WHERE m.list_id = ?
+        ORDER BY u.username`, userID, listID)
+    if err != nil {
+        log.Printf("Error retrieving list members: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving list"})
+        return
+    }
+    defer rows.Close()
+
+    members := []gin.H{}
+    for rows.Next() {
+        var username, profilePicture string
+        var addedAt time.Time
+        var active bool
+        if err := rows.Scan(&username, &profilePicture, &addedAt, &active); err != nil {
+            log.Printf("Error scanning list member: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving list"})
+            return
+        }
+        members = append(members, gin.H{
+            "username":        username,
+            "profile_picture": profilePicture,
+            "added_at":        addedAt.Format("2006-01-02 15:04:05"),
+            "active":          active,
+        })
+    }
+
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through list members: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving list"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"id": listID, "name": name, "members": members})
+}
+
+// RenameAudienceList renames a list
+func RenameAudienceList(c *gin.Context) {
+    _, listID, ok := ownedList(c)
+    if !ok {
+        return
+    }
+
+    var request struct {
+        Name string `json:"name" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+    name, valid := validListName(request.Name)
+    if !valid {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "List names are 1 to 50 characters"})
+        return
+    }
+
+    _, err := db.DB.Exec("UPDATE audience_lists SET name = ? WHERE id = ?", name, listID)
+    if isDuplicateEntry(err) {
+        c.JSON(http.StatusConflict, gin.H{"error": "You already have a list with this name"})
+        return
+    } else if err != nil {
+        log.Printf("Error renaming list: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error renaming list"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"id": listID, "name": name})
+}
+
+// DeleteAudienceList deletes a list unless a rule still uses it as its audience
+func DeleteAudienceList(c *gin.Context) {
+    _, listID, ok := ownedList(c)
+    if !ok {
+        return
+    }
+
+    var inUse bool
+    if err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM audience_rules WHERE list_id = ?)", listID).Scan(&inUse); err != nil {
+        log.Printf("Error checking list use: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting list"})
+        return
+    }
+    if inUse {
+        c.JSON(http.StatusConflict, gin.H{"error": "This list is the audience of a setting. Choose another audience first."})
+        return
+    }
+
+    if _, err := db.DB.Exec("DELETE FROM audience_lists WHERE id = ?", listID); err != nil {
+        log.Printf("Error deleting list: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting list"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "List deleted"})
+}
+
+// AddAudienceListMember adds an account the user follows to a list
+func AddAudienceListMember(c *gin.Context) {
+    userID, listID, ok := ownedList(c)
+    if !ok {
+        return
+    }
+
+    var request struct {
+        Username string `json:"username" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    var memberID int64
+    var following bool
+    err := db.DB.QueryRow(`
+        SELECT u.id, EXISTS(SELECT 1 FROM followers f WHERE f.follower_id = ? AND f.following_id = u.id)
+        FROM users u WHERE u.username = ?`, userID, request.Username).Scan(&memberID, &following)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User does not exist"})
+        return
+    } else if err != nil {
+        log.Printf("Error retrieving user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error adding list member"})
+        return
+    }
+    if !following {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "You can only add accounts you follow"})
+        return
+    }
+
+    if _, err := db.DB.Exec("INSERT IGNORE INTO audience_list_members (list_id, member_id) VALUES (?, ?)", listID, memberID); err != nil {
+        log.Printf("Error adding list member: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error adding list member"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Added to list"})
+}
+
+// RemoveAudienceListMember takes an account off a list
+func RemoveAudienceListMember(c *gin.Context) {
+    _, listID, ok := ownedList(c)
+    if !ok {
+        return
+    }
+
+    result, err := db.DB.Exec(`
+        DELETE m FROM audience_list_members m
+        JOIN users u ON u.id = m.member_id
+        WHERE m.list_id = ? AND u.username = ?`, listID, c.Param("username"))
+    if err != nil {
+        log.Printf("Error removing list member: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error removing list member"})
+        return
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "This user is not on the list"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Removed from list"})
+}
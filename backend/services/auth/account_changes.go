@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/services/aws"
+	"github.com/vaanskii/vansify/services/mail"
+	activeUsers "github.com/vaanskii/vansify/services/user"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const (
+    emailTokenChangeEmail = "change_email"
+    changeEmailTokenTTL   = 24 * time.Hour
+
+    defaultUsernameChangeCooldownDays = 30
+    defaultUsernameReservationDays    = 30
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,50}$`)
+
+// envDays reads a number of days from the environment, falling back to a default
+func envDays(name string, fallback int) time.Duration {
+    days, err := strconv.Atoi(os.Getenv(name))
+    if err != nil || days < 0 {
+        days = fallback
+    }
+    return time.Duration(days) * 24 * time.Hour
+}
+
+// usernameChangeCooldown is how long a user has to wait between username changes,
+// USERNAME_CHANGE_COOLDOWN_DAYS or 30 days
+func usernameChangeCooldown() time.Duration {
+    return envDays("USERNAME_CHANGE_COOLDOWN_DAYS", defaultUsernameChangeCooldownDays)
+}
+
+// usernameReservation is how long an old username stays with its previous owner,
+// USERNAME_RESERVATION_DAYS or 30 days. It never ends before the refresh tokens
+// issued for the old name have expired.
+func usernameReservation() time.Duration {
+    reservation := envDays("USERNAME_RESERVATION_DAYS", defaultUsernameReservationDays)
+    if reservation < 7*24*time.Hour {
+        reservation = 7 * 24 * time.Hour
+    }
+    return reservation
+}
+
+// rowQuerier is what usernameTaken needs, satisfied by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+    QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// usernameTaken reports whether a username belongs to another account or is still
+// reserved for someone who gave it up. userID is the account asking, 0 for sign ups.
+func usernameTaken(q rowQuerier, username string, userID int64) (bool, error) {
+    var taken bool
+    err := q.QueryRow(`
+        SELECT EXISTS(SELECT 1 FROM users WHERE username = ? AND id <> ?)
+            OR EXISTS(SELECT 1 FROM username_reservations WHERE username = ? AND user_id <> ? AND reserved_until > NOW())`,
+        username, userID, username, userID).Scan(&taken)
+    return taken, err
+}
+
+// isDuplicateEntry reports whether an insert or update ran into a unique key
+func isDuplicateEntry(err error) bool {
+    mysqlErr, ok := err.(*mysqlDriver.MySQLError)
+    return ok && mysqlErr.Number == 1062
+}
+
+// RequestEmailChange sends a confirmation link to a new address and warns the current one
+func RequestEmailChange(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var request struct {
+        Email       string `json:"email" binding:"required"`
+        Password    string `json:"password"`
+        ReauthToken string `json:"reauth_token"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    newEmail := strings.TrimSpace(request.Email)
+    if address, err := netmail.ParseAddress(newEmail); err != nil || address.Address != newEmail || len(newEmail) > 100 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+        return
+    }
+
+    ok, err := reauthenticated(customClaims.Username, request.Password, request.ReauthToken)
+    if err != nil {
+        log.Printf("Error checking credentials: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing email"})
+        return
+    }
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Please confirm your password or log in with your provider again"})
+        return
+    }
+
+    var dbUser models.User
+    err = db.DB.QueryRow("SELECT id, username, email FROM users WHERE username = ?", customClaims.Username).Scan(&dbUser.ID, &dbUser.Username, &dbUser.Email)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+        return
+    }
+    if strings.EqualFold(newEmail, dbUser.Email) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "This is already your email address"})
+        return
+    }
+
+    var emailTaken bool
+    err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", newEmail).Scan(&emailTaken)
+    if err != nil {
+        log.Printf("Error checking existing email: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing email"})
+        return
+    }
+    if emailTaken {
+        c.JSON(http.StatusConflict, gin.H{"error": "Email already exists. Please use another one."})
+        return
+    }
+
+    _, err = db.DB.Exec("UPDATE users SET pending_email = ? WHERE id = ?", newEmail, dbUser.ID)
+    if err != nil {
+        log.Printf("Error saving pending email: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing email"})
+        return
+    }
+
+    // A new request replaces the link of the previous one
+    token, err := issueEmailToken(dbUser.ID, emailTokenChangeEmail, changeEmailTokenTTL)
+    if err != nil {
+        log.Printf("Error issuing email change token: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing email"})
+        return
+    }
+
+    confirmLink := requestOrigin(c) + "/confirm-email?token=" + url.QueryEscape(token)
+    go func() {
+        body := fmt.Sprintf("Hi %s,<br><br>Please confirm that this is the new email address of your Vansify account: <a href='%s'>Confirm email</a><br><br>The link expires in 24 hours.",
+            dbUser.Username, confirmLink)
+        if err := mail.Send(newEmail, "Confirm your new email address", body); err != nil {
+            log.Println("Error sending email change confirmation:", err)
+        }
+
+        body = fmt.Sprintf("Hi %s,<br><br>Someone asked to change the email address of your Vansify account to %s. Nothing changes until the new address is confirmed.<br><br>If this was not you, change your password right away.",
+            dbUser.Username, newEmail)
+        if err := mail.Send(dbUser.Email, "Your email address is being changed", body); err != nil {
+            log.Println("Error sending email change alert:", err)
+        }
+    }()
+
+    c.JSON(http.StatusOK, gin.H{"message": "Check your new email address to confirm the change.", "pending_email": newEmail})
+}
+
+// ConfirmEmailChange switches to the new address with the link that was sent to it
+func ConfirmEmailChange(c *gin.Context) {
+    userID, err := consumeEmailToken(c.Query("token"), emailTokenChangeEmail)
+    if err != nil {
+        respondEmailTokenError(c, err, "confirmation link")
+        return
+    }
+
+    var username, oldEmail string
+    var pendingEmail sql.NullString
+    err = db.DB.QueryRow("SELECT username, email, pending_email FROM users WHERE id = ?", userID).Scan(&username, &oldEmail, &pendingEmail)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+        return
+    }
+    if !pendingEmail.Valid {
+        c.JSON(http.StatusConflict, gin.H{"error": "There is no email change to confirm"})
+        return
+    }
+
+    // The address is known to work now, so it counts as verified
+    _, err = db.DB.Exec("UPDATE users SET email = pending_email, pending_email = NULL, verified = TRUE WHERE id = ?", userID)
+    if isDuplicateEntry(err) {
+        c.JSON(http.StatusConflict, gin.H{"error": "Email already exists. Please use another one."})
+        return
+    } else if err != nil {
+        log.Printf("Error changing email: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing email"})
+        return
+    }
+
+    go func() {
+        body := fmt.Sprintf("Hi %s,<br><br>The email address of your Vansify account was changed to %s. This address will no longer receive emails about your account.<br><br>If this was not you, contact us right away.",
+            username, pendingEmail.String)
+        if err := mail.Send(oldEmail, "Your email address was changed", body); err != nil {
+            log.Println("Error sending email changed alert:", err)
+        }
+    }()
+
+    c.JSON(http.StatusOK, gin.H{"message": "Your email address was changed.", "email": pendingEmail.String})
+}
+
+// ChangeUsername renames the logged in user. The old name stays reserved for them for a
+// while, and every reference to it, including the folder of their uploads, is renamed.
+func ChangeUsername(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var request struct {
+        Username string `json:"username" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    oldUsername := customClaims.Username
+    newUsername := strings.TrimSpace(request.Username)
+    if !usernamePattern.MatchString(newUsername) {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames are 3 to 50 letters, digits, dots, dashes or underscores"})
+        return
+    }
+    if newUsername == oldUsername {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "This is already your username"})
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing username"})
+        return
+    }
+    defer tx.Rollback()
+
+    var dbUser models.User
+    var role string
+    var cooldownLeft int64
+    err = tx.QueryRow(`
+        SELECT id, email, role, COALESCE(TIMESTAMPDIFF(SECOND, NOW(), DATE_ADD(username_changed_at, INTERVAL ? SECOND)), 0)
+        FROM users WHERE username = ? FOR UPDATE`, int(usernameChangeCooldown().Seconds()), oldUsername).
+        Scan(&dbUser.ID, &dbUser.Email, &role, &cooldownLeft)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+        return
+    }
+    if cooldownLeft > 0 {
+        c.Header("Retry-After", strconv.FormatInt(cooldownLeft, 10))
+        c.JSON(http.StatusTooManyRequests, gin.H{"error": "You changed your username recently. Please try again later."})
+        return
+    }
+
+    taken, err := usernameTaken(tx, newUsername, dbUser.ID)
+    if err != nil {
+        log.Printf("Error checking username: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing username"})
+        return
+    }
+    if taken {
+        c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+        return
+    }
+
+    // Uploads are copied before the rows point at them and the originals are only
+    // deleted after the commit, so a failure never leaves a broken picture behind
+    oldPrefix, newPrefix := "profile/"+oldUsername+"/", "profile/"+newUsername+"/"
+    if err := aws.CopyPrefix(oldPrefix, newPrefix); err != nil {
+        log.Printf("Error copying uploads: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing username"})
+        return
+    }
+
+    // Chats and messages reference the user by ID and need no changes
+    statements := []struct {
+        query string
+        args  []interface{}
+    }{
+        {"UPDATE users SET username = ?, username_changed_at = NOW(), profile_picture = REPLACE(profile_picture, ?, ?) WHERE id = ?",
+            []interface{}{newUsername, "/" + oldPrefix, "/" + newPrefix, dbUser.ID}},
+        {"DELETE FROM username_reservations WHERE username = ? AND user_id = ?", []interface{}{newUsername, dbUser.ID}},
+        {`INSERT INTO username_reservations (username, user_id, reserved_until) VALUES (?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))
+            ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), reserved_until = VALUES(reserved_until)`,
+            []interface{}{oldUsername, dbUser.ID, int(usernameReservation().Seconds())}},
+    }
+    for _, statement := range statements {
+        if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+            if isDuplicateEntry(err) {
+                c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+                return
+            }
+            log.Printf("Error renaming user: %s: %v\n", statement.query, err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing username"})
+            return
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
+        log.Printf("Error renaming user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing username"})
+        return
+    }
+
+    go func() {
+        if err := aws.DeletePrefix(oldPrefix); err != nil {
+            log.Printf("Error deleting old uploads of %s: %v\n", oldUsername, err)
+        }
+    }()
+
+    // Tokens and sockets still carry the old name, so the client starts over with new ones
+    DisconnectEverywhere(oldUsername, "username changed")
+    go activeUsers.FetchActiveUsersAndBroadcast(db.DB)
+
+    accessToken, err := utils.GenerateAccessToken(newUsername, dbUser.Email, role)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating access token"})
+        return
+    }
+    refreshToken, err := utils.GenerateRefreshToken(newUsername, dbUser.Email, role)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating refresh token"})
+        return
+    }
+
+    if _, err := c.Cookie("refresh_token"); err == nil {
+        c.SetCookie("refresh_token", refreshToken, 7*24*3600, "/", "", false, true)
+    }
+
+    go func() {
+        body := fmt.Sprintf("Hi %s,<br><br>Your Vansify username was changed from %s to %s. Your old username stays reserved for you for %d days.<br><br>If this was not you, change your password right away.",
+            newUsername, oldUsername, newUsername, int(usernameReservation().Hours()/24))
+        if err := mail.Send(dbUser.Email, "Your username was changed", body); err != nil {
+            log.Println("Error sending username changed email:", err)
+        }
+    }()
+
+    c.JSON(http.StatusOK, gin.H{
+        "message":       "Your username was changed.",
+        "username":      newUsername,
+        "access_token":  accessToken,
+        "refresh_token": refreshToken,
+    })
+}
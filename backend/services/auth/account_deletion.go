@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/services/mail"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const (
+    emailTokenCancelDeletion = "cancel_deletion"
+
+    defaultDeletionGraceDays = 14
+    reauthTokenTTL           = 5 * time.Minute
+)
+
+// deletionGracePeriod is how long a deleted account can still be restored,
+// ACCOUNT_DELETION_GRACE_DAYS or two weeks
+func deletionGracePeriod() time.Duration {
+    days, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"))
+    if err != nil || days < 0 {
+        days = defaultDeletionGraceDays
+    }
+    return time.Duration(days) * 24 * time.Hour
+}
+
+// cancelDeletionOnLogin reports whether logging in during the grace period restores the
+// account. It does unless ACCOUNT_DELETION_CANCEL_ON_LOGIN is false, in which case only
+// the link from the email does.
+func cancelDeletionOnLogin() bool {
+    return os.Getenv("ACCOUNT_DELETION_CANCEL_ON_LOGIN") != "false"
+}
+
+// BeginReauth sends a logged in OAuth user back to their provider to confirm it is them
+func BeginReauth(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    provider := c.Param("provider")
+    if !enabledProviders[provider] {
+        c.String(http.StatusBadRequest, "You must select a valid provider")
+        return
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    beginOAuth(c, provider, oauthIntentReauth, userID)
+}
+
+// completeReauth hands the frontend a short-lived reauth token if the provider
+// confirmed an identity linked to the user who started the flow
+func completeReauth(c *gin.Context, userID int64, identity oauthIdentity) {
+    redirect := func(query string) {
+        c.Redirect(http.StatusTemporaryRedirect, os.Getenv("FRONTEND_URL")+"/settings/account?"+query)
+    }
+
+    var username, email string
+    err := db.DB.QueryRow(`
+        SELECT u.username, u.email
+        FROM user_identities i
+        JOIN users u ON u.id = i.user_id
+        WHERE i.provider = ? AND i.subject = ? AND u.id = ?`, identity.Provider, identity.Subject, userID).Scan(&username, &email)
+    if err == sql.ErrNoRows {
+        redirect("reauth_error=identity_mismatch&provider=" + url.QueryEscape(identity.Provider))
+        return
+    } else if err != nil {
+        log.Println("Error checking identity:", err)
+        redirect("reauth_error=server_error&provider=" + url.QueryEscape(identity.Provider))
+        return
+    }
+
+    token, err := utils.SignToken(utils.TokenReauth, &utils.CustomClaims{
+        Username: username,
+        Email:    email,
+        RegisteredClaims: jwt.RegisteredClaims{
+            Subject: username,
+        },
+    }, reauthTokenTTL)
+    if err != nil {
+        log.Println("Error generating reauth token:", err)
+        redirect("reauth_error=server_error&provider=" + url.QueryEscape(identity.Provider))
+        return
+    }
+
+    redirect("reauth_token=" + url.QueryEscape(token))
+}
+
+// reauthenticated checks the password or reauth token sent along with a destructive
+// request. Password accounts may use either, OAuth accounts need the reauth token.
+func reauthenticated(username, password, reauthToken string) (bool, error) {
+    if reauthToken != "" {
+        claims, err := utils.ValidateToken(reauthToken, utils.TokenReauth)
+        return err == nil && claims.Username == username, nil
+    }
+
+    var user models.User
+    err := db.DB.QueryRow("SELECT password, oauth_user FROM users WHERE username = ?", username).Scan(&user.Password, &user.OauthUser)
+    if err != nil {
+        return false, err
+    }
+    return !user.OauthUser && password != "" && user.CheckPassword(password), nil
+}
+
+// RequestAccountDeletion schedules the account for deletion after the grace period
+// and logs it out everywhere. The purge itself runs in the background.
+func RequestAccountDeletion(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "No claims found"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+        return
+    }
+
+    var request struct {
+        Password    string `json:"password"`
+        ReauthToken string `json:"reauth_token"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    ok, err := reauthenticated(customClaims.Username, request.Password, request.ReauthToken)
+    if err != nil {
+        log.Printf("Error checking credentials: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting user account"})
+        return
+    }
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Please confirm your password or log in with your provider again"})
+        return
+    }
+
+    var dbUser models.User
+    err = db.DB.QueryRow("SELECT id, username, email FROM users WHERE username = ?", customClaims.Username).Scan(&dbUser.ID, &dbUser.Username, &dbUser.Email)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+        return
+    }
+
+    grace := deletionGracePeriod()
+    result, err := db.DB.Exec(`
+        UPDATE users SET deletion_requested_at = NOW(), deletion_scheduled_for = DATE_ADD(NOW(), INTERVAL ? SECOND)
+        WHERE id = ? AND deletion_requested_at IS NULL`, int(grace.Seconds()), dbUser.ID)
+    if err != nil {
+        log.Printf("Error scheduling account deletion: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting user account"})
+        return
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        c.JSON(http.StatusConflict, gin.H{"error": "Account deletion is already scheduled"})
+        return
+    }
+
+    if err := EndSessions(dbUser.ID, dbUser.Username, "account deleted"); err != nil {
+        log.Printf("Error ending sessions: %v\n", err)
+    }
+    c.SetCookie("refresh_token", "", -1, "/", "", false, true)
+
+    deleteAt := time.Now().Add(grace)
+    origin := requestOrigin(c)
+    go func() {
+        if err := sendDeletionScheduledEmail(origin, dbUser, deleteAt); err != nil {
+            log.Println("Error sending deletion email:", err)
+        }
+    }()
+
+    c.JSON(http.StatusOK, gin.H{
+        "message":      "Your account will be deleted. Check your email if you change your mind.",
+        "delete_after": deleteAt.UTC().Format(time.RFC3339),
+    })
+}
+
+// sendDeletionScheduledEmail confirms the deletion request and offers a way back
+func sendDeletionScheduledEmail(origin string, dbUser models.User, deleteAt time.Time) error {
+    ttl := time.Until(deleteAt)
+    if ttl < time.Hour {
+        ttl = time.Hour
+    }
+    token, err := issueEmailToken(dbUser.ID, emailTokenCancelDeletion, ttl)
+    if err != nil {
+        return err
+    }
+
+    cancelLink := origin + "/cancel-deletion?token=" + url.QueryEscape(token)
+    body := fmt.Sprintf("Hi %s,<br><br>Your Vansify account is scheduled for deletion on %s. After that your messages, chats, followers, notifications and uploads are removed for good.<br><br>Changed your mind? <a href='%s'>Keep my account</a>",
+        dbUser.Username, deleteAt.UTC().Format("January 2, 2006 15:04 MST"), cancelLink)
+    if cancelDeletionOnLogin() {
+        body += "<br><br>Logging in before then also keeps your account."
+    }
+    return mail.Send(dbUser.Email, "Your account will be deleted", body)
+}
+
+// sendDeletionCancelledEmail confirms that the account stays
+func sendDeletionCancelledEmail(dbUser models.User) error {
+    body := fmt.Sprintf("Hi %s,<br><br>The deletion of your Vansify account was cancelled and your account stays as it was. If you did not do this, please change your password.", dbUser.Username)
+    return mail.Send(dbUser.Email, "Your account will not be deleted", body)
+}
+
+// cancelAccountDeletion clears a scheduled deletion. It reports false if none was scheduled.
+func cancelAccountDeletion(dbUser models.User) (bool, error) {
+    result, err := db.DB.Exec("UPDATE users SET deletion_requested_at = NULL, deletion_scheduled_for = NULL WHERE id = ? AND deletion_requested_at IS NOT NULL", dbUser.ID)
+    if err != nil {
+        return false, err
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        return false, nil
+    }
+
+    _, err = db.DB.Exec("UPDATE email_tokens SET expires_at = NOW() WHERE user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > NOW()", dbUser.ID, emailTokenCancelDeletion)
+    if err != nil {
+        log.Println("Error expiring cancel deletion tokens:", err)
+    }
+
+    go func() {
+        if err := sendDeletionCancelledEmail(dbUser); err != nil {
+            log.Println("Error sending deletion cancelled email:", err)
+        }
+    }()
+    return true, nil
+}
+
+// CancelAccountDeletion restores an account scheduled for deletion with the link from the email
+func CancelAccountDeletion(c *gin.Context) {
+    userID, err := consumeEmailToken(c.Query("token"), emailTokenCancelDeletion)
+    if err != nil {
+        respondEmailTokenError(c, err, "link")
+        return
+    }
+
+    var dbUser models.User
+    err = db.DB.QueryRow("SELECT id, username, email FROM users WHERE id = ?", userID).Scan(&dbUser.ID, &dbUser.Username, &dbUser.Email)
+    if err != nil {
+        c.JSON(http.StatusGone, gin.H{"error": "This account has already been deleted"})
+        return
+    }
+
+    cancelled, err := cancelAccountDeletion(dbUser)
+    if err != nil {
+        log.Printf("Error cancelling account deletion: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error cancelling account deletion"})
+        return
+    }
+    if !cancelled {
+        c.JSON(http.StatusOK, gin.H{"message": "Your account is not scheduled for deletion."})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Your account will not be deleted. You can log in again."})
+}
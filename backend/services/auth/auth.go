@@ -4,50 +4,31 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
+	"net/url"
 
 	"github.com/gin-gonic/gin"
-	"github.com/lpernett/godotenv"
 	"github.com/vaanskii/vansify/db"
 	"github.com/vaanskii/vansify/models"
 	"github.com/vaanskii/vansify/services/chat"
+	"github.com/vaanskii/vansify/services/mail"
 	activeUsers "github.com/vaanskii/vansify/services/user"
 
 	"github.com/vaanskii/vansify/utils"
-	"gopkg.in/gomail.v2"
 )
 
-func sendVerificationEmail(c *gin.Context, email string, token string) error {
-    godotenv.Load()
-    m := gomail.NewMessage()
-    m.SetHeader("From", os.Getenv("SMTP_USER"))
-    m.SetHeader("To", email)
-    m.SetHeader("Subject", "Email Verification")
-
+// requestOrigin returns the frontend origin the request was sent from
+func requestOrigin(c *gin.Context) string {
     // Extract the origin from the request
     frontendURL := c.Request.Header.Get("Origin")
     if frontendURL == "" {
         frontendURL = "http://localhost:5173" // Fallback to a default value if origin is not available
     }
+    return frontendURL
+}
 
-    verificationLink := frontendURL + "/verify?token=" + token
-    m.SetBody("text/html", "Please verify your email by clicking this link: <a href='" + verificationLink + "'>Verify Email</a>")
-
-    // Convert SMTP_PORT from string to int
-    port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
-    if err != nil {
-        return err
-    }
-
-    d := gomail.NewDialer(os.Getenv("SMTP_SERVER"), port, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASS"))
-
-    // Send the email
-    if err := d.DialAndSend(m); err != nil {
-        return err
-    }
-
-    return nil
+func sendVerificationEmail(c *gin.Context, email string, token string) error {
+    verificationLink := requestOrigin(c) + "/verify?token=" + url.QueryEscape(token)
+    return mail.Send(email, "Email Verification", "Please verify your email by clicking this link: <a href='" + verificationLink + "'>Verify Email</a>")
 }
 
 // RegisterUser handles user registration
@@ -82,16 +63,15 @@ func RegisterUser(c *gin.Context) {
         user.ProfilePicture = "https://cdn.pixabay.com/photo/2015/10/05/22/37/blank-profile-picture-973460_1280.png"
     }
 
-    // Check if username already exists
-    var existingUsername string
-    err := db.DB.QueryRow("SELECT username FROM users WHERE username = ?", user.Username).Scan(&existingUsername)
-    if err == nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Username already exists. Please choose another one."})
-        return
-    } else if err != sql.ErrNoRows {
+    // Check if username already exists or is reserved for its previous owner
+    taken, err := usernameTaken(db.DB, user.Username, 0)
+    if err != nil {
         // Handle potential database error
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking existing username"})
         return
+    } else if taken {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Username already exists. Please choose another one."})
+        return
     }
 
     // Check if email already exists
@@ -115,15 +95,20 @@ func RegisterUser(c *gin.Context) {
     user.Verified = false
 
     // Save user to the database
-    _, err = db.DB.Exec("INSERT INTO users (username, password, email, profile_picture, verified, oauth_user) VALUES (?, ?, ?, ?, ?, ?)", 
+    result, err := db.DB.Exec("INSERT INTO users (username, password, email, profile_picture, verified, oauth_user) VALUES (?, ?, ?, ?, ?, ?)", 
         user.Username, user.Password, user.Email, user.ProfilePicture, user.Verified, user.OauthUser)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving user to database"})
         return
     }
+    user.ID, _ = result.LastInsertId()
 
     // Generate a verification token
-    token := GenerateVerificationToken(user.Email)
+    token, err := GenerateVerificationToken(user.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating verification token"})
+        return
+    }
 
     // Send verification email
     if err := sendVerificationEmail(c, user.Email, token); err != nil {
@@ -146,37 +131,80 @@ func LoginUser(c *gin.Context) {
         return
     }
 
-    row := db.DB.QueryRow("SELECT id, username, email, password, verified FROM users WHERE username = ?", request.Username)
+    row := db.DB.QueryRow(`
+        SELECT id, username, email, password, verified, COALESCE(TIMESTAMPDIFF(SECOND, NOW(), locked_until), 0)
+        FROM users WHERE username = ?`, request.Username)
     var dbUser models.User
-    if err := row.Scan(&dbUser.ID, &dbUser.Username, &dbUser.Email, &dbUser.Password, &dbUser.Verified); err != nil {
+    var lockedFor int
+    if err := row.Scan(&dbUser.ID, &dbUser.Username, &dbUser.Email, &dbUser.Password, &dbUser.Verified, &lockedFor); err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+        return
+    }
+
+    // A locked account answers like a wrong password, so the lock does not tell anyone
+    // that the username exists. The owner learns about it from the unlock email.
+    if lockedFor > 0 {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
         return
     }
 
     // Check password
     if !dbUser.CheckPassword(request.Password) {
+        recordFailedLogin(c, dbUser)
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
         return
     }
 
+    if _, err := db.DB.Exec("UPDATE users SET failed_login_attempts = 0, locked_until = NULL WHERE id = ?", dbUser.ID); err != nil {
+        log.Println("Error resetting failed login attempts:", err)
+    }
+
     if !dbUser.Verified {
         c.JSON(http.StatusForbidden, gin.H{"error": "Please verify your email before logging in."})
         return
     }
 
+    completeLogin(c, dbUser, request.RememberMe)
+}
+
+// completeLogin issues the access/refresh token pair for an authenticated user,
+// marks them as active and updates message statuses in their chats.
+func completeLogin(c *gin.Context, dbUser models.User, rememberMe bool) {
+    state, err := loadAccountState(dbUser.Username)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user"})
+        return
+    }
+    if state.Suspended {
+        respondSuspended(c, state)
+        return
+    }
+
+    deletionCancelled := false
+    if state.DeletionPending {
+        if !cancelDeletionOnLogin() {
+            c.JSON(http.StatusForbidden, gin.H{"error": "This account is scheduled for deletion. Use the link in the email to keep it."})
+            return
+        }
+        if deletionCancelled, err = cancelAccountDeletion(dbUser); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error cancelling account deletion"})
+            return
+        }
+    }
+
     // Generate tokens
-    accessToken, err := utils.GenerateAccessToken(request.Username, dbUser.Email)
+    accessToken, err := utils.GenerateAccessToken(dbUser.Username, dbUser.Email, state.Role)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating access token"})
         return
     }
-    refreshToken, err := utils.GenerateRefreshToken(request.Username, dbUser.Email)
+    refreshToken, err := utils.GenerateRefreshToken(dbUser.Username, dbUser.Email, state.Role)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating refresh token"})
         return
     }
 
-    if request.RememberMe {
+    if rememberMe {
         c.SetCookie("refresh_token", refreshToken, 7*24*3600, "/", "", false, true)
     }
 
@@ -186,6 +214,8 @@ func LoginUser(c *gin.Context) {
         log.Println("Error updating user active status:", err)
     }
 
+    go recordLoginDevice(dbUser.ID, dbUser.Username, c.Request.UserAgent(), c.ClientIP())
+
     c.JSON(http.StatusOK, gin.H{
         "access_token": accessToken,
         "refresh_token": refreshToken,
@@ -193,7 +223,9 @@ func LoginUser(c *gin.Context) {
         "username": dbUser.Username,
         "email": dbUser.Email,
         "oauth_user": dbUser.OauthUser,
+        "role": state.Role,
         "active": true,
+        "deletion_cancelled": deletionCancelled,
     })
 
     // Trigger status update for messages
@@ -208,7 +240,12 @@ func LoginUser(c *gin.Context) {
         activeUsers.FetchActiveUsersAndBroadcast(db.DB)
 
         // Update message statuses for all chats involving the user
-        rows, err := db.DB.Query("SELECT chat_id, user1, user2 FROM chats WHERE user1 = ? OR user2 = ?", dbUser.Username, dbUser.Username)
+        rows, err := db.DB.Query(`
+            SELECT c.chat_id, u1.username, u2.username
+            FROM chats c
+            JOIN users u1 ON u1.id = c.user1_id
+            JOIN users u2 ON u2.id = c.user2_id
+            WHERE c.user1_id = ? OR c.user2_id = ?`, dbUser.ID, dbUser.ID)
         if err != nil {
             log.Println("Error querying chats for user:", err)
             return
@@ -266,37 +303,3 @@ func LogoutUser(c *gin.Context) {
     go activeUsers.FetchActiveUsersAndBroadcast(db.DB)
 }
 
-
-func DeleteUser(c *gin.Context) {
-    // Retrieve the claims from the context set by the middleware
-    claims, exists := c.Get("claims")
-    if !exists {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "No claims found"})
-        return
-    }
-
-    // Assuming claims is of type *utils.CustomClaims
-    customClaims, ok := claims.(*utils.CustomClaims)
-    if !ok {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
-        return
-    }
-
-    // Get username from claims
-    username := customClaims.Username
-
-    // Delete the user from the database
-    result, err := db.DB.Exec("DELETE FROM users WHERE username = ?", username)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting user account"})
-        return
-    }
-
-    rowsAffected, _ := result.RowsAffected()
-    if rowsAffected == 0 {
-        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-        return
-    }
-
-    c.JSON(http.StatusOK, gin.H{"message": "Account deleted successfully"})
-}
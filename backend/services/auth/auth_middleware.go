@@ -8,7 +8,11 @@ import (
 	"github.com/vaanskii/vansify/utils"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware authenticates the request with an access token or a personal access
+// token. Personal access tokens are only accepted on routes that list scopes, and
+// must hold all of them. Suspended accounts and revoked sessions are rejected, and the
+// role in the claims is replaced with the current one.
+func AuthMiddleware(scopes ...string) gin.HandlerFunc {
     return func(c *gin.Context) {
         var token string
         authHeader := c.GetHeader("Authorization")
@@ -20,23 +24,107 @@ func AuthMiddleware() gin.HandlerFunc {
             token = c.Query("token")
         }
 
+        token = strings.TrimSpace(token)
         if token == "" {
             c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
             return
         }
 
-        parsedToken, err := utils.VerifyJWT(token)
+        if isPersonalToken(token) {
+            if len(scopes) == 0 {
+                c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Personal access tokens cannot be used for this endpoint"})
+                return
+            }
+
+            claims, granted, err := authenticatePersonalToken(token)
+            if err == errPersonalTokenInvalid {
+                c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+                return
+            } else if err != nil {
+                c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Error checking token"})
+                return
+            }
+
+            if !hasScopes(granted, scopes) {
+                c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+                c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token is missing the required scopes", "required_scopes": scopes})
+                return
+            }
+
+            if !checkAccountState(c, claims) {
+                return
+            }
+
+            c.Set("claims", claims)
+            c.Set("scopes", granted)
+            c.Next()
+            return
+        }
+
+        // Only access tokens; refresh, reset and onboarding tokens have other audiences
+        claims, err := utils.ValidateToken(token, utils.TokenAccess)
         if err != nil {
             c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
             return
         }
 
-        claims, ok := parsedToken.Claims.(*utils.CustomClaims)
-        if !ok || !parsedToken.Valid {
-            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+        if !checkAccountState(c, claims) {
+            return
+        }
+
+        c.Set("claims", claims)
+        c.Next()
+    }
+}
+
+// checkAccountState aborts the request if the account is suspended or the token was
+// revoked, and otherwise refreshes the role in the claims
+func checkAccountState(c *gin.Context, claims *utils.CustomClaims) bool {
+    state, err := loadAccountState(claims.Username)
+    if err != nil {
+        c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return false
+    }
+
+    if state.Suspended {
+        respondSuspended(c, state)
+        return false
+    }
+
+    // Personal access tokens are revoked by deleting them
+    if claims.TokenType != personalTokenType && state.tokenRevoked(claims) {
+        c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return false
+    }
+
+    claims.Role = state.Role
+    return true
+}
+
+// OptionalAuthMiddleware sets the claims when the request carries a valid access token
+// and lets it through anonymously otherwise, for routes that show more to logged in users
+func OptionalAuthMiddleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        authHeader := c.GetHeader("Authorization")
+        token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+        if !strings.HasPrefix(authHeader, "Bearer ") || token == "" {
+            c.Next()
+            return
+        }
+
+        claims, err := utils.ValidateToken(token, utils.TokenAccess)
+        if err != nil {
+            c.Next()
+            return
+        }
+
+        state, err := loadAccountState(claims.Username)
+        if err != nil || state.Suspended || state.tokenRevoked(claims) {
+            c.Next()
             return
         }
 
+        claims.Role = state.Role
         c.Set("claims", claims)
         c.Next()
     }
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// Purposes of the single-use tokens that are sent by email
+const (
+    emailTokenVerifyEmail   = "verify_email"
+    emailTokenUnlockAccount = "unlock_account"
+)
+
+var (
+    errEmailTokenInvalid = errors.New("invalid token")
+    errEmailTokenExpired = errors.New("token has expired")
+    errEmailTokenUsed    = errors.New("token has already been used")
+)
+
+// issueEmailToken stores the hash of a new single-use token for the given purpose and
+// returns the raw token. Earlier unused tokens for the same purpose stop being valid.
+func issueEmailToken(userID int64, purpose string, ttl time.Duration) (string, error) {
+    token, err := utils.GenerateRandomToken(32)
+    if err != nil {
+        return "", err
+    }
+
+    _, err = db.DB.Exec("UPDATE email_tokens SET expires_at = NOW() WHERE user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > NOW()", userID, purpose)
+    if err != nil {
+        return "", err
+    }
+
+    _, err = db.DB.Exec("INSERT INTO email_tokens (user_id, purpose, token_hash, expires_at) VALUES (?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))",
+        userID, purpose, utils.HashToken(token), int(ttl.Seconds()))
+    if err != nil {
+        return "", err
+    }
+
+    return token, nil
+}
+
+// consumeEmailToken marks a token as used and returns the ID of the user it was issued to
+func consumeEmailToken(token, purpose string) (int64, error) {
+    var id, userID int64
+    var used, expired bool
+    err := db.DB.QueryRow("SELECT id, user_id, used_at IS NOT NULL, expires_at < NOW() FROM email_tokens WHERE token_hash = ? AND purpose = ?",
+        utils.HashToken(token), purpose).Scan(&id, &userID, &used, &expired)
+    if err == sql.ErrNoRows {
+        return 0, errEmailTokenInvalid
+    } else if err != nil {
+        return 0, err
+    }
+
+    if used {
+        return 0, errEmailTokenUsed
+    }
+    if expired {
+        return 0, errEmailTokenExpired
+    }
+
+    // Only one concurrent request may flip used_at
+    result, err := db.DB.Exec("UPDATE email_tokens SET used_at = NOW() WHERE id = ? AND used_at IS NULL", id)
+    if err != nil {
+        return 0, err
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        return 0, errEmailTokenUsed
+    }
+
+    return userID, nil
+}
+
+// recentEmailTokens reports how many tokens were issued for the purpose during the
+// last day and how many seconds ago the latest of them was created
+func recentEmailTokens(userID int64, purpose string) (int, int, error) {
+    var count int
+    var secondsAgo sql.NullInt64
+    err := db.DB.QueryRow(`
+        SELECT COUNT(*), TIMESTAMPDIFF(SECOND, MAX(created_at), NOW())
+        FROM email_tokens
+        WHERE user_id = ? AND purpose = ? AND created_at > DATE_SUB(NOW(), INTERVAL 1 DAY)`, userID, purpose).Scan(&count, &secondsAgo)
+    if err != nil {
+        return 0, 0, err
+    }
+    return count, int(secondsAgo.Int64), nil
+}
+
+// respondEmailTokenError answers a request whose token could not be consumed. Expired
+// and reused links get distinct status codes so the frontend can offer the next step.
+func respondEmailTokenError(c *gin.Context, err error, link string) {
+    switch err {
+    case errEmailTokenInvalid:
+        c.JSON(http.StatusBadRequest, gin.H{"error": "This " + link + " is invalid"})
+    case errEmailTokenExpired:
+        c.JSON(http.StatusGone, gin.H{"error": "This " + link + " has expired. Please request a new one."})
+    case errEmailTokenUsed:
+        c.JSON(http.StatusConflict, gin.H{"error": "This " + link + " has already been used"})
+    default:
+        log.Printf("Error consuming %s: %v\n", link, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking " + link})
+    }
+}
@@ -1,48 +1,50 @@
 package auth
 
 import (
-	"context"
+	"database/sql"
 	"crypto/rand"
-	"encoding/base64"
 	"encoding/gob"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"net/url"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/sessions"
 	"github.com/lpernett/godotenv"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
-	"github.com/markbates/goth/providers/google"
 	"github.com/vaanskii/vansify/db"
 	"github.com/vaanskii/vansify/models"
 	"github.com/vaanskii/vansify/services/chat"
 	activeUsers "github.com/vaanskii/vansify/services/user"
 	"github.com/vaanskii/vansify/utils"
-	"golang.org/x/oauth2"
 )
 
 const (
-    key    = "RandomString"
     MaxAge = 86400 * 30
     IsProd = false
 )
 
-var tokenStore = struct {
-    sync.Mutex
-    tokens map[string]string
-}{tokens: make(map[string]string)}
+// oauthIdentity is an account a user proved to own at an OAuth provider
+type oauthIdentity struct {
+    Provider string
+    Subject  string
+    Email    string
+    // EmailVerified is set when the provider asserted the user owns Email
+    EmailVerified bool
+}
 
+// UserRequest finishes a sign up through a provider. The email always comes from the
+// identity the signup code is bound to.
 type UserRequest struct {
     Username string `json:"username" binding:"required"`
-    Email    string `json:"email" binding:"required"`
+    Token    string `json:"token" binding:"required"`
 }
 
 type ContextKey string
@@ -51,29 +53,27 @@ func init() {
     gob.Register(time.Time{})
 }
 
-func InitGoogleAuth() {
+// InitOAuthProviders registers every provider listed in OAUTH_PROVIDERS with goth
+func InitOAuthProviders() {
     if err := godotenv.Load(); err != nil {
-        log.Printf("Error loading .env file init google auth: %v", err)
+        log.Printf("Error loading .env file init oauth providers: %v", err)
     }
 
-    googleClientID := os.Getenv("GOOGLE_CLIENT_ID")
-    googleClientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
     backendUrl := os.Getenv("BACKEND_URL")
-
-    if googleClientID == "" || googleClientSecret == "" || backendUrl == "" {
+    if backendUrl == "" {
         log.Fatal("Critical environment variables are missing")
     }
 
-    googleScopes := []string{
-        "openid",
-        "profile",
-        "email",
-        "https://www.googleapis.com/auth/drive.file",
-        "https://www.googleapis.com/auth/drive.readonly",
-        "https://www.googleapis.com/auth/drive",
+    // The session only has to survive the round trip to the provider, but every
+    // instance has to share the key for the callback to reach any of them
+    sessionSecret := []byte(os.Getenv("SESSION_SECRET"))
+    if len(sessionSecret) == 0 {
+        log.Println("SESSION_SECRET is not set, generating a temporary one")
+        sessionSecret = make([]byte, 32)
+        rand.Read(sessionSecret)
     }
 
-    store := sessions.NewCookieStore([]byte(key))
+    store := sessions.NewCookieStore(sessionSecret)
     store.Options = &sessions.Options{
         Path:     "/",
         MaxAge:   MaxAge,
@@ -82,23 +82,38 @@ func InitGoogleAuth() {
     }
     gothic.Store = store
 
-    // Initialize Google provider with updated scopes and access type
-    googleProvider := google.New(googleClientID, googleClientSecret, backendUrl+"/v1/auth/google/callback", googleScopes...)
-    googleProvider.SetAccessType("offline")
-    goth.UseProviders(googleProvider)
+    var providers []goth.Provider
+    for _, name := range configuredProviders() {
+        provider, err := newOAuthProvider(name, backendUrl)
+        if err != nil {
+            log.Fatalf("Error configuring OAuth provider %s: %v", name, err)
+        }
+        providers = append(providers, provider)
+        enabledProviders[name] = true
+    }
+    goth.UseProviders(providers...)
 }
 
 func AuthHandler(c *gin.Context) {
     provider := c.Param("provider")
-    allowedProviders := map[string]bool{
-        "google": true,
-    }
-
-    if !allowedProviders[provider] {
+    if !enabledProviders[provider] {
         c.String(http.StatusBadRequest, "You must select a valid provider")
         return
     }
 
+    beginOAuth(c, provider, oauthIntentLogin, 0)
+}
+
+// What the callback does with the identity once the provider confirmed it
+const (
+    oauthIntentLogin  = ""
+    oauthIntentLink   = "link"
+    oauthIntentReauth = "reauth"
+)
+
+// beginOAuth redirects to the provider. Linking and re-authentication are started by a
+// logged in user, whose ID the callback receives along with the intent.
+func beginOAuth(c *gin.Context, provider, intent string, userID int64) {
     c.Request.URL.RawQuery = "provider=" + provider
     session, err := gothic.Store.Get(c.Request, "gothic-session")
     if err != nil {
@@ -107,6 +122,13 @@ func AuthHandler(c *gin.Context) {
     }
 
     session.Values["provider"] = provider
+    if intent != oauthIntentLogin {
+        session.Values["intent"] = intent
+        session.Values["intent_user_id"] = userID
+    } else {
+        delete(session.Values, "intent")
+        delete(session.Values, "intent_user_id")
+    }
     if err := session.Save(c.Request, c.Writer); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
         return
@@ -118,31 +140,37 @@ func AuthHandler(c *gin.Context) {
         return
     }
 
-    url += "&prompt=select_account"
+    if provider == "google" {
+        url += "&prompt=select_account"
+    }
     http.Redirect(c.Writer, c.Request, url, http.StatusTemporaryRedirect)
 }
 
 
-func GenerateShortToken() string {
-    b := make([]byte, 12)
-    rand.Read(b)
-    return base64.RawURLEncoding.EncodeToString(b)[:16]
-}
-
 func AuthCallback(c *gin.Context) {
     provider := c.Param("provider")
-    type contextKey string
-    const providerKey contextKey = "provider"
-    ctx := context.WithValue(c.Request.Context(), providerKey, provider)
-    c.Request = c.Request.WithContext(ctx)
+    if !enabledProviders[provider] {
+        c.String(http.StatusBadRequest, "You must select a valid provider")
+        return
+    }
+    c.Request.URL.RawQuery = c.Request.URL.RawQuery + "&provider=" + url.QueryEscape(provider)
 
-    _, err := gothic.Store.Get(c.Request, "gothic-session")
+    session, err := gothic.Store.Get(c.Request, "gothic-session")
     if err != nil {
         log.Println("Error retrieving session in AuthCallback:", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve session"})
         return
     }
 
+    // A logged in user who started the flow through /link or /reauth
+    intent, _ := session.Values["intent"].(string)
+    intentUserID, _ := session.Values["intent_user_id"].(int64)
+    if intent != oauthIntentLogin {
+        delete(session.Values, "intent")
+        delete(session.Values, "intent_user_id")
+        session.Save(c.Request, c.Writer)
+    }
+
     user, err := gothic.CompleteUserAuth(c.Writer, c.Request)
     if err != nil {
         log.Println("Error completing user auth:", err)
@@ -150,100 +178,166 @@ func AuthCallback(c *gin.Context) {
         return
     }
 
-    token := &oauth2.Token{
-        AccessToken:  user.AccessToken,
-        RefreshToken: user.RefreshToken,
-        Expiry:       user.ExpiresAt,
-    }
+    identity := oauthIdentity{Provider: provider, Subject: user.UserID, Email: user.Email, EmailVerified: providerEmailVerified(provider, user)}
+    frontendUrl := os.Getenv("FRONTEND_URL")
 
-    saveToken("token.json", token)
+    switch intent {
+    case oauthIntentLink:
+        linkIdentity(c, intentUserID, identity)
+        return
+    case oauthIntentReauth:
+        completeReauth(c, intentUserID, identity)
+        return
+    }
 
-    var existingUser models.User
-    err = db.DB.QueryRow("SELECT id, username, password, email, oauth_user, active FROM users WHERE email = ?", user.Email).Scan(
-        &existingUser.ID, &existingUser.Username, &existingUser.Password, &existingUser.Email, &existingUser.OauthUser, &existingUser.Active,
-    )
+    existingUser, err := findUserByIdentity(identity)
+    if err == sql.ErrNoRows {
+        existingUser, err = adoptLegacyOAuthUser(identity)
+    }
     if err == nil {
         log.Println("User already exists:", existingUser.Email)
+        completeOAuthLogin(c, existingUser, provider)
+        return
+    } else if err != sql.ErrNoRows {
+        log.Println("Error looking up identity:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error looking up user"})
+        return
+    }
 
-        // Generate tokens for existing user
-        accessToken, err := utils.GenerateAccessToken(existingUser.Username, existingUser.Email)
-        if err != nil {
-            log.Println("Error generating access token:", err)
-            c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error generating access token: %v", err)})
-            return
-        }
+    // Identities are never matched by email. The owner of an existing account has
+    // to log in first and link the provider from their settings.
+    var emailTaken bool
+    err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", user.Email).Scan(&emailTaken)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error looking up user"})
+        return
+    }
+    if emailTaken {
+        redirectURL := fmt.Sprintf("%s/login?error=account_exists&provider=%s", frontendUrl, url.QueryEscape(provider))
+        c.Redirect(http.StatusTemporaryRedirect, redirectURL)
+        return
+    }
 
-        refreshToken, err := utils.GenerateRefreshToken(existingUser.Username, existingUser.Email)
-        if err != nil {
-            log.Println("Error generating refresh token:", err)
-            c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error generating refresh token: %v", err)})
-            return
-        }
+    // The account needs an email, and some providers let users keep theirs private
+    if identity.Email == "" {
+        redirectURL := fmt.Sprintf("%s/login?error=email_required&provider=%s", frontendUrl, url.QueryEscape(provider))
+        c.Redirect(http.StatusTemporaryRedirect, redirectURL)
+        return
+    }
 
-        frontendUrl := os.Getenv("FRONTEND_URL")
-        redirectURL := fmt.Sprintf("%s/auth/google/callback?username=%s&access_token=%s&refresh_token=%s&id=%d&oauth_user=%t&active=%t",
-            frontendUrl, url.QueryEscape(existingUser.Username), url.QueryEscape(accessToken), url.QueryEscape(refreshToken), existingUser.ID, existingUser.OauthUser, existingUser.Active)
+    tx, err := db.DB.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting sign up"})
+        return
+    }
+    defer tx.Rollback()
 
-        c.Redirect(http.StatusTemporaryRedirect, redirectURL)
+    code, err := issueOnboardingCode(tx, identity, onboardingStageCallback, onboardingCallbackTTL)
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        log.Println("Error issuing onboarding code:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting sign up"})
+        return
+    }
 
-        // Reintegrating active status update
-        go func() {
-            _, err := db.DB.Exec("UPDATE users SET active = true, last_active = NULL WHERE email = ?", user.Email)
-            if err != nil {
-                log.Println("Error updating user active status:", err)
-                return
-            }
+    // Redirect with the code
+    redirectURL := fmt.Sprintf("%s/authset?token=%s", frontendUrl, url.QueryEscape(code))
+    c.Redirect(http.StatusTemporaryRedirect, redirectURL)
+}
 
-            // Fetch active users and broadcast
-            activeUsers.FetchActiveUsersAndBroadcast(db.DB)
+// completeOAuthLogin issues tokens for a user who logged in through a provider
+// and hands them to the frontend
+func completeOAuthLogin(c *gin.Context, existingUser models.User, provider string) {
+    frontendUrl := os.Getenv("FRONTEND_URL")
 
-            // Update message statuses for all chats involving the user
-            rows, err := db.DB.Query("SELECT chat_id, user1, user2 FROM chats WHERE user1 = ? OR user2 = ?", existingUser.Username, existingUser.Username)
-            if err != nil {
-                log.Println("Error querying chats for user:", err)
-                return
-            }
-            defer rows.Close()
-
-            for rows.Next() {
-                var chatID, user1, user2 string
-                if err := rows.Scan(&chatID, &user1, &user2); err != nil {
-                    log.Println("Error scanning chat ID:", err)
-                    continue
-                }
-
-                var otherUser string
-                if existingUser.Username == user1 {
-                    otherUser = user2
-                } else {
-                    otherUser = user1
-                }
-
-                go chat.UpdateStatusWhenUserBecomesActive(chatID, existingUser.Username, otherUser)
-            }
-        }()
+    state, err := loadAccountState(existingUser.Username)
+    if err != nil {
+        log.Println("Error retrieving account state:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user"})
+        return
+    }
+    if state.Suspended {
+        redirectURL := fmt.Sprintf("%s/login?error=account_suspended&provider=%s", frontendUrl, url.QueryEscape(provider))
+        c.Redirect(http.StatusTemporaryRedirect, redirectURL)
         return
     }
+    if state.DeletionPending {
+        if !cancelDeletionOnLogin() {
+            redirectURL := fmt.Sprintf("%s/login?error=account_pending_deletion&provider=%s", frontendUrl, url.QueryEscape(provider))
+            c.Redirect(http.StatusTemporaryRedirect, redirectURL)
+            return
+        }
+        if _, err := cancelAccountDeletion(existingUser); err != nil {
+            log.Println("Error cancelling account deletion:", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error cancelling account deletion"})
+            return
+        }
+    }
 
-    shortToken := GenerateShortToken()
+    // Generate tokens for existing user
+    accessToken, err := utils.GenerateAccessToken(existingUser.Username, existingUser.Email, state.Role)
+    if err != nil {
+        log.Println("Error generating access token:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error generating access token: %v", err)})
+        return
+    }
 
-    tokenStore.Lock()
-    tokenStore.tokens[shortToken] = user.Email 
-    tokenStore.Unlock()
+    refreshToken, err := utils.GenerateRefreshToken(existingUser.Username, existingUser.Email, state.Role)
+    if err != nil {
+        log.Println("Error generating refresh token:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error generating refresh token: %v", err)})
+        return
+    }
 
-    go func(token string) {
-        time.Sleep(10 * time.Minute)
-        tokenStore.Lock()
-        delete(tokenStore.tokens, token)
-        tokenStore.Unlock()
-    }(shortToken)
+    redirectURL := fmt.Sprintf("%s/auth/%s/callback?username=%s&access_token=%s&refresh_token=%s&id=%d&oauth_user=%t&active=%t",
+        frontendUrl, url.PathEscape(provider), url.QueryEscape(existingUser.Username), url.QueryEscape(accessToken), url.QueryEscape(refreshToken), existingUser.ID, existingUser.OauthUser, existingUser.Active)
 
-    // Redirect with the token
-    frontendUrl := os.Getenv("FRONTEND_URL")
-    redirectURL := fmt.Sprintf("%s/authset?token=%s", frontendUrl, url.QueryEscape(shortToken))
     c.Redirect(http.StatusTemporaryRedirect, redirectURL)
-}
 
+    // Reintegrating active status update
+    go func() {
+        _, err := db.DB.Exec("UPDATE users SET active = true, last_active = NULL WHERE id = ?", existingUser.ID)
+        if err != nil {
+            log.Println("Error updating user active status:", err)
+            return
+        }
+
+        // Fetch active users and broadcast
+        activeUsers.FetchActiveUsersAndBroadcast(db.DB)
+
+        // Update message statuses for all chats involving the user
+        rows, err := db.DB.Query(`
+            SELECT c.chat_id, u1.username, u2.username
+            FROM chats c
+            JOIN users u1 ON u1.id = c.user1_id
+            JOIN users u2 ON u2.id = c.user2_id
+            WHERE c.user1_id = ? OR c.user2_id = ?`, existingUser.ID, existingUser.ID)
+        if err != nil {
+            log.Println("Error querying chats for user:", err)
+            return
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+            var chatID, user1, user2 string
+            if err := rows.Scan(&chatID, &user1, &user2); err != nil {
+                log.Println("Error scanning chat ID:", err)
+                continue
+            }
+
+            var otherUser string
+            if existingUser.Username == user1 {
+                otherUser = user2
+            } else {
+                otherUser = user1
+            }
+
+            go chat.UpdateStatusWhenUserBecomesActive(chatID, existingUser.Username, otherUser)
+        }
+    }()
+}
 
 func ValidateOauthToken(c *gin.Context) {
     var request struct {
@@ -254,16 +348,45 @@ func ValidateOauthToken(c *gin.Context) {
         return
     }
 
-    tokenStore.Lock()
-    email, exists := tokenStore.tokens[request.Token]
-    tokenStore.Unlock()
+    tx, err := db.DB.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking sign-up link"})
+        return
+    }
+    defer tx.Rollback()
+
+    // The code from the URL is exchanged for one that never shows up in history or logs
+    identity, err := consumeOnboardingCode(tx, request.Token, onboardingStageCallback)
+    if err != nil {
+        respondEmailTokenError(c, err, "sign-up link")
+        return
+    }
+
+    signupCode, err := issueOnboardingCode(tx, identity, onboardingStageSignup, onboardingSignupTTL)
+    if err != nil {
+        log.Println("Error issuing onboarding code:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking sign-up link"})
+        return
+    }
 
-    if !exists {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+    // The signup code rides in an onboarding token, which no other endpoint accepts
+    onboardingToken, err := utils.SignToken(utils.TokenOnboarding, &utils.CustomClaims{
+        Email: identity.Email,
+        RegisteredClaims: jwt.RegisteredClaims{
+            Subject: identity.Provider + ":" + identity.Subject,
+            ID:      signupCode,
+        },
+    }, onboardingSignupTTL)
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        log.Println("Error issuing onboarding token:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking sign-up link"})
         return
     }
 
-    c.JSON(http.StatusOK, gin.H{"email": email}) 
+    c.JSON(http.StatusOK, gin.H{"email": identity.Email, "provider": identity.Provider, "token": onboardingToken})
 }
 
 
@@ -274,20 +397,58 @@ func CreateUserWithUsername(c *gin.Context) {
         return
     }
 
-    var existingUsername string
-    err := db.DB.QueryRow("SELECT username FROM users WHERE username = ?", userReq.Username).Scan(&existingUsername)
-    if err == nil {
+    claims, err := utils.ValidateToken(userReq.Token, utils.TokenOnboarding)
+    if errors.Is(err, jwt.ErrTokenExpired) {
+        respondEmailTokenError(c, errEmailTokenExpired, "sign-up session")
+        return
+    } else if err != nil {
+        respondEmailTokenError(c, errEmailTokenInvalid, "sign-up session")
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+        return
+    }
+    defer tx.Rollback()
+
+    // Returning early rolls back, so a taken username does not burn the code
+    identity, err := consumeOnboardingCode(tx, claims.ID, onboardingStageSignup)
+    if err != nil {
+        respondEmailTokenError(c, err, "sign-up session")
+        return
+    }
+
+    taken, err := usernameTaken(tx, userReq.Username, 0)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+        return
+    } else if taken {
         c.JSON(http.StatusBadRequest, gin.H{"error": "Username already taken"})
         return
     }
 
+    // Someone may have registered the address or linked the identity since the callback
+    var emailTaken, identityLinked bool
+    err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?), EXISTS(SELECT 1 FROM user_identities WHERE provider = ? AND subject = ?)",
+        identity.Email, identity.Provider, identity.Subject).Scan(&emailTaken, &identityLinked)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+        return
+    }
+    if emailTaken || identityLinked {
+        c.JSON(http.StatusConflict, gin.H{"error": "An account already exists for this login. Please log in instead."})
+        return
+    }
+
     password := generatePassword()
 
     newUser := models.User{
         Username:       userReq.Username,
         Password:       password,
-        Email:          userReq.Email,
-        Verified:        true,
+        Email:          identity.Email,
+        Verified:       identity.EmailVerified,
         OauthUser:      true,
         Active:         true,
     }
@@ -298,7 +459,7 @@ func CreateUserWithUsername(c *gin.Context) {
         return
     }
 
-    result, err := db.DB.Exec("INSERT INTO users (username, password, email, verified, oauth_user) VALUES (?, ?, ?, ?, ?)", newUser.Username, newUser.Password, newUser.Email, newUser.Verified, newUser.OauthUser)
+    result, err := tx.Exec("INSERT INTO users (username, password, email, verified, oauth_user) VALUES (?, ?, ?, ?, ?)", newUser.Username, newUser.Password, newUser.Email, newUser.Verified, newUser.OauthUser)
     if err != nil {
         log.Println("Database error:", err)
         c.String(http.StatusInternalServerError, fmt.Sprintf("Database error: %v", err))
@@ -307,13 +468,39 @@ func CreateUserWithUsername(c *gin.Context) {
 
     userID, _ := result.LastInsertId()
 
-    accessToken, err := utils.GenerateAccessToken(newUser.Username, newUser.Email)
+    // Remember the provider identity so the next login finds this account
+    _, err = tx.Exec("INSERT INTO user_identities (user_id, provider, subject, email, last_login_at) VALUES (?, ?, ?, ?, NOW())",
+        userID, identity.Provider, identity.Subject, identity.Email)
+    if err != nil {
+        log.Println("Error saving user identity:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        log.Println("Error creating user:", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+        return
+    }
+
+    // An address the provider did not vouch for is verified like any other
+    if !newUser.Verified {
+        token, err := GenerateVerificationToken(userID)
+        if err == nil {
+            err = sendVerificationEmail(c, newUser.Email, token)
+        }
+        if err != nil {
+            log.Println("Error sending verification email:", err)
+        }
+    }
+
+    accessToken, err := utils.GenerateAccessToken(newUser.Username, newUser.Email, RoleUser)
     if err != nil {
         c.String(http.StatusInternalServerError, fmt.Sprintf("Error generating access token: %v", err))
         return
     }
 
-    refreshToken, err := utils.GenerateRefreshToken(newUser.Username, newUser.Email)
+    refreshToken, err := utils.GenerateRefreshToken(newUser.Username, newUser.Email, RoleUser)
     if err != nil {
         c.String(http.StatusInternalServerError, fmt.Sprintf("Error generating refresh token: %v", err))
         return
@@ -329,6 +516,7 @@ func CreateUserWithUsername(c *gin.Context) {
         "email":         newUser.Email,
         "id":            userID,
         "oauth_user":    newUser.OauthUser,
+        "verified":      newUser.Verified,
     })
 }
 
@@ -350,14 +538,3 @@ func generatePassword() string {
     return string(password)
 }
 
-
-func saveToken(path string, token *oauth2.Token) {
-    fmt.Printf("Saving credential file to: %s\n", path)
-    f, err := os.Create(path)
-    if err != nil {
-        log.Fatalf("Unable to save oauth token: %v", err)
-    }
-    defer f.Close()
-
-    json.NewEncoder(f).Encode(token)
-}
\ No newline at end of file
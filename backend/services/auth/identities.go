@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// findUserByIdentity returns the user an identity is linked to
+func findUserByIdentity(identity oauthIdentity) (models.User, error) {
+    var user models.User
+    err := db.DB.QueryRow(`
+        SELECT u.id, u.username, u.email, u.oauth_user, u.active
+        FROM user_identities i
+        JOIN users u ON u.id = i.user_id
+        WHERE i.provider = ? AND i.subject = ?`, identity.Provider, identity.Subject).
+        Scan(&user.ID, &user.Username, &user.Email, &user.OauthUser, &user.Active)
+    if err != nil {
+        return user, err
+    }
+
+    _, err = db.DB.Exec("UPDATE user_identities SET last_login_at = NOW() WHERE provider = ? AND subject = ?", identity.Provider, identity.Subject)
+    if err != nil {
+        log.Println("Error updating identity last login:", err)
+    }
+
+    return user, nil
+}
+
+// adoptLegacyOAuthUser links a Google identity to an account created through Google
+// before identities were stored. Such accounts have no identities yet and were
+// matched by email, so this is the only place where the email is trusted.
+func adoptLegacyOAuthUser(identity oauthIdentity) (models.User, error) {
+    var user models.User
+    if identity.Provider != "google" || identity.Email == "" || !identity.EmailVerified {
+        return user, sql.ErrNoRows
+    }
+
+    err := db.DB.QueryRow(`
+        SELECT u.id, u.username, u.email, u.oauth_user, u.active
+        FROM users u
+        WHERE u.email = ? AND u.oauth_user = TRUE
+        AND NOT EXISTS (SELECT 1 FROM user_identities i WHERE i.user_id = u.id)`, identity.Email).
+        Scan(&user.ID, &user.Username, &user.Email, &user.OauthUser, &user.Active)
+    if err != nil {
+        return user, err
+    }
+
+    _, err = db.DB.Exec("INSERT INTO user_identities (user_id, provider, subject, email, last_login_at) VALUES (?, ?, ?, ?, NOW())",
+        user.ID, identity.Provider, identity.Subject, identity.Email)
+    if err != nil {
+        return user, err
+    }
+
+    return user, nil
+}
+
+// linkIdentity attaches an identity to a logged in user and sends them back to the frontend
+func linkIdentity(c *gin.Context, userID int64, identity oauthIdentity) {
+    redirect := func(query string) {
+        c.Redirect(http.StatusTemporaryRedirect, os.Getenv("FRONTEND_URL")+"/settings/connections?"+query)
+    }
+
+    var ownerID int64
+    err := db.DB.QueryRow("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", identity.Provider, identity.Subject).Scan(&ownerID)
+    if err == nil {
+        if ownerID == userID {
+            redirect("linked=" + url.QueryEscape(identity.Provider))
+        } else {
+            redirect("link_error=identity_in_use&provider=" + url.QueryEscape(identity.Provider))
+        }
+        return
+    } else if err != sql.ErrNoRows {
+        log.Println("Error checking identity:", err)
+        redirect("link_error=server_error&provider=" + url.QueryEscape(identity.Provider))
+        return
+    }
+
+    var providerLinked bool
+    err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM user_identities WHERE user_id = ? AND provider = ?)", userID, identity.Provider).Scan(&providerLinked)
+    if err != nil {
+        log.Println("Error checking identity:", err)
+        redirect("link_error=server_error&provider=" + url.QueryEscape(identity.Provider))
+        return
+    }
+    if providerLinked {
+        redirect("link_error=provider_already_linked&provider=" + url.QueryEscape(identity.Provider))
+        return
+    }
+
+    _, err = db.DB.Exec("INSERT INTO user_identities (user_id, provider, subject, email) VALUES (?, ?, ?, ?)",
+        userID, identity.Provider, identity.Subject, identity.Email)
+    if err != nil {
+        log.Println("Error linking identity:", err)
+        redirect("link_error=server_error&provider=" + url.QueryEscape(identity.Provider))
+        return
+    }
+
+    redirect("linked=" + url.QueryEscape(identity.Provider))
+}
+
+// LinkProvider starts the OAuth flow that links a provider to the logged in user
+func LinkProvider(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    provider := c.Param("provider")
+    if !enabledProviders[provider] {
+        c.String(http.StatusBadRequest, "You must select a valid provider")
+        return
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    beginOAuth(c, provider, oauthIntentLink, userID)
+}
+
+// GetIdentities lists the providers linked to the logged in user
+func GetIdentities(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT i.provider, COALESCE(i.email, ''), i.created_at, i.last_login_at
+        FROM user_identities i
+        JOIN users u ON u.id = i.user_id
+        WHERE u.username = ?
+        ORDER BY i.created_at`, customClaims.Username)
+    if err != nil {
+        log.Printf("Error fetching identities: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching identities"})
+        return
+    }
+    defer rows.Close()
+
+    identities := []gin.H{}
+    for rows.Next() {
+        var provider, email string
+        var createdAt time.Time
+        var lastLoginAt sql.NullTime
+        if err := rows.Scan(&provider, &email, &createdAt, &lastLoginAt); err != nil {
+            log.Printf("Error scanning identity: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching identities"})
+            return
+        }
+
+        identity := gin.H{
+            "provider":      provider,
+            "email":         email,
+            "created_at":    createdAt.Format(time.RFC3339),
+            "last_login_at": nil,
+        }
+        if lastLoginAt.Valid {
+            identity["last_login_at"] = lastLoginAt.Time.Format(time.RFC3339)
+        }
+        identities = append(identities, identity)
+    }
+
+    if err := rows.Err(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching identities"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"identities": identities, "available_providers": configuredProviders()})
+}
+
+// UnlinkIdentity removes a linked provider from the logged in user
+func UnlinkIdentity(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    provider := c.Param("provider")
+
+    var userID int64
+    var oauthUser bool
+    var identityCount, passkeyCount int
+    err := db.DB.QueryRow(`
+        SELECT u.id, u.oauth_user,
+            (SELECT COUNT(*) FROM user_identities WHERE user_id = u.id),
+            (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = u.id)
+        FROM users u WHERE u.username = ?`, customClaims.Username).Scan(&userID, &oauthUser, &identityCount, &passkeyCount)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user"})
+        return
+    }
+
+    // Accounts created through a provider have a random password nobody knows
+    if oauthUser && identityCount <= 1 && passkeyCount == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Add another way to log in before unlinking your last provider"})
+        return
+    }
+
+    result, err := db.DB.Exec("DELETE FROM user_identities WHERE user_id = ? AND provider = ?", userID, provider)
+    if err != nil {
+        log.Printf("Error unlinking identity: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unlinking provider"})
+        return
+    }
+
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s is not linked to your account", provider)})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Provider unlinked"})
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/services/mail"
+)
+
+const (
+    lockoutThreshold    = 5
+    lockoutBaseDuration = time.Minute
+    lockoutMaxDuration  = 24 * time.Hour
+    unlockTokenTTL      = 24 * time.Hour
+)
+
+// lockoutDuration returns how long an account stays locked after the given number of
+// consecutive failed login attempts. Every further failure doubles the duration.
+func lockoutDuration(attempts int) time.Duration {
+    if attempts < lockoutThreshold {
+        return 0
+    }
+
+    duration := lockoutBaseDuration
+    for i := lockoutThreshold; i < attempts && duration < lockoutMaxDuration; i++ {
+        duration *= 2
+    }
+    if duration > lockoutMaxDuration {
+        duration = lockoutMaxDuration
+    }
+    return duration
+}
+
+// recordFailedLogin counts a failed password attempt and locks the account once
+// the threshold is reached. The first lock of a streak sends an unlock email.
+func recordFailedLogin(c *gin.Context, dbUser models.User) {
+    _, err := db.DB.Exec("UPDATE users SET failed_login_attempts = failed_login_attempts + 1 WHERE id = ?", dbUser.ID)
+    if err != nil {
+        log.Println("Error recording failed login attempt:", err)
+        return
+    }
+
+    var attempts int
+    if err := db.DB.QueryRow("SELECT failed_login_attempts FROM users WHERE id = ?", dbUser.ID).Scan(&attempts); err != nil {
+        log.Println("Error reading failed login attempts:", err)
+        return
+    }
+
+    duration := lockoutDuration(attempts)
+    if duration == 0 {
+        return
+    }
+
+    _, err = db.DB.Exec("UPDATE users SET locked_until = DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE id = ?", int(duration.Seconds()), dbUser.ID)
+    if err != nil {
+        log.Println("Error locking account:", err)
+        return
+    }
+
+    if attempts == lockoutThreshold {
+        origin := requestOrigin(c)
+        go func() {
+            if err := sendUnlockEmail(origin, dbUser, duration); err != nil {
+                log.Println("Error sending unlock email:", err)
+            }
+        }()
+    }
+}
+
+// sendUnlockEmail tells the owner about the lock and when it runs out, and lets them
+// unlock the account. Login answers do not reveal the lock, so this is where they learn of it.
+func sendUnlockEmail(origin string, dbUser models.User, duration time.Duration) error {
+    token, err := issueEmailToken(dbUser.ID, emailTokenUnlockAccount, unlockTokenTTL)
+    if err != nil {
+        return err
+    }
+
+    unlockLink := origin + "/unlock-account?token=" + url.QueryEscape(token)
+    lockedUntil := time.Now().Add(duration).UTC().Format("January 2, 2006 15:04 MST")
+    return mail.Send(dbUser.Email, "Your account has been locked",
+        "We locked your account after several failed login attempts. Logging in with your password will not work until " + lockedUntil + ". Attempts made while it is locked are not counted, but the next failed attempt after the lock ends locks it again for twice as long. " +
+        "If this was you, you can unlock it right away by clicking this link: <a href='" + unlockLink + "'>Unlock account</a>. " +
+        "If it wasn't you, consider changing your password.")
+}
+
+// UnlockAccount lifts a lockout using the link from the unlock email
+func UnlockAccount(c *gin.Context) {
+    userID, err := consumeEmailToken(c.Query("token"), emailTokenUnlockAccount)
+    if err != nil {
+        respondEmailTokenError(c, err, "unlock link")
+        return
+    }
+
+    _, err = db.DB.Exec("UPDATE users SET failed_login_attempts = 0, locked_until = NULL WHERE id = ?", userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unlocking account"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Account unlocked. You can now log in."})
+}
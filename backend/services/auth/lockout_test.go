@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+    for _, test := range []struct {
+        attempts int
+        want     time.Duration
+    }{
+        {0, 0},
+        {1, 0},
+        {lockoutThreshold - 1, 0},
+        {lockoutThreshold, time.Minute},
+        {lockoutThreshold + 1, 2 * time.Minute},
+        {lockoutThreshold + 2, 4 * time.Minute},
+        {lockoutThreshold + 3, 8 * time.Minute},
+        {lockoutThreshold + 10, 1024 * time.Minute},
+        // 2048 minutes is past the cap
+        {lockoutThreshold + 11, 24 * time.Hour},
+        {lockoutThreshold + 12, 24 * time.Hour},
+        {1000, 24 * time.Hour},
+    } {
+        if got := lockoutDuration(test.attempts); got != test.want {
+            t.Errorf("lockoutDuration(%d) = %v, want %v", test.attempts, got, test.want)
+        }
+    }
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const maxUserAgentLen = 255
+
+// recordLoginDevice remembers the device a user logged in from, recognised by its user
+// agent, and notifies the user when it is new. The first device of an account is not
+// announced.
+func recordLoginDevice(userID int64, username, userAgent, ip string) {
+    if userAgent == "" {
+        userAgent = "unknown"
+    }
+    if len(userAgent) > maxUserAgentLen {
+        userAgent = userAgent[:maxUserAgentLen]
+    }
+    fingerprint := utils.HashToken(userAgent)
+
+    // One affected row means the device was inserted rather than seen again
+    result, err := db.DB.Exec(`
+        INSERT INTO login_devices (user_id, fingerprint, user_agent, last_ip) VALUES (?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE last_ip = VALUES(last_ip), last_seen_at = NOW()`, userID, fingerprint, userAgent, ip)
+    if err != nil {
+        log.Println("Error recording login device:", err)
+        return
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected != 1 {
+        return
+    }
+
+    var devices int
+    if err := db.DB.QueryRow("SELECT COUNT(*) FROM login_devices WHERE user_id = ?", userID).Scan(&devices); err != nil {
+        log.Println("Error counting login devices:", err)
+        return
+    }
+    if devices < 2 {
+        return
+    }
+
+    delivery := notifications.DeliveryFor(userID, models.NewDeviceLoginNotificationType)
+    if !delivery.Store {
+        return
+    }
+    _, err = notifications.Create(db.DB, models.Notification{
+        UserID:   userID,
+        Type:     models.NewDeviceLoginNotificationType,
+        ObjectID: fingerprint,
+        Payload:  map[string]interface{}{"user_agent": userAgent, "ip": ip},
+    }, "")
+    if err != nil {
+        log.Println("Error creating new device notification:", err)
+        return
+    }
+    if !delivery.InApp {
+        return
+    }
+
+    var count int
+    if err := db.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND is_read = false", userID).Scan(&count); err != nil {
+        log.Println("Error fetching unread notification count:", err)
+        return
+    }
+    payload, err := json.Marshal(map[string]interface{}{
+        "type":                      string(models.NewDeviceLoginNotificationType),
+        "unread_notification_count": count,
+        "receiver":                  username,
+    })
+    if err != nil {
+        log.Println("Error marshalling new device notification:", err)
+        return
+    }
+    notifications.GlobalNotificationHub.BroadcastNotification(username, payload)
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/services/mail"
+)
+
+const (
+    emailTokenMagicLogin = "magic_login"
+
+    magicLinkTTL            = 15 * time.Minute
+    magicLinkResendInterval = time.Minute
+    magicLinkDailyMax       = 10
+)
+
+func sendMagicLinkEmail(c *gin.Context, email string, token string) error {
+    loginLink := requestOrigin(c) + "/magic-login?token=" + url.QueryEscape(token)
+    return mail.Send(email, "Your login link", "Click this link to log in to Vansify: <a href='" + loginLink + "'>Log in</a><br><br>The link works once and expires in 15 minutes. If you did not ask for it, you can ignore this email.")
+}
+
+// RequestMagicLink emails a single-use login link. It works for password and OAuth
+// accounts alike, since both are tied to an email address.
+func RequestMagicLink(c *gin.Context) {
+    var request struct {
+        Email string `json:"email" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    // Answer the same way whether or not the address belongs to an account
+    response := gin.H{"message": "If an account exists for this email, a login link has been sent."}
+
+    var userID int64
+    var suspended bool
+    err := db.DB.QueryRow("SELECT id, suspended_at IS NOT NULL FROM users WHERE email = ?", request.Email).Scan(&userID, &suspended)
+    if err != nil || suspended {
+        c.JSON(http.StatusOK, response)
+        return
+    }
+
+    // From here on only the account owner's inbox can tell what happened. Throttled
+    // and failed sends are logged and answered like any other request, so the answer
+    // never reveals that the address has an account.
+    sentToday, secondsAgo, err := recentEmailTokens(userID, emailTokenMagicLogin)
+    if err != nil {
+        log.Printf("Error checking login links: %v\n", err)
+        c.JSON(http.StatusOK, response)
+        return
+    }
+    if sentToday >= magicLinkDailyMax || (sentToday > 0 && secondsAgo < int(magicLinkResendInterval.Seconds())) {
+        log.Printf("Login link for user %d throttled\n", userID)
+        c.JSON(http.StatusOK, response)
+        return
+    }
+
+    // Only the latest link works
+    token, err := issueEmailToken(userID, emailTokenMagicLogin, magicLinkTTL)
+    if err != nil {
+        log.Printf("Error generating login link: %v\n", err)
+        c.JSON(http.StatusOK, response)
+        return
+    }
+
+    if err := sendMagicLinkEmail(c, request.Email, token); err != nil {
+        log.Printf("Error sending login link: %v\n", err)
+    }
+
+    c.JSON(http.StatusOK, response)
+}
+
+// MagicLinkLogin logs in with the token from a login link. It is a POST so that mail
+// scanners following the link cannot use it up before the user does.
+func MagicLinkLogin(c *gin.Context) {
+    var request struct {
+        Token      string `json:"token" binding:"required"`
+        RememberMe bool   `json:"remember_me"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    userID, err := consumeEmailToken(request.Token, emailTokenMagicLogin)
+    if err != nil {
+        respondEmailTokenError(c, err, "login link")
+        return
+    }
+
+    var dbUser models.User
+    err = db.DB.QueryRow("SELECT id, username, email, verified, oauth_user FROM users WHERE id = ?", userID).
+        Scan(&dbUser.ID, &dbUser.Username, &dbUser.Email, &dbUser.Verified, &dbUser.OauthUser)
+    if err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Login link is no longer valid"})
+        return
+    }
+
+    // Using the link proves the address works, and it is no password guess either
+    _, err = db.DB.Exec("UPDATE users SET verified = TRUE, failed_login_attempts = 0, locked_until = NULL WHERE id = ?", dbUser.ID)
+    if err != nil {
+        log.Println("Error updating user after login link:", err)
+    }
+    dbUser.Verified = true
+
+    completeLogin(c, dbUser, request.RememberMe)
+}
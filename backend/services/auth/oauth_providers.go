@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/github"
+	"github.com/markbates/goth/providers/gitlab"
+	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/openidConnect"
+)
+
+// enabledProviders holds the names of the OAuth providers configured in OAUTH_PROVIDERS
+var enabledProviders = map[string]bool{}
+
+// oauthCredentials reads the client ID and secret of a provider, e.g. GITHUB_CLIENT_ID
+func oauthCredentials(prefix string) (string, string, error) {
+    clientID := os.Getenv(prefix + "_CLIENT_ID")
+    clientSecret := os.Getenv(prefix + "_CLIENT_SECRET")
+    if clientID == "" || clientSecret == "" {
+        return "", "", fmt.Errorf("%s_CLIENT_ID and %s_CLIENT_SECRET are required", prefix, prefix)
+    }
+    return clientID, clientSecret, nil
+}
+
+// newOAuthProvider builds the goth provider for one entry of OAUTH_PROVIDERS
+func newOAuthProvider(name, backendUrl string) (goth.Provider, error) {
+    callbackURL := func(providerName string) string {
+        return backendUrl + "/v1/auth/" + providerName + "/callback"
+    }
+
+    switch name {
+    case "google":
+        clientID, clientSecret, err := oauthCredentials("GOOGLE")
+        if err != nil {
+            return nil, err
+        }
+        return google.New(clientID, clientSecret, callbackURL("google"), "openid", "profile", "email"), nil
+
+    case "github":
+        clientID, clientSecret, err := oauthCredentials("GITHUB")
+        if err != nil {
+            return nil, err
+        }
+        return github.New(clientID, clientSecret, callbackURL("github"), "read:user", "user:email"), nil
+
+    case "gitlab":
+        clientID, clientSecret, err := oauthCredentials("GITLAB")
+        if err != nil {
+            return nil, err
+        }
+        if baseURL := os.Getenv("GITLAB_URL"); baseURL != "" {
+            baseURL = strings.TrimSuffix(baseURL, "/")
+            return gitlab.NewCustomisedURL(clientID, clientSecret, callbackURL("gitlab"),
+                baseURL+"/oauth/authorize", baseURL+"/oauth/token", baseURL+"/api/v4/user", "read_user"), nil
+        }
+        return gitlab.New(clientID, clientSecret, callbackURL("gitlab"), "read_user"), nil
+
+    case "oidc":
+        clientID, clientSecret, err := oauthCredentials("OIDC")
+        if err != nil {
+            return nil, err
+        }
+        discoveryURL := os.Getenv("OIDC_DISCOVERY_URL")
+        if discoveryURL == "" {
+            return nil, fmt.Errorf("OIDC_DISCOVERY_URL is required")
+        }
+        return openidConnect.NewNamed("oidc", clientID, clientSecret, callbackURL("oidc"), discoveryURL, "openid", "profile", "email")
+    }
+
+    return nil, fmt.Errorf("unknown OAuth provider %q", name)
+}
+
+// configuredProviders returns the provider names listed in OAUTH_PROVIDERS, google by default
+func configuredProviders() []string {
+    raw := os.Getenv("OAUTH_PROVIDERS")
+    if raw == "" {
+        return []string{"google"}
+    }
+
+    var names []string
+    for _, name := range strings.Split(raw, ",") {
+        if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+// providerEmailVerified reports whether a provider asserted that the user owns the
+// email it returned. Anything it does not assert explicitly counts as unverified.
+func providerEmailVerified(provider string, user goth.User) bool {
+    if user.Email == "" {
+        return false
+    }
+
+    switch provider {
+    case "google":
+        // The v2 userinfo endpoint calls it verified_email
+        return rawDataTrue(user.RawData, "verified_email") || rawDataTrue(user.RawData, "email_verified")
+    case "github":
+        // goth only falls back to the emails API when the profile has no public email,
+        // and only takes a primary, verified address from it
+        publicEmail, _ := user.RawData["email"].(string)
+        return publicEmail == ""
+    case "gitlab":
+        // GitLab sets confirmed_at once the primary address is confirmed
+        confirmedAt, _ := user.RawData["confirmed_at"].(string)
+        return confirmedAt != ""
+    case "oidc":
+        return rawDataTrue(user.RawData, "email_verified")
+    }
+    return false
+}
+
+// rawDataTrue reads a boolean claim, which some providers send as a string
+func rawDataTrue(rawData map[string]interface{}, key string) bool {
+    switch value := rawData[key].(type) {
+    case bool:
+        return value
+    case string:
+        return strings.EqualFold(value, "true")
+    }
+    return false
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/vaanskii/vansify/utils"
+)
+
+// Stages of a sign up through an OAuth provider. The callback code travels in the
+// /authset URL and is exchanged once for a signup code that only /v1/create-user accepts.
+const (
+    onboardingStageCallback = "callback"
+    onboardingStageSignup   = "signup"
+
+    onboardingCallbackTTL = 10 * time.Minute
+    onboardingSignupTTL   = 30 * time.Minute
+)
+
+// issueOnboardingCode stores the hash of a new single-use code bound to the identity
+// the provider verified and returns the raw code
+func issueOnboardingCode(tx *sql.Tx, identity oauthIdentity, stage string, ttl time.Duration) (string, error) {
+    code, err := utils.GenerateRandomToken(32)
+    if err != nil {
+        return "", err
+    }
+
+    // Codes nobody came back for are of no use to anyone
+    _, err = tx.Exec("DELETE FROM oauth_onboarding_codes WHERE expires_at < DATE_SUB(NOW(), INTERVAL 1 DAY)")
+    if err != nil {
+        return "", err
+    }
+
+    _, err = tx.Exec(`
+        INSERT INTO oauth_onboarding_codes (code_hash, stage, provider, subject, email, email_verified, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))`,
+        utils.HashToken(code), stage, identity.Provider, identity.Subject, identity.Email, identity.EmailVerified, int(ttl.Seconds()))
+    if err != nil {
+        return "", err
+    }
+
+    return code, nil
+}
+
+// consumeOnboardingCode marks a code as used and returns the identity it is bound to.
+// The row stays locked until the transaction ends, and rolling back gives the code back.
+func consumeOnboardingCode(tx *sql.Tx, code, stage string) (oauthIdentity, error) {
+    var id int64
+    var identity oauthIdentity
+    var used, expired bool
+    err := tx.QueryRow(`
+        SELECT id, provider, subject, email, email_verified, used_at IS NOT NULL, expires_at < NOW()
+        FROM oauth_onboarding_codes
+        WHERE code_hash = ? AND stage = ?
+        FOR UPDATE`, utils.HashToken(code), stage).
+        Scan(&id, &identity.Provider, &identity.Subject, &identity.Email, &identity.EmailVerified, &used, &expired)
+    if err == sql.ErrNoRows {
+        return identity, errEmailTokenInvalid
+    } else if err != nil {
+        return identity, err
+    }
+
+    if used {
+        return identity, errEmailTokenUsed
+    }
+    if expired {
+        return identity, errEmailTokenExpired
+    }
+
+    _, err = tx.Exec("UPDATE oauth_onboarding_codes SET used_at = NOW() WHERE id = ?", id)
+    if err != nil {
+        return identity, err
+    }
+
+    return identity, nil
+}
@@ -0,0 +1,446 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const passkeyCeremonyTTL = 5 * time.Minute
+
+var webAuthn *webauthn.WebAuthn
+
+// passkeyUser adapts a stored user and their credentials to webauthn.User
+type passkeyUser struct {
+    id          int64
+    username    string
+    credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+    return []byte(strconv.FormatInt(u.id, 10))
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+    return u.username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+    return u.username
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+    return u.credentials
+}
+
+// InitWebAuthn configures the relying party used for passkey ceremonies
+func InitWebAuthn() {
+    rpID := os.Getenv("WEBAUTHN_RP_ID")
+    if rpID == "" {
+        rpID = "localhost"
+    }
+
+    origins := []string{"http://localhost:5173"}
+    if rawOrigins := os.Getenv("WEBAUTHN_RP_ORIGINS"); rawOrigins != "" {
+        origins = strings.Split(rawOrigins, ",")
+    }
+
+    var err error
+    webAuthn, err = webauthn.New(&webauthn.Config{
+        RPID:          rpID,
+        RPDisplayName: "Vansify",
+        RPOrigins:     origins,
+    })
+    if err != nil {
+        log.Fatalf("Error configuring WebAuthn: %v", err)
+    }
+}
+
+// loadPasskeyUser fetches a user together with all of their registered passkeys
+func loadPasskeyUser(userID int64) (*passkeyUser, error) {
+    user := &passkeyUser{id: userID}
+    err := db.DB.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&user.username)
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT credential_id, public_key, attestation_type, aaguid, sign_count, transports, backup_eligible, backup_state
+        FROM webauthn_credentials WHERE user_id = ?`, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var credential webauthn.Credential
+        var transports string
+        if err := rows.Scan(&credential.ID, &credential.PublicKey, &credential.AttestationType, &credential.Authenticator.AAGUID,
+            &credential.Authenticator.SignCount, &transports, &credential.Flags.BackupEligible, &credential.Flags.BackupState); err != nil {
+            return nil, err
+        }
+        if transports != "" {
+            for _, transport := range strings.Split(transports, ",") {
+                credential.Transport = append(credential.Transport, protocol.AuthenticatorTransport(transport))
+            }
+        }
+        user.credentials = append(user.credentials, credential)
+    }
+
+    return user, rows.Err()
+}
+
+// savePasskeyCeremony stores the session data of a started ceremony and returns its ID
+func savePasskeyCeremony(userID sql.NullInt64, ceremony string, session *webauthn.SessionData) (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    sessionID := hex.EncodeToString(b)
+
+    data, err := json.Marshal(session)
+    if err != nil {
+        return "", err
+    }
+
+    _, err = db.DB.Exec("INSERT INTO webauthn_sessions (id, user_id, ceremony, data, expires_at) VALUES (?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))",
+        sessionID, userID, ceremony, string(data), int(passkeyCeremonyTTL.Seconds()))
+    if err != nil {
+        return "", err
+    }
+
+    return sessionID, nil
+}
+
+// takePasskeyCeremony loads and deletes the session data of a ceremony so it can only be finished once
+func takePasskeyCeremony(sessionID, ceremony string) (sql.NullInt64, *webauthn.SessionData, error) {
+    var userID sql.NullInt64
+    var data string
+    var expired bool
+    err := db.DB.QueryRow("SELECT user_id, data, expires_at < NOW() FROM webauthn_sessions WHERE id = ? AND ceremony = ?", sessionID, ceremony).
+        Scan(&userID, &data, &expired)
+    if err != nil {
+        return userID, nil, err
+    }
+
+    if _, err := db.DB.Exec("DELETE FROM webauthn_sessions WHERE id = ? OR expires_at < NOW()", sessionID); err != nil {
+        return userID, nil, err
+    }
+
+    if expired {
+        return userID, nil, errors.New("passkey ceremony expired")
+    }
+
+    var session webauthn.SessionData
+    if err := json.Unmarshal([]byte(data), &session); err != nil {
+        return userID, nil, err
+    }
+
+    return userID, &session, nil
+}
+
+// BeginPasskeyRegistration starts registering a new passkey for the logged in user
+func BeginPasskeyRegistration(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    user, err := loadPasskeyUser(userID)
+    if err != nil {
+        log.Printf("Error loading passkeys: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading passkeys"})
+        return
+    }
+
+    // Prevent registering the same authenticator twice
+    exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+    for _, credential := range user.credentials {
+        exclusions = append(exclusions, credential.Descriptor())
+    }
+
+    options, session, err := webAuthn.BeginRegistration(user,
+        webauthn.WithExclusions(exclusions),
+        webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+    )
+    if err != nil {
+        log.Printf("Error beginning passkey registration: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error beginning passkey registration"})
+        return
+    }
+
+    sessionID, err := savePasskeyCeremony(sql.NullInt64{Int64: userID, Valid: true}, "registration", session)
+    if err != nil {
+        log.Printf("Error saving passkey session: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error beginning passkey registration"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "options": options})
+}
+
+// FinishPasskeyRegistration verifies the authenticator response and stores the new passkey
+func FinishPasskeyRegistration(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    sessionUserID, session, err := takePasskeyCeremony(c.Query("session_id"), "registration")
+    if err != nil || !sessionUserID.Valid || sessionUserID.Int64 != userID {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired passkey session"})
+        return
+    }
+
+    parsedResponse, err := protocol.ParseCredentialCreationResponseBody(c.Request.Body)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid passkey response"})
+        return
+    }
+
+    user, err := loadPasskeyUser(userID)
+    if err != nil {
+        log.Printf("Error loading passkeys: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading passkeys"})
+        return
+    }
+
+    credential, err := webAuthn.CreateCredential(user, *session, parsedResponse)
+    if err != nil {
+        log.Printf("Error verifying passkey registration: %v\n", err)
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey registration failed"})
+        return
+    }
+
+    name := strings.TrimSpace(c.Query("name"))
+    if name == "" {
+        name = "Passkey"
+    }
+
+    transports := make([]string, 0, len(credential.Transport))
+    for _, transport := range credential.Transport {
+        transports = append(transports, string(transport))
+    }
+
+    result, err := db.DB.Exec(`
+        INSERT INTO webauthn_credentials (user_id, credential_id, public_key, attestation_type, aaguid, sign_count, transports, backup_eligible, backup_state, name)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        userID, credential.ID, credential.PublicKey, credential.AttestationType, credential.Authenticator.AAGUID,
+        credential.Authenticator.SignCount, strings.Join(transports, ","), credential.Flags.BackupEligible, credential.Flags.BackupState, name)
+    if err != nil {
+        log.Printf("Error saving passkey: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving passkey"})
+        return
+    }
+
+    passkeyID, _ := result.LastInsertId()
+
+    c.JSON(http.StatusCreated, gin.H{
+        "id":         passkeyID,
+        "name":       name,
+        "transports": transports,
+    })
+}
+
+// BeginPasskeyLogin starts a passwordless login with a discoverable credential
+func BeginPasskeyLogin(c *gin.Context) {
+    options, session, err := webAuthn.BeginDiscoverableLogin()
+    if err != nil {
+        log.Printf("Error beginning passkey login: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error beginning passkey login"})
+        return
+    }
+
+    sessionID, err := savePasskeyCeremony(sql.NullInt64{}, "login", session)
+    if err != nil {
+        log.Printf("Error saving passkey session: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error beginning passkey login"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "options": options})
+}
+
+// FinishPasskeyLogin verifies the assertion and logs the owner of the passkey in
+func FinishPasskeyLogin(c *gin.Context) {
+    _, session, err := takePasskeyCeremony(c.Query("session_id"), "login")
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired passkey session"})
+        return
+    }
+
+    parsedResponse, err := protocol.ParseCredentialRequestResponseBody(c.Request.Body)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid passkey response"})
+        return
+    }
+
+    findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+        userID, err := strconv.ParseInt(string(userHandle), 10, 64)
+        if err != nil {
+            return nil, err
+        }
+        return loadPasskeyUser(userID)
+    }
+
+    user, credential, err := webAuthn.ValidatePasskeyLogin(findUser, *session, parsedResponse)
+    if err != nil {
+        log.Printf("Error verifying passkey login: %v\n", err)
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey login failed"})
+        return
+    }
+
+    if credential.Authenticator.CloneWarning {
+        log.Printf("Passkey sign count went backwards for user %s, possible cloned authenticator\n", user.WebAuthnName())
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey login failed"})
+        return
+    }
+
+    passkey := user.(*passkeyUser)
+    _, err = db.DB.Exec("UPDATE webauthn_credentials SET sign_count = ?, backup_state = ?, last_used_at = NOW() WHERE user_id = ? AND credential_id = ?",
+        credential.Authenticator.SignCount, credential.Flags.BackupState, passkey.id, credential.ID)
+    if err != nil {
+        log.Println("Error updating passkey sign count:", err)
+    }
+
+    var dbUser models.User
+    err = db.DB.QueryRow("SELECT id, username, email, verified, oauth_user FROM users WHERE id = ?", passkey.id).
+        Scan(&dbUser.ID, &dbUser.Username, &dbUser.Email, &dbUser.Verified, &dbUser.OauthUser)
+    if err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey login failed"})
+        return
+    }
+
+    completeLogin(c, dbUser, c.Query("remember_me") == "true")
+}
+
+// ListPasskeys returns the passkeys registered by the logged in user
+func ListPasskeys(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT w.id, w.name, w.transports, w.backup_eligible, w.created_at, w.last_used_at
+        FROM webauthn_credentials w
+        JOIN users u ON w.user_id = u.id
+        WHERE u.username = ?
+        ORDER BY w.created_at DESC`, customClaims.Username)
+    if err != nil {
+        log.Printf("Error fetching passkeys: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching passkeys"})
+        return
+    }
+    defer rows.Close()
+
+    passkeys := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var name, transports string
+        var backupEligible bool
+        var createdAt time.Time
+        var lastUsedAt sql.NullTime
+        if err := rows.Scan(&id, &name, &transports, &backupEligible, &createdAt, &lastUsedAt); err != nil {
+            log.Printf("Error scanning passkey: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching passkeys"})
+            return
+        }
+
+        passkey := gin.H{
+            "id":              id,
+            "name":            name,
+            "transports":      strings.FieldsFunc(transports, func(r rune) bool { return r == ',' }),
+            "backup_eligible": backupEligible,
+            "created_at":      createdAt.Format(time.RFC3339),
+            "last_used_at":    nil,
+        }
+        if lastUsedAt.Valid {
+            passkey["last_used_at"] = lastUsedAt.Time.Format(time.RFC3339)
+        }
+        passkeys = append(passkeys, passkey)
+    }
+
+    if err := rows.Err(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching passkeys"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"passkeys": passkeys})
+}
+
+// DeletePasskey removes one of the logged in user's passkeys
+func DeletePasskey(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    result, err := db.DB.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = (SELECT id FROM users WHERE username = ?)",
+        c.Param("id"), customClaims.Username)
+    if err != nil {
+        log.Printf("Error deleting passkey: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting passkey"})
+        return
+    }
+
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Passkey deleted"})
+}
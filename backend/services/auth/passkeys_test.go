@@ -0,0 +1,392 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/vaanskii/vansify/db/dbtest"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const (
+    passkeyTestUserID = 7
+    passkeyTestOrigin = "http://localhost:5173"
+)
+
+func TestMain(m *testing.M) {
+    gin.SetMode(gin.TestMode)
+    os.Setenv("WEBAUTHN_RP_ID", "localhost")
+    os.Setenv("WEBAUTHN_RP_ORIGINS", passkeyTestOrigin)
+    InitWebAuthn()
+    utils.InitKeyring()
+    os.Exit(m.Run())
+}
+
+// virtualAuthenticator is a platform authenticator holding one ES256 passkey
+type virtualAuthenticator struct {
+    key          *ecdsa.PrivateKey
+    credentialID []byte
+    signCount    uint32
+}
+
+func newVirtualAuthenticator(t *testing.T) *virtualAuthenticator {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    credentialID := make([]byte, 16)
+    rand.Read(credentialID)
+    return &virtualAuthenticator{key: key, credentialID: credentialID}
+}
+
+func (a *virtualAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+    data, _ := json.Marshal(map[string]string{
+        "type":      ceremony,
+        "challenge": base64.RawURLEncoding.EncodeToString(challenge),
+        "origin":    passkeyTestOrigin,
+    })
+    return data
+}
+
+func (a *virtualAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+    rpIDHash := sha256.Sum256([]byte("localhost"))
+    data := append(rpIDHash[:], flags)
+    data = binary.BigEndian.AppendUint32(data, a.signCount)
+    return append(data, attested...)
+}
+
+// register answers the creation options with a "none" attestation of the passkey
+func (a *virtualAuthenticator) register(t *testing.T, options protocol.CredentialCreation) []byte {
+    publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+        PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+        Curve:         int64(webauthncose.P256),
+        XCoord:        a.key.X.FillBytes(make([]byte, 32)),
+        YCoord:        a.key.Y.FillBytes(make([]byte, 32)),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    attested := make([]byte, 16) // AAGUID
+    attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+    attested = append(attested, a.credentialID...)
+    attested = append(attested, publicKey...)
+
+    // User present, user verified, attested credential data included
+    attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+        "fmt":      "none",
+        "attStmt":  map[string]interface{}{},
+        "authData": a.authenticatorData(0x45, attested),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    body, _ := json.Marshal(map[string]interface{}{
+        "id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+        "rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+        "type":  "public-key",
+        "response": map[string]interface{}{
+            "clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options.Response.Challenge)),
+            "attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+            "transports":        []string{"internal"},
+        },
+    })
+    return body
+}
+
+// assert signs the request options with the current sign count
+func (a *virtualAuthenticator) assert(t *testing.T, options protocol.CredentialAssertion, userHandle []byte) []byte {
+    authenticatorData := a.authenticatorData(0x05, nil)
+    clientData := a.clientData("webauthn.get", options.Response.Challenge)
+    clientDataHash := sha256.Sum256(clientData)
+    digest := sha256.Sum256(append(append([]byte{}, authenticatorData...), clientDataHash[:]...))
+    signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    body, _ := json.Marshal(map[string]interface{}{
+        "id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+        "rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+        "type":  "public-key",
+        "response": map[string]interface{}{
+            "clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+            "authenticatorData": base64.RawURLEncoding.EncodeToString(authenticatorData),
+            "signature":         base64.RawURLEncoding.EncodeToString(signature),
+            "userHandle":        base64.RawURLEncoding.EncodeToString(userHandle),
+        },
+    })
+    return body
+}
+
+type storedSession struct {
+    userID   driver.Value
+    ceremony string
+    data     string
+}
+
+// passkeyStore keeps the passkey tables of one user behind the fake database
+type passkeyStore struct {
+    mu          sync.Mutex
+    sessions    map[string]storedSession
+    credentials [][]driver.Value
+}
+
+func (s *passkeyStore) sessionCount() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.sessions)
+}
+
+func (s *passkeyStore) signCount(t *testing.T) int64 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.credentials) != 1 {
+        t.Fatalf("stored %d passkeys, want 1", len(s.credentials))
+    }
+    return s.credentials[0][4].(int64)
+}
+
+func newPasskeyTest(t *testing.T) (*passkeyStore, *dbtest.Fake, *gin.Engine) {
+    store := &passkeyStore{sessions: map[string]storedSession{}}
+    fake := dbtest.Open(t)
+
+    fake.Answer(`^SELECT id FROM users WHERE username = \?`, dbtest.Result{Columns: []string{"id"}, Rows: [][]driver.Value{{int64(passkeyTestUserID)}}})
+    fake.Answer(`^SELECT username FROM users WHERE id = \?`, dbtest.Result{Columns: []string{"username"}, Rows: [][]driver.Value{{"alice"}}})
+    fake.Answer(`^SELECT id, username, email, verified, oauth_user FROM users WHERE id = \?`, dbtest.Result{
+        Columns: []string{"id", "username", "email", "verified", "oauth_user"},
+        Rows:    [][]driver.Value{{int64(passkeyTestUserID), "alice", "alice@example.com", true, false}},
+    })
+    fake.Answer(`^SELECT id, role, suspended_at IS NOT NULL`, dbtest.Result{
+        Columns: []string{"id", "role", "suspended", "suspension_reason", "tokens_valid_after", "deletion_pending"},
+        Rows:    [][]driver.Value{{int64(passkeyTestUserID), "user", false, nil, int64(0), false}},
+    })
+    fake.Answer(`^UPDATE users SET active = true`, dbtest.Result{RowsAffected: 1})
+
+    fake.On(`^INSERT INTO webauthn_sessions`, func(args []driver.Value) dbtest.Result {
+        store.mu.Lock()
+        defer store.mu.Unlock()
+        store.sessions[args[0].(string)] = storedSession{userID: args[1], ceremony: args[2].(string), data: args[3].(string)}
+        return dbtest.Result{RowsAffected: 1}
+    })
+    fake.On(`^SELECT user_id, data, expires_at < NOW\(\) FROM webauthn_sessions`, func(args []driver.Value) dbtest.Result {
+        store.mu.Lock()
+        defer store.mu.Unlock()
+        result := dbtest.Result{Columns: []string{"user_id", "data", "expired"}}
+        if session, ok := store.sessions[args[0].(string)]; ok && session.ceremony == args[1] {
+            result.Rows = [][]driver.Value{{session.userID, session.data, false}}
+        }
+        return result
+    })
+    fake.On(`^DELETE FROM webauthn_sessions`, func(args []driver.Value) dbtest.Result {
+        store.mu.Lock()
+        defer store.mu.Unlock()
+        delete(store.sessions, args[0].(string))
+        return dbtest.Result{RowsAffected: 1}
+    })
+
+    fake.On(`^SELECT credential_id, public_key, .* FROM webauthn_credentials WHERE user_id = \?`, func([]driver.Value) dbtest.Result {
+        store.mu.Lock()
+        defer store.mu.Unlock()
+        return dbtest.Result{
+            Columns: []string{"credential_id", "public_key", "attestation_type", "aaguid", "sign_count", "transports", "backup_eligible", "backup_state"},
+            Rows:    append([][]driver.Value{}, store.credentials...),
+        }
+    })
+    fake.On(`^INSERT INTO webauthn_credentials`, func(args []driver.Value) dbtest.Result {
+        store.mu.Lock()
+        defer store.mu.Unlock()
+        store.credentials = append(store.credentials, args[1:9])
+        return dbtest.Result{LastInsertID: int64(len(store.credentials)), RowsAffected: 1}
+    })
+    fake.On(`^UPDATE webauthn_credentials SET sign_count = \?`, func(args []driver.Value) dbtest.Result {
+        store.mu.Lock()
+        defer store.mu.Unlock()
+        for _, credential := range store.credentials {
+            if bytes.Equal(credential[0].([]byte), args[3].([]byte)) {
+                credential[4] = args[0]
+                credential[7] = args[1]
+            }
+        }
+        return dbtest.Result{RowsAffected: 1}
+    })
+
+    loggedIn := func(c *gin.Context) {
+        c.Set("claims", &utils.CustomClaims{Username: "alice"})
+    }
+    router := gin.New()
+    router.POST("/passkeys/register/begin", loggedIn, BeginPasskeyRegistration)
+    router.POST("/passkeys/register/finish", loggedIn, FinishPasskeyRegistration)
+    router.POST("/passkeys/login/begin", BeginPasskeyLogin)
+    router.POST("/passkeys/login/finish", FinishPasskeyLogin)
+
+    return store, fake, router
+}
+
+func post(router *gin.Engine, path string, body []byte) *httptest.ResponseRecorder {
+    recorder := httptest.NewRecorder()
+    router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+    return recorder
+}
+
+func beginPasskeyCeremony(t *testing.T, router *gin.Engine, path string, options interface{}) string {
+    recorder := post(router, path, nil)
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("%s: got %d %s", path, recorder.Code, recorder.Body)
+    }
+    response := struct {
+        SessionID string          `json:"session_id"`
+        Options   json.RawMessage `json:"options"`
+    }{}
+    if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+        t.Fatal(err)
+    }
+    if err := json.Unmarshal(response.Options, options); err != nil {
+        t.Fatal(err)
+    }
+    return response.SessionID
+}
+
+func registerPasskey(t *testing.T, router *gin.Engine, authenticator *virtualAuthenticator) {
+    var options protocol.CredentialCreation
+    sessionID := beginPasskeyCeremony(t, router, "/passkeys/register/begin", &options)
+
+    recorder := post(router, "/passkeys/register/finish?session_id="+sessionID+"&name=Laptop", authenticator.register(t, options))
+    if recorder.Code != http.StatusCreated {
+        t.Fatalf("finishing registration: got %d %s", recorder.Code, recorder.Body)
+    }
+}
+
+func loginWithPasskey(t *testing.T, router *gin.Engine, authenticator *virtualAuthenticator) *httptest.ResponseRecorder {
+    var options protocol.CredentialAssertion
+    sessionID := beginPasskeyCeremony(t, router, "/passkeys/login/begin", &options)
+    userHandle := []byte(strconv.Itoa(passkeyTestUserID))
+    return post(router, "/passkeys/login/finish?session_id="+sessionID, authenticator.assert(t, options, userHandle))
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+    store, fake, router := newPasskeyTest(t)
+    authenticator := newVirtualAuthenticator(t)
+
+    var options protocol.CredentialCreation
+    sessionID := beginPasskeyCeremony(t, router, "/passkeys/register/begin", &options)
+    if store.sessionCount() != 1 {
+        t.Fatalf("stored %d passkey sessions, want 1", store.sessionCount())
+    }
+    userHandle, _ := options.Response.User.ID.(string)
+    if decoded, _ := base64.RawURLEncoding.DecodeString(userHandle); string(decoded) != strconv.Itoa(passkeyTestUserID) {
+        t.Errorf("user handle is %q", userHandle)
+    }
+
+    body := authenticator.register(t, options)
+    recorder := post(router, "/passkeys/register/finish?session_id="+sessionID+"&name=Laptop", body)
+    if recorder.Code != http.StatusCreated {
+        t.Fatalf("finishing registration: got %d %s", recorder.Code, recorder.Body)
+    }
+    if store.sessionCount() != 0 {
+        t.Errorf("registration left %d passkey sessions", store.sessionCount())
+    }
+    if len(fake.Statements(`^INSERT INTO webauthn_credentials`)) != 1 {
+        t.Errorf("passkey was not stored")
+    }
+
+    // The session is consumed, so the same response cannot register the passkey again
+    recorder = post(router, "/passkeys/register/finish?session_id="+sessionID, body)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("finishing a consumed registration: got %d, want 400", recorder.Code)
+    }
+    if len(fake.Statements(`^INSERT INTO webauthn_credentials`)) != 1 {
+        t.Errorf("a consumed session stored a passkey")
+    }
+}
+
+func TestPasskeyLogin(t *testing.T) {
+    store, _, router := newPasskeyTest(t)
+    authenticator := newVirtualAuthenticator(t)
+    registerPasskey(t, router, authenticator)
+
+    authenticator.signCount = 1
+    var options protocol.CredentialAssertion
+    sessionID := beginPasskeyCeremony(t, router, "/passkeys/login/begin", &options)
+    body := authenticator.assert(t, options, []byte(strconv.Itoa(passkeyTestUserID)))
+
+    recorder := post(router, "/passkeys/login/finish?session_id="+sessionID, body)
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("finishing login: got %d %s", recorder.Code, recorder.Body)
+    }
+    var response struct {
+        AccessToken string `json:"access_token"`
+        Username    string `json:"username"`
+    }
+    if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+        t.Fatal(err)
+    }
+    if response.Username != "alice" {
+        t.Errorf("logged in as %q, want alice", response.Username)
+    }
+    if claims, err := utils.ValidateToken(response.AccessToken, utils.TokenAccess); err != nil || claims.Username != "alice" {
+        t.Errorf("access token is not valid for alice: %v", err)
+    }
+    if store.sessionCount() != 0 {
+        t.Errorf("login left %d passkey sessions", store.sessionCount())
+    }
+    if count := store.signCount(t); count != 1 {
+        t.Errorf("stored sign count %d, want 1", count)
+    }
+
+    // Replaying the assertion finds its session gone
+    recorder = post(router, "/passkeys/login/finish?session_id="+sessionID, body)
+    if recorder.Code != http.StatusBadRequest {
+        t.Errorf("replaying a login: got %d, want 400", recorder.Code)
+    }
+}
+
+func TestPasskeyLoginRejectsSignCountThatDidNotIncrease(t *testing.T) {
+    store, fake, router := newPasskeyTest(t)
+    authenticator := newVirtualAuthenticator(t)
+    registerPasskey(t, router, authenticator)
+
+    authenticator.signCount = 5
+    if recorder := loginWithPasskey(t, router, authenticator); recorder.Code != http.StatusOK {
+        t.Fatalf("first login: got %d %s", recorder.Code, recorder.Body)
+    }
+
+    // A clone signs a fresh challenge, but cannot know the counter moved on
+    recorder := loginWithPasskey(t, router, authenticator)
+    if recorder.Code != http.StatusUnauthorized {
+        t.Errorf("login with a repeated sign count: got %d, want 401", recorder.Code)
+    }
+    authenticator.signCount = 3
+    recorder = loginWithPasskey(t, router, authenticator)
+    if recorder.Code != http.StatusUnauthorized {
+        t.Errorf("login with a lower sign count: got %d, want 401", recorder.Code)
+    }
+
+    if count := store.signCount(t); count != 5 {
+        t.Errorf("stored sign count %d, want 5", count)
+    }
+    if updates := fake.Statements(`^UPDATE webauthn_credentials SET sign_count`); len(updates) != 1 {
+        t.Errorf("sign count was updated %d times, want once", len(updates))
+    }
+    if store.sessionCount() != 0 {
+        t.Errorf("failed logins left %d passkey sessions", store.sessionCount())
+    }
+}
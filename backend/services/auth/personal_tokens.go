@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// Scopes a personal access token can be granted. Routes declare the scopes they need
+// in cmd/main.go; routes that declare none only accept interactive logins.
+const (
+    ScopeChatRead          = "chat:read"
+    ScopeChatWrite         = "chat:write"
+    ScopeFollowRead        = "follow:read"
+    ScopeFollowWrite       = "follow:write"
+    ScopeNotificationsRead = "notifications:read"
+)
+
+var validScopes = map[string]bool{
+    ScopeChatRead:          true,
+    ScopeChatWrite:         true,
+    ScopeFollowRead:        true,
+    ScopeFollowWrite:       true,
+    ScopeNotificationsRead: true,
+}
+
+const (
+    // personalTokenPrefix tells personal access tokens apart from JWTs
+    personalTokenPrefix = "vpat_"
+
+    // personalTokenType is the token type of the claims built from a personal access token
+    personalTokenType = "personal_access"
+
+    personalTokenDefaultDays = 30
+    personalTokenMaxDays     = 365
+)
+
+var errPersonalTokenInvalid = errors.New("invalid personal access token")
+
+// isPersonalToken reports whether a bearer token is a personal access token
+func isPersonalToken(token string) bool {
+    return strings.HasPrefix(token, personalTokenPrefix)
+}
+
+// authenticatePersonalToken resolves a personal access token to its owner and scopes
+func authenticatePersonalToken(token string) (*utils.CustomClaims, []string, error) {
+    var id int64
+    var username, email, scopes string
+    err := db.DB.QueryRow(`
+        SELECT t.id, u.username, u.email, t.scopes
+        FROM personal_access_tokens t
+        JOIN users u ON u.id = t.user_id
+        WHERE t.token_hash = ? AND t.expires_at > NOW()`, utils.HashToken(token)).Scan(&id, &username, &email, &scopes)
+    if err == sql.ErrNoRows {
+        return nil, nil, errPersonalTokenInvalid
+    } else if err != nil {
+        return nil, nil, err
+    }
+
+    // Scripts may call many times a second, a minute is precise enough
+    _, err = db.DB.Exec("UPDATE personal_access_tokens SET last_used_at = NOW() WHERE id = ? AND (last_used_at IS NULL OR last_used_at < DATE_SUB(NOW(), INTERVAL 1 MINUTE))", id)
+    if err != nil {
+        log.Println("Error updating personal access token last use:", err)
+    }
+
+    claims := &utils.CustomClaims{Username: username, Email: email, TokenType: personalTokenType}
+    claims.Subject = username
+    claims.ID = strconv.FormatInt(id, 10)
+    return claims, strings.Fields(scopes), nil
+}
+
+// hasScopes reports whether every required scope was granted
+func hasScopes(granted []string, required []string) bool {
+    for _, scope := range required {
+        found := false
+        for _, g := range granted {
+            if g == scope {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    return true
+}
+
+// CreatePersonalToken creates a personal access token for the logged in user. The raw
+// token is only returned once.
+func CreatePersonalToken(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var request struct {
+        Name          string   `json:"name" binding:"required"`
+        Scopes        []string `json:"scopes" binding:"required"`
+        ExpiresInDays int      `json:"expires_in_days"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    request.Name = strings.TrimSpace(request.Name)
+    if request.Name == "" || len(request.Name) > 100 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be between 1 and 100 characters"})
+        return
+    }
+
+    scopeSet := map[string]bool{}
+    for _, scope := range request.Scopes {
+        if !validScopes[scope] {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+            return
+        }
+        scopeSet[scope] = true
+    }
+    if len(scopeSet) == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+        return
+    }
+    scopes := make([]string, 0, len(scopeSet))
+    for scope := range scopeSet {
+        scopes = append(scopes, scope)
+    }
+    sort.Strings(scopes)
+
+    if request.ExpiresInDays == 0 {
+        request.ExpiresInDays = personalTokenDefaultDays
+    }
+    if request.ExpiresInDays < 1 || request.ExpiresInDays > personalTokenMaxDays {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days must be between 1 and " + strconv.Itoa(personalTokenMaxDays)})
+        return
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    random, err := utils.GenerateRandomToken(32)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
+        return
+    }
+    token := personalTokenPrefix + random
+
+    result, err := db.DB.Exec(`
+        INSERT INTO personal_access_tokens (user_id, name, token_hash, token_hint, scopes, expires_at)
+        VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? DAY))`,
+        userID, request.Name, utils.HashToken(token), token[len(token)-4:], strings.Join(scopes, " "), request.ExpiresInDays)
+    if err != nil {
+        log.Printf("Error creating personal access token: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating token"})
+        return
+    }
+    tokenID, _ := result.LastInsertId()
+
+    c.JSON(http.StatusCreated, gin.H{
+        "id":         tokenID,
+        "name":       request.Name,
+        "scopes":     scopes,
+        "token":      token,
+        "expires_at": time.Now().AddDate(0, 0, request.ExpiresInDays).UTC().Format(time.RFC3339),
+        "message":    "Copy the token now, it will not be shown again",
+    })
+}
+
+// ListPersonalTokens lists the logged in user's personal access tokens without their secrets
+func ListPersonalTokens(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT t.id, t.name, t.token_hint, t.scopes, t.created_at, t.expires_at, t.last_used_at, t.expires_at < NOW()
+        FROM personal_access_tokens t
+        JOIN users u ON u.id = t.user_id
+        WHERE u.username = ?
+        ORDER BY t.created_at DESC`, customClaims.Username)
+    if err != nil {
+        log.Printf("Error fetching personal access tokens: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching tokens"})
+        return
+    }
+    defer rows.Close()
+
+    tokens := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var name, hint, scopes string
+        var createdAt, expiresAt time.Time
+        var lastUsedAt sql.NullTime
+        var expired bool
+        if err := rows.Scan(&id, &name, &hint, &scopes, &createdAt, &expiresAt, &lastUsedAt, &expired); err != nil {
+            log.Printf("Error scanning personal access token: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching tokens"})
+            return
+        }
+
+        token := gin.H{
+            "id":           id,
+            "name":         name,
+            "token_hint":   personalTokenPrefix + "..." + hint,
+            "scopes":       strings.Fields(scopes),
+            "created_at":   createdAt.Format(time.RFC3339),
+            "expires_at":   expiresAt.Format(time.RFC3339),
+            "last_used_at": nil,
+            "expired":      expired,
+        }
+        if lastUsedAt.Valid {
+            token["last_used_at"] = lastUsedAt.Time.Format(time.RFC3339)
+        }
+        tokens = append(tokens, token)
+    }
+
+    if err := rows.Err(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching tokens"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"tokens": tokens, "available_scopes": []string{
+        ScopeChatRead, ScopeChatWrite, ScopeFollowRead, ScopeFollowWrite, ScopeNotificationsRead,
+    }})
+}
+
+// DeletePersonalToken revokes one of the logged in user's personal access tokens
+func DeletePersonalToken(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    tokenID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+        return
+    }
+
+    result, err := db.DB.Exec(`
+        DELETE t FROM personal_access_tokens t
+        JOIN users u ON u.id = t.user_id
+        WHERE t.id = ? AND u.username = ?`, tokenID, customClaims.Username)
+    if err != nil {
+        log.Printf("Error deleting personal access token: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting token"})
+        return
+    }
+
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
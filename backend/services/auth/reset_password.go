@@ -2,7 +2,6 @@ package auth
 
 import (
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
@@ -11,29 +10,13 @@ import (
 	"github.com/lpernett/godotenv"
 	"github.com/vaanskii/vansify/db"
 	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/services/mail"
 	"github.com/vaanskii/vansify/utils"
-	"gopkg.in/gomail.v2"
 )
 
 // sendResetPasswordEmail sends the reset password email
 func sendResetPasswordEmail(email, link string) error {
-    if err := godotenv.Load(); err != nil {
-        return err
-    }
-
-    port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
-    if err != nil {
-        return err
-    }
-
-    m := gomail.NewMessage()
-    m.SetHeader("From", os.Getenv("SMTP_USER"))
-    m.SetHeader("To", email)
-    m.SetHeader("Subject", "Reset Password")
-    m.SetBody("text/html", "Please reset your password by clicking this link: <a href='" + link + "'>here</a>")
-
-    d := gomail.NewDialer(os.Getenv("SMTP_SERVER"), port, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASS"))
-    return d.DialAndSend(m)
+    return mail.Send(email, "Reset Password", "Please reset your password by clicking this link: <a href='" + link + "'>here</a>")
 }
 
 // ForgotPassword handles sending a reset password email
@@ -62,12 +45,10 @@ func ForgotPassword(c *gin.Context) {
 
     claims := &utils.CustomClaims{
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(time.Now().Add(1 * time.Hour)),
-            Subject:   strconv.FormatInt(user.ID, 10),
+            Subject: strconv.FormatInt(user.ID, 10),
         },
     }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+    tokenString, err := utils.SignToken(utils.TokenReset, claims, 1*time.Hour)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
         return
@@ -100,20 +81,12 @@ func ResetPassword(c *gin.Context) {
         return
     }
 
-    token, err := jwt.ParseWithClaims(request.Token, &utils.CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-        return []byte(os.Getenv("JWT_SECRET")), nil
-    })
+    claims, err := utils.ValidateToken(request.Token, utils.TokenReset)
     if err != nil {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
         return
     }
 
-    claims, ok := token.Claims.(*utils.CustomClaims)
-    if !ok || !token.Valid {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-        return
-    }
-
     // Check if the token has already been used
     var tokenCount int
     err = db.DB.QueryRow("SELECT COUNT(*) FROM used_tokens WHERE token = ?", request.Token).Scan(&tokenCount)
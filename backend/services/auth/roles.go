@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// Roles, each one allowed everything the previous one is
+const (
+    RoleUser      = "user"
+    RoleModerator = "moderator"
+    RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+    RoleUser:      1,
+    RoleModerator: 2,
+    RoleAdmin:     3,
+}
+
+// RoleAtLeast reports whether a role includes the permissions of another
+func RoleAtLeast(role, required string) bool {
+    return roleRanks[role] >= roleRanks[required]
+}
+
+// ValidRole reports whether a role exists
+func ValidRole(role string) bool {
+    return roleRanks[role] > 0
+}
+
+// accountState is what has to be checked on every request because it can change
+// while tokens are still valid
+type accountState struct {
+    ID               int64
+    Role             string
+    Suspended        bool
+    SuspensionReason string
+    // TokensValidAfter is a unix time; tokens issued at or before it were revoked
+    TokensValidAfter int64
+    DeletionPending  bool
+}
+
+// loadAccountState reads the role, suspension and token revocation of a user
+func loadAccountState(username string) (accountState, error) {
+    var state accountState
+    var reason sql.NullString
+    err := db.DB.QueryRow(`
+        SELECT id, role, suspended_at IS NOT NULL, suspension_reason, COALESCE(UNIX_TIMESTAMP(tokens_valid_after), 0),
+            deletion_requested_at IS NOT NULL
+        FROM users WHERE username = ?`, username).
+        Scan(&state.ID, &state.Role, &state.Suspended, &reason, &state.TokensValidAfter, &state.DeletionPending)
+    state.SuspensionReason = reason.String
+    return state, err
+}
+
+// tokenRevoked reports whether a token was issued before the user's sessions were ended
+func (s accountState) tokenRevoked(claims *utils.CustomClaims) bool {
+    if s.TokensValidAfter == 0 {
+        return false
+    }
+    return claims.IssuedAt == nil || claims.IssuedAt.Unix() <= s.TokensValidAfter
+}
+
+// respondSuspended answers a request from a suspended account
+func respondSuspended(c *gin.Context, state accountState) {
+    response := gin.H{"error": "This account has been suspended"}
+    if state.SuspensionReason != "" {
+        response["reason"] = state.SuspensionReason
+    }
+    c.AbortWithStatusJSON(http.StatusForbidden, response)
+}
+
+// RequireRole rejects requests from users below the given role. It has to run after
+// AuthMiddleware, which loads the current role of the user.
+func RequireRole(role string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        claims, exists := c.Get("claims")
+        if !exists {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+            return
+        }
+        customClaims, ok := claims.(*utils.CustomClaims)
+        if !ok {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+            return
+        }
+
+        if !RoleAtLeast(customClaims.Role, role) {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+            return
+        }
+
+        c.Next()
+    }
+}
+
+// RefreshToken exchanges a refresh token for a new access token, unless the account
+// was suspended or logged out everywhere since the refresh token was issued
+func RefreshToken(c *gin.Context) {
+    var request struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    claims, err := utils.ValidateToken(request.RefreshToken, utils.TokenRefresh)
+    if err != nil {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+        return
+    }
+
+    state, err := loadAccountState(claims.Username)
+    if err != nil || state.tokenRevoked(claims) {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+        return
+    }
+    if state.Suspended {
+        respondSuspended(c, state)
+        return
+    }
+
+    accessToken, err := utils.GenerateAccessToken(claims.Username, claims.Email, state.Role)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating access token"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"access_token": accessToken})
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"github.com/vaanskii/vansify/db"
+	notifications "github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/notifications/chat_notifications"
+	"github.com/vaanskii/vansify/services/chat"
+	activeUsers "github.com/vaanskii/vansify/services/user"
+)
+
+// DisconnectEverywhere closes every WebSocket a user has open
+func DisconnectEverywhere(username, reason string) {
+    notifications.GlobalNotificationHub.DisconnectUser(username, reason)
+    chat_notifications.ChatNotification.DisconnectUser(username, reason)
+    chat.DisconnectUser(username, reason)
+    activeUsers.DisconnectUser(username, reason)
+}
+
+// EndSessions revokes every access and refresh token issued to a user so far and
+// disconnects them. Personal access tokens are deleted as well.
+func EndSessions(userID int64, username, reason string) error {
+    _, err := db.DB.Exec("UPDATE users SET tokens_valid_after = NOW(), active = false, last_active = NOW() WHERE id = ?", userID)
+    if err != nil {
+        return err
+    }
+
+    _, err = db.DB.Exec("DELETE FROM personal_access_tokens WHERE user_id = ?", userID)
+    if err != nil {
+        return err
+    }
+
+    DisconnectEverywhere(username, reason)
+    go activeUsers.FetchActiveUsersAndBroadcast(db.DB)
+    return nil
+}
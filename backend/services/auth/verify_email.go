@@ -1,38 +1,34 @@
 package auth
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"log"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vaanskii/vansify/db"
 )
 
-// GenerateVerificationToken generates a random verification token
-func GenerateVerificationToken(email string) string {
-	// Create a random byte slice
-	b := make([]byte, 32)
-	_, err := rand.Read(b)
-	if err != nil {
-		return ""
-	}
+const (
+	verificationTokenTTL       = 24 * time.Hour
+	verificationResendInterval = time.Minute
+	verificationResendDailyMax = 5
+)
 
-	return base64.URLEncoding.EncodeToString(b) + ":" + email 
+// GenerateVerificationToken issues a single-use email verification token for the user
+func GenerateVerificationToken(userID int64) (string, error) {
+	return issueEmailToken(userID, emailTokenVerifyEmail, verificationTokenTTL)
 }
 
 func VerifyEmail(c *gin.Context){
-	token := c.Query("token")
-	parts := strings.Split(token, ":")
-	if len(parts) != 2 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token"})
+	userID, err := consumeEmailToken(c.Query("token"), emailTokenVerifyEmail)
+	if err != nil {
+		respondEmailTokenError(c, err, "verification link")
 		return
 	}
 
-	email := parts[1]
-	// Find the user by email and update the verified status
-	_, err := db.DB.Exec("UPDATE users SET verified = ? WHERE email =?", true, email)
+	// Update the verified status of the user the token was issued to
+	_, err = db.DB.Exec("UPDATE users SET verified = ? WHERE id = ?", true, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error verifying email"})
 		return
@@ -40,3 +36,52 @@ func VerifyEmail(c *gin.Context){
 
 	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully! You can now log in."})
 }
+
+// ResendVerificationEmail sends a fresh verification link to an unverified account
+func ResendVerificationEmail(c *gin.Context) {
+	var request struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// Answer the same way for unknown and already verified addresses
+	response := gin.H{"message": "If the account exists and is not verified yet, a new verification email has been sent."}
+
+	var userID int64
+	var verified bool
+	err := db.DB.QueryRow("SELECT id, verified FROM users WHERE email = ?", request.Email).Scan(&userID, &verified)
+	if err != nil || verified {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	// Throttled and failed sends are logged and answered like any other request, so
+	// the answer never reveals that an unverified account has the address
+	sentToday, secondsAgo, err := recentEmailTokens(userID, emailTokenVerifyEmail)
+	if err != nil {
+		log.Printf("Error checking verification emails: %v\n", err)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if sentToday >= verificationResendDailyMax || (sentToday > 0 && secondsAgo < int(verificationResendInterval.Seconds())) {
+		log.Printf("Verification email for user %d throttled\n", userID)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	token, err := GenerateVerificationToken(userID)
+	if err != nil {
+		log.Printf("Error generating verification token: %v\n", err)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	if err := sendVerificationEmail(c, request.Email, token); err != nil {
+		log.Printf("Error sending verification email: %v\n", err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
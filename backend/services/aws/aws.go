@@ -7,10 +7,13 @@ import (
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -139,3 +142,159 @@ func UploadFile(c *gin.Context) {
         "fileURL":  fileURL,
     })
 }
+
+// DeletePrefix removes every object stored under a key prefix, e.g. "profile/alice/"
+func DeletePrefix(prefix string) error {
+    if sess == nil {
+        return fmt.Errorf("AWS session is not initialized")
+    }
+
+    // Nothing can have been uploaded without a bucket
+    bucketName := os.Getenv("AWS_BUCKET_NAME")
+    if bucketName == "" {
+        return nil
+    }
+    svc := s3.New(sess)
+
+    var deleteErr error
+    err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+        Bucket: aws.String(bucketName),
+        Prefix: aws.String(prefix),
+    }, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+        if len(page.Contents) == 0 {
+            return true
+        }
+
+        objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+        for _, object := range page.Contents {
+            objects = append(objects, &s3.ObjectIdentifier{Key: object.Key})
+        }
+
+        output, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+            Bucket: aws.String(bucketName),
+            Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+        })
+        if err != nil {
+            deleteErr = err
+            return false
+        }
+        if len(output.Errors) > 0 {
+            deleteErr = fmt.Errorf("unable to delete %s: %s", aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+            return false
+        }
+        return true
+    })
+    if err != nil {
+        return err
+    }
+    return deleteErr
+}
+
+// ErrNotConfigured is returned when no bucket is set up to store objects in
+var ErrNotConfigured = fmt.Errorf("storage is not configured")
+
+// bucket returns the S3 client and bucket name, or ErrNotConfigured
+func bucket() (*s3.S3, string, error) {
+    bucketName := os.Getenv("AWS_BUCKET_NAME")
+    if sess == nil || bucketName == "" {
+        return nil, "", ErrNotConfigured
+    }
+    return s3.New(sess), bucketName, nil
+}
+
+// KeyFromURL turns the URL of an uploaded file back into its object key. It reports
+// false for URLs that do not point into our bucket, like the default profile picture.
+func KeyFromURL(fileURL string) (string, bool) {
+    prefix := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", os.Getenv("AWS_BUCKET_NAME"), os.Getenv("AWS_REGION"))
+    if os.Getenv("AWS_BUCKET_NAME") == "" || !strings.HasPrefix(fileURL, prefix) || len(fileURL) == len(prefix) {
+        return "", false
+    }
+    return strings.TrimPrefix(fileURL, prefix), true
+}
+
+// GetObject opens a stored object for reading. The caller closes it.
+func GetObject(key string) (io.ReadCloser, int64, error) {
+    svc, bucketName, err := bucket()
+    if err != nil {
+        return nil, 0, err
+    }
+
+    output, err := svc.GetObject(&s3.GetObjectInput{
+        Bucket: aws.String(bucketName),
+        Key:    aws.String(key),
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+    return output.Body, aws.Int64Value(output.ContentLength), nil
+}
+
+// PutPrivateObject stores an object that is only reachable through the API, never
+// through a public URL
+func PutPrivateObject(key string, body io.ReadSeeker, contentType string) error {
+    svc, bucketName, err := bucket()
+    if err != nil {
+        return err
+    }
+
+    _, err = svc.PutObject(&s3.PutObjectInput{
+        Bucket:      aws.String(bucketName),
+        Key:         aws.String(key),
+        Body:        body,
+        ContentType: aws.String(contentType),
+        ACL:         aws.String("private"),
+    })
+    return err
+}
+
+// DeleteObject removes a single object
+func DeleteObject(key string) error {
+    svc, bucketName, err := bucket()
+    if err == ErrNotConfigured {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    _, err = svc.DeleteObject(&s3.DeleteObjectInput{
+        Bucket: aws.String(bucketName),
+        Key:    aws.String(key),
+    })
+    return err
+}
+
+// CopyPrefix copies every object under one key prefix to another, e.g. when the folder
+// of a profile is renamed. Copies are public like the uploads they come from.
+func CopyPrefix(from, to string) error {
+    svc, bucketName, err := bucket()
+    if err == ErrNotConfigured {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    var copyErr error
+    err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+        Bucket: aws.String(bucketName),
+        Prefix: aws.String(from),
+    }, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+        for _, object := range page.Contents {
+            key := aws.StringValue(object.Key)
+            _, err := svc.CopyObject(&s3.CopyObjectInput{
+                Bucket:     aws.String(bucketName),
+                CopySource: aws.String(url.PathEscape(bucketName + "/" + key)),
+                Key:        aws.String(to + strings.TrimPrefix(key, from)),
+                ACL:        aws.String("public-read"),
+            })
+            if err != nil {
+                copyErr = fmt.Errorf("unable to copy %s: %w", key, err)
+                return false
+            }
+        }
+        return true
+    })
+    if err != nil {
+        return err
+    }
+    return copyErr
+}
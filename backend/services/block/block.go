@@ -0,0 +1,261 @@
+package block
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// IsBlocked reports whether either of two users has blocked the other. Blocks work
+// both ways so neither side can follow or message the other.
+func IsBlocked(userID, otherID int64) (bool, error) {
+    var blocked bool
+    err := db.DB.QueryRow(`
+        SELECT EXISTS(SELECT 1 FROM user_blocks
+            WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?))`,
+        userID, otherID, otherID, userID).Scan(&blocked)
+    return blocked, err
+}
+
+// IsMuted reports whether a user muted someone and should not be notified about them
+func IsMuted(userID, mutedID int64) (bool, error) {
+    var muted bool
+    err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM user_mutes WHERE muter_id = ? AND muted_id = ?)", userID, mutedID).Scan(&muted)
+    return muted, err
+}
+
+// resolveTarget looks up the current user and the user named in the path
+func resolveTarget(c *gin.Context) (userID int64, targetID int64, ok bool) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, valid := claims.(*utils.CustomClaims)
+    if !valid {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    if customClaims.Username == c.Param("username") {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot do this to yourself"})
+        return
+    }
+
+    err := db.DB.QueryRow(`
+        SELECT me.id, u.id
+        FROM users me
+        JOIN users u ON u.username = ?
+        WHERE me.username = ?`, c.Param("username"), customClaims.Username).Scan(&userID, &targetID)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User does not exist"})
+        return
+    } else if err != nil {
+        log.Printf("Error retrieving user IDs: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user IDs"})
+        return
+    }
+
+    ok = true
+    return
+}
+
+// BlockUser blocks a user and removes any follow between the two of them
+func BlockUser(c *gin.Context) {
+    userID, targetID, ok := resolveTarget(c)
+    if !ok {
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Printf("Error starting transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting transaction"})
+        return
+    }
+    defer tx.Rollback()
+
+    statements := []struct {
+        query string
+        args  []interface{}
+    }{
+        {"INSERT IGNORE INTO user_blocks (blocker_id, blocked_id) VALUES (?, ?)", []interface{}{userID, targetID}},
+        {"DELETE FROM followers WHERE (follower_id = ? AND following_id = ?) OR (follower_id = ? AND following_id = ?)", []interface{}{userID, targetID, targetID, userID}},
+        {"DELETE FROM follow_requests WHERE (requester_id = ? AND target_id = ?) OR (requester_id = ? AND target_id = ?)", []interface{}{userID, targetID, targetID, userID}},
+        {"DELETE FROM notifications WHERE user_id = ? AND type = ? AND actor_id = ?", []interface{}{userID, models.FollowRequestNotificationType, targetID}},
+    }
+    for _, statement := range statements {
+        if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+            log.Printf("Error blocking user: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error blocking user"})
+            return
+        }
+    }
+
+    // Unread follow notifications about the removed follows go away with them
+    blockerChanged, err := notifications.RetractFollow(tx, userID, targetID)
+    if err != nil {
+        log.Printf("Error retracting follow notification: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error blocking user"})
+        return
+    }
+    targetChanged, err := notifications.RetractFollow(tx, targetID, userID)
+    if err != nil {
+        log.Printf("Error retracting follow notification: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error blocking user"})
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        log.Printf("Error committing transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error committing transaction"})
+        return
+    }
+
+    if blockerChanged {
+        claims, _ := c.Get("claims")
+        if _, err := notifications.BroadcastUnreadCount(userID, claims.(*utils.CustomClaims).Username); err != nil {
+            log.Printf("Error broadcasting notification count: %v\n", err)
+        }
+    }
+    if targetChanged {
+        if _, err := notifications.BroadcastUnreadCount(targetID, c.Param("username")); err != nil {
+            log.Printf("Error broadcasting notification count: %v\n", err)
+        }
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "User blocked"})
+}
+
+// UnblockUser lifts a block. Removed follows are not restored.
+func UnblockUser(c *gin.Context) {
+    userID, targetID, ok := resolveTarget(c)
+    if !ok {
+        return
+    }
+
+    result, err := db.DB.Exec("DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?", userID, targetID)
+    if err != nil {
+        log.Printf("Error unblocking user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unblocking user"})
+        return
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "You have not blocked this user"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "User unblocked"})
+}
+
+// MuteUser stops notifications about a user without affecting anything else
+func MuteUser(c *gin.Context) {
+    userID, targetID, ok := resolveTarget(c)
+    if !ok {
+        return
+    }
+
+    _, err := db.DB.Exec("INSERT IGNORE INTO user_mutes (muter_id, muted_id) VALUES (?, ?)", userID, targetID)
+    if err != nil {
+        log.Printf("Error muting user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error muting user"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "User muted"})
+}
+
+// UnmuteUser turns notifications about a user back on
+func UnmuteUser(c *gin.Context) {
+    userID, targetID, ok := resolveTarget(c)
+    if !ok {
+        return
+    }
+
+    result, err := db.DB.Exec("DELETE FROM user_mutes WHERE muter_id = ? AND muted_id = ?", userID, targetID)
+    if err != nil {
+        log.Printf("Error unmuting user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unmuting user"})
+        return
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "You have not muted this user"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "User unmuted"})
+}
+
+// ListBlockedUsers returns the users the current user blocked
+func ListBlockedUsers(c *gin.Context) {
+    listUsers(c, "blocked_users", `
+        SELECT u.username, u.profile_picture, b.created_at
+        FROM user_blocks b
+        JOIN users me ON me.id = b.blocker_id
+        JOIN users u ON u.id = b.blocked_id
+        WHERE me.username = ?
+        ORDER BY b.created_at DESC`)
+}
+
+// ListMutedUsers returns the users the current user muted
+func ListMutedUsers(c *gin.Context) {
+    listUsers(c, "muted_users", `
+        SELECT u.username, u.profile_picture, m.created_at
+        FROM user_mutes m
+        JOIN users me ON me.id = m.muter_id
+        JOIN users u ON u.id = m.muted_id
+        WHERE me.username = ?
+        ORDER BY m.created_at DESC`)
+}
+
+func listUsers(c *gin.Context, key, query string) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    rows, err := db.DB.Query(query, customClaims.Username)
+    if err != nil {
+        log.Printf("Error retrieving %s: %v\n", key, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving users"})
+        return
+    }
+    defer rows.Close()
+
+    users := []gin.H{}
+    for rows.Next() {
+        var username, profilePicture string
+        var createdAt time.Time
+        if err := rows.Scan(&username, &profilePicture, &createdAt); err != nil {
+            log.Printf("Error scanning %s: %v\n", key, err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving users"})
+            return
+        }
+        users = append(users, gin.H{
+            "username":        username,
+            "profile_picture": profilePicture,
+            "created_at":      createdAt.Format("2006-01-02 15:04:05"),
+        })
+    }
+
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through %s: %v\n", key, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving users"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{key: users})
+}
@@ -8,14 +8,17 @@ import (
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/vaanskii/vansify/db"
 	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
 	"github.com/vaanskii/vansify/notifications/chat_notifications"
+	"github.com/vaanskii/vansify/notifications/webpush"
+	"github.com/vaanskii/vansify/services/audience"
+	"github.com/vaanskii/vansify/services/block"
 	chatHub "github.com/vaanskii/vansify/services/chat/hub"
 	"github.com/vaanskii/vansify/services/user"
 	"github.com/vaanskii/vansify/utils"
@@ -32,6 +35,11 @@ var (
 	hub = chatHub.NewHub()
 )
 
+// DisconnectUser closes every chat WebSocket of a user
+func DisconnectUser(username, reason string) {
+	hub.DisconnectUser(username, reason)
+}
+
 func generateChatID() (string, error) {
 	bytes := make([]byte, 16)
 	if _, err := rand.Read(bytes); err != nil {
@@ -40,6 +48,18 @@ func generateChatID() (string, error) {
     return hex.EncodeToString(bytes), nil
 }
 
+// loadChat reads the IDs and usernames of the two users of a chat
+func loadChat(chatID string) (models.Chat, error) {
+    var chat models.Chat
+    err := db.DB.QueryRow(`
+        SELECT c.chat_id, c.user1_id, u1.username, c.user2_id, u2.username, c.request_status
+        FROM chats c
+        JOIN users u1 ON u1.id = c.user1_id
+        JOIN users u2 ON u2.id = c.user2_id
+        WHERE c.chat_id = ?`, chatID).Scan(&chat.ChatID, &chat.User1ID, &chat.User1, &chat.User2ID, &chat.User2, &chat.RequestStatus)
+    return chat, err
+}
+
 
 // Creating chat if not exists
 func CreateChat(c *gin.Context) {
@@ -60,26 +80,62 @@ func CreateChat(c *gin.Context) {
     }
     chat.User1 = user1  // Automatically set user1 from the authenticated user
 
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", chat.User1).Scan(&chat.User1ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
     // Check if user2 exists
-    var user2Exists bool
-    err := db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", chat.User2).Scan(&user2Exists)
-    if err != nil || !user2Exists {
+    err = db.DB.QueryRow("SELECT id FROM users WHERE username = ?", chat.User2).Scan(&chat.User2ID)
+    if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "User2 does not exist"})
         return
     }
 
+    blocked, err := block.IsBlocked(chat.User1ID, chat.User2ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking blocks"})
+        return
+    }
+    if blocked {
+        c.JSON(http.StatusForbidden, gin.H{"error": "You cannot message this user"})
+        return
+    }
+
     // Check if chat already exists
-    var existingChat string
-    err = db.DB.QueryRow("SELECT chat_id FROM chats WHERE (user1 = ? AND user2 = ?) OR (user1 = ? AND user2 = ?)",
-        chat.User1, chat.User2, chat.User2, chat.User1).Scan(&existingChat)
+    var existingChat, requestStatus string
+    var requesterID int64
+    err = db.DB.QueryRow("SELECT chat_id, request_status, user1_id FROM chats WHERE (user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?)",
+        chat.User1ID, chat.User2ID, chat.User2ID, chat.User1ID).Scan(&existingChat, &requestStatus, &requesterID)
     if err == nil {
-        c.JSON(http.StatusOK, gin.H{"chat_id": existingChat})
+        // Starting a chat with someone whose message request you received accepts it
+        if requestStatus != requestAccepted && requesterID == chat.User2ID {
+            if err := acceptMessageRequest(existingChat, chat.User2ID, chat.User2); err != nil {
+                log.Printf("Error accepting message request: %v\n", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accepting message request"})
+                return
+            }
+            requestStatus = requestAccepted
+        }
+        c.JSON(http.StatusOK, gin.H{"chat_id": existingChat, "request_status": requestStatus})
         return
     } else if err != sql.ErrNoRows {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking existing chat"})
         return
     }
 
+    // Chats from outside the audience user2 chose wait in their message requests
+    allowed, err := audience.Allows(audience.RuleChat, chat.User2ID, chat.User1ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking chat permissions"})
+        return
+    }
+    chat.RequestStatus = requestAccepted
+    if !allowed {
+        chat.RequestStatus = requestPending
+    }
+
     // If chat does not exist, create a new one
     chatID, err := generateChatID()
     if err != nil {
@@ -87,36 +143,32 @@ func CreateChat(c *gin.Context) {
         return
     }
     chat.ChatID = chatID
-    _, execErr := db.DB.Exec("INSERT INTO chats (chat_id, user1, user2) VALUES (?, ?, ?)", chat.ChatID, chat.User1, chat.User2)
+    _, execErr := db.DB.Exec("INSERT INTO chats (chat_id, user1_id, user2_id, request_status) VALUES (?, ?, ?, ?)", chat.ChatID, chat.User1ID, chat.User2ID, chat.RequestStatus)
     if execErr != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving chat to database"})
         return
     }
 
     // Do not notify the other user until a message is sent
-    c.JSON(http.StatusOK, gin.H{"chat_id": chat.ChatID})
+    c.JSON(http.StatusOK, gin.H{"chat_id": chat.ChatID, "request_status": chat.RequestStatus})
 }
 
 func ChatWsHandler(c *gin.Context) {
     chatID := c.Param("chatID")
-    token := c.Query("token")
 
-    token = strings.TrimSpace(token)
-
-    // Verify JWT token
-    parsedToken, err := utils.VerifyJWT(token)
-    if err != nil {
+    // AuthMiddleware has checked the token, including the scopes of personal access tokens
+    claims, exists := c.Get("claims")
+    if !exists {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
         return
     }
-
-    claims, ok := parsedToken.Claims.(*utils.CustomClaims)
-    if !ok || !parsedToken.Valid {
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
         return
     }
 
-    senderUsername := claims.Username
+    senderUsername := customClaims.Username
 
     // Upgrade to WebSocket
     conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -125,28 +177,32 @@ func ChatWsHandler(c *gin.Context) {
     }
     defer conn.Close()
 
-    cm := user.ChatManagerInstance
-    cm.AddUserToChat(chatID, senderUsername)
-    defer cm.RemoveUserFromChat(chatID, senderUsername)
-
-    hub.AddConnection(conn, senderUsername)
-    defer hub.RemoveConnection(conn)
-
     // Retrieve chat users
-    var chat models.Chat
-    err = db.DB.QueryRow("SELECT user1, user2 FROM chats WHERE chat_id = ?", chatID).Scan(&chat.User1, &chat.User2)
+    chat, err := loadChat(chatID)
     if err != nil {
         return
     }
 
-    // Determine recipient username
+    // Determine the sender and recipient; only the two users of a chat can write to it
+    var senderID, recipientID int64
     var recipientUsername string
-    if senderUsername == chat.User1 {
-        recipientUsername = chat.User2
-    } else {
-        recipientUsername = chat.User1
+    switch senderUsername {
+    case chat.User1:
+        senderID, recipientID, recipientUsername = chat.User1ID, chat.User2ID, chat.User2
+    case chat.User2:
+        senderID, recipientID, recipientUsername = chat.User2ID, chat.User1ID, chat.User1
+    default:
+        return
     }
 
+    // Only participants are registered in the chat, so others get no broadcasts or read receipts
+    cm := user.ChatManagerInstance
+    cm.AddUserToChat(chatID, senderUsername)
+    defer cm.RemoveUserFromChat(chatID, senderUsername)
+
+    hub.AddConnection(conn, senderUsername)
+    defer hub.RemoveConnection(conn)
+
     for {
         messageType, p, err := conn.ReadMessage()
         if err != nil {
@@ -158,39 +214,74 @@ func ChatWsHandler(c *gin.Context) {
             continue
         }
 
+        // Blocks can start while the socket is open
+        blocked, err := block.IsBlocked(senderID, recipientID)
+        if err != nil || blocked {
+            errorMessage, _ := json.Marshal(map[string]interface{}{
+                "type":  "ERROR",
+                "error": "You cannot message this user",
+            })
+            conn.WriteMessage(websocket.TextMessage, errorMessage)
+            continue
+        }
+
+        // The recipient can accept or decline a message request while the socket is open
+        var requestStatus string
+        if err := db.DB.QueryRow("SELECT request_status FROM chats WHERE chat_id = ?", chatID).Scan(&requestStatus); err != nil {
+            continue
+        }
+        if errorText := messageRequestError(requestStatus, senderID == chat.User1ID); errorText != "" {
+            errorMessage, _ := json.Marshal(map[string]interface{}{
+                "type":  "ERROR",
+                "error": errorText,
+            })
+            conn.WriteMessage(websocket.TextMessage, errorMessage)
+            continue
+        }
+
+        // Messages from muted users, and message requests, are delivered without notifying the recipient
+        muted, err := block.IsMuted(recipientID, senderID)
+        if err != nil {
+            muted = false
+        }
+        if requestStatus == requestPending {
+            muted = true
+        }
+
         incomingMessage.ChatID = chatID
+        incomingMessage.UserID = senderID
         incomingMessage.Username = senderUsername
         incomingMessage.Status = "sending"
 
         // Check for duplicate message
         var duplicateMessageID int
-        err = db.DB.QueryRow("SELECT id FROM messages WHERE chat_id = ? AND message = ? AND username = ? AND created_at = ?", 
-            incomingMessage.ChatID, incomingMessage.Message, incomingMessage.Username, incomingMessage.CreatedAt).Scan(&duplicateMessageID)
+        err = db.DB.QueryRow("SELECT id FROM messages WHERE chat_id = ? AND message = ? AND user_id = ? AND created_at = ?", 
+            incomingMessage.ChatID, incomingMessage.Message, incomingMessage.UserID, incomingMessage.CreatedAt).Scan(&duplicateMessageID)
         if err == nil {
             continue
         }
 
 
         var senderProfilePicture string
-        err = db.DB.QueryRow("SELECT profile_picture FROM users WHERE username = ?", senderUsername).Scan(&senderProfilePicture)
+        err = db.DB.QueryRow("SELECT profile_picture FROM users WHERE id = ?", senderID).Scan(&senderProfilePicture)
         if err != nil {
             senderProfilePicture = ""
         }
 
         var recipientProfilePicture string
-        err = db.DB.QueryRow("SELECT profile_picture FROM users WHERE username = ?", recipientUsername).Scan(&recipientProfilePicture)
+        err = db.DB.QueryRow("SELECT profile_picture FROM users WHERE id = ?", recipientID).Scan(&recipientProfilePicture)
         if err != nil {
             recipientProfilePicture = ""
         }
 
-        // Reset the deleted_for field for the chat and messages
-        _, err = db.DB.Exec("UPDATE chats SET deleted_for = NULL WHERE chat_id = ?", chatID)
+        // A new message brings the chat back for users who deleted it
+        _, err = db.DB.Exec("DELETE FROM chat_deletions WHERE chat_id = ?", chatID)
         if err != nil {
         }
 
         // Save message to database with initial status 'sending'
-        result, execErr := db.DB.Exec("INSERT INTO messages (chat_id, message, username, file_url, status, created_at) VALUES (?, ?, ?, ?, ?, ?)",
-            incomingMessage.ChatID, incomingMessage.Message, incomingMessage.Username, incomingMessage.FileURL, incomingMessage.Status, incomingMessage.CreatedAt)
+        result, execErr := db.DB.Exec("INSERT INTO messages (chat_id, message, user_id, file_url, status, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+            incomingMessage.ChatID, incomingMessage.Message, incomingMessage.UserID, incomingMessage.FileURL, incomingMessage.Status, incomingMessage.CreatedAt)
         if execErr != nil {
             continue
         }
@@ -269,9 +360,9 @@ func ChatWsHandler(c *gin.Context) {
         // Marshal the full message
         broadcastMessage, _ := json.Marshal(fullMessage)
 
-        // Send the message to the recipient only
+        // Send the message to the recipient only; message requests reach them only in the chat
         recipientConn := hub.GetConnectionByUsername(recipientUsername)
-        if recipientConn != nil {
+        if recipientConn != nil && (requestStatus == requestAccepted || cm.IsUserInChat(chatID, recipientUsername)) {
             recipientConn.WriteMessage(messageType, broadcastMessage)
         }
 
@@ -284,53 +375,50 @@ func ChatWsHandler(c *gin.Context) {
         if err != nil {
         }
 
-        var recipientID int
-        err = db.DB.QueryRow("SELECT id FROM users WHERE username = ?", recipientUsername).Scan(&recipientID)
-        if err != nil {
-        } else {
-            if !cm.IsUserInChat(chatID, recipientUsername) {
-                // Only send notifications if the recipient is not in the chat
-                chat_notifications.NotifyNewMessage(int64(recipientID), incomingMessage)
-                chatUnreadCount, err := chat_notifications.GetUnreadChatMessagesCount(int64(recipientID), chatID)
+        recipientInChat := cm.IsUserInChat(chatID, recipientUsername)
+        if !recipientInChat && !muted {
+            // Only send notifications if the recipient is not in the chat, and only where their preferences allow
+            delivery := notifications.DeliveryFor(recipientID, models.MessageNotificationType)
+            if delivery.Store {
+                chat_notifications.NotifyNewMessage(recipientID, incomingMessage)
+            }
+            chatUnreadCount, err := chat_notifications.GetUnreadChatMessagesCount(recipientID, chatID)
+            if err == nil && delivery.ChatSocket {
+                totalUnreadCount, err := chat_notifications.GetTotalUnreadMessageCount(recipientID)
                 if err == nil {
-                    totalUnreadCount, err := chat_notifications.GetTotalUnreadMessageCount(int64(recipientID))
-                    if err == nil {
-                        chatNotificationMessage := map[string]interface{}{
-                            "user_id":            recipientID,
-                            "chat_id":            chatID,
-                            "unread_count":       chatUnreadCount,
-                            "total_unread_count": totalUnreadCount,
-                            "message":            incomingMessage.Message,
-                            "recipient":          recipientUsername,
-                            "user":               senderUsername,
-                            "profile_picture":    senderProfilePicture,
-                            "receiver_profile_picture": recipientProfilePicture,
-                            "sender_profile_picture": senderProfilePicture,
-                            "sender":             senderUsername,
-                            "last_message_time":  time.Now().UTC().Format(time.RFC3339),
-                            "last_message":       lastMessage,
-                        }
-                        chatNotificationJSON, _ := json.Marshal(chatNotificationMessage)
-                        chat_notifications.ChatNotification.SendChatNotification(recipientUsername, chatNotificationJSON)
+                    chatNotificationMessage := map[string]interface{}{
+                        "user_id":            recipientID,
+                        "chat_id":            chatID,
+                        "unread_count":       chatUnreadCount,
+                        "total_unread_count": totalUnreadCount,
+                        "message":            incomingMessage.Message,
+                        "recipient":          recipientUsername,
+                        "user":               senderUsername,
+                        "profile_picture":    senderProfilePicture,
+                        "receiver_profile_picture": recipientProfilePicture,
+                        "sender_profile_picture": senderProfilePicture,
+                        "sender":             senderUsername,
+                        "last_message_time":  time.Now().UTC().Format(time.RFC3339),
+                        "last_message":       lastMessage,
                     }
+                    chatNotificationJSON, _ := json.Marshal(chatNotificationMessage)
+                    chat_notifications.ChatNotification.SendChatNotification(recipientUsername, chatNotificationJSON)
                 }
-            } else {
-                // Simplified notification if the recipient is in the chat
-                chatNotificationMessage := map[string]interface{}{
-                    "chat_id": chatID,
-                    "last_message_time": time.Now().UTC().Format(time.RFC3339),
-                    "last_message": lastMessage,
-                    "user": senderUsername,
-                    "receiver_profile_picture": recipientProfilePicture,
-                    "sender_profile_picture": senderProfilePicture,
-                    "receiver": recipientUsername,
-                    "sender": senderUsername,
-                }
-                chatNotificationJSON, _ := json.Marshal(chatNotificationMessage)
-                chat_notifications.ChatNotification.SendChatNotification(recipientUsername, chatNotificationJSON)
             }
-            
-            // Always send notification to the sender to update their chat view
+            // A recipient with the app closed gets a Web Push on their devices instead
+            if !chat_notifications.ChatNotification.IsConnected(recipientUsername) {
+                webpush.Notify(recipientID, webpush.Message{
+                    Type:   models.MessageNotificationType,
+                    Title:  senderUsername,
+                    Body:   incomingMessage.Message,
+                    Tag:    "chat-" + chatID,
+                    URL:    "/inbox/" + chatID,
+                    Actor:  senderUsername,
+                    ChatID: chatID,
+                })
+            }
+        } else if recipientInChat {
+            // Simplified notification if the recipient is in the chat
             chatNotificationMessage := map[string]interface{}{
                 "chat_id": chatID,
                 "last_message_time": time.Now().UTC().Format(time.RFC3339),
@@ -342,9 +430,22 @@ func ChatWsHandler(c *gin.Context) {
                 "sender": senderUsername,
             }
             chatNotificationJSON, _ := json.Marshal(chatNotificationMessage)
-            chat_notifications.ChatNotification.SendChatNotification(senderUsername, chatNotificationJSON)
-                        
+            chat_notifications.ChatNotification.SendChatNotification(recipientUsername, chatNotificationJSON)
+        }
+        
+        // Always send notification to the sender to update their chat view
+        chatNotificationMessage := map[string]interface{}{
+            "chat_id": chatID,
+            "last_message_time": time.Now().UTC().Format(time.RFC3339),
+            "last_message": lastMessage,
+            "user": senderUsername,
+            "receiver_profile_picture": recipientProfilePicture,
+            "sender_profile_picture": senderProfilePicture,
+            "receiver": recipientUsername,
+            "sender": senderUsername,
         }
+        chatNotificationJSON, _ := json.Marshal(chatNotificationMessage)
+        chat_notifications.ChatNotification.SendChatNotification(senderUsername, chatNotificationJSON)
     }
 }
 
@@ -358,7 +459,7 @@ func UpdateStatusWhenUserBecomesActive(chatID string, recipientUsername string,
     }
 
     if isActive && !lastActive.Valid {
-        rows, err := db.DB.Query("SELECT id FROM messages WHERE chat_id = ? AND username = ? AND status = 'sent'", chatID, senderUsername)
+        rows, err := db.DB.Query("SELECT id FROM messages WHERE chat_id = ? AND user_id = (SELECT id FROM users WHERE username = ?) AND status = 'sent'", chatID, senderUsername)
         if err != nil {
             return
         }
@@ -373,7 +474,7 @@ func UpdateStatusWhenUserBecomesActive(chatID string, recipientUsername string,
             messageIDs = append(messageIDs, messageID)
         }
 
-        _, err = db.DB.Exec("UPDATE messages SET status = 'delivered' WHERE chat_id = ? AND username = ? AND status = 'sent'", chatID, senderUsername)
+        _, err = db.DB.Exec("UPDATE messages SET status = 'delivered' WHERE chat_id = ? AND user_id = (SELECT id FROM users WHERE username = ?) AND status = 'sent'", chatID, senderUsername)
         if err != nil {
         } else {
             statusUpdateMessage := map[string]interface{}{
@@ -405,30 +506,26 @@ func MarkChatNotificationsAsRead(c *gin.Context) {
     chatID := c.Param("chatID")
 
     // Ensure user is part of the chat
-    var chat models.Chat
-    err := db.DB.QueryRow("SELECT user1, user2 FROM chats WHERE chat_id = ?", chatID).Scan(&chat.User1, &chat.User2)
+    chat, err := loadChat(chatID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error querying chat"})
         return
     }
 
-    // Determine recipient username
-    var recipientUsername string
-    if username == chat.User1 {
-        recipientUsername = chat.User2
-    } else {
-        recipientUsername = chat.User1
-    }
-
-    var userID int64
-    err = db.DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+    // Determine the other user of the chat
+    var userID, otherUserID int64
+    switch username {
+    case chat.User1:
+        userID, otherUserID = chat.User1ID, chat.User2ID
+    case chat.User2:
+        userID, otherUserID = chat.User2ID, chat.User1ID
+    default:
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
         return
     }
 
     // Update message statuses to "read" only if the user is the recipient
-    _, err = db.DB.Exec("UPDATE messages SET status = 'read' WHERE chat_id = ? AND username = ?", chatID, recipientUsername)
+    _, err = db.DB.Exec("UPDATE messages SET status = 'read' WHERE chat_id = ? AND user_id = ?", chatID, otherUserID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating message statuses to read"})
         return
@@ -473,6 +570,26 @@ func GetChatHistory(c *gin.Context) {
 
     username := customClaims.Username
 
+    chat, err := loadChat(chatID)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error querying chat"})
+        return
+    }
+
+    var userID int64
+    switch username {
+    case chat.User1:
+        userID = chat.User1ID
+    case chat.User2:
+        userID = chat.User2ID
+    default:
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
     // Get limit and offset from query parameters
     limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
     if err != nil || limit <= 0 {
@@ -486,8 +603,14 @@ func GetChatHistory(c *gin.Context) {
         return
     }
 
-    // Fetch messages for the chat with pagination, including messages marked as deleted for the user
-    rows, err := db.DB.Query("SELECT id, chat_id, message, username, file_url, created_at, status FROM messages WHERE chat_id = ? AND (deleted_for IS NULL OR deleted_for NOT LIKE ?) ORDER BY created_at DESC LIMIT ? OFFSET ?", chatID, "%"+username+"%", limit, offset)
+    // Fetch messages for the chat with pagination, leaving out the ones the user deleted
+    rows, err := db.DB.Query(`
+        SELECT m.id, m.chat_id, m.message, m.user_id, u.username, COALESCE(m.file_url, ''), m.created_at, m.status, u.profile_picture
+        FROM messages m
+        JOIN users u ON u.id = m.user_id
+        WHERE m.chat_id = ? AND NOT EXISTS (SELECT 1 FROM message_deletions d WHERE d.message_id = m.id AND d.user_id = ?)
+        ORDER BY m.created_at DESC
+        LIMIT ? OFFSET ?`, chatID, userID, limit, offset)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching chat history"})
         return
@@ -498,18 +621,12 @@ func GetChatHistory(c *gin.Context) {
     for rows.Next() {
         var message models.Message
         var createdAt time.Time
-        if err := rows.Scan(&message.ID, &message.ChatID, &message.Message, &message.Username, &message.FileURL, &createdAt, &message.Status); err != nil {
+        var profilePicture string
+        if err := rows.Scan(&message.ID, &message.ChatID, &message.Message, &message.UserID, &message.Username, &message.FileURL, &createdAt, &message.Status, &profilePicture); err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning message"})
             return
         }
 
-        // Fetch the profile picture for the message sender
-        var profilePicture string
-        err := db.DB.QueryRow("SELECT profile_picture FROM users WHERE username = ?", message.Username).Scan(&profilePicture)
-        if err != nil {
-            profilePicture = ""
-        }
-
         formattedTime := createdAt.Format(time.RFC3339)
         messages = append(messages, map[string]interface{}{
             "id":              message.ID,
@@ -531,7 +648,12 @@ func CheckChatExists(c *gin.Context) {
 	user2 := c.Param("user2")
   
 	var chatID string
-	err := db.DB.QueryRow("SELECT chat_id FROM chats WHERE (user1 = ? AND user2 = ?) OR (user1 = ? AND user2 = ?)", user1, user2, user2, user1).Scan(&chatID)
+	err := db.DB.QueryRow(`
+		SELECT c.chat_id
+		FROM chats c
+		JOIN users u1 ON u1.id = c.user1_id
+		JOIN users u2 ON u2.id = c.user2_id
+		WHERE (u1.username = ? AND u2.username = ?) OR (u1.username = ? AND u2.username = ?)`, user1, user2, user2, user1).Scan(&chatID)
 	if err != nil {
 	  if err == sql.ErrNoRows {
 		c.JSON(http.StatusOK, gin.H{"chat_id": ""})
@@ -560,10 +682,9 @@ func DeleteChat(c *gin.Context) {
     }
 
     username := customClaims.Username
-    var chat models.Chat
 
     // Ensure the user is part of the chat
-    err := db.DB.QueryRow("SELECT user1, user2 FROM chats WHERE chat_id = ?", chatID).Scan(&chat.User1, &chat.User2)
+    chat, err := loadChat(chatID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error querying chat"})
         return
@@ -588,15 +709,8 @@ func DeleteChat(c *gin.Context) {
     }
 
     // Mark the chat as deleted for both users
-    _, err = db.DB.Exec(`
-        UPDATE chats 
-        SET deleted_for = 
-            CASE 
-                WHEN deleted_for IS NULL OR deleted_for = '' THEN ?
-                ELSE CONCAT(deleted_for, ',', ?)
-            END 
-        WHERE chat_id = ?`, 
-        chat.User1+","+chat.User2, chat.User1+","+chat.User2, chatID)
+    _, err = db.DB.Exec("INSERT IGNORE INTO chat_deletions (user_id, chat_id) VALUES (?, ?), (?, ?)",
+        chat.User1ID, chatID, chat.User2ID, chatID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marking chat as deleted"})
         return
@@ -629,38 +743,25 @@ func DeleteUserMessages(c *gin.Context) {
     }
 
     username := customClaims.Username
-    var chatUserCount int
-    err := db.DB.QueryRow("SELECT COUNT(*) FROM chats WHERE chat_id = ? AND (user1 = ? OR user2 = ?)", chatID, username, username).Scan(&chatUserCount)
-    if err != nil || chatUserCount == 0 {
+    chat, err := loadChat(chatID)
+    if err != nil || (username != chat.User1 && username != chat.User2) {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
         return
     }
+    userID := chat.User1ID
+    if username == chat.User2 {
+        userID = chat.User2ID
+    }
 
     // Mark all messages as deleted for the user
-    _, err = db.DB.Exec(`
-        UPDATE messages 
-        SET deleted_for = 
-            CASE 
-                WHEN deleted_for IS NULL OR deleted_for = '' THEN ?
-                ELSE CONCAT_WS(',', deleted_for, ?)
-            END 
-        WHERE chat_id = ? AND (deleted_for IS NULL OR deleted_for NOT LIKE ?)`, 
-        username, username, chatID, "%"+username+"%")
+    _, err = db.DB.Exec("INSERT IGNORE INTO message_deletions (user_id, message_id) SELECT ?, id FROM messages WHERE chat_id = ?", userID, chatID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marking messages as deleted"})
         return
     }
 
     // Mark the chat as deleted for the user
-    _, err = db.DB.Exec(`
-        UPDATE chats 
-        SET deleted_for = 
-            CASE 
-                WHEN deleted_for IS NULL OR deleted_for = '' THEN ?
-                ELSE CONCAT(deleted_for, ',', ?)
-            END 
-        WHERE chat_id = ? AND (deleted_for IS NULL OR deleted_for NOT LIKE ?)`, 
-        username, username, chatID, "%"+username+"%")
+    _, err = db.DB.Exec("INSERT IGNORE INTO chat_deletions (user_id, chat_id) VALUES (?, ?)", userID, chatID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marking chat as deleted"})
         return
@@ -684,7 +785,8 @@ func DeleteMessage(c *gin.Context) {
     messageID := c.Param("messageID")
 
     var message models.Message
-    err := db.DB.QueryRow("SELECT id, chat_id, username, status FROM messages WHERE id = ?", messageID).Scan(&message.ID, &message.ChatID, &message.Username, &message.Status)
+    err := db.DB.QueryRow("SELECT m.id, m.chat_id, m.user_id, u.username, m.status FROM messages m JOIN users u ON u.id = m.user_id WHERE m.id = ?", messageID).
+        Scan(&message.ID, &message.ChatID, &message.UserID, &message.Username, &message.Status)
     if err != nil {
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect message ID"})
         return
@@ -709,21 +811,13 @@ func DeleteMessage(c *gin.Context) {
     }
 
     // Identify the recipient of the chat
-    var recipientUsername string
-    var chat models.Chat
-    err = db.DB.QueryRow("SELECT user1, user2 FROM chats WHERE chat_id = ?", message.ChatID).Scan(&chat.User1, &chat.User2)
+    chat, err := loadChat(message.ChatID)
     if err == nil {
-        if username == chat.User1 {
-            recipientUsername = chat.User2
-        } else {
-            recipientUsername = chat.User1
+        recipientUserID := chat.User1ID
+        if message.UserID == chat.User1ID {
+            recipientUserID = chat.User2ID
         }
-    }
 
-    // Fetch recipient userID
-    var recipientUserID int64
-    err = db.DB.QueryRow("SELECT id FROM users WHERE username = ?", recipientUsername).Scan(&recipientUserID)
-    if err == nil {
         // Delete chat notification for the recipient if exists
         _, err = db.DB.Exec("DELETE FROM chat_notifications WHERE user_id = ? AND chat_id = ?", recipientUserID, message.ChatID)
         if err == nil {
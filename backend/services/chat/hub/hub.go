@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	"github.com/gorilla/websocket"
+	"github.com/vaanskii/vansify/utils"
 )
 
 type Hub struct {
@@ -44,6 +45,23 @@ func (hub *Hub) GetConnectionByUsername(username string) *websocket.Conn {
     return nil
 }
 
+// DisconnectUser closes every chat connection of a user
+func (h *Hub) DisconnectUser(username, reason string) {
+    h.mu.Lock()
+    var conns []*websocket.Conn
+    for conn, user := range h.connections {
+        if user == username {
+            conns = append(conns, conn)
+            delete(h.connections, conn)
+        }
+    }
+    h.mu.Unlock()
+
+    for _, conn := range conns {
+        utils.CloseWebSocket(conn, reason)
+    }
+}
+
 // BroadcastMessage sends a message to all connected clients except the sender
 func (h *Hub) BroadcastMessage(sender *websocket.Conn, messageType int, message []byte) {
     h.mu.Lock()
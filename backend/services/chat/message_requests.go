@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/notifications/chat_notifications"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// Request statuses of a chat. A chat is a message request when user1 is outside the
+// chat audience of user2 at the time it is created.
+const (
+    requestAccepted = "accepted"
+    requestPending  = "pending"
+    requestDeclined = "declined"
+)
+
+// messageRequestError explains why a message cannot be sent in a chat with the given
+// request status, or returns an empty string if it can. The requester can keep writing
+// while the request is pending, but the recipient has to accept it before replying.
+func messageRequestError(status string, isRequester bool) string {
+    switch {
+    case status == requestAccepted:
+        return ""
+    case !isRequester:
+        return "Accept the message request to reply"
+    case status == requestDeclined:
+        return "This user is not accepting messages from you"
+    default:
+        return ""
+    }
+}
+
+// acceptMessageRequest turns a message request into a regular chat and lets the
+// requester know
+func acceptMessageRequest(chatID string, requesterID int64, requesterUsername string) error {
+    _, err := db.DB.Exec("UPDATE chats SET request_status = ?, request_decided_at = NOW() WHERE chat_id = ?", requestAccepted, chatID)
+    if err != nil {
+        return err
+    }
+
+    if !notifications.DeliveryFor(requesterID, models.MessageNotificationType).ChatSocket {
+        return nil
+    }
+
+    acceptedMessage, _ := json.Marshal(map[string]interface{}{
+        "type":    "MESSAGE_REQUEST_ACCEPTED",
+        "chat_id": chatID,
+    })
+    chat_notifications.ChatNotification.SendChatNotification(requesterUsername, acceptedMessage)
+    return nil
+}
+
+// ListMessageRequests returns the pending message requests of the current user, newest
+// first. Requests without messages are left out until the first message is sent.
+func ListMessageRequests(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT c.chat_id, u.username, u.profile_picture, c.created_at,
+            COUNT(m.id), MAX(m.created_at),
+            (SELECT lm.message FROM messages lm WHERE lm.chat_id = c.chat_id ORDER BY lm.created_at DESC LIMIT 1)
+        FROM chats c
+        JOIN users u ON u.id = c.user1_id
+        JOIN messages m ON m.chat_id = c.chat_id
+        WHERE c.user2_id = ? AND c.request_status = ?
+            AND NOT EXISTS (
+                SELECT 1 FROM user_blocks b
+                WHERE (b.blocker_id = c.user1_id AND b.blocked_id = c.user2_id) OR (b.blocker_id = c.user2_id AND b.blocked_id = c.user1_id)
+            )
+        GROUP BY c.chat_id, u.username, u.profile_picture, c.created_at
+        ORDER BY MAX(m.created_at) DESC`, userID, requestPending)
+    if err != nil {
+        log.Printf("Error retrieving message requests: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving message requests"})
+        return
+    }
+    defer rows.Close()
+
+    requests := []gin.H{}
+    for rows.Next() {
+        var chatID, username, profilePicture string
+        var requestedAt, lastMessageTime sql.NullTime
+        var messageCount int
+        var lastMessage sql.NullString
+        if err := rows.Scan(&chatID, &username, &profilePicture, &requestedAt, &messageCount, &lastMessageTime, &lastMessage); err != nil {
+            log.Printf("Error scanning message request: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving message requests"})
+            return
+        }
+        requests = append(requests, gin.H{
+            "chat_id":           chatID,
+            "user":              username,
+            "profile_picture":   profilePicture,
+            "requested_at":      requestedAt.Time.UTC().Format("2006-01-02T15:04:05Z"),
+            "message_count":     messageCount,
+            "last_message":      lastMessage.String,
+            "last_message_time": lastMessageTime.Time.UTC().Format("2006-01-02T15:04:05Z"),
+        })
+    }
+
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through message requests: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving message requests"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"requests": requests})
+}
+
+// receivedRequest loads the chat in the path if the current user received it as a
+// message request, answering the request otherwise
+func receivedRequest(c *gin.Context) (chat models.Chat, ok bool) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, valid := claims.(*utils.CustomClaims)
+    if !valid {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    chat, err := loadChat(c.Param("chatID"))
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Message request not found"})
+        return
+    } else if err != nil {
+        log.Printf("Error retrieving chat: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error querying chat"})
+        return
+    }
+    if chat.User2 != customClaims.Username || chat.RequestStatus == requestAccepted {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Message request not found"})
+        return
+    }
+
+    return chat, true
+}
+
+// AcceptMessageRequest moves a message request, pending or declined, to the chats of
+// the current user
+func AcceptMessageRequest(c *gin.Context) {
+    chat, ok := receivedRequest(c)
+    if !ok {
+        return
+    }
+    chatID := chat.ChatID
+
+    if err := acceptMessageRequest(chatID, chat.User1ID, chat.User1); err != nil {
+        log.Printf("Error accepting message request: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error accepting message request"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"chat_id": chatID, "request_status": requestAccepted})
+}
+
+// DeclineMessageRequest hides a message request and stops the requester from sending
+// more messages. The requester is not notified; they only find out when they next write.
+func DeclineMessageRequest(c *gin.Context) {
+    chat, ok := receivedRequest(c)
+    if !ok {
+        return
+    }
+    chatID := chat.ChatID
+    if chat.RequestStatus == requestDeclined {
+        c.JSON(http.StatusOK, gin.H{"chat_id": chatID, "request_status": requestDeclined})
+        return
+    }
+
+    _, err := db.DB.Exec("UPDATE chats SET request_status = ?, request_decided_at = NOW() WHERE chat_id = ?", requestDeclined, chatID)
+    if err != nil {
+        log.Printf("Error declining message request: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error declining message request"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"chat_id": chatID, "request_status": requestDeclined})
+}
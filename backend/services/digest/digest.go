@@ -0,0 +1,415 @@
+package digest
+
+import (
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/services/mail"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const (
+    // awayFor is how long a user has to be gone before they get a digest
+    awayFor = 24 * time.Hour
+    // digestInterval is the least time between two digests to the same user
+    digestInterval = 24 * time.Hour
+    // maxChats is how many chats a digest lists before summing up the rest
+    maxChats = 5
+    // maxNames is how many followers or requesters a digest names
+    maxNames = 3
+)
+
+var (
+    //go:embed templates/digest.html
+    htmlSource string
+    //go:embed templates/digest.txt
+    textSource string
+
+    htmlTemplate = htmltemplate.Must(htmltemplate.New("digest.html").Parse(htmlSource))
+    textTemplate = texttemplate.Must(texttemplate.New("digest.txt").Parse(textSource))
+)
+
+// RunDigestWorker emails digests of unread activity to users who have been away
+func RunDigestWorker(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        sendDueDigests()
+        <-ticker.C
+    }
+}
+
+// recipient is a user due a digest, with what their last digest covered
+type recipient struct {
+    id                     int64
+    username, email        string
+    notificationsUntil     int64
+    chatNotificationsUntil int64
+}
+
+// chatSummary is one chat with unread messages in a digest
+type chatSummary struct {
+    Username string
+    Count    int
+    Link     string
+}
+
+// content fills the digest templates
+type content struct {
+    Username        string
+    Chats           []chatSummary
+    MoreChats       int
+    Followers       string
+    FollowRequests  string
+    AppLink         string
+    UnsubscribeLink string
+}
+
+// sendDueDigests finds users who have been away, have not had a digest lately and have
+// unread activity their last digest did not cover, in types they want emailed
+func sendDueDigests() {
+    rows, err := db.DB.Query(`
+        SELECT u.id, u.username, u.email, COALESCE(d.notifications_until, 0), COALESCE(d.chat_notifications_until, 0)
+        FROM users u
+        LEFT JOIN (
+            SELECT user_id, MAX(notifications_until) AS notifications_until,
+                MAX(chat_notifications_until) AS chat_notifications_until, MAX(sent_at) AS sent_at
+            FROM email_digests GROUP BY user_id
+        ) d ON d.user_id = u.id
+        WHERE u.email_digest = TRUE AND u.verified = TRUE AND u.active = FALSE
+            AND u.last_active < NOW() - INTERVAL ? SECOND
+            AND u.suspended_at IS NULL AND u.deletion_scheduled_for IS NULL
+            AND (d.sent_at IS NULL OR d.sent_at < NOW() - INTERVAL ? SECOND)
+            AND (
+                EXISTS (
+                    SELECT 1 FROM chat_notifications cn
+                    WHERE cn.user_id = u.id AND cn.is_read = FALSE AND cn.id > COALESCE(d.chat_notifications_until, 0)
+                        AND NOT EXISTS (
+                            SELECT 1 FROM notification_preferences p
+                            WHERE p.user_id = u.id AND p.type = ? AND p.channel = ? AND p.enabled = FALSE
+                        )
+                )
+                OR EXISTS (
+                    SELECT 1 FROM notifications n
+                    WHERE n.user_id = u.id AND n.is_read = FALSE AND n.type IN (?, ?) AND n.id > COALESCE(d.notifications_until, 0)
+                        AND NOT EXISTS (
+                            SELECT 1 FROM notification_preferences p
+                            WHERE p.user_id = u.id AND p.type = n.type AND p.channel = ? AND p.enabled = FALSE
+                        )
+                )
+            )
+        LIMIT 200`,
+        int(awayFor.Seconds()), int(digestInterval.Seconds()),
+        models.MessageNotificationType, notifications.ChannelEmail,
+        models.FollowNotificationType, models.FollowRequestNotificationType, notifications.ChannelEmail)
+    if err != nil {
+        log.Println("Error fetching users due a digest:", err)
+        return
+    }
+
+    var due []recipient
+    for rows.Next() {
+        var r recipient
+        if err := rows.Scan(&r.id, &r.username, &r.email, &r.notificationsUntil, &r.chatNotificationsUntil); err != nil {
+            log.Println("Error scanning user due a digest:", err)
+            continue
+        }
+        due = append(due, r)
+    }
+    rows.Close()
+
+    for _, r := range due {
+        if err := sendDigest(r); err != nil {
+            log.Printf("Error sending digest to user %d: %v\n", r.id, err)
+        }
+    }
+}
+
+// sendDigest builds and sends the digest of one user. The digest is recorded before it
+// is sent, so a second worker or a later run never sends the same activity again; if
+// sending fails the record is removed and the next run tries again.
+func sendDigest(r recipient) error {
+    messages := notifications.DeliveryFor(r.id, models.MessageNotificationType)
+    if messages.Quiet {
+        // Do-not-disturb hours hold every channel, the digest goes out after them
+        return nil
+    }
+    follows := notifications.DeliveryFor(r.id, models.FollowNotificationType)
+    requests := notifications.DeliveryFor(r.id, models.FollowRequestNotificationType)
+
+    data := content{Username: r.username, AppLink: os.Getenv("FRONTEND_URL")}
+    chatNotificationsUntil, notificationsUntil := r.chatNotificationsUntil, r.notificationsUntil
+
+    if messages.Email {
+        chats, moreChats, until, err := unreadChats(r)
+        if err != nil {
+            return err
+        }
+        data.Chats, data.MoreChats = chats, moreChats
+        if until > chatNotificationsUntil {
+            chatNotificationsUntil = until
+        }
+    }
+
+    var types []interface{}
+    if follows.Email {
+        types = append(types, models.FollowNotificationType)
+    }
+    if requests.Email {
+        types = append(types, models.FollowRequestNotificationType)
+    }
+    if len(types) > 0 {
+        followers, followRequests, until, err := unreadFollows(r, types)
+        if err != nil {
+            return err
+        }
+        data.Followers, data.FollowRequests = followers, followRequests
+        if until > notificationsUntil {
+            notificationsUntil = until
+        }
+    }
+
+    if len(data.Chats) == 0 && data.Followers == "" && data.FollowRequests == "" {
+        return nil
+    }
+
+    token, err := utils.GenerateRandomToken(32)
+    if err != nil {
+        return err
+    }
+    digestID, claimed, err := claimDigest(r.id, notificationsUntil, chatNotificationsUntil, utils.HashToken(token))
+    if err != nil || !claimed {
+        return err
+    }
+
+    data.UnsubscribeLink = os.Getenv("BACKEND_URL") + "/v1/email/unsubscribe?token=" + url.QueryEscape(token)
+    var html, text bytes.Buffer
+    if err := htmlTemplate.Execute(&html, data); err != nil {
+        releaseDigest(digestID)
+        return err
+    }
+    if err := textTemplate.Execute(&text, data); err != nil {
+        releaseDigest(digestID)
+        return err
+    }
+
+    // One-click unsubscribe from the mail client (RFC 8058)
+    headers := map[string]string{
+        "List-Unsubscribe":      "<" + data.UnsubscribeLink + ">",
+        "List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+    }
+    if err := mail.SendAlternative(r.email, "Your unread activity on Vansify", text.String(), html.String(), headers); err != nil {
+        releaseDigest(digestID)
+        return err
+    }
+    return nil
+}
+
+// unreadChats sums up the unread messages of a user per chat, newest first, with the
+// newest chat notification it saw
+func unreadChats(r recipient) ([]chatSummary, int, int64, error) {
+    rows, err := db.DB.Query(`
+        SELECT cn.chat_id, o.username, COUNT(*), MAX(cn.id)
+        FROM chat_notifications cn
+        JOIN chats c ON c.chat_id = cn.chat_id
+        JOIN users o ON o.id = IF(c.user1_id = cn.user_id, c.user2_id, c.user1_id)
+        WHERE cn.user_id = ? AND cn.is_read = FALSE AND cn.id > ?
+        GROUP BY cn.chat_id, o.username
+        ORDER BY MAX(cn.id) DESC`, r.id, r.chatNotificationsUntil)
+    if err != nil {
+        return nil, 0, 0, err
+    }
+    defer rows.Close()
+
+    var chats []chatSummary
+    var until int64
+    more := 0
+    for rows.Next() {
+        var chatID string
+        var chat chatSummary
+        var newest int64
+        if err := rows.Scan(&chatID, &chat.Username, &chat.Count, &newest); err != nil {
+            return nil, 0, 0, err
+        }
+        if newest > until {
+            until = newest
+        }
+        if len(chats) == maxChats {
+            more++
+            continue
+        }
+        chat.Link = os.Getenv("FRONTEND_URL") + "/inbox/" + url.PathEscape(chatID)
+        chats = append(chats, chat)
+    }
+    return chats, more, until, rows.Err()
+}
+
+// unreadFollows describes the unread follow and follow request notifications of a user,
+// with the newest notification it saw
+func unreadFollows(r recipient, types []interface{}) (string, string, int64, error) {
+    args := append([]interface{}{r.id, r.notificationsUntil}, types...)
+    rows, err := db.DB.Query(`
+        SELECT n.id, n.type, n.payload, COALESCE(a.username, '')
+        FROM notifications n
+        LEFT JOIN users a ON a.id = n.actor_id
+        WHERE n.user_id = ? AND n.is_read = FALSE AND n.id > ? AND n.type IN (?`+strings.Repeat(", ?", len(types)-1)+`)
+        ORDER BY n.id DESC`, args...)
+    if err != nil {
+        return "", "", 0, err
+    }
+    defer rows.Close()
+
+    var followers, requesters []string
+    followerCount, requestCount := 0, 0
+    var until int64
+    for rows.Next() {
+        var id int64
+        var notificationType models.NotificationType
+        var payloadJSON sql.NullString
+        var actor string
+        if err := rows.Scan(&id, &notificationType, &payloadJSON, &actor); err != nil {
+            return "", "", 0, err
+        }
+        if id > until {
+            until = id
+        }
+
+        payload := map[string]interface{}{}
+        if payloadJSON.Valid {
+            json.Unmarshal([]byte(payloadJSON.String), &payload)
+        }
+        // Follow notifications within a window are aggregated into one row
+        names := []string{}
+        if actors, ok := payload["actors"].([]interface{}); ok {
+            for _, name := range actors {
+                if name, ok := name.(string); ok && name != "" {
+                    names = append(names, name)
+                }
+            }
+        }
+        if len(names) == 0 && actor != "" {
+            names = []string{actor}
+        }
+        count := len(names)
+        if actorCount, ok := payload["actor_count"].(float64); ok && int(actorCount) > count {
+            count = int(actorCount)
+        }
+        if count == 0 {
+            count = 1
+        }
+
+        if notificationType == models.FollowNotificationType {
+            followers, followerCount = append(followers, names...), followerCount+count
+        } else {
+            requesters, requestCount = append(requesters, names...), requestCount+count
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return "", "", 0, err
+    }
+
+    var followersText, requestsText string
+    if followerCount > 0 {
+        followersText = namesSummary(followers, followerCount) + " started following you."
+    }
+    if requestCount > 0 {
+        requestsText = namesSummary(requesters, requestCount) + " asked to follow you."
+    }
+    return followersText, requestsText, until, nil
+}
+
+// namesSummary names the first few distinct users and counts the rest, e.g.
+// "alice, bob and 3 others"
+func namesSummary(names []string, count int) string {
+    seen := map[string]bool{}
+    var shown []string
+    for _, name := range names {
+        if !seen[name] && len(shown) < maxNames {
+            seen[name] = true
+            shown = append(shown, name)
+        }
+    }
+    if len(shown) == 0 {
+        if count == 1 {
+            return "Someone"
+        }
+        return fmt.Sprintf("%d people", count)
+    }
+
+    others := count - len(shown)
+    switch {
+    case others <= 0 && len(shown) == 1:
+        return shown[0]
+    case others <= 0:
+        return strings.Join(shown[:len(shown)-1], ", ") + " and " + shown[len(shown)-1]
+    case others == 1:
+        return strings.Join(shown, ", ") + " and 1 other"
+    default:
+        return fmt.Sprintf("%s and %d others", strings.Join(shown, ", "), others)
+    }
+}
+
+// claimDigest records a digest before it is sent. Locking the user row makes workers
+// take turns, and a digest is not claimed if one went out lately or already covered
+// the same activity.
+func claimDigest(userID, notificationsUntil, chatNotificationsUntil int64, tokenHash string) (int64, bool, error) {
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return 0, false, err
+    }
+    defer tx.Rollback()
+
+    var enabled bool
+    err = tx.QueryRow("SELECT email_digest FROM users WHERE id = ? FOR UPDATE", userID).Scan(&enabled)
+    if err == sql.ErrNoRows || (err == nil && !enabled) {
+        return 0, false, nil
+    } else if err != nil {
+        return 0, false, err
+    }
+
+    var covered bool
+    err = tx.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM email_digests
+            WHERE user_id = ? AND (sent_at > NOW() - INTERVAL ? SECOND
+                OR (notifications_until >= ? AND chat_notifications_until >= ?))
+        )`, userID, int(digestInterval.Seconds()), notificationsUntil, chatNotificationsUntil).Scan(&covered)
+    if err != nil || covered {
+        return 0, false, err
+    }
+
+    result, err := tx.Exec("INSERT INTO email_digests (user_id, notifications_until, chat_notifications_until, unsubscribe_token_hash) VALUES (?, ?, ?, ?)",
+        userID, notificationsUntil, chatNotificationsUntil, tokenHash)
+    if err != nil {
+        return 0, false, err
+    }
+    digestID, err := result.LastInsertId()
+    if err != nil {
+        return 0, false, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, false, err
+    }
+    return digestID, true, nil
+}
+
+// releaseDigest removes the record of a digest that could not be sent
+func releaseDigest(digestID int64) {
+    if _, err := db.DB.Exec("DELETE FROM email_digests WHERE id = ?", digestID); err != nil {
+        log.Printf("Error releasing digest %d: %v\n", digestID, err)
+    }
+}
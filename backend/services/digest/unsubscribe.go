@@ -0,0 +1,132 @@
+package digest
+
+import (
+	"database/sql"
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// unsubscribe turns digests off for the user a digest token was sent to
+func unsubscribe(token string) (bool, error) {
+    var userID int64
+    err := db.DB.QueryRow("SELECT user_id FROM email_digests WHERE unsubscribe_token_hash = ?", utils.HashToken(token)).Scan(&userID)
+    if err == sql.ErrNoRows {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
+
+    if _, err := db.DB.Exec("UPDATE users SET email_digest = FALSE WHERE id = ?", userID); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+//go:embed templates/unsubscribe.html
+var unsubscribeSource string
+
+var unsubscribeTemplate = template.Must(template.New("unsubscribe.html").Parse(unsubscribeSource))
+
+// Unsubscribe handles the link in a digest email. It only shows a page that asks to
+// confirm, since mail scanners fetch links and would otherwise unsubscribe the user.
+func Unsubscribe(c *gin.Context) {
+    c.Header("Content-Type", "text/html; charset=utf-8")
+    c.Header("Referrer-Policy", "no-referrer")
+    c.Status(http.StatusOK)
+    if err := unsubscribeTemplate.Execute(c.Writer, gin.H{"Token": c.Query("token")}); err != nil {
+        log.Printf("Error rendering unsubscribe page: %v\n", err)
+    }
+}
+
+// UnsubscribeOneClick handles the POST mail clients send for List-Unsubscribe-Post
+// (RFC 8058), and the confirmation of the unsubscribe page, which is redirected to the
+// notification settings of the frontend
+func UnsubscribeOneClick(c *gin.Context) {
+    fromPage := c.PostForm("confirm") == "page"
+    redirect := func(query string) {
+        c.Redirect(http.StatusSeeOther, os.Getenv("FRONTEND_URL")+"/settings/notifications?"+query)
+    }
+
+    found, err := unsubscribe(c.Query("token"))
+    if err != nil {
+        log.Printf("Error unsubscribing from digests: %v\n", err)
+        if fromPage {
+            redirect("digest_error=server_error")
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unsubscribing"})
+        return
+    }
+    if !found {
+        if fromPage {
+            redirect("digest_error=invalid_token")
+            return
+        }
+        c.JSON(http.StatusNotFound, gin.H{"error": "Invalid token"})
+        return
+    }
+    if fromPage {
+        redirect("digest=unsubscribed")
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"message": "Unsubscribed from digest emails"})
+}
+
+// GetDigestSetting reports whether the user gets digest emails
+func GetDigestSetting(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var enabled bool
+    err := db.DB.QueryRow("SELECT email_digest FROM users WHERE username = ?", customClaims.Username).Scan(&enabled)
+    if err != nil {
+        log.Printf("Error retrieving digest setting: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving digest setting"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"enabled": enabled})
+}
+
+// UpdateDigestSetting turns digest emails on or off
+func UpdateDigestSetting(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var request struct {
+        Enabled *bool `json:"enabled" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    if _, err := db.DB.Exec("UPDATE users SET email_digest = ? WHERE username = ?", *request.Enabled, customClaims.Username); err != nil {
+        log.Printf("Error updating digest setting: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating digest setting"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"enabled": *request.Enabled})
+}
@@ -0,0 +1,167 @@
+package follow
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const (
+    defaultConnectionsLimit = 20
+    maxConnectionsLimit     = 100
+)
+
+// connectionCursor points at the last entry of a page. Follows are ordered by the
+// time they were made and then by user ID, since several can share a second.
+type connectionCursor struct {
+    FollowedAt int64
+    UserID     int64
+}
+
+func (cur connectionCursor) encode() string {
+    return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", cur.FollowedAt, cur.UserID)))
+}
+
+func decodeConnectionCursor(raw string) (connectionCursor, bool) {
+    var cur connectionCursor
+    decoded, err := base64.RawURLEncoding.DecodeString(raw)
+    if err != nil {
+        return cur, false
+    }
+    parts := strings.SplitN(string(decoded), ":", 2)
+    if len(parts) != 2 {
+        return cur, false
+    }
+    cur.FollowedAt, err = strconv.ParseInt(parts[0], 10, 64)
+    if err != nil {
+        return cur, false
+    }
+    cur.UserID, err = strconv.ParseInt(parts[1], 10, 64)
+    return cur, err == nil
+}
+
+// listConnections answers GetFollowers and GetFollowing. list is "followers" for the
+// users following the named user and "followings" for the users they follow. Each
+// entry says whether the viewer follows that user and is followed by them.
+func listConnections(c *gin.Context, list string) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    ownerID, ok := connectionsVisible(c, customClaims.Username, c.Param("username"))
+    if !ok {
+        return
+    }
+
+    var viewerID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&viewerID)
+    if err != nil {
+        log.Printf("Error retrieving user ID: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultConnectionsLimit)))
+    if err != nil || limit < 1 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit specified"})
+        return
+    }
+    if limit > maxConnectionsLimit {
+        limit = maxConnectionsLimit
+    }
+
+    // The owner is on one side of the follow and the listed users on the other
+    ownerColumn, userColumn := "f.following_id", "f.follower_id"
+    if list == "followings" {
+        ownerColumn, userColumn = "f.follower_id", "f.following_id"
+    }
+
+    conditions := []string{ownerColumn + " = ?"}
+    args := []interface{}{viewerID, viewerID, ownerID}
+    if q := strings.TrimSpace(c.Query("q")); q != "" {
+        conditions = append(conditions, "u.username LIKE ?")
+        args = append(args, "%"+q+"%")
+    }
+    if raw := c.Query("cursor"); raw != "" {
+        cur, ok := decodeConnectionCursor(raw)
+        if !ok {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+            return
+        }
+        conditions = append(conditions, "(f.created_at < FROM_UNIXTIME(?) OR (f.created_at = FROM_UNIXTIME(?) AND u.id < ?))")
+        args = append(args, cur.FollowedAt, cur.FollowedAt, cur.UserID)
+    }
+
+    // One extra row tells whether there is another page
+    rows, err := db.DB.Query(`
+        SELECT u.id, u.username, u.profile_picture, UNIX_TIMESTAMP(f.created_at),
+            EXISTS(SELECT 1 FROM followers v WHERE v.follower_id = ? AND v.following_id = u.id),
+            EXISTS(SELECT 1 FROM followers v WHERE v.follower_id = u.id AND v.following_id = ?)
+        FROM followers f
+        JOIN users u ON u.id = `+userColumn+`
+        WHERE `+strings.Join(conditions, " AND ")+`
+        ORDER BY f.created_at DESC, u.id DESC
+        LIMIT ?`, append(args, limit+1)...)
+    if err != nil {
+        log.Printf("Error retrieving %s: %v\n", list, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving " + list})
+        return
+    }
+    defer rows.Close()
+
+    users := []gin.H{}
+    var last connectionCursor
+    hasMore := false
+    for rows.Next() {
+        if len(users) == limit {
+            hasMore = true
+            break
+        }
+
+        var id, followedAt int64
+        var username, profilePicture string
+        var isFollowing, isFollowedBy bool
+        if err := rows.Scan(&id, &username, &profilePicture, &followedAt, &isFollowing, &isFollowedBy); err != nil {
+            log.Printf("Error scanning %s: %v\n", list, err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving " + list})
+            return
+        }
+        users = append(users, gin.H{
+            "id":              id,
+            "username":        username,
+            "profile_picture": profilePicture,
+            "followed_at":     time.Unix(followedAt, 0).UTC().Format(time.RFC3339),
+            "is_following":    isFollowing,
+            "is_followed_by":  isFollowedBy,
+        })
+        last = connectionCursor{FollowedAt: followedAt, UserID: id}
+    }
+
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through %s: %v\n", list, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving " + list})
+        return
+    }
+
+    var nextCursor interface{}
+    if hasMore {
+        nextCursor = last.encode()
+    }
+
+    c.JSON(http.StatusOK, gin.H{list: users, "next_cursor": nextCursor})
+}
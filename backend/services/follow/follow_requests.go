@@ -0,0 +1,485 @@
+package follow
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/services/block"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// requestFollow asks a private account to accept a follower, finishing the transaction
+// FollowUser started. The request is only announced to the account if notify is set.
+func requestFollow(c *gin.Context, tx *sql.Tx, requesterID int64, requesterUsername string, targetID int64, targetUsername string, notify bool) {
+    var requested bool
+    err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM follow_requests WHERE requester_id = ? AND target_id = ?)", requesterID, targetID).Scan(&requested)
+    if err != nil {
+        log.Printf("Error checking follow request: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking follow status"})
+        tx.Rollback()
+        return
+    }
+    if requested {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "You have already requested to follow this user"})
+        tx.Rollback()
+        return
+    }
+
+    _, err = tx.Exec("INSERT INTO follow_requests (requester_id, target_id) VALUES (?, ?)", requesterID, targetID)
+    if err != nil {
+        log.Printf("Error creating follow request: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error following user"})
+        tx.Rollback()
+        return
+    }
+
+    delivery := notifications.DeliveryFor(targetID, models.FollowRequestNotificationType)
+    if notify && delivery.Store {
+        // The payload is ready for the follow notification the request turns into once approved
+        _, err = notifications.Create(tx, models.Notification{
+            UserID:  targetID,
+            Type:    models.FollowRequestNotificationType,
+            ActorID: requesterID,
+            Payload: notifications.FollowNotificationPayload([]string{requesterUsername}),
+        }, requesterUsername)
+        if err != nil {
+            log.Printf("Error creating follow request notification: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+            tx.Rollback()
+            return
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
+        log.Printf("Error committing transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error committing transaction"})
+        return
+    }
+
+    if notify && delivery.Store && delivery.InApp {
+        if err := broadcastNotificationCount(targetID, targetUsername, requesterUsername); err != nil {
+            log.Printf("Error broadcasting notification count: %v\n", err)
+        }
+    }
+    if notify && delivery.Store {
+        pushFollowNotification(targetID, targetUsername, models.FollowRequestNotificationType, requesterUsername)
+    }
+
+    c.JSON(http.StatusAccepted, gin.H{"message": "Follow request sent", "status": "requested"})
+}
+
+// cancelFollowRequest withdraws a pending request when someone unfollows a private
+// account they are not following yet
+func cancelFollowRequest(c *gin.Context, requesterID int64, requesterUsername string, targetID int64, targetUsername string) {
+    removed, err := removeFollowRequest(requesterID, targetID)
+    if err != nil {
+        log.Printf("Error cancelling follow request: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unfollowing user"})
+        return
+    }
+    if !removed {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "You are not following this user"})
+        return
+    }
+
+    if err := broadcastNotificationCount(targetID, targetUsername, requesterUsername); err != nil {
+        log.Printf("Error broadcasting notification count: %v\n", err)
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Follow request cancelled"})
+}
+
+// removeFollowRequest deletes a pending request together with its notification. It
+// reports false if there was no such request.
+func removeFollowRequest(requesterID, targetID int64) (bool, error) {
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    result, err := tx.Exec("DELETE FROM follow_requests WHERE requester_id = ? AND target_id = ?", requesterID, targetID)
+    if err != nil {
+        return false, err
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        return false, nil
+    }
+
+    _, err = tx.Exec("DELETE FROM notifications WHERE user_id = ? AND type = ? AND actor_id = ?", targetID, models.FollowRequestNotificationType, requesterID)
+    if err != nil {
+        return false, err
+    }
+
+    return true, tx.Commit()
+}
+
+// CanSeeConnections reports whether a viewer may see who an account follows and is
+// followed by. Public accounts show them to everyone, private ones only to the owner
+// and their followers. An empty viewer is someone who is not logged in.
+func CanSeeConnections(viewerUsername string, ownerID int64) (bool, error) {
+    var visible bool
+    err := db.DB.QueryRow(`
+        SELECT NOT u.private OR u.username = ? OR EXISTS(
+            SELECT 1 FROM followers f JOIN users v ON v.id = f.follower_id
+            WHERE v.username = ? AND f.following_id = u.id)
+        FROM users u WHERE u.id = ?`, viewerUsername, viewerUsername, ownerID).Scan(&visible)
+    return visible, err
+}
+
+// connectionsVisible looks up the user whose lists are requested. It answers the
+// request itself and reports false unless the viewer may see them.
+func connectionsVisible(c *gin.Context, viewer, username string) (int64, bool) {
+    var ownerID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&ownerID)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+        return 0, false
+    } else if err != nil {
+        log.Printf("Error retrieving user: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user"})
+        return 0, false
+    }
+
+    visible, err := CanSeeConnections(viewer, ownerID)
+    if err != nil {
+        log.Printf("Error checking account privacy: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user"})
+        return 0, false
+    }
+    if !visible {
+        c.JSON(http.StatusForbidden, gin.H{"error": "This account is private", "private": true})
+        return 0, false
+    }
+    return ownerID, true
+}
+
+// ListFollowRequests returns the pending requests to follow the current user, newest first
+func ListFollowRequests(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    rows, err := db.DB.Query(`
+        SELECT r.id, u.username, u.profile_picture, r.created_at
+        FROM follow_requests r
+        JOIN users u ON u.id = r.requester_id
+        JOIN users t ON t.id = r.target_id
+        WHERE t.username = ?
+        ORDER BY r.created_at DESC, r.id DESC`, customClaims.Username)
+    if err != nil {
+        log.Printf("Error retrieving follow requests: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving follow requests"})
+        return
+    }
+    defer rows.Close()
+
+    requests := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var username, profilePicture string
+        var createdAt time.Time
+        if err := rows.Scan(&id, &username, &profilePicture, &createdAt); err != nil {
+            log.Printf("Error scanning follow request: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving follow requests"})
+            return
+        }
+        requests = append(requests, gin.H{
+            "id":              id,
+            "username":        username,
+            "profile_picture": profilePicture,
+            "created_at":      createdAt.Format("2006-01-02 15:04:05"),
+        })
+    }
+
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through follow requests: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving follow requests"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"follow_requests": requests})
+}
+
+// requestParties looks up the current user and the user named in the path
+func requestParties(c *gin.Context) (targetID int64, targetUsername string, requesterID int64, requesterUsername string, ok bool) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, valid := claims.(*utils.CustomClaims)
+    if !valid {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    targetUsername = customClaims.Username
+    requesterUsername = c.Param("username")
+    err := db.DB.QueryRow(`
+        SELECT t.id, r.id
+        FROM users t
+        JOIN users r ON r.username = ?
+        WHERE t.username = ?`, requesterUsername, targetUsername).Scan(&targetID, &requesterID)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User does not exist"})
+        return
+    } else if err != nil {
+        log.Printf("Error retrieving user IDs: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user IDs"})
+        return
+    }
+
+    ok = true
+    return
+}
+
+// ApproveFollowRequest lets the requester follow the current user. The request
+// notification turns into a regular follow notification and the requester is told.
+func ApproveFollowRequest(c *gin.Context) {
+    targetID, targetUsername, requesterID, requesterUsername, ok := requestParties(c)
+    if !ok {
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Printf("Error starting transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting transaction"})
+        return
+    }
+    defer tx.Rollback()
+
+    result, err := tx.Exec("DELETE FROM follow_requests WHERE requester_id = ? AND target_id = ?", requesterID, targetID)
+    if err != nil {
+        log.Printf("Error approving follow request: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error approving follow request"})
+        return
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"error": "No follow request from this user"})
+        return
+    }
+
+    _, err = tx.Exec("INSERT IGNORE INTO followers (follower_id, following_id) VALUES (?, ?)", requesterID, targetID)
+    if err != nil {
+        log.Printf("Error creating follow relationship: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error approving follow request"})
+        return
+    }
+
+    // The request notification turns into a follow notification of its own
+    statements := []struct {
+        query string
+        args  []interface{}
+    }{
+        {"INSERT IGNORE INTO notification_actors (notification_id, actor_id) SELECT id, actor_id FROM notifications WHERE user_id = ? AND type = ? AND actor_id = ?",
+            []interface{}{targetID, models.FollowRequestNotificationType, requesterID}},
+        {"UPDATE notifications SET type = ?, message = ? WHERE user_id = ? AND type = ? AND actor_id = ?",
+            []interface{}{models.FollowNotificationType, notifications.Render(models.FollowNotificationType, requesterUsername, nil), targetID, models.FollowRequestNotificationType, requesterID}},
+    }
+    for _, statement := range statements {
+        if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+            log.Printf("Error updating follow request notification: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+            return
+        }
+    }
+
+    muted, err := block.IsMuted(requesterID, targetID)
+    if err != nil {
+        log.Printf("Error checking mutes: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error approving follow request"})
+        return
+    }
+
+    delivery := notifications.DeliveryFor(requesterID, models.FollowAcceptedNotificationType)
+    notify := !muted && delivery.Store
+    if notify {
+        _, err = notifications.Create(tx, models.Notification{
+            UserID:  requesterID,
+            Type:    models.FollowAcceptedNotificationType,
+            ActorID: targetID,
+        }, targetUsername)
+        if err != nil {
+            log.Printf("Error creating follow accepted notification: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+            return
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
+        log.Printf("Error committing transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error committing transaction"})
+        return
+    }
+
+    if notify && delivery.InApp {
+        if err := broadcastNotificationCount(requesterID, requesterUsername, targetUsername); err != nil {
+            log.Printf("Error broadcasting notification count: %v\n", err)
+        }
+    }
+    if notify {
+        pushFollowNotification(requesterID, requesterUsername, models.FollowAcceptedNotificationType, targetUsername)
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Follow request approved"})
+}
+
+// RejectFollowRequest turns down a pending request without telling the requester
+func RejectFollowRequest(c *gin.Context) {
+    targetID, targetUsername, requesterID, requesterUsername, ok := requestParties(c)
+    if !ok {
+        return
+    }
+
+    removed, err := removeFollowRequest(requesterID, targetID)
+    if err != nil {
+        log.Printf("Error rejecting follow request: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error rejecting follow request"})
+        return
+    }
+    if !removed {
+        c.JSON(http.StatusNotFound, gin.H{"error": "No follow request from this user"})
+        return
+    }
+
+    if err := broadcastNotificationCount(targetID, targetUsername, requesterUsername); err != nil {
+        log.Printf("Error broadcasting notification count: %v\n", err)
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Follow request rejected"})
+}
+
+// SetAccountPrivacy makes the current user's account private or public. Going public
+// approves every pending request.
+func SetAccountPrivacy(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var request struct {
+        Private *bool `json:"private" binding:"required"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    var userID int64
+    err := db.DB.QueryRow("SELECT id FROM users WHERE username = ?", customClaims.Username).Scan(&userID)
+    if err != nil {
+        log.Printf("Error retrieving user ID: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Printf("Error starting transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error starting transaction"})
+        return
+    }
+    defer tx.Rollback()
+
+    _, err = tx.Exec("UPDATE users SET private = ? WHERE id = ?", *request.Private, userID)
+    if err != nil {
+        log.Printf("Error updating account privacy: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating account privacy"})
+        return
+    }
+
+    var approved int64
+    if !*request.Private {
+        rows, err := tx.Query(`
+            SELECT r.requester_id, EXISTS(SELECT 1 FROM notifications n WHERE n.user_id = r.target_id AND n.type = ? AND n.actor_id = r.requester_id)
+            FROM follow_requests r WHERE r.target_id = ? FOR UPDATE`, models.FollowRequestNotificationType, userID)
+        if err != nil {
+            log.Printf("Error retrieving follow requests: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating account privacy"})
+            return
+        }
+        var requesters, requestersNotified []int64
+        for rows.Next() {
+            var requesterID int64
+            var hasNotification bool
+            if err := rows.Scan(&requesterID, &hasNotification); err != nil {
+                rows.Close()
+                log.Printf("Error scanning follow request: %v\n", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating account privacy"})
+                return
+            }
+            requesters = append(requesters, requesterID)
+            if hasNotification {
+                requestersNotified = append(requestersNotified, requesterID)
+            }
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            log.Printf("Error iterating through follow requests: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating account privacy"})
+            return
+        }
+
+        statements := []struct {
+            query string
+            args  []interface{}
+        }{
+            {"INSERT IGNORE INTO followers (follower_id, following_id) SELECT requester_id, target_id FROM follow_requests WHERE target_id = ?", []interface{}{userID}},
+            {"DELETE FROM notifications WHERE user_id = ? AND type = ?", []interface{}{userID, models.FollowRequestNotificationType}},
+            {"DELETE FROM follow_requests WHERE target_id = ?", []interface{}{userID}},
+        }
+        for _, statement := range statements {
+            if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+                log.Printf("Error approving follow requests: %v\n", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating account privacy"})
+                return
+            }
+        }
+        approved = int64(len(requesters))
+
+        // Requests the user was notified about become follows in the aggregated follow
+        // notification, like any other follow
+        for _, requesterID := range requestersNotified {
+            if _, err := notifications.NotifyFollow(tx, userID, requesterID); err != nil {
+                log.Printf("Error creating follow notification: %v\n", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating account privacy"})
+                return
+            }
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
+        log.Printf("Error committing transaction: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error committing transaction"})
+        return
+    }
+
+    if approved > 0 {
+        if _, err := notifications.BroadcastUnreadCount(userID, customClaims.Username); err != nil {
+            log.Printf("Error broadcasting notification count: %v\n", err)
+        }
+    }
+
+    c.JSON(http.StatusOK, gin.H{"private": *request.Private, "approved_requests": approved})
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vaanskii/vansify/db"
 	"github.com/vaanskii/vansify/models"
 	"github.com/vaanskii/vansify/notifications"
+	"github.com/vaanskii/vansify/notifications/webpush"
+	"github.com/vaanskii/vansify/services/block"
 	"github.com/vaanskii/vansify/utils"
 )
 
@@ -32,12 +35,13 @@ func FollowUser(c *gin.Context) {
 
     // Use a single query to get follower and following IDs
     var followerID, followingID int64
+    var private bool
     err := db.DB.QueryRow(`
-        SELECT f.id, u.id 
+        SELECT f.id, u.id, u.private 
         FROM users f 
         JOIN users u ON u.username = ? 
         WHERE f.username = ?`, followingUsername, followerUsername).
-        Scan(&followerID, &followingID)
+        Scan(&followerID, &followingID, &private)
     if err != nil {
         if err == sql.ErrNoRows {
             c.JSON(http.StatusBadRequest, gin.H{"error": "User does not exist"})
@@ -48,6 +52,25 @@ func FollowUser(c *gin.Context) {
         return
     }
 
+    blocked, err := block.IsBlocked(followerID, followingID)
+    if err != nil {
+        log.Printf("Error checking blocks: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking follow status"})
+        return
+    }
+    if blocked {
+        c.JSON(http.StatusForbidden, gin.H{"error": "You cannot follow this user"})
+        return
+    }
+
+    // Users who muted the follower still gain the follower, just without a notification
+    muted, err := block.IsMuted(followingID, followerID)
+    if err != nil {
+        log.Printf("Error checking mutes: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking follow status"})
+        return
+    }
+
     // Check if the follow relationship already exists and create it if not
     tx, err := db.DB.Begin()
     if err != nil {
@@ -70,6 +93,12 @@ func FollowUser(c *gin.Context) {
         return
     }
 
+    // Private accounts approve their followers first
+    if private {
+        requestFollow(c, tx, followerID, followerUsername, followingID, followingUsername, !muted)
+        return
+    }
+
     // Create follow relationship and notification
     _, err = tx.Exec("INSERT INTO followers (follower_id, following_id) VALUES (?, ?)", followerID, followingID)
     if err != nil {
@@ -79,13 +108,17 @@ func FollowUser(c *gin.Context) {
         return
     }
 
-    message := followerUsername + " started following you"
-    _, err = tx.Exec("INSERT INTO notifications (user_id, type, message, follower_id) VALUES (?, ?, ?, ?)", followingID, models.FollowNotificationType, message, followerID)
-    if err != nil {
-        log.Printf("Error creating follow notification: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
-        tx.Rollback()
-        return
+    // Follows within a window share one notification
+    delivery := notifications.DeliveryFor(followingID, models.FollowNotificationType)
+    notified := false
+    if !muted && delivery.Store {
+        notified, err = notifications.NotifyFollow(tx, followingID, followerID)
+        if err != nil {
+            log.Printf("Error creating follow notification: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating notification"})
+            tx.Rollback()
+            return
+        }
     }
 
     err = tx.Commit()
@@ -95,37 +128,68 @@ func FollowUser(c *gin.Context) {
         return
     }
 
-    // Get the unread notification count
-    notificationCount, err := getUnreadNotificationCount(followingID)
+    if notified && delivery.InApp {
+        if err := broadcastNotificationCount(followingID, followingUsername, followerUsername); err != nil {
+            log.Printf("Error broadcasting notification count: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching unread notification count"})
+            return
+        }
+    }
+    if notified {
+        pushFollowNotification(followingID, followingUsername, models.FollowNotificationType, followerUsername)
+    }
+
+    c.JSON(http.StatusOK, gin.H{"message": "Successfully followed user", "status": "following"})
+}
+
+
+func getUnreadNotificationCount(userID int64) (int, error) {
+    var count int
+    err := db.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND is_read = false", userID).Scan(&count)
+    return count, err
+}
+
+// broadcastNotificationCount pushes the unread notification count of a user to their
+// notification socket
+func broadcastNotificationCount(userID int64, username, sender string) error {
+    notificationCount, err := getUnreadNotificationCount(userID)
     if err != nil {
-        log.Printf("Error fetching unread notification count: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching unread notification count"})
-        return
+        return err
     }
 
     notificationMessage := map[string]interface{}{
         "unread_notification_count": notificationCount,
-        "sender":                    followerUsername,
-        "receiver":                  followingUsername,
+        "sender":                    sender,
+        "receiver":                  username,
     }
 
     notificationJSON, err := json.Marshal(notificationMessage)
     if err != nil {
-        log.Printf("Error marshalling notification count: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error marshalling notification count"})
-        return
+        return err
     }
 
-    notifications.GlobalNotificationHub.BroadcastNotification(followingUsername, notificationJSON)
-
-    c.JSON(http.StatusOK, gin.H{"message": "Successfully followed user"})
+    notifications.GlobalNotificationHub.BroadcastNotification(username, notificationJSON)
+    return nil
 }
 
-
-func getUnreadNotificationCount(userID int64) (int, error) {
-    var count int
-    err := db.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND is_read = false", userID).Scan(&count)
-    return count, err
+// pushFollowNotification sends a follow notification as a Web Push when the user has no
+// notification socket open. Follows share a tag so a device shows only the latest.
+func pushFollowNotification(userID int64, username string, notificationType models.NotificationType, actor string) {
+    if notifications.GlobalNotificationHub.IsConnected(username) {
+        return
+    }
+    tag := "follow"
+    if notificationType != models.FollowNotificationType {
+        tag = strings.ToLower(string(notificationType)) + "-" + actor
+    }
+    webpush.Notify(userID, webpush.Message{
+        Type:  notificationType,
+        Title: "Vansify",
+        Body:  notifications.Render(notificationType, actor, nil),
+        Tag:   tag,
+        URL:   "/" + actor,
+        Actor: actor,
+    })
 }
 
 func UnfollowUser(c *gin.Context) {
@@ -174,8 +238,8 @@ func UnfollowUser(c *gin.Context) {
     }
 
     if !followExists {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "You are not following this user"})
         tx.Rollback()
+        cancelFollowRequest(c, followerID, followerUsername, followingID, followingUsername)
         return
     }
 
@@ -186,12 +250,27 @@ func UnfollowUser(c *gin.Context) {
         return
     }
 
+    // An unread notification about the follow goes away with it
+    retracted, err := notifications.RetractFollow(tx, followingID, followerID)
+    if err != nil {
+        log.Printf("Error retracting follow notification: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error unfollowing user"})
+        tx.Rollback()
+        return
+    }
+
     err = tx.Commit()
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error committing transaction"})
         return
     }
 
+    if retracted {
+        if err := broadcastNotificationCount(followingID, followingUsername, followerUsername); err != nil {
+            log.Printf("Error broadcasting notification count: %v\n", err)
+        }
+    }
+
     c.JSON(http.StatusOK, gin.H{"message": "Successfully unfollowed user"})
 }
 
@@ -231,84 +310,26 @@ func CheckFollowStatus(c *gin.Context) {
         return
     }
 
+    var requested bool
+    err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM follow_requests WHERE requester_id = ? AND target_id = ?)", followerID, followingID).Scan(&requested)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking follow request status"})
+        return
+    }
+
     c.JSON(http.StatusOK, gin.H{
         "is_following": follows,
         "is_followed_by": followedBy,
+        "is_requested": requested,
     })
 }
 
+// GetFollowers lists who follows a user, most recent first
 func GetFollowers(c *gin.Context) {
-    username := c.Param("username")
-    
-    var followers []gin.H
-    query := `
-        SELECT u.username, u.profile_picture 
-        FROM followers f 
-        JOIN users u ON f.follower_id = u.id 
-        JOIN users u2 ON f.following_id = u2.id 
-        WHERE u2.username = ?`
-    
-    rows, err := db.DB.Query(query, username)
-    if err != nil {
-        log.Printf("Error retrieving followers: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving followers"})
-        return
-    }
-    defer rows.Close()
-
-    for rows.Next() {
-        var username, profilePicture string
-        if err := rows.Scan(&username, &profilePicture); err != nil {
-            log.Printf("Error scanning follower: %v\n", err)
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving followers"})
-            return
-        }
-        followers = append(followers, gin.H{"username": username, "profile_picture": profilePicture})
-    }
-
-    if err := rows.Err(); err != nil {
-        log.Printf("Error iterating through followers: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving followers"})
-        return
-    }
-
-    c.JSON(http.StatusOK, gin.H{"followers": followers})
+    listConnections(c, "followers")
 }
 
+// GetFollowing lists who a user follows, most recent first
 func GetFollowing(c *gin.Context) {
-    username := c.Param("username")
-    
-    var followings []gin.H
-    query := `
-        SELECT u.username, u.profile_picture 
-        FROM followers f 
-        JOIN users u ON f.following_id = u.id 
-        JOIN users u2 ON f.follower_id = u2.id 
-        WHERE u2.username = ?`
-    
-    rows, err := db.DB.Query(query, username)
-    if err != nil {
-        log.Printf("Error retrieving followings: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving followings"})
-        return
-    }
-    defer rows.Close()
-
-    for rows.Next() {
-        var username, profilePicture string
-        if err := rows.Scan(&username, &profilePicture); err != nil {
-            log.Printf("Error scanning following user: %v\n", err)
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving followings"})
-            return
-        }
-        followings = append(followings, gin.H{"username": username, "profile_picture": profilePicture})
-    }
-
-    if err := rows.Err(); err != nil {
-        log.Printf("Error iterating through followings: %v\n", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving followings"})
-        return
-    }
-
-    c.JSON(http.StatusOK, gin.H{"followings": followings})
+    listConnections(c, "followings")
 }
@@ -0,0 +1,49 @@
+package mail
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/lpernett/godotenv"
+	"gopkg.in/gomail.v2"
+)
+
+// Send delivers an HTML email through the configured SMTP server
+func Send(to, subject, body string) error {
+    m := gomail.NewMessage()
+    m.SetHeader("From", os.Getenv("SMTP_USER"))
+    m.SetHeader("To", to)
+    m.SetHeader("Subject", subject)
+    m.SetBody("text/html", body)
+
+    return dialAndSend(m)
+}
+
+// SendAlternative delivers an email with a plain text and an HTML version, and any
+// extra headers such as List-Unsubscribe
+func SendAlternative(to, subject, text, html string, headers map[string]string) error {
+    m := gomail.NewMessage()
+    m.SetHeader("From", os.Getenv("SMTP_USER"))
+    m.SetHeader("To", to)
+    m.SetHeader("Subject", subject)
+    for name, value := range headers {
+        m.SetHeader(name, value)
+    }
+    m.SetBody("text/plain", text)
+    m.AddAlternative("text/html", html)
+
+    return dialAndSend(m)
+}
+
+func dialAndSend(m *gomail.Message) error {
+    godotenv.Load()
+
+    // Convert SMTP_PORT from string to int
+    port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+    if err != nil {
+        return err
+    }
+
+    d := gomail.NewDialer(os.Getenv("SMTP_SERVER"), port, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASS"))
+    return d.DialAndSend(m)
+}
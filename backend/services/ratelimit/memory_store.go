@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type bucket struct {
+    tokens    float64
+    updatedAt time.Time
+    period    time.Duration
+}
+
+// MemoryStore keeps token buckets in process memory
+type MemoryStore struct {
+    buckets map[string]*bucket
+    mu      sync.Mutex
+}
+
+// NewMemoryStore creates a MemoryStore and starts removing idle buckets
+func NewMemoryStore() *MemoryStore {
+    s := &MemoryStore{buckets: make(map[string]*bucket)}
+    go s.cleanup(time.Minute)
+    return s
+}
+
+// Take takes a token from the bucket stored under key
+func (s *MemoryStore) Take(key string, rule Rule) (Result, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now()
+    b, exists := s.buckets[key]
+    if !exists {
+        b = &bucket{tokens: float64(rule.Burst), updatedAt: now}
+        s.buckets[key] = b
+    }
+
+    var result Result
+    b.tokens, result = refill(b.tokens, now.Sub(b.updatedAt), rule)
+    b.updatedAt = now
+    b.period = rule.Period
+
+    return result, nil
+}
+
+// cleanup drops buckets that have had time to refill completely
+func (s *MemoryStore) cleanup(interval time.Duration) {
+    for {
+        time.Sleep(interval)
+
+        s.mu.Lock()
+        for key, b := range s.buckets {
+            if time.Since(b.updatedAt) > b.period {
+                delete(s.buckets, key)
+            }
+        }
+        s.mu.Unlock()
+    }
+}
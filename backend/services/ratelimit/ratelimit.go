@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rule describes a token bucket that holds up to Burst tokens and refills
+// completely once per Period
+type Rule struct {
+    Burst  int
+    Period time.Duration
+}
+
+// Result describes the state of a bucket after a token was requested
+type Result struct {
+    Allowed    bool
+    Limit      int
+    Remaining  int
+    ResetAfter time.Duration
+    RetryAfter time.Duration
+}
+
+// Store keeps token buckets. MemoryStore only serves a single instance, SQLStore
+// can be shared by every replica of the API.
+type Store interface {
+    Take(key string, rule Rule) (Result, error)
+}
+
+// KeyFunc extracts the bucket key from a request. An empty key skips the limit.
+type KeyFunc func(c *gin.Context) string
+
+// refill applies the token bucket algorithm to a bucket that last held tokens
+// elapsed ago and tries to take one token from it
+func refill(tokens float64, elapsed time.Duration, rule Rule) (float64, Result) {
+    rate := float64(rule.Burst) / rule.Period.Seconds()
+    tokens = math.Min(float64(rule.Burst), tokens+elapsed.Seconds()*rate)
+
+    result := Result{Limit: rule.Burst}
+    if tokens >= 1 {
+        tokens--
+        result.Allowed = true
+    } else {
+        result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+    }
+    result.Remaining = int(tokens)
+    result.ResetAfter = time.Duration((float64(rule.Burst) - tokens) / rate * float64(time.Second))
+
+    return tokens, result
+}
+
+// ByIP keys requests by the client IP address
+func ByIP(c *gin.Context) string {
+    return "ip:" + c.ClientIP()
+}
+
+// ByJSONField keys requests by a field of the JSON body, for example the
+// username of a login attempt. The body is restored for the handler.
+func ByJSONField(field string) KeyFunc {
+    return func(c *gin.Context) string {
+        body, err := io.ReadAll(c.Request.Body)
+        if err != nil {
+            return ""
+        }
+        c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+        var payload map[string]interface{}
+        if err := json.Unmarshal(body, &payload); err != nil {
+            return ""
+        }
+        value, _ := payload[field].(string)
+        value = strings.ToLower(strings.TrimSpace(value))
+        if value == "" {
+            return ""
+        }
+        return field + ":" + value
+    }
+}
+
+// Limit throttles the requests that share a key according to the rule and
+// reports the state of the bucket in RateLimit-* headers
+func Limit(store Store, name string, rule Rule, keyFunc KeyFunc) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        key := keyFunc(c)
+        if key == "" {
+            c.Next()
+            return
+        }
+
+        result, err := store.Take(name+":"+key, rule)
+        if err != nil {
+            // Fail open, an unavailable store should not lock everybody out
+            log.Printf("Error checking rate limit %s: %v\n", name, err)
+            c.Next()
+            return
+        }
+
+        // With several limits on one route report the most restrictive one
+        current, err := strconv.Atoi(c.Writer.Header().Get("RateLimit-Remaining"))
+        if err != nil || result.Remaining <= current {
+            c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+            c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+            c.Header("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.ResetAfter.Seconds()))))
+        }
+
+        if !result.Allowed {
+            c.Header("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+            c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests. Please try again later."})
+            return
+        }
+
+        c.Next()
+    }
+}
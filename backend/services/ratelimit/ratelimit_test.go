@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRefill(t *testing.T) {
+    // One token a second, up to five
+    rule := Rule{Burst: 5, Period: 5 * time.Second}
+
+    for _, test := range []struct {
+        name       string
+        tokens     float64
+        elapsed    time.Duration
+        allowed    bool
+        left       float64
+        remaining  int
+        retryAfter time.Duration
+        resetAfter time.Duration
+    }{
+        {"full bucket", 5, 0, true, 4, 4, 0, time.Second},
+        {"last token", 1, 0, true, 0, 0, 0, 5 * time.Second},
+        {"empty bucket", 0, 0, false, 0, 0, time.Second, 5 * time.Second},
+        {"half a token", 0.5, 0, false, 0.5, 0, 500 * time.Millisecond, 4500 * time.Millisecond},
+        {"refilled after a gap", 0, 2 * time.Second, true, 1, 1, 0, 4 * time.Second},
+        {"partly refilled", 0, 1500 * time.Millisecond, true, 0.5, 0, 0, 4500 * time.Millisecond},
+        {"not refilled enough", 0, 500 * time.Millisecond, false, 0.5, 0, 500 * time.Millisecond, 4500 * time.Millisecond},
+        {"refill stops at the burst", 0, time.Hour, true, 4, 4, 0, time.Second},
+    } {
+        left, result := refill(test.tokens, test.elapsed, rule)
+        if result.Allowed != test.allowed {
+            t.Errorf("%s: allowed is %v, want %v", test.name, result.Allowed, test.allowed)
+        }
+        if math.Abs(left-test.left) > 1e-9 {
+            t.Errorf("%s: %v tokens left, want %v", test.name, left, test.left)
+        }
+        if result.Limit != rule.Burst || result.Remaining != test.remaining {
+            t.Errorf("%s: limit %d remaining %d, want %d and %d", test.name, result.Limit, result.Remaining, rule.Burst, test.remaining)
+        }
+        if (result.RetryAfter - test.retryAfter).Abs() > time.Millisecond {
+            t.Errorf("%s: retry after %v, want %v", test.name, result.RetryAfter, test.retryAfter)
+        }
+        if (result.ResetAfter - test.resetAfter).Abs() > time.Millisecond {
+            t.Errorf("%s: reset after %v, want %v", test.name, result.ResetAfter, test.resetAfter)
+        }
+    }
+}
+
+func TestRefillBurst(t *testing.T) {
+    rule := Rule{Burst: 3, Period: time.Minute}
+
+    // A full bucket allows the burst back to back, then nothing until a token refills
+    tokens := float64(rule.Burst)
+    var result Result
+    for i := 0; i < rule.Burst; i++ {
+        tokens, result = refill(tokens, 0, rule)
+        if !result.Allowed {
+            t.Fatalf("request %d of the burst was refused", i+1)
+        }
+    }
+    tokens, result = refill(tokens, time.Second, rule)
+    if result.Allowed {
+        t.Fatalf("request past the burst was allowed")
+    }
+    if want := 19 * time.Second; (result.RetryAfter - want).Abs() > time.Millisecond {
+        t.Errorf("retry after %v, want %v", result.RetryAfter, want)
+    }
+
+    // Waiting the whole seconds the Retry-After header announces is enough
+    wait := time.Duration(math.Ceil(result.RetryAfter.Seconds())) * time.Second
+    tokens, result = refill(tokens, wait, rule)
+    if !result.Allowed {
+        t.Errorf("request after Retry-After was refused")
+    }
+    if _, result = refill(tokens, 0, rule); result.Allowed {
+        t.Errorf("second request after Retry-After was allowed")
+    }
+}
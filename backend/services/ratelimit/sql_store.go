@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// SQLStore keeps token buckets in the rate_limit_buckets table so that the
+// limits are shared by every instance of the API
+type SQLStore struct {
+    db *sql.DB
+}
+
+// NewSQLStore creates a SQLStore on top of the given database and starts
+// removing idle buckets
+func NewSQLStore(db *sql.DB) *SQLStore {
+    s := &SQLStore{db: db}
+    go s.cleanup(time.Minute)
+    return s
+}
+
+// Take takes a token from the bucket stored under key
+func (s *SQLStore) Take(key string, rule Rule) (Result, error) {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return Result{}, err
+    }
+    defer tx.Rollback()
+
+    // Make sure the row exists so it can be locked
+    _, err = tx.Exec("INSERT IGNORE INTO rate_limit_buckets (bucket_key, tokens, updated_at) VALUES (?, ?, NOW(6))", key, rule.Burst)
+    if err != nil {
+        return Result{}, err
+    }
+
+    var tokens float64
+    var elapsedMicros int64
+    err = tx.QueryRow("SELECT tokens, TIMESTAMPDIFF(MICROSECOND, updated_at, NOW(6)) FROM rate_limit_buckets WHERE bucket_key = ? FOR UPDATE", key).
+        Scan(&tokens, &elapsedMicros)
+    if err != nil {
+        return Result{}, err
+    }
+
+    tokens, result := refill(tokens, time.Duration(elapsedMicros)*time.Microsecond, rule)
+
+    _, err = tx.Exec("UPDATE rate_limit_buckets SET tokens = ?, updated_at = NOW(6), expires_at = DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE bucket_key = ?",
+        tokens, int(rule.Period.Seconds()), key)
+    if err != nil {
+        return Result{}, err
+    }
+
+    if err := tx.Commit(); err != nil {
+        return Result{}, err
+    }
+
+    return result, nil
+}
+
+// cleanup removes buckets that have had time to refill completely
+func (s *SQLStore) cleanup(interval time.Duration) {
+    for {
+        time.Sleep(interval)
+
+        if _, err := s.db.Exec("DELETE FROM rate_limit_buckets WHERE expires_at < NOW()"); err != nil {
+            log.Printf("Error removing expired rate limit buckets: %v\n", err)
+        }
+    }
+}
@@ -0,0 +1,99 @@
+package report
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+// Reasons a user can be reported for
+var validReasons = map[string]bool{
+    "spam":                  true,
+    "harassment":            true,
+    "impersonation":         true,
+    "inappropriate_content": true,
+    "other":                 true,
+}
+
+// ReportUser files a report about another user for the moderators
+func ReportUser(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    var request struct {
+        Reason  string `json:"reason" binding:"required"`
+        Details string `json:"details"`
+    }
+    if err := c.ShouldBindJSON(&request); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+        return
+    }
+
+    if !validReasons[request.Reason] {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reason"})
+        return
+    }
+    request.Details = strings.TrimSpace(request.Details)
+    if len(request.Details) > 1000 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Details must be at most 1000 characters"})
+        return
+    }
+
+    reportedUsername := c.Param("username")
+    if reportedUsername == customClaims.Username {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot report yourself"})
+        return
+    }
+
+    var reporterID, reportedID int64
+    err := db.DB.QueryRow(`
+        SELECT r.id, u.id
+        FROM users r
+        JOIN users u ON u.username = ?
+        WHERE r.username = ?`, reportedUsername, customClaims.Username).
+        Scan(&reporterID, &reportedID)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+        return
+    } else if err != nil {
+        log.Printf("Error retrieving user IDs: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user IDs"})
+        return
+    }
+
+    // One open report per reporter is enough for the moderators to act on
+    var alreadyReported bool
+    err = db.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM reports WHERE reporter_id = ? AND reported_id = ? AND status = 'open')", reporterID, reportedID).Scan(&alreadyReported)
+    if err != nil {
+        log.Printf("Error checking reports: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reporting user"})
+        return
+    }
+    if alreadyReported {
+        c.JSON(http.StatusConflict, gin.H{"error": "You have already reported this user"})
+        return
+    }
+
+    _, err = db.DB.Exec("INSERT INTO reports (reporter_id, reported_id, reason, details) VALUES (?, ?, ?, ?)",
+        reporterID, reportedID, request.Reason, request.Details)
+    if err != nil {
+        log.Printf("Error creating report: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reporting user"})
+        return
+    }
+
+    c.JSON(http.StatusCreated, gin.H{"message": "Thanks, the report was sent to the moderators"})
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/utils"
 )
 
 func SearchUsers(db *sql.DB) gin.HandlerFunc {
@@ -19,15 +20,27 @@ func SearchUsers(db *sql.DB) gin.HandlerFunc {
 
         log.Printf("[INFO] Received search request for query: %s\n", query)
 
+        // Logged in users do not see anyone they blocked or who blocked them
+        var viewer string
+        if claims, exists := c.Get("claims"); exists {
+            if customClaims, ok := claims.(*utils.CustomClaims); ok {
+                viewer = customClaims.Username
+            }
+        }
+
         // ✅ Debugging log: Check SQL query execution
         rows, err := db.Query(`
             SELECT id, username, profile_picture, 
                 MATCH(username) AGAINST (? IN NATURAL LANGUAGE MODE) AS relevance
             FROM users 
-            WHERE MATCH(username) AGAINST (? IN NATURAL LANGUAGE MODE)
-            OR username LIKE ? 
+            WHERE (MATCH(username) AGAINST (? IN NATURAL LANGUAGE MODE)
+            OR username LIKE ?)
+            AND NOT EXISTS (
+                SELECT 1 FROM user_blocks b JOIN users v ON v.username = ?
+                WHERE (b.blocker_id = users.id AND b.blocked_id = v.id) OR (b.blocker_id = v.id AND b.blocked_id = users.id)
+            )
             ORDER BY relevance DESC, CHAR_LENGTH(username) ASC
-        `, query, query, "%"+query+"%")
+        `, query, query, "%"+query+"%", viewer)
 
         if err != nil {
             log.Printf("[ERROR] Database query execution failed: %v\n", err)
@@ -0,0 +1,410 @@
+package suggestions
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/utils"
+)
+
+const (
+    // suggestionsTTL is how long computed suggestions are used before the worker redoes them
+    suggestionsTTL = 24 * time.Hour
+    // suggestionsActiveWithin limits the worker to users who were around recently
+    suggestionsActiveWithin = 30 * 24 * time.Hour
+    maxStoredSuggestions    = 50
+    suggestionsBatchSize    = 100
+
+    defaultSuggestionsLimit = 10
+    maxSuggestionsLimit     = 50
+)
+
+// Weights of the signals a suggestion is ranked by
+const (
+    mutualWeight     = 3.0
+    sharedChatWeight = 5.0
+    followsYouWeight = 4.0
+)
+
+// RunSuggestionWorker refreshes the suggestions of recently active users whose
+// suggestions are missing or out of date, checking every interval
+func RunSuggestionWorker(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        refreshStaleSuggestions()
+        <-ticker.C
+    }
+}
+
+// refreshStaleSuggestions recomputes one batch of stale suggestions
+func refreshStaleSuggestions() {
+    rows, err := db.DB.Query(`
+        SELECT id FROM users
+        WHERE (suggestions_computed_at IS NULL OR suggestions_computed_at < DATE_SUB(NOW(), INTERVAL ? SECOND))
+            AND (active = TRUE OR last_active > DATE_SUB(NOW(), INTERVAL ? SECOND))
+            AND suspended_at IS NULL AND deletion_requested_at IS NULL
+        ORDER BY suggestions_computed_at IS NOT NULL, suggestions_computed_at
+        LIMIT ?`, int(suggestionsTTL.Seconds()), int(suggestionsActiveWithin.Seconds()), suggestionsBatchSize)
+    if err != nil {
+        log.Println("Error fetching users to suggest for:", err)
+        return
+    }
+
+    var userIDs []int64
+    for rows.Next() {
+        var userID int64
+        if err := rows.Scan(&userID); err != nil {
+            log.Println("Error scanning user to suggest for:", err)
+            continue
+        }
+        userIDs = append(userIDs, userID)
+    }
+    rows.Close()
+
+    for _, userID := range userIDs {
+        claimed, err := claimSuggestions(userID)
+        if err != nil {
+            log.Println("Error claiming suggestions:", err)
+            continue
+        }
+        if !claimed {
+            continue
+        }
+        if err := computeSuggestions(userID); err != nil {
+            log.Printf("Error computing suggestions for user %d: %v\n", userID, err)
+        }
+    }
+}
+
+// claimSuggestions marks the suggestions of a user as being computed, so that only
+// one instance does it. It reports false if they were fresh after all.
+func claimSuggestions(userID int64) (bool, error) {
+    result, err := db.DB.Exec(`
+        UPDATE users SET suggestions_computed_at = NOW()
+        WHERE id = ? AND (suggestions_computed_at IS NULL OR suggestions_computed_at < DATE_SUB(NOW(), INTERVAL ? SECOND))`,
+        userID, int(suggestionsTTL.Seconds()))
+    if err != nil {
+        return false, err
+    }
+    rowsAffected, _ := result.RowsAffected()
+    return rowsAffected > 0, nil
+}
+
+// candidate is an account that might be suggested, with the signals found for it
+type candidate struct {
+    id             int64
+    mutualCount    int
+    sampleMutualID sql.NullInt64
+    sharedChat     bool
+    followsYou     bool
+    score          float64
+}
+
+// computeSuggestions ranks friends of friends, chat partners and followers the user
+// does not follow back, and replaces the stored suggestions with the best of them
+func computeSuggestions(userID int64) error {
+    candidates := map[int64]*candidate{}
+    get := func(id int64) *candidate {
+        if candidates[id] == nil {
+            candidates[id] = &candidate{id: id}
+        }
+        return candidates[id]
+    }
+
+    // Accounts followed by people the user follows, with the most recently followed of those people
+    rows, err := db.DB.Query(`
+        SELECT f2.following_id, COUNT(*),
+            CAST(SUBSTRING_INDEX(GROUP_CONCAT(f1.following_id ORDER BY f1.created_at DESC), ',', 1) AS UNSIGNED)
+        FROM followers f1
+        JOIN followers f2 ON f2.follower_id = f1.following_id
+        WHERE f1.follower_id = ? AND f2.following_id != ?
+        GROUP BY f2.following_id`, userID, userID)
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var id, sample int64
+        var count int
+        if err := rows.Scan(&id, &count, &sample); err != nil {
+            rows.Close()
+            return err
+        }
+        c := get(id)
+        c.mutualCount = count
+        c.sampleMutualID = sql.NullInt64{Int64: sample, Valid: true}
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    // People the user has chatted with
+    rows, err = db.DB.Query(`
+        SELECT CASE WHEN c.user1_id = ? THEN c.user2_id ELSE c.user1_id END
+        FROM chats c
+        WHERE (c.user1_id = ? OR c.user2_id = ?)
+            AND NOT EXISTS (SELECT 1 FROM chat_deletions d WHERE d.chat_id = c.chat_id AND d.user_id = ?)`,
+        userID, userID, userID, userID)
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return err
+        }
+        get(id).sharedChat = true
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    // Followers the user does not follow back
+    rows, err = db.DB.Query("SELECT follower_id FROM followers WHERE following_id = ?", userID)
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return err
+        }
+        get(id).followsYou = true
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    if len(candidates) == 0 {
+        _, err := db.DB.Exec("DELETE FROM follow_suggestions WHERE user_id = ?", userID)
+        return err
+    }
+    ids := make([]string, 0, len(candidates))
+    args := []interface{}{userID}
+    for id := range candidates {
+        ids = append(ids, "?")
+        args = append(args, id)
+    }
+
+    // Leave out the user, accounts they follow or asked to follow, blocks either way and
+    // accounts that are suspended or being deleted, and weigh in how recently the rest were active
+    rows, err = db.DB.Query(`
+        SELECT u.id, u.active, TIMESTAMPDIFF(SECOND, u.last_active, NOW())
+        FROM users u
+        JOIN users me ON me.id = ?
+        WHERE u.id != me.id
+            AND u.suspended_at IS NULL AND u.deletion_requested_at IS NULL
+            AND NOT EXISTS (SELECT 1 FROM followers f WHERE f.follower_id = me.id AND f.following_id = u.id)
+            AND NOT EXISTS (SELECT 1 FROM follow_requests r WHERE r.requester_id = me.id AND r.target_id = u.id)
+            AND NOT EXISTS (SELECT 1 FROM user_blocks b
+                WHERE (b.blocker_id = me.id AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = me.id))
+            AND u.id IN (`+strings.Join(ids, ", ")+`)`, args...)
+    if err != nil {
+        return err
+    }
+    var ranked []*candidate
+    for rows.Next() {
+        var id int64
+        var active bool
+        var inactiveFor sql.NullInt64
+        if err := rows.Scan(&id, &active, &inactiveFor); err != nil {
+            rows.Close()
+            return err
+        }
+        c := candidates[id]
+        c.score = float64(c.mutualCount)*mutualWeight + recencyScore(active, inactiveFor)
+        if c.sharedChat {
+            c.score += sharedChatWeight
+        }
+        if c.followsYou {
+            c.score += followsYouWeight
+        }
+        ranked = append(ranked, c)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    sort.Slice(ranked, func(i, j int) bool {
+        if ranked[i].score != ranked[j].score {
+            return ranked[i].score > ranked[j].score
+        }
+        return ranked[i].id > ranked[j].id
+    })
+    if len(ranked) > maxStoredSuggestions {
+        ranked = ranked[:maxStoredSuggestions]
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("DELETE FROM follow_suggestions WHERE user_id = ?", userID); err != nil {
+        return err
+    }
+    for _, c := range ranked {
+        _, err := tx.Exec(`
+            INSERT INTO follow_suggestions (user_id, suggested_id, score, mutual_count, sample_mutual_id, shared_chat, follows_you)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`, userID, c.id, c.score, c.mutualCount, c.sampleMutualID, c.sharedChat, c.followsYou)
+        if err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// recencyScore favours accounts that are online or were recently
+func recencyScore(active bool, inactiveFor sql.NullInt64) float64 {
+    if active && !inactiveFor.Valid {
+        return 2
+    }
+    if !inactiveFor.Valid {
+        return 0
+    }
+    switch age := time.Duration(inactiveFor.Int64) * time.Second; {
+    case age < 24*time.Hour:
+        return 1.5
+    case age < 7*24*time.Hour:
+        return 1
+    case age < 30*24*time.Hour:
+        return 0.5
+    default:
+        return 0
+    }
+}
+
+// suggestionReasons explains a suggestion in a few words
+func suggestionReasons(mutualCount int, sampleMutual sql.NullString, sharedChat, followsYou bool) []string {
+    var reasons []string
+    if mutualCount > 0 && sampleMutual.Valid {
+        switch mutualCount {
+        case 1:
+            reasons = append(reasons, "followed by "+sampleMutual.String)
+        case 2:
+            reasons = append(reasons, "followed by "+sampleMutual.String+" and 1 other")
+        default:
+            reasons = append(reasons, fmt.Sprintf("followed by %s and %d others", sampleMutual.String, mutualCount-1))
+        }
+    }
+    if followsYou {
+        reasons = append(reasons, "follows you")
+    }
+    if sharedChat {
+        reasons = append(reasons, "you have chatted")
+    }
+    return reasons
+}
+
+// GetSuggestions returns accounts the current user may want to follow, best first.
+// They come from the background job; only the first request of a user computes them.
+func GetSuggestions(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+
+    limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSuggestionsLimit)))
+    if err != nil || limit < 1 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit specified"})
+        return
+    }
+    if limit > maxSuggestionsLimit {
+        limit = maxSuggestionsLimit
+    }
+
+    var userID int64
+    var computedAt sql.NullTime
+    err = db.DB.QueryRow("SELECT id, suggestions_computed_at FROM users WHERE username = ?", customClaims.Username).Scan(&userID, &computedAt)
+    if err != nil {
+        log.Printf("Error retrieving user ID: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving user ID"})
+        return
+    }
+
+    if !computedAt.Valid {
+        claimed, err := claimSuggestions(userID)
+        if err == nil && claimed {
+            err = computeSuggestions(userID)
+        }
+        if err != nil {
+            log.Printf("Error computing suggestions: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving suggestions"})
+            return
+        }
+    }
+
+    // Follows and blocks made since the job ran are filtered out here
+    rows, err := db.DB.Query(`
+        SELECT u.id, u.username, u.profile_picture, s.mutual_count, m.username, s.shared_chat, s.follows_you
+        FROM follow_suggestions s
+        JOIN users u ON u.id = s.suggested_id
+        LEFT JOIN users m ON m.id = s.sample_mutual_id
+        WHERE s.user_id = ?
+            AND u.suspended_at IS NULL AND u.deletion_requested_at IS NULL
+            AND NOT EXISTS (SELECT 1 FROM followers f WHERE f.follower_id = s.user_id AND f.following_id = s.suggested_id)
+            AND NOT EXISTS (SELECT 1 FROM follow_requests r WHERE r.requester_id = s.user_id AND r.target_id = s.suggested_id)
+            AND NOT EXISTS (SELECT 1 FROM user_blocks b
+                WHERE (b.blocker_id = s.user_id AND b.blocked_id = s.suggested_id) OR (b.blocker_id = s.suggested_id AND b.blocked_id = s.user_id))
+        ORDER BY s.score DESC, s.suggested_id DESC
+        LIMIT ?`, userID, limit)
+    if err != nil {
+        log.Printf("Error retrieving suggestions: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving suggestions"})
+        return
+    }
+    defer rows.Close()
+
+    suggestions := []gin.H{}
+    for rows.Next() {
+        var id int64
+        var username, profilePicture string
+        var mutualCount int
+        var sampleMutual sql.NullString
+        var sharedChat, followsYou bool
+        if err := rows.Scan(&id, &username, &profilePicture, &mutualCount, &sampleMutual, &sharedChat, &followsYou); err != nil {
+            log.Printf("Error scanning suggestion: %v\n", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving suggestions"})
+            return
+        }
+        suggestions = append(suggestions, gin.H{
+            "id":              id,
+            "username":        username,
+            "profile_picture": profilePicture,
+            "mutual_count":    mutualCount,
+            "shared_chat":     sharedChat,
+            "follows_you":     followsYou,
+            "reasons":         suggestionReasons(mutualCount, sampleMutual, sharedChat, followsYou),
+        })
+    }
+
+    if err := rows.Err(); err != nil {
+        log.Printf("Error iterating through suggestions: %v\n", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving suggestions"})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"suggestions": suggestions})
+}
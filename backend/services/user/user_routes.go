@@ -4,43 +4,39 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vaanskii/vansify/db"
 	"github.com/vaanskii/vansify/models"
+	"github.com/vaanskii/vansify/services/audience"
+	follow "github.com/vaanskii/vansify/services/follow"
 	"github.com/vaanskii/vansify/utils"
 )
 
-// UserProfile holds the user profile details to be returned in the response
+// UserProfile holds the user profile details to be returned in the response. The
+// follower and following lists themselves are paginated under /v1/followers and /v1/following.
 type UserProfile struct {
 	ID              int64         `json:"id"`
 	Username        string        `json:"username"`
 	FollowersCount  int           `json:"followers_count"`
 	FollowingsCount int           `json:"followings_count"`
-	Followers       []Follower    `json:"followers"`
-	Followings      []Following   `json:"followings"`
 	ProfilePicture   string        `json:"profile_picture"`
     OauthUser       bool          `json:"oauth_user"`
-}
-
-type Follower struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-}
-
-type Following struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
+    Private         bool          `json:"private"`
+    // ConnectionsHidden is set when the account is private and the viewer cannot list its follows
+    ConnectionsHidden bool        `json:"connections_hidden"`
+    // ProfileHidden is set when the viewer is outside the profile audience; the picture and counts are left empty
+    ProfileHidden   bool          `json:"profile_hidden"`
 }
 
 // GetUserByUsername function geting user by username
 func GetUserByUsername(c *gin.Context) {
     username := c.Param("username")
     var user models.User
+    var private bool
 
     // Fetch user details by username
-    err := db.DB.QueryRow("SELECT id, username, email, profile_picture, verified, created_at, oauth_user FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Email, &user.ProfilePicture, &user.Verified, &user.CreatedAt, &user.OauthUser)
+    err := db.DB.QueryRow("SELECT id, username, email, profile_picture, verified, created_at, oauth_user, private FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Email, &user.ProfilePicture, &user.Verified, &user.CreatedAt, &user.OauthUser, &private)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
         return
@@ -52,48 +48,46 @@ func GetUserByUsername(c *gin.Context) {
         Username:       user.Username,
         ProfilePicture: user.ProfilePicture,
         OauthUser:      user.OauthUser,
+        Private:        private,
     }
 
-    // Fetch follower count and following count in one query using subqueries
-    err = db.DB.QueryRow(`
-        SELECT 
-            (SELECT COUNT(*) FROM followers WHERE following_id = ?) AS followers_count,
-            (SELECT COUNT(*) FROM followers WHERE follower_id = ?) AS followings_count
-        `, user.ID, user.ID).Scan(&profile.FollowersCount, &profile.FollowingsCount)
+    // Private accounts only show their lists to followers
+    var viewer string
+    var viewerID int64
+    if claims, exists := c.Get("claims"); exists {
+        if customClaims, ok := claims.(*utils.CustomClaims); ok {
+            viewer = customClaims.Username
+            db.DB.QueryRow("SELECT id FROM users WHERE username = ?", viewer).Scan(&viewerID)
+        }
+    }
+    visible, err := follow.CanSeeConnections(viewer, user.ID)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching followers and followings count"})
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking account privacy"})
         return
     }
+    profile.ConnectionsHidden = !visible
 
-    // Fetch followers and followings in one query using UNION
-    query := `
-        SELECT u.id, u.username, 'follower' AS relation FROM followers f JOIN users u ON f.follower_id = u.id WHERE f.following_id = ?
-        UNION ALL
-        SELECT u.id, u.username, 'following' AS relation FROM followers f JOIN users u ON f.following_id = u.id WHERE f.follower_id = ?
-    `
-    rows, err := db.DB.Query(query, user.ID, user.ID)
+    // The profile picture and counts are only shown to the audience the user chose
+    fieldsVisible, err := audience.Allows(audience.RuleProfile, user.ID, viewerID)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching followers and followings"})
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking account privacy"})
         return
     }
-    defer rows.Close()
-
-    for rows.Next() {
-        var id int
-        var username, relation string
-        if err := rows.Scan(&id, &username, &relation); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning follower/following"})
-            return
-        }
-        if relation == "follower" {
-            profile.Followers = append(profile.Followers, Follower{ID: id, Username: username})
-        } else {
-            profile.Followings = append(profile.Followings, Following{ID: id, Username: username})
-        }
+    if !fieldsVisible {
+        profile.ProfilePicture = ""
+        profile.ProfileHidden = true
+        c.JSON(http.StatusOK, profile)
+        return
     }
 
-    if err := rows.Err(); err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error iterating through followers/followings"})
+    // Fetch follower count and following count in one query using subqueries
+    err = db.DB.QueryRow(`
+        SELECT 
+            (SELECT COUNT(*) FROM followers WHERE following_id = ?) AS followers_count,
+            (SELECT COUNT(*) FROM followers WHERE follower_id = ?) AS followings_count
+        `, user.ID, user.ID).Scan(&profile.FollowersCount, &profile.FollowingsCount)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching followers and followings count"})
         return
     }
 
@@ -120,23 +114,29 @@ func GetUserChats(c *gin.Context) {
         return
     }
 
+    // Chats the user deleted stay hidden until a new message arrives
     query := `
         SELECT 
             c.chat_id, 
-            c.user1, 
-            c.user2, 
-            COALESCE(c.deleted_for, '') AS deleted_for, 
+            other.username, 
             COALESCE(MAX(m.created_at), '') AS last_message_time,
-            COALESCE((SELECT message FROM messages WHERE chat_id = c.chat_id AND (deleted_for IS NULL OR deleted_for NOT LIKE ?) ORDER BY created_at DESC LIMIT 1), '') AS last_message,
-            (SELECT profile_picture FROM users u WHERE u.username = CASE WHEN c.user1 = ? THEN c.user2 ELSE c.user1 END) AS profile_picture,
-            (SELECT COUNT(*) FROM chat_notifications WHERE user_id = ? AND chat_id = c.chat_id AND is_read = false) AS unread_count
+            COALESCE((
+                SELECT lm.message FROM messages lm
+                WHERE lm.chat_id = c.chat_id AND NOT EXISTS (SELECT 1 FROM message_deletions d WHERE d.message_id = lm.id AND d.user_id = ?)
+                ORDER BY lm.created_at DESC LIMIT 1), '') AS last_message,
+            other.profile_picture,
+            (SELECT COUNT(*) FROM chat_notifications WHERE user_id = ? AND chat_id = c.chat_id AND is_read = false) AS unread_count,
+            c.request_status
         FROM chats c
+        JOIN users other ON other.id = CASE WHEN c.user1_id = ? THEN c.user2_id ELSE c.user1_id END
         LEFT JOIN messages m ON c.chat_id = m.chat_id
-        WHERE (c.user1 = ? OR c.user2 = ?)
-        GROUP BY c.chat_id, c.user1, c.user2, c.deleted_for
+        WHERE (c.user1_id = ? OR (c.user2_id = ? AND c.request_status = 'accepted'))
+            AND NOT EXISTS (SELECT 1 FROM chat_deletions cd WHERE cd.chat_id = c.chat_id AND cd.user_id = ?)
+        GROUP BY c.chat_id, other.username, other.profile_picture, c.request_status
         HAVING last_message IS NOT NULL`
     
-    rows, err := db.DB.Query(query, "%"+username+"%", username, userID, username, username)
+    // Message requests the user received are listed by /v1/me/message-requests instead
+    rows, err := db.DB.Query(query, userID, userID, userID, userID, userID, userID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching user chats"})
         return
@@ -145,24 +145,15 @@ func GetUserChats(c *gin.Context) {
 
     var chats []map[string]interface{}
     for rows.Next() {
-        var chatID, user1, user2, deletedFor, profilePicture string
+        var chatID, otherUser, profilePicture, requestStatus string
         var lastMessageTime, lastMessage sql.NullString
         var unreadCount int
 
-        if err := rows.Scan(&chatID, &user1, &user2, &deletedFor, &lastMessageTime, &lastMessage, &profilePicture, &unreadCount); err != nil {
+        if err := rows.Scan(&chatID, &otherUser, &lastMessageTime, &lastMessage, &profilePicture, &unreadCount, &requestStatus); err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning chat"})
             return
         }
 
-        if deletedFor != "" && contains(deletedFor, username) {
-            continue
-        }
-
-        otherUser := user1
-        if user1 == username {
-            otherUser = user2
-        }
-
         // Append 'Z' to indicate UTC time
         lastMessageTimeStr := lastMessageTime.String
         if lastMessageTimeStr != "" {
@@ -176,6 +167,7 @@ func GetUserChats(c *gin.Context) {
             "last_message_time":  lastMessageTimeStr,
             "profile_picture":    profilePicture,
             "last_message":       lastMessage.String, 
+            "request_status":     requestStatus,
         })
         log.Print("Chats", chats)
     }
@@ -188,16 +180,6 @@ func GetUserChats(c *gin.Context) {
     c.JSON(http.StatusOK, gin.H{"chats": chats})
 }
 
-func contains(deletedFor, username string) bool {
-    for _, u := range strings.Split(deletedFor, ",") {
-        if u == username {
-            return true
-        }
-    }
-    return false
-}
-
-
 func GetActiveUsersHandler(c *gin.Context) {
     claims, exists := c.Get("claims")
     if !exists {
@@ -215,10 +197,16 @@ func GetActiveUsersHandler(c *gin.Context) {
 
     rows, err := db.DB.Query(`
         SELECT u.username, u.profile_picture 
-        FROM users u
-        JOIN chats c ON (c.user1 = u.username OR c.user2 = u.username)
-        WHERE u.active = true AND u.username != ? AND (c.user1 = ? OR c.user2 = ?)`,
-        authenticatedUsername, authenticatedUsername, authenticatedUsername)
+        FROM users me
+        JOIN chats c ON (c.user1_id = me.id OR c.user2_id = me.id)
+        JOIN users u ON u.id = CASE WHEN c.user1_id = me.id THEN c.user2_id ELSE c.user1_id END
+        WHERE me.username = ? AND u.active = true AND u.id != me.id AND c.request_status = 'accepted'
+            AND NOT EXISTS (
+                SELECT 1 FROM user_blocks b
+                WHERE (b.blocker_id = me.id AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = me.id)
+            )
+            AND `+audience.Condition(audience.RulePresence, "u.id", "me.id"),
+        authenticatedUsername)
     
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving active users"})
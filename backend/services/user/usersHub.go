@@ -3,12 +3,15 @@ package user
 import (
 	"database/sql"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/vaanskii/vansify/db"
+	"github.com/vaanskii/vansify/services/audience"
+	"github.com/vaanskii/vansify/utils"
 )
 
 var (
@@ -25,14 +28,25 @@ var (
     clientMutex = &sync.Mutex{}
 )
 
-// Handle WebSocket connections
+// Handle WebSocket connections of the logged in user
 func HandleConnections(c *gin.Context) {
+    claims, exists := c.Get("claims")
+    if !exists {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    customClaims, ok := claims.(*utils.CustomClaims)
+    if !ok {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+        return
+    }
+    username := customClaims.Username
+
     ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade to WebSocket"})
         return
     }
-    username := c.Query("username")
 
     clientMutex.Lock()
     clients[ws] = username
@@ -89,6 +103,23 @@ func HandleConnections(c *gin.Context) {
     }
 }
 
+// DisconnectUser closes the active users connections of a user
+func DisconnectUser(username, reason string) {
+    clientMutex.Lock()
+    var conns []*websocket.Conn
+    for client, clientUsername := range clients {
+        if clientUsername == username {
+            conns = append(conns, client)
+            delete(clients, client)
+        }
+    }
+    clientMutex.Unlock()
+
+    for _, conn := range conns {
+        utils.CloseWebSocket(conn, reason)
+    }
+}
+
 func HandleMessages() {
     for {
         msg := <-broadcast
@@ -113,7 +144,7 @@ func FetchActiveUsersAndBroadcast(db *sql.DB) {
     rows, err := db.Query(`
         SELECT u.username, u.profile_picture 
         FROM users u
-        JOIN chats c ON (c.user1 = u.username OR c.user2 = u.username)
+        JOIN chats c ON (c.user1_id = u.id OR c.user2_id = u.id)
         WHERE u.active = true 
         GROUP BY u.username, u.profile_picture
     `)
@@ -136,20 +167,34 @@ func FetchActiveUsersAndBroadcast(db *sql.DB) {
         return
     }
 
+    // Relations are loaded for every connected user at once, without holding the lock
+    clientMutex.Lock()
+    viewers := make(map[string]bool)
+    for _, username := range clients {
+        viewers[username] = true
+    }
+    clientMutex.Unlock()
+    if len(viewers) == 0 {
+        return
+    }
+
+    visible, err := visibleActiveUsers(db, viewers)
+    if err != nil {
+        return
+    }
+
     clientMutex.Lock()
     for client, username := range clients {
+        // Users who connected since are sent the list by their own broadcast
+        if !viewers[username] {
+            continue
+        }
         usersToSend := []struct {
             Username       string `json:"username"`
             ProfilePicture string `json:"profile_picture"`
         }{}
         for _, user := range activeUsers {
-            var chatExists bool
-            err := db.QueryRow(`
-                SELECT EXISTS(
-                    SELECT 1 FROM chats WHERE (user1 = ? AND user2 = ?) OR (user1 = ? AND user2 = ?)
-                )`, username, user.Username, user.Username, username).Scan(&chatExists)
-
-            if err == nil && chatExists {
+            if visible[username][user.Username] {
                 usersToSend = append(usersToSend, user)
             }
         }
@@ -162,3 +207,43 @@ func FetchActiveUsersAndBroadcast(db *sql.DB) {
     }
     clientMutex.Unlock()
 }
+
+// visibleActiveUsers maps each viewer to the active users they see: those they have an
+// accepted chat with, neither has blocked, and whose presence audience includes them
+func visibleActiveUsers(db *sql.DB, viewers map[string]bool) (map[string]map[string]bool, error) {
+    args := make([]interface{}, 0, len(viewers))
+    for username := range viewers {
+        args = append(args, username)
+    }
+
+    rows, err := db.Query(`
+        SELECT DISTINCT v.username, o.username
+        FROM chats c
+        JOIN users o ON o.id IN (c.user1_id, c.user2_id)
+        JOIN users v ON v.id IN (c.user1_id, c.user2_id) AND v.id <> o.id
+        WHERE c.request_status = 'accepted'
+        AND o.active = true
+        AND v.username IN (?`+strings.Repeat(", ?", len(args)-1)+`)
+        AND NOT EXISTS (
+            SELECT 1 FROM user_blocks b
+            WHERE (b.blocker_id = c.user1_id AND b.blocked_id = c.user2_id) OR (b.blocker_id = c.user2_id AND b.blocked_id = c.user1_id)
+        )
+        AND `+audience.Condition(audience.RulePresence, "o.id", "v.id"), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    visible := make(map[string]map[string]bool)
+    for rows.Next() {
+        var viewer, active string
+        if err := rows.Scan(&viewer, &active); err != nil {
+            return nil, err
+        }
+        if visible[viewer] == nil {
+            visible[viewer] = make(map[string]bool)
+        }
+        visible[viewer][active] = true
+    }
+    return visible, rows.Err()
+}
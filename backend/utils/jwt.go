@@ -2,110 +2,94 @@ package utils
 
 import (
 	"fmt"
-	"net/http"
 	"os"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/lpernett/godotenv"
+)
+
+// Token types. Each one has its own audience, so a token can only be used where it was
+// meant to, e.g. a password reset token is never accepted as an access token. Reauth
+// tokens prove a recent OAuth login before destructive account changes.
+const (
+    TokenAccess     = "access"
+    TokenRefresh    = "refresh"
+    TokenReset      = "reset"
+    TokenOnboarding = "onboarding"
+    TokenReauth     = "reauth"
 )
 
 type CustomClaims struct {
-    Username string `json:"username"`
-    Email    string `json:"email"`
+    Username  string `json:"username"`
+    Email     string `json:"email"`
+    Role      string `json:"role,omitempty"`
+    TokenType string `json:"token_type"`
     jwt.RegisteredClaims
 }
 
+// tokenIssuer is the iss claim of every token, JWT_ISSUER or "vansify"
+func tokenIssuer() string {
+    if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+        return issuer
+    }
+    return "vansify"
+}
 
-var jwtSecret []byte
-
+// tokenAudience is the aud claim of a token type
+func tokenAudience(tokenType string) string {
+    return tokenIssuer() + ":" + tokenType
+}
 
-// LoadEnv loads environment variables from the .env file
-func LoadEnv() error {
-	godotenv.Load()
-	// Get the JWT Secret from .env
-	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
-	return nil
+// SignToken fills in the type, audience, issuer and lifetime of the claims and signs them
+func SignToken(tokenType string, claims *CustomClaims, ttl time.Duration) (string, error) {
+    now := time.Now()
+    claims.TokenType = tokenType
+    claims.Issuer = tokenIssuer()
+    claims.Audience = jwt.ClaimStrings{tokenAudience(tokenType)}
+    claims.IssuedAt = jwt.NewNumericDate(now)
+    claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+    return signWithKeyring(claims)
 }
 
 // GenerateAccessToken generates a short-lived JWT access token for a user
-func GenerateAccessToken(username, email string) (string, error) {
-    expirationTime := time.Now().Add(15 * time.Minute)
+func GenerateAccessToken(username, email, role string) (string, error) {
     claims := &CustomClaims{
         Username: username,
         Email:    email,
+        Role:     role,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(expirationTime),
-            Subject:   username,
+            Subject: username,
         },
     }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString(jwtSecret)
+    return SignToken(TokenAccess, claims, 15*time.Minute)
 }
 
-func GenerateRefreshToken(username, email string) (string, error) {
-    expirationTime := time.Now().Add(7 * 24 * time.Hour)
+func GenerateRefreshToken(username, email, role string) (string, error) {
     claims := &CustomClaims{
         Username: username,
         Email:    email,
+        Role:     role,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(expirationTime),
-            Subject:   username,
+            Subject: username,
         },
     }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString(jwtSecret)
+    return SignToken(TokenRefresh, claims, 7*24*time.Hour)
 }
 
-func ValidateToken(tokenString string) (*CustomClaims, error) {
-    token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(t *jwt.Token) (interface{}, error) {
-        return jwtSecret, nil
-    })
+// ValidateToken verifies a token of the given type and returns its claims
+func ValidateToken(tokenString, tokenType string) (*CustomClaims, error) {
+    token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, verificationKey,
+        jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+        jwt.WithIssuer(tokenIssuer()),
+        jwt.WithAudience(tokenAudience(tokenType)),
+        jwt.WithExpirationRequired(),
+    )
     if err != nil {
         return nil, err
     }
-    if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
-        return claims, nil
-    }
-    return nil, fmt.Errorf("invalid token claims")
-}
-
-
-func VerifyJWT(tokenString string) (*jwt.Token, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil {
-        return nil, err
-    }
-    if !token.Valid {
-        return nil, fmt.Errorf("invalid token")
+    claims, ok := token.Claims.(*CustomClaims)
+    if !ok || !token.Valid || claims.TokenType != tokenType {
+        return nil, fmt.Errorf("invalid token claims")
     }
-    return token, nil
-}
-
-
-func RefreshToken(c *gin.Context) {
-    var request struct {
-        RefreshToken string `json:"refresh_token"`
-    }
-    if err := c.ShouldBindJSON(&request); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-        return
-    }
-
-    claims, err := ValidateToken(request.RefreshToken)
-    if err != nil {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
-        return
-    }
-
-    accessToken, err := GenerateAccessToken(claims.Username, claims.Email)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating access token"})
-        return
-    }
-
-    c.JSON(http.StatusOK, gin.H{"access_token": accessToken})
+    return claims, nil
 }
@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lpernett/godotenv"
+)
+
+// signingKey is a private key tokens are signed with, identified by the kid header
+type signingKey struct {
+    kid    string
+    method jwt.SigningMethod
+    key    crypto.Signer
+}
+
+// keyring holds the key new tokens are signed with and every public key tokens are
+// still accepted for. Rotating means adding a new key, making it the signing key and
+// removing the old one once the tokens it signed have expired.
+var keyring = struct {
+    sync.RWMutex
+    signing *signingKey
+    public  map[string]crypto.PublicKey
+}{public: map[string]crypto.PublicKey{}}
+
+// InitKeyring loads the JWT keys from JWT_KEYS_DIR. Every file in the directory is a PEM
+// encoded key named after its kid. Private keys (PKCS#8 RSA or Ed25519, or PKCS#1 RSA)
+// can sign and verify, public keys only verify. JWT_SIGNING_KID selects the signing key,
+// the last private key by name is used otherwise. Outside GIN_MODE=release a missing
+// JWT_KEYS_DIR falls back to a temporary key.
+func InitKeyring() {
+    godotenv.Load()
+
+    dir := os.Getenv("JWT_KEYS_DIR")
+    if dir == "" {
+        // A temporary key logs everyone out on restart, and every replica would sign
+        // with its own, so it is only for development
+        if os.Getenv("GIN_MODE") == "release" {
+            log.Fatal("JWT_KEYS_DIR is required when GIN_MODE=release")
+        }
+        log.Println("JWT_KEYS_DIR is not set, generating a temporary signing key for development")
+        _, private, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            log.Fatalf("Error generating JWT signing key: %v", err)
+        }
+        if err := addKey(keyThumbprint(private.Public()), private); err != nil {
+            log.Fatalf("Error adding JWT signing key: %v", err)
+        }
+        return
+    }
+
+    paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+    if err != nil {
+        log.Fatalf("Error listing JWT keys: %v", err)
+    }
+    sort.Strings(paths)
+
+    signingKid := os.Getenv("JWT_SIGNING_KID")
+    for _, path := range paths {
+        kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+        key, err := readKey(path)
+        if err != nil {
+            log.Fatalf("Error loading JWT key %s: %v", path, err)
+        }
+
+        if signer, ok := key.(crypto.Signer); ok && (signingKid == "" || signingKid == kid) {
+            err = addKey(kid, signer)
+        } else {
+            err = addVerificationKey(kid, key)
+        }
+        if err != nil {
+            log.Fatalf("Error loading JWT key %s: %v", path, err)
+        }
+    }
+
+    if keyring.signing == nil {
+        log.Fatal("No JWT signing key found in JWT_KEYS_DIR")
+    }
+    log.Printf("Signing JWTs with key %s, accepting %d keys\n", keyring.signing.kid, len(keyring.public))
+}
+
+// readKey parses a PEM encoded private or public key
+func readKey(path string) (any, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("no PEM data found")
+    }
+
+    switch block.Type {
+    case "PRIVATE KEY":
+        return x509.ParsePKCS8PrivateKey(block.Bytes)
+    case "RSA PRIVATE KEY":
+        return x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "PUBLIC KEY":
+        return x509.ParsePKIXPublicKey(block.Bytes)
+    }
+    return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// addKey makes a private key the signing key and accepts its public key
+func addKey(kid string, key crypto.Signer) error {
+    method, err := signingMethodFor(key.Public())
+    if err != nil {
+        return err
+    }
+    if err := addVerificationKey(kid, key.Public()); err != nil {
+        return err
+    }
+
+    keyring.Lock()
+    keyring.signing = &signingKey{kid: kid, method: method, key: key}
+    keyring.Unlock()
+    return nil
+}
+
+// addVerificationKey accepts tokens signed by the private half of a public key
+func addVerificationKey(kid string, key any) error {
+    if signer, ok := key.(crypto.Signer); ok {
+        key = signer.Public()
+    }
+    if _, err := signingMethodFor(key); err != nil {
+        return err
+    }
+
+    keyring.Lock()
+    keyring.public[kid] = key
+    keyring.Unlock()
+    return nil
+}
+
+// signingMethodFor picks RS256 for RSA keys and EdDSA for Ed25519 keys
+func signingMethodFor(key crypto.PublicKey) (jwt.SigningMethod, error) {
+    switch k := key.(type) {
+    case *rsa.PublicKey:
+        if k.N.BitLen() < 2048 {
+            return nil, fmt.Errorf("RSA keys must have at least 2048 bits")
+        }
+        return jwt.SigningMethodRS256, nil
+    case ed25519.PublicKey:
+        return jwt.SigningMethodEdDSA, nil
+    }
+    return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// keyThumbprint derives a kid from the public key for keys that have no file name
+func keyThumbprint(key crypto.PublicKey) string {
+    der, _ := x509.MarshalPKIXPublicKey(key)
+    sum := sha256.Sum256(der)
+    return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// signWithKeyring signs the claims with the current signing key and sets the kid header
+func signWithKeyring(claims jwt.Claims) (string, error) {
+    keyring.RLock()
+    signing := keyring.signing
+    keyring.RUnlock()
+    if signing == nil {
+        return "", fmt.Errorf("no JWT signing key loaded")
+    }
+
+    token := jwt.NewWithClaims(signing.method, claims)
+    token.Header["kid"] = signing.kid
+    return token.SignedString(signing.key)
+}
+
+// verificationKey looks up the public key named by the kid header of a token
+func verificationKey(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+
+    keyring.RLock()
+    key, ok := keyring.public[kid]
+    keyring.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("unknown signing key %q", kid)
+    }
+
+    // A key only verifies the algorithm it was made for
+    method, err := signingMethodFor(key)
+    if err != nil || method.Alg() != token.Method.Alg() {
+        return nil, fmt.Errorf("signing method %s does not match key %q", token.Method.Alg(), kid)
+    }
+    return key, nil
+}
+
+// JWKSHandler publishes the public keys tokens are verified with
+func JWKSHandler(c *gin.Context) {
+    keyring.RLock()
+    kids := make([]string, 0, len(keyring.public))
+    for kid := range keyring.public {
+        kids = append(kids, kid)
+    }
+    sort.Strings(kids)
+
+    keys := make([]gin.H, 0, len(kids))
+    for _, kid := range kids {
+        switch key := keyring.public[kid].(type) {
+        case *rsa.PublicKey:
+            keys = append(keys, gin.H{
+                "kty": "RSA",
+                "use": "sig",
+                "alg": jwt.SigningMethodRS256.Alg(),
+                "kid": kid,
+                "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+                "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+            })
+        case ed25519.PublicKey:
+            keys = append(keys, gin.H{
+                "kty": "OKP",
+                "use": "sig",
+                "alg": jwt.SigningMethodEdDSA.Alg(),
+                "kid": kid,
+                "crv": "Ed25519",
+                "x":   base64.RawURLEncoding.EncodeToString(key),
+            })
+        }
+    }
+    keyring.RUnlock()
+
+    c.Header("Cache-Control", "public, max-age=300")
+    c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
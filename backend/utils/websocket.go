@@ -0,0 +1,15 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseWebSocket tells the client why the server is closing the connection and closes
+// it, which also ends the read loop of the handler that owns the connection
+func CloseWebSocket(conn *websocket.Conn, reason string) {
+    message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+    conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+    conn.Close()
+}
@@ -29,7 +29,7 @@ export const useActiveUsersStore = defineStore('activeUsers', () => {
 
   const connectWebSocket = () => {
     if (store.user.isAuthenticated && !ws.value) {
-      const wsUrl = `${wsConst}//${apiUrl}/v1/active-users/ws?username=${encodeURIComponent(store.user.username)}`;
+      const wsUrl = `${wsConst}//${apiUrl}/v1/active-users/ws?token=${encodeURIComponent(store.user.access)}`;
       ws.value = new WebSocket(wsUrl);
 
       ws.value.onopen = () => {